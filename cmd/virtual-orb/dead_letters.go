@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+)
+
+const deadLettersUsage = `Usage: virtual-orb dead-letters <command> [arguments]
+
+Commands:
+  list                 List the dead letters, oldest failure first.
+  inspect <id>         Print a dead letter in full.
+  purge <id>|--all     Delete one or every dead letter.
+  replay <id>|--all    Send one or every dead letter again to BASE_URL;
+                       letters accepted by the backend are deleted.
+`
+
+// RunDeadLetters runs a dead-letters subcommand against the store in
+// DEAD_LETTER_DIR.
+//
+// Parameters:
+//
+//	args: Arguments following "dead-letters" on the command line.
+//	out: Writer the output is printed to.
+//
+// Returns:
+//
+//	The process exit code.
+func RunDeadLetters(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(out, deadLettersUsage)
+		return 2
+	}
+	store, err := platform.OpenDeadLetterStore(GetEnvWithDefault("DEAD_LETTER_DIR", "data/dead-letters"))
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	all := flags.Bool("all", false, "apply to every dead letter")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	ids := flags.Args()
+
+	switch args[0] {
+	case "list":
+		err = listDeadLetters(store, out)
+	case "inspect":
+		if len(ids) != 1 {
+			fmt.Fprint(out, deadLettersUsage)
+			return 2
+		}
+		err = inspectDeadLetter(store, ids[0], out)
+	case "purge", "replay":
+		if *all == (len(ids) > 0) {
+			fmt.Fprint(out, deadLettersUsage)
+			return 2
+		}
+		if *all {
+			ids, err = deadLetterIDs(store)
+		}
+		if err == nil && args[0] == "purge" {
+			err = purgeDeadLetters(store, ids, out)
+		} else if err == nil {
+			err = replayDeadLetters(store, ids, out)
+		}
+	default:
+		fmt.Fprint(out, deadLettersUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
+
+func listDeadLetters(store domain.DeadLetterStore, out io.Writer) error {
+	letters, err := store.List()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tROUTE\tREASON\tSTATUS\tATTEMPTS\tFAILED AT")
+	for _, letter := range letters {
+		fmt.Fprintf(w, "%s\t%s %s\t%s\t%d\t%d\t%s\n", letter.Id, letter.Method, letter.Route,
+			letter.Reason, letter.StatusCode, letter.Attempts, letter.FailedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func inspectDeadLetter(store domain.DeadLetterStore, id string, out io.Writer) error {
+	letter, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(data))
+	return nil
+}
+
+func purgeDeadLetters(store domain.DeadLetterStore, ids []string, out io.Writer) error {
+	for _, id := range ids {
+		if err := store.Remove(id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s purged\n", id)
+	}
+	return nil
+}
+
+// replayDeadLetters sends the dead letters again through a request service
+// configured like the one of the running orb, signatures and negotiated
+// capabilities included.
+func replayDeadLetters(store domain.DeadLetterStore, ids []string, out io.Writer) error {
+	transport, err := platform.NewHTTPClient(GetHTTPClientConfig())
+	if err != nil {
+		return err
+	}
+	encodingOpts, err := GetEncodingOptions()
+	if err != nil {
+		return err
+	}
+	endpoints, err := GetEndpoints(nil)
+	if err != nil {
+		return err
+	}
+	statusBatchSize, _ := strconv.Atoi(GetEnvWithDefault("STATUS_BATCH_SIZE", "50"))
+	signUpBatchSize, _ := strconv.Atoi(GetEnvWithDefault("SIGN_UP_BATCH_SIZE", "1"))
+	negotiated, err := NegotiateCapabilities(context.Background(), transport, endpoints, service.RetryPolicy{MaxAttempts: 1}, false,
+		GetCapabilities(statusBatchSize, signUpBatchSize))
+	if err != nil {
+		return err
+	}
+	orbID := GetEnvWithDefault("ORB_ID", "1")
+	client := service.Chain(transport,
+		service.Identity(GetEnvWithDefault("USER_AGENT", "virtual-orb"), orbID),
+		service.Signing(orbID, GetEnvWithDefault("SIGN_KEY", "default-secret-key"), service.WithScheme(negotiated.SignatureScheme)))
+	opts := append(encodingOpts, service.WithAPIVersion(negotiated.APIVersion))
+	if len(endpoints) > 1 {
+		opts = append(opts, service.WithEndpoints(service.NewEndpointPool(endpoints, client, GetFailoverConfig())))
+	}
+	cb := service.NewCircuitBreaker(GetBreakerSettings("", "Replay Circuit Breaker"))
+	requestSvc := service.NewRequestSvc(endpoints[0].URL, client, cb, opts...)
+	deadLetters := service.NewDeadLetterSvc(store, requestSvc)
+
+	failed := 0
+	for _, id := range ids {
+		statusCode, err := deadLetters.Replay(context.Background(), id)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "%s failed with status %d: %v\n", id, statusCode, err)
+			continue
+		}
+		fmt.Fprintf(out, "%s replayed with status %d\n", id, statusCode)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d dead letters could not be replayed", failed, len(ids))
+	}
+	return nil
+}
+
+func deadLetterIDs(store domain.DeadLetterStore) ([]string, error) {
+	letters, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(letters))
+	for _, letter := range letters {
+		ids = append(ids, letter.Id)
+	}
+	return ids, nil
+}
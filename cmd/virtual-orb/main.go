@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
 	"fmt"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 
 	"net/http"
 	"os"
 	"time"
+	"virtual-orb/pkg/domain"
 	"virtual-orb/pkg/platform"
 	"virtual-orb/pkg/service"
 
@@ -16,6 +23,9 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/sony/gobreaker"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 // main is the entry point for the application. It initializes the logger,
@@ -37,56 +47,477 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "dead-letters" {
+		os.Exit(RunDeadLetters(os.Args[2:], os.Stdout))
+	}
+
 	orbIDStr := GetEnvWithDefault("ORB_ID", "1")
 	orbID, _ := strconv.ParseInt(orbIDStr, 10, 64)
 	signKey := GetEnvWithDefault("SIGN_KEY", "default-secret-key")
-	cbTimeoutStr := GetEnvWithDefault("CB_TIMEOUT", "60s")
-	cbTimeout, _ := time.ParseDuration(cbTimeoutStr)
-	cbMaxRequestsStr := GetEnvWithDefault("CB_MAX_REQUESTS", "5")
-	cbMaxRequests, _ := strconv.Atoi(cbMaxRequestsStr)
-	cbIntervalStr := GetEnvWithDefault("CB_INTERVAL", "60s")
-	cbInterval, _ := time.ParseDuration(cbIntervalStr)
+	cbFailureStatusesStr := GetEnvWithDefault("CB_FAILURE_STATUSES", "500-599")
+	cbCountTimeoutsStr := GetEnvWithDefault("CB_COUNT_TIMEOUTS", "true")
+	cbCountTimeouts, _ := strconv.ParseBool(cbCountTimeoutsStr)
+	cbCountCancellationsStr := GetEnvWithDefault("CB_COUNT_CANCELLATIONS", "false")
+	cbCountCancellations, _ := strconv.ParseBool(cbCountCancellationsStr)
 	statusPeriodicIntervalStr := GetEnvWithDefault("STATUS_PERIODIC_INTERVAL", "4s")
 	statusPeriodicInterval, _ := time.ParseDuration(statusPeriodicIntervalStr)
 	signUpPeriodicIntervalStr := GetEnvWithDefault("SIGN_UP_PERIODIC_INTERVAL", "5s")
 	signUpPeriodicInterval, _ := time.ParseDuration(signUpPeriodicIntervalStr)
-	baseURL := GetEnvWithDefault("BASE_URL", "http://mock-uniqueness-service:8001")
+	metricsAddr := GetEnvWithDefault("METRICS_ADDR", ":8002")
+	statusTimeoutStr := GetEnvWithDefault("STATUS_TIMEOUT", "3s")
+	statusTimeout, _ := time.ParseDuration(statusTimeoutStr)
+	signUpTimeoutStr := GetEnvWithDefault("SIGN_UP_TIMEOUT", "4s")
+	signUpTimeout, _ := time.ParseDuration(signUpTimeoutStr)
+	retryMaxAttemptsStr := GetEnvWithDefault("RETRY_MAX_ATTEMPTS", "3")
+	retryMaxAttempts, _ := strconv.Atoi(retryMaxAttemptsStr)
+	retryBaseDelayStr := GetEnvWithDefault("RETRY_BASE_DELAY", "200ms")
+	retryBaseDelay, _ := time.ParseDuration(retryBaseDelayStr)
+	retryMaxDelayStr := GetEnvWithDefault("RETRY_MAX_DELAY", "2s")
+	retryMaxDelay, _ := time.ParseDuration(retryMaxDelayStr)
+	statusRetryMaxAttemptsStr := GetEnvWithDefault("STATUS_RETRY_MAX_ATTEMPTS", retryMaxAttemptsStr)
+	statusRetryMaxAttempts, _ := strconv.Atoi(statusRetryMaxAttemptsStr)
+	signUpRetryMaxAttemptsStr := GetEnvWithDefault("SIGN_UP_RETRY_MAX_ATTEMPTS", retryMaxAttemptsStr)
+	signUpRetryMaxAttempts, _ := strconv.Atoi(signUpRetryMaxAttemptsStr)
+	statusMaxConcurrentStr := GetEnvWithDefault("STATUS_MAX_CONCURRENT", "1")
+	statusMaxConcurrent, _ := strconv.Atoi(statusMaxConcurrentStr)
+	signUpMaxConcurrentStr := GetEnvWithDefault("SIGN_UP_MAX_CONCURRENT", "2")
+	signUpMaxConcurrent, _ := strconv.Atoi(signUpMaxConcurrentStr)
+	statusRateLimitStr := GetEnvWithDefault("STATUS_RATE_LIMIT", "1")
+	statusRateLimit, _ := strconv.ParseFloat(statusRateLimitStr, 64)
+	statusRateBurstStr := GetEnvWithDefault("STATUS_RATE_BURST", "5")
+	statusRateBurst, _ := strconv.Atoi(statusRateBurstStr)
+	signUpRateLimitStr := GetEnvWithDefault("SIGN_UP_RATE_LIMIT", "1")
+	signUpRateLimit, _ := strconv.ParseFloat(signUpRateLimitStr, 64)
+	signUpRateBurstStr := GetEnvWithDefault("SIGN_UP_RATE_BURST", "5")
+	signUpRateBurst, _ := strconv.Atoi(signUpRateBurstStr)
+	statusBufferCapacityStr := GetEnvWithDefault("STATUS_BUFFER_CAPACITY", "120")
+	statusBufferCapacity, _ := strconv.Atoi(statusBufferCapacityStr)
+	statusSpillPath := GetEnvWithDefault("STATUS_SPILL_PATH", "")
+	statusSpillCapacityStr := GetEnvWithDefault("STATUS_SPILL_CAPACITY", "10000")
+	statusSpillCapacity, _ := strconv.Atoi(statusSpillCapacityStr)
+	statusBatchSizeStr := GetEnvWithDefault("STATUS_BATCH_SIZE", "50")
+	statusBatchSize, _ := strconv.Atoi(statusBatchSizeStr)
+	statusBatchLingerStr := GetEnvWithDefault("STATUS_BATCH_LINGER", "0s")
+	statusBatchLinger, _ := time.ParseDuration(statusBatchLingerStr)
+	signUpBatchSizeStr := GetEnvWithDefault("SIGN_UP_BATCH_SIZE", "1")
+	signUpBatchSize, _ := strconv.Atoi(signUpBatchSizeStr)
+	signUpBatchLingerStr := GetEnvWithDefault("SIGN_UP_BATCH_LINGER", "0s")
+	signUpBatchLinger, _ := time.ParseDuration(signUpBatchLingerStr)
+	outboxPath := GetEnvWithDefault("OUTBOX_PATH", "")
+	outboxCapacityStr := GetEnvWithDefault("OUTBOX_CAPACITY", "1000")
+	outboxCapacity, _ := strconv.Atoi(outboxCapacityStr)
+	outboxMaxAgeStr := GetEnvWithDefault("OUTBOX_MAX_AGE", "72h")
+	outboxMaxAge, _ := time.ParseDuration(outboxMaxAgeStr)
+	outboxPollIntervalStr := GetEnvWithDefault("OUTBOX_POLL_INTERVAL", "1s")
+	outboxPollInterval, _ := time.ParseDuration(outboxPollIntervalStr)
+	outboxMaxAttemptsStr := GetEnvWithDefault("OUTBOX_MAX_ATTEMPTS", "20")
+	outboxMaxAttempts, _ := strconv.Atoi(outboxMaxAttemptsStr)
+	deadLetterDir := GetEnvWithDefault("DEAD_LETTER_DIR", "")
+	contractValidationStr := GetEnvWithDefault("CONTRACT_VALIDATION", "false")
+	contractValidation, _ := strconv.ParseBool(contractValidationStr)
+	userAgent := GetEnvWithDefault("USER_AGENT", "virtual-orb")
+	requestLoggingStr := GetEnvWithDefault("REQUEST_LOGGING", "false")
+	requestLogging, _ := strconv.ParseBool(requestLoggingStr)
+	transportName := GetEnvWithDefault("TRANSPORT", "http")
+	statusSink := GetEnvWithDefault("STATUS_SINK", "http")
 	snowflakeNode, err := snowflake.NewNode(orbID)
 	if err != nil {
 		logger.Error("Creating snowflake node failed",
 			zap.Error(err))
 		os.Exit(1)
 	}
-	httpClient := http.DefaultClient
-	cbSettings := gobreaker.Settings{
-		Name:        "HTTP Request Circuit Breaker",
-		Timeout:     cbTimeout,
-		MaxRequests: uint32(cbMaxRequests),
-		Interval:    cbInterval,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			failureRatio := float64(counts.TotalFailures) / float64(counts.Requests)
-			return counts.Requests >= 3 && failureRatio >= 0.6
-		},
+	transport, err := platform.NewHTTPClient(GetHTTPClientConfig())
+	if err != nil {
+		logger.Error("Creating HTTP client failed",
+			zap.Error(err))
+		os.Exit(1)
+	}
+	cbFailureStatuses, err := service.ParseStatusRanges(cbFailureStatusesStr)
+	if err != nil {
+		logger.Error("Parsing circuit breaker failure statuses failed",
+			zap.Error(err))
+		os.Exit(1)
 	}
 
-	cb := gobreaker.NewCircuitBreaker(cbSettings)
-	requestSvc := service.NewRequestSvc(baseURL, httpClient, cb)
-	signUp := service.NewSignUpSvc(signKey, snowflakeNode, requestSvc)
-	systemInfo := platform.NewSystemInfo()
-	status := service.NewStatusSvc(requestSvc, systemInfo)
+	breakerStates := expvar.NewMap("circuit_breaker_state")
+	breakerTransitions := expvar.NewMap("circuit_breaker_transitions")
+	onStateChange := func(name string, from gobreaker.State, to gobreaker.State) {
+		logger.Warn("Circuit breaker changed state",
+			zap.String("name", name),
+			zap.String("from", from.String()),
+			zap.String("to", to.String()))
+		state := new(expvar.String)
+		state.Set(to.String())
+		breakerStates.Set(name, state)
+		breakerTransitions.Add(to.String(), 1)
+	}
+
+	// Each route gets its own breaker so that a failing endpoint cannot
+	// block the other; the default one guards any remaining route.
+	cbSettings := GetBreakerSettings("", "HTTP Request Circuit Breaker")
+	cbSettings.OnStateChange = onStateChange
+	cb := service.NewCircuitBreaker(cbSettings)
+	statusCbSettings := GetBreakerSettings("STATUS_", "Status Circuit Breaker")
+	statusCbSettings.OnStateChange = onStateChange
+	statusCb := service.NewCircuitBreaker(statusCbSettings)
+	signUpCbSettings := GetBreakerSettings("SIGN_UP_", "Sign-up Circuit Breaker")
+	signUpCbSettings.OnStateChange = onStateChange
+	signUpCb := service.NewCircuitBreaker(signUpCbSettings)
+	classifier := service.ResponseClassifier{
+		FailureStatuses:    cbFailureStatuses,
+		CountTimeouts:      cbCountTimeouts,
+		CountCancellations: cbCountCancellations,
+	}
+	encodingOpts, err := GetEncodingOptions()
+	if err != nil {
+		logger.Error("Parsing request encoding failed",
+			zap.Error(err))
+		os.Exit(1)
+	}
+	endpoints, err := GetEndpoints(onStateChange)
+	if err != nil {
+		logger.Error("Parsing uniqueness service endpoints failed",
+			zap.Error(err))
+		os.Exit(1)
+	}
+	retryPolicy := service.RetryPolicy{
+		MaxAttempts: retryMaxAttempts,
+		BaseDelay:   retryBaseDelay,
+		MaxDelay:    retryMaxDelay,
+	}
+	// Cancelling ctx on SIGINT/SIGTERM aborts in-flight requests and stops both jobs.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Options are negotiated before anything is signed, as the signature
+	// scheme is one of them, once the uniqueness service answers. If it
+	// cannot be asked, the orb starts with the options of a legacy service
+	// and renegotiates in the background. The gRPC transport keeps the
+	// defaults.
+	supported := GetCapabilities(statusBatchSize, signUpBatchSize)
+	negotiated := service.DefaultNegotiated()
+	renegotiate := false
+	if transportName == "http" {
+		negotiated, err = NegotiateCapabilities(ctx, transport, endpoints, retryPolicy, true, supported)
+		switch {
+		case errors.Is(err, domain.ErrInvalidCapability) || errors.Is(err, domain.ErrNoCommonCapability):
+			logger.Error("Negotiating capabilities with the uniqueness service failed",
+				zap.Error(err))
+			os.Exit(1)
+		case err != nil:
+			logger.Warn("Asking the uniqueness service for its capabilities failed, starting with legacy options",
+				zap.Error(err))
+			negotiated = service.LegacyNegotiated()
+			renegotiate = true
+		default:
+			logger.Info("Negotiated capabilities with the uniqueness service",
+				zap.Any("capabilities", negotiated))
+		}
+	}
+	negotiation := service.NewNegotiation(negotiated)
+	expvar.Publish("capabilities", expvar.Func(func() any {
+		return negotiation.Current()
+	}))
+	// Batches never exceed what the uniqueness service accepts.
+	if n := negotiated.MaxStatusBatchSize; n > 0 && n < statusBatchSize {
+		statusBatchSize = n
+	}
+	if n := negotiated.MaxSignUpBatchSize; n > 0 && n < signUpBatchSize {
+		signUpBatchSize = n
+	}
+	// Metrics are published through expvar at /debug/vars.
+	requestCounts := expvar.NewMap("request_count")
+	requestDurations := expvar.NewMap("request_duration_ms")
+	middlewares := []service.Middleware{
+		service.Identity(userAgent, orbIDStr),
+		service.Signing(orbIDStr, signKey, service.WithNegotiatedScheme(negotiation)),
+	}
+	if requestLogging {
+		middlewares = append(middlewares, service.Logging(func(entry service.RequestLog) {
+			logger.Info("Sent request",
+				zap.String("method", entry.Method),
+				zap.String("url", entry.URL),
+				zap.Any("header", entry.Header),
+				zap.Int("status", entry.StatusCode),
+				zap.Duration("elapsed", entry.Elapsed),
+				zap.Error(entry.Err))
+		}))
+	}
+	middlewares = append(middlewares, service.Timing(func(route string, statusCode int, elapsed time.Duration) {
+		requestCounts.Add(route, 1)
+		requestDurations.AddFloat(route, float64(elapsed)/float64(time.Millisecond))
+	}))
+	httpClient := service.Chain(transport, middlewares...)
+	statusRetryPolicy := retryPolicy
+	statusRetryPolicy.MaxAttempts = statusRetryMaxAttempts
+	signUpRetryPolicy := retryPolicy
+	signUpRetryPolicy.MaxAttempts = signUpRetryMaxAttempts
+	// The Date header of responses tells how far off the orb clock is.
+	clock := service.NewClockMonitor(GetClockConfig())
+	expvar.Publish("clock_skew", expvar.Func(func() any {
+		return clock.Snapshot()
+	}))
+	requestOpts := append(encodingOpts,
+		service.WithNegotiatedAPIVersion(negotiation),
+		service.WithClockMonitor(clock),
+		service.WithRetryPolicy(retryPolicy),
+		service.WithRouteRetryPolicy("/status", statusRetryPolicy),
+		service.WithRouteRetryPolicy("/sign-up", signUpRetryPolicy),
+		service.WithRouteRetryPolicy("/sign-up/batch", signUpRetryPolicy),
+		service.WithResponseClassifier(classifier),
+		service.WithRouteBreaker(statusCb, "/status", "/status/batch"),
+		service.WithRouteBreaker(signUpCb, "/sign-up", "/sign-up/batch"),
+		service.WithBulkhead(statusMaxConcurrent, "/status", "/status/batch"),
+		service.WithBulkhead(signUpMaxConcurrent, "/sign-up", "/sign-up/batch"),
+	)
+	// A zero rate leaves the route limited by the backend's headers only.
+	if statusRateLimit > 0 {
+		requestOpts = append(requestOpts, service.WithRateLimit(statusRateLimit, statusRateBurst, "/status", "/status/batch"))
+	}
+	if signUpRateLimit > 0 {
+		requestOpts = append(requestOpts, service.WithRateLimit(signUpRateLimit, signUpRateBurst, "/sign-up", "/sign-up/batch"))
+	}
+	if contractValidation {
+		requestOpts = append(requestOpts, service.WithContracts(service.DefaultContracts()))
+	}
+	// With several instances of the uniqueness service, requests fail over
+	// between them and health checks decide when to fail back.
+	var checkEndpoints func(ctx context.Context)
+	if len(endpoints) > 1 && transportName != "grpc" {
+		pool := service.NewEndpointPool(endpoints, httpClient, GetFailoverConfig())
+		requestOpts = append(requestOpts, service.WithEndpoints(pool))
+		checkEndpoints = pool.Run
+		expvar.Publish("endpoints", expvar.Func(func() any {
+			return pool.Endpoints()
+		}))
+	}
+	var requestSvc domain.RequestSvc
+	switch transportName {
+	case "http":
+		httpRequestSvc := service.NewRequestSvc(endpoints[0].URL, httpClient, cb, requestOpts...)
+		expvar.Publish("circuit_breakers", expvar.Func(func() any {
+			return httpRequestSvc.Breakers()
+		}))
+		requestSvc = httpRequestSvc
+	case "grpc":
+		conn, err := GetGRPCConn()
+		if err != nil {
+			logger.Error("Connecting to the uniqueness service over gRPC failed",
+				zap.Error(err))
+			os.Exit(1)
+		}
+		defer conn.Close()
+		// Calls get the same route breakers, bulkheads and rate limits as
+		// HTTP requests.
+		grpcOpts := []service.GRPCOption{
+			service.WithGRPCSigning(orbIDStr, signKey),
+			service.WithGRPCRouteBreaker(statusCb, "/status", "/status/batch"),
+			service.WithGRPCRouteBreaker(signUpCb, "/sign-up", "/sign-up/batch"),
+			service.WithGRPCBulkhead(statusMaxConcurrent, "/status", "/status/batch"),
+			service.WithGRPCBulkhead(signUpMaxConcurrent, "/sign-up", "/sign-up/batch"),
+		}
+		if statusRateLimit > 0 {
+			grpcOpts = append(grpcOpts, service.WithGRPCRateLimit(statusRateLimit, statusRateBurst, "/status", "/status/batch"))
+		}
+		if signUpRateLimit > 0 {
+			grpcOpts = append(grpcOpts, service.WithGRPCRateLimit(signUpRateLimit, signUpRateBurst, "/sign-up", "/sign-up/batch"))
+		}
+		grpcRequestSvc := service.NewGRPCRequestSvc(conn, cb, grpcOpts...)
+		expvar.Publish("circuit_breakers", expvar.Func(func() any {
+			return grpcRequestSvc.Breakers()
+		}))
+		requestSvc = grpcRequestSvc
+	default:
+		logger.Error("Unknown transport",
+			zap.String("transport", transportName))
+		os.Exit(1)
+	}
+	// With a channel URL, statuses stream over a WebSocket while it is up,
+	// the transport above carrying them otherwise.
+	var runChannel func(ctx context.Context)
+	if channelCfg := GetChannelConfig(); channelCfg.URL != "" {
+		pushCounts := expvar.NewMap("channel_pushes")
+		channel := service.NewChannel(channelCfg, requestSvc,
+			service.WithChannelMiddlewares(
+				service.Identity(userAgent, orbIDStr),
+				service.Signing(orbIDStr, signKey, service.WithNegotiatedScheme(negotiation)),
+			),
+			service.WithPushHandler(func(message domain.PushMessage) {
+				logger.Info("Received pushed message",
+					zap.String("topic", message.Topic),
+					zap.ByteString("body", message.Body))
+				pushCounts.Add(message.Topic, 1)
+			}))
+		expvar.Publish("channel_connected", expvar.Func(func() any {
+			return channel.Connected()
+		}))
+		requestSvc = channel
+		runChannel = channel.Run
+	}
+	healthCfg, gateCaptures := GetHealthConfig(outboxPath != "")
+	// Probes go through the default breaker; the route breakers guarding
+	// statuses and sign-ups are fed their outcome too.
+	health := service.NewHealthMonitor(requestSvc, healthCfg, service.WithProbeBreakers(statusCb, signUpCb),
+		service.WithHealthChange(func(from, to domain.Connectivity) {
+			logger.Warn("Uniqueness service connectivity changed",
+				zap.String("from", string(from)),
+				zap.String("to", string(to)))
+		}))
+	expvar.Publish("backend_health", expvar.Func(func() any {
+		return health.Snapshot()
+	}))
+	systemInfo := service.ReportClockSkew(platform.NewSystemInfo(), clock)
+	var statusOpts []service.StatusOption
+	var signUpOpts []service.SignUpOption
+	var deadLetters domain.DeadLetterStore
+	deadLetterCounts := expvar.NewMap("dead_letters")
+	if deadLetterDir != "" {
+		store, err := platform.OpenDeadLetterStore(deadLetterDir)
+		if err != nil {
+			logger.Error("Opening dead letter store failed",
+				zap.Error(err))
+			os.Exit(1)
+		}
+		deadLetters = &countingDeadLetters{store, deadLetterCounts}
+		statusOpts = append(statusOpts, service.WithStatusDeadLetters(deadLetters))
+		signUpOpts = append(signUpOpts, service.WithDeadLetters(deadLetters))
+	}
+	if statusBufferCapacity > 0 {
+		bufferCfg := service.StatusBufferConfig{Capacity: statusBufferCapacity}
+		if statusSpillPath != "" {
+			spill, err := platform.OpenStatusSpill(statusSpillPath)
+			if err != nil {
+				logger.Error("Opening status spill failed",
+					zap.Error(err))
+				os.Exit(1)
+			}
+			bufferCfg.Spill = spill
+			bufferCfg.SpillCapacity = statusSpillCapacity
+		}
+		statusBuffer, err := service.NewStatusBuffer(bufferCfg)
+		if err != nil {
+			logger.Error("Creating status buffer failed",
+				zap.Error(err))
+			os.Exit(1)
+		}
+		expvar.Publish("status_buffer_pending", expvar.Func(func() any {
+			return statusBuffer.Len()
+		}))
+		statusOpts = append(statusOpts, service.WithStatusBuffer(statusBuffer, service.BatchConfig{
+			MaxSize:   statusBatchSize,
+			MaxLinger: statusBatchLinger,
+		}))
+	}
+	var status domain.StatusSvc
+	switch statusSink {
+	case "http":
+		status = service.NewStatusSvc(requestSvc, systemInfo, statusOpts...)
+	case "mqtt":
+		// Statuses are published to the broker instead of posted to /status.
+		mqttCfg, telemetryCfg := GetMQTTConfig(orbIDStr)
+		publisher, err := platform.NewMQTTPublisher(mqttCfg)
+		if err != nil {
+			logger.Error("Creating MQTT publisher failed",
+				zap.Error(err))
+			os.Exit(1)
+		}
+		defer publisher.Close(time.Second)
+		expvar.Publish("mqtt_connected", expvar.Func(func() any {
+			return publisher.Connected()
+		}))
+		status, err = service.NewTelemetrySvc(publisher, systemInfo, orbIDStr, telemetryCfg)
+		if err != nil {
+			logger.Error("Creating telemetry service failed",
+				zap.Error(err))
+			os.Exit(1)
+		}
+	default:
+		logger.Error("Unknown status sink",
+			zap.String("sink", statusSink))
+		os.Exit(1)
+	}
+
+	signUpOutcomes := expvar.NewMap("sign_up_outcomes")
+	var sender interface{ Run(ctx context.Context) }
+	if outboxPath != "" {
+		outbox, err := platform.OpenOutbox(platform.OutboxConfig{
+			Path:     outboxPath,
+			Capacity: outboxCapacity,
+			MaxAge:   outboxMaxAge,
+			OnExpire: func(entry domain.OutboxEntry) {
+				logger.Warn("Sign-up expired in outbox", zap.String("id", entry.Id))
+				signUpOutcomes.Add("expired", 1)
+				if deadLetters == nil {
+					return
+				}
+				letter := service.OutboxDeadLetter(entry, domain.DeadLetterExpired, 0, 0, domain.ErrTransientFailure)
+				if err := deadLetters.Add(letter); err != nil {
+					logger.Error("Storing dead letter failed", zap.String("id", entry.Id), zap.Error(err))
+				}
+			},
+		})
+		if err != nil {
+			logger.Error("Opening sign-up outbox failed",
+				zap.Error(err))
+			os.Exit(1)
+		}
+		defer outbox.Close()
+		expvar.Publish("sign_up_outbox_pending", expvar.Func(func() any {
+			return outbox.Len()
+		}))
+		signUpOpts = append(signUpOpts, service.WithOutbox(outbox))
+		senderRetryPolicy := retryPolicy
+		senderRetryPolicy.MaxAttempts = outboxMaxAttempts
+		sender = service.NewSignUpSender(outbox, requestSvc, service.SenderConfig{
+			PollInterval: outboxPollInterval,
+			Retry:        senderRetryPolicy,
+			DeadLetters:  deadLetters,
+			Batch: service.BatchConfig{
+				MaxSize:   signUpBatchSize,
+				MaxLinger: signUpBatchLinger,
+			},
+		}, func(result *domain.SignUpResult, err error) {
+			LogSignUp(logger, signUpOutcomes, result, err)
+		})
+	}
+	signUpOpts = append(signUpOpts,
+		service.WithNegotiatedOptions(negotiation),
+		service.WithSignUpClock(clock))
+	signUp := service.NewSignUpSvc(signKey, snowflakeNode, requestSvc, signUpOpts...)
+	go func() {
+		if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+			logger.Error("Serving metrics failed", zap.Error(err))
+		}
+	}()
+
+	// Captures start once the uniqueness service answers, or after the
+	// wait, in which case they stay suppressed until it does. Over HTTP the
+	// wait came before the negotiation, so a single probe tells where it
+	// ended.
+	if transportName == "http" {
+		health.Check(ctx)
+	} else if err := health.WaitUntilReady(ctx); err != nil {
+		logger.Warn("Uniqueness service not ready", zap.Error(err))
+	}
 
 	statusTicker := time.NewTicker(statusPeriodicInterval)
+	defer statusTicker.Stop()
 	signUpTicker := time.NewTicker(signUpPeriodicInterval)
-	done := make(chan bool)
+	defer signUpTicker.Stop()
+	var jobs sync.WaitGroup
 
 	// Goroutine for periodically reporting status
+	jobs.Add(1)
 	go func() {
+		defer jobs.Done()
 		for {
 			select {
-			case <-done:
+			case <-ctx.Done():
 				return
 			case <-statusTicker.C:
-				err := status.Report()
+				reportCtx, cancel := context.WithTimeout(ctx, statusTimeout)
+				err := status.Report(reportCtx)
+				cancel()
 				if err != nil {
 					logger.Error("Reporting status failed", zap.Error(err))
 				} else {
@@ -97,36 +528,511 @@ func main() {
 	}()
 
 	// Goroutine for periodically simulating a signup process
+	jobs.Add(1)
 	go func() {
+		defer jobs.Done()
 		for {
 			select {
-			case <-done:
+			case <-ctx.Done():
 				return
 			case <-signUpTicker.C:
+				if gateCaptures && !health.Ready() {
+					logger.Warn("Skipping capture while the uniqueness service is unhealthy")
+					signUpOutcomes.Add("suppressed", 1)
+					continue
+				}
 				imgData, err := platform.GenerateRandomImageData()
 				if err != nil {
 					logger.Error("Scanning iris image failed", zap.Error(err))
 				}
 
-				err = signUp.SignUp(imgData)
-				if err != nil {
-					logger.Error("Signing up failed", zap.Error(err))
-				} else {
-					logger.Info("Signing up succeeded")
-				}
+				signUpCtx, cancel := context.WithTimeout(ctx, signUpTimeout)
+				result, err := signUp.SignUp(signUpCtx, imgData)
+				cancel()
+				LogSignUp(logger, signUpOutcomes, result, err)
 			}
 		}
 	}()
 
+	// Goroutine for delivering the sign-ups queued in the outbox
+	if sender != nil {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			sender.Run(ctx)
+		}()
+	}
+
+	// Goroutine for checking the health of the uniqueness service instances
+	if checkEndpoints != nil {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			checkEndpoints(ctx)
+		}()
+	}
+
+	// Goroutine for keeping the WebSocket channel open
+	if runChannel != nil {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			runChannel(ctx)
+		}()
+	}
+
+	// Goroutine for renegotiating capabilities the uniqueness service could not be asked for at boot
+	if renegotiate {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			RenegotiateCapabilities(ctx, logger, negotiation, transport, endpoints, retryPolicy, supported)
+		}()
+	}
+
+	// Goroutine for probing the health of the uniqueness service
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		health.Run(ctx)
+	}()
+
 	// Implement graceful shutdown incase jobs were doing work at time of stoppage
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
+	<-ctx.Done()
 	logger.Info("Gracefully shutting down server...")
-	statusTicker.Stop()
-	done <- true
-	os.Exit(0)
+	jobs.Wait()
+}
+
+// countingDeadLetters counts the dead letters added to a store per reason.
+type countingDeadLetters struct {
+	domain.DeadLetterStore
+	counts *expvar.Map
+}
+
+// Add stores the dead letter and counts it once stored.
+func (c *countingDeadLetters) Add(letter domain.DeadLetter) error {
+	if err := c.DeadLetterStore.Add(letter); err != nil {
+		return err
+	}
+	c.counts.Add(string(letter.Reason), 1)
+	return nil
+}
 
+// LogSignUp logs the outcome of a sign-up and counts it in the outcomes metric.
+//
+// Parameters:
+//
+//	logger: Logger the outcome is written to.
+//	outcomes: Metric counting sign-ups per outcome.
+//	result: Outcome of the sign-up, or nil if it never reached the uniqueness service.
+//	err: Error matching the outcome, if any.
+func LogSignUp(logger *zap.Logger, outcomes *expvar.Map, result *domain.SignUpResult, err error) {
+	if result == nil {
+		if errors.Is(err, domain.ErrClockSkewed) {
+			outcomes.Add("clock_skewed", 1)
+		}
+		logger.Error("Signing up failed", zap.Error(err))
+		return
+	}
+	outcomes.Add(string(result.Outcome), 1)
+	switch {
+	case result.Outcome == domain.SignUpQueued:
+		logger.Info("Signing up was queued", zap.String("id", result.Id))
+	case err == nil:
+		logger.Info("Signing up succeeded", zap.String("id", result.Id))
+	case errors.Is(err, domain.ErrDuplicateSignUp):
+		logger.Info("Signing up found a duplicate",
+			zap.String("id", result.Id),
+			zap.String("matchId", result.MatchID))
+	case result.Outcome == domain.SignUpUnconfirmed:
+		logger.Warn("Signing up was accepted but not confirmed",
+			zap.String("id", result.Id),
+			zap.Error(err))
+	case errors.Is(err, domain.ErrSignUpRejected):
+		logger.Warn("Signing up was rejected",
+			zap.String("id", result.Id),
+			zap.String("reason", result.Reason))
+	default:
+		logger.Error("Signing up failed", zap.String("id", result.Id), zap.Error(err))
+	}
+}
+
+// GetEndpoints reads the instances of the uniqueness service from BASE_URL,
+// a comma-separated list, most preferred first; see service.ParseEndpoints.
+// With several instances, each gets a circuit breaker of its own, configured
+// by the ENDPOINT_CB_* environment variables.
+//
+// Parameters:
+//
+//	onStateChange: Called when the breaker of an instance changes state, or nil.
+//
+// Returns:
+//
+//	The instances, or an error if BASE_URL is malformed.
+func GetEndpoints(onStateChange func(name string, from gobreaker.State, to gobreaker.State)) ([]service.Endpoint, error) {
+	endpoints, err := service.ParseEndpoints(GetEnvWithDefault("BASE_URL", "http://mock-uniqueness-service:8001"))
+	if err != nil || len(endpoints) == 1 {
+		return endpoints, err
+	}
+	for i := range endpoints {
+		settings := GetBreakerSettings("ENDPOINT_", "Endpoint Circuit Breaker "+endpoints[i].URL)
+		settings.OnStateChange = onStateChange
+		endpoints[i].Breaker = service.NewCircuitBreaker(settings)
+	}
+	return endpoints, nil
+}
+
+// GetHealthConfig reads how the health of the uniqueness service is probed.
+// The interval and timeout are those of the endpoint health checks.
+// Captures are never suppressed when sign-ups are queued in an outbox, which
+// delivers them once the service recovers.
+//
+// Parameters:
+//
+//	outbox: Whether sign-ups are queued in an outbox.
+//
+// Returns:
+//
+//	Probing settings, and whether captures are suppressed while the service
+//	is unhealthy.
+func GetHealthConfig(outbox bool) (service.HealthConfig, bool) {
+	healthInterval, _ := time.ParseDuration(GetEnvWithDefault("HEALTH_CHECK_INTERVAL", "10s"))
+	healthTimeout, _ := time.ParseDuration(GetEnvWithDefault("HEALTH_CHECK_TIMEOUT", "2s"))
+	waitForReady, _ := time.ParseDuration(GetEnvWithDefault("HEALTH_WAIT_FOR_READY", "30s"))
+	failureThreshold, _ := strconv.Atoi(GetEnvWithDefault("HEALTH_FAILURE_THRESHOLD", "2"))
+	gateCaptures, _ := strconv.ParseBool(GetEnvWithDefault("HEALTH_GATE_CAPTURES", "true"))
+	return service.HealthConfig{
+		Interval:         healthInterval,
+		Timeout:          healthTimeout,
+		WaitForReady:     waitForReady,
+		FailureThreshold: failureThreshold,
+	}, gateCaptures && !outbox
+}
+
+// GetClockConfig reads how the skew of the orb clock is estimated and
+// bounded.
+//
+// Returns:
+//
+//	Settings of the clock monitor.
+func GetClockConfig() service.ClockConfig {
+	maxSkew, _ := time.ParseDuration(GetEnvWithDefault("CLOCK_MAX_SKEW", "30s"))
+	window, _ := strconv.Atoi(GetEnvWithDefault("CLOCK_SKEW_WINDOW", "8"))
+	return service.ClockConfig{
+		MaxSkew: maxSkew,
+		Window:  window,
+	}
+}
+
+// GetFailoverConfig reads the health checking and fail-back settings of the
+// uniqueness service instances.
+//
+// Returns:
+//
+//	Failover settings of the endpoint pool.
+func GetFailoverConfig() service.FailoverConfig {
+	healthInterval, _ := time.ParseDuration(GetEnvWithDefault("HEALTH_CHECK_INTERVAL", "10s"))
+	healthTimeout, _ := time.ParseDuration(GetEnvWithDefault("HEALTH_CHECK_TIMEOUT", "2s"))
+	failBackAfter, _ := time.ParseDuration(GetEnvWithDefault("FAIL_BACK_AFTER", "30s"))
+	return service.FailoverConfig{
+		HealthInterval: healthInterval,
+		HealthTimeout:  healthTimeout,
+		FailBackAfter:  failBackAfter,
+	}
+}
+
+// GetChannelConfig reads the WebSocket channel settings from the CHANNEL_*
+// environment variables. CHANNEL_ROUTES lists the routes sent over the
+// channel, separated by commas.
+//
+// Returns:
+//
+//	Settings of the channel, with an empty URL when it is disabled.
+func GetChannelConfig() service.ChannelConfig {
+	routes := GetEnvList("CHANNEL_ROUTES", "/status")
+	heartbeatInterval, _ := time.ParseDuration(GetEnvWithDefault("CHANNEL_HEARTBEAT_INTERVAL", "15s"))
+	heartbeatTimeout, _ := time.ParseDuration(GetEnvWithDefault("CHANNEL_HEARTBEAT_TIMEOUT", "45s"))
+	handshakeTimeout, _ := time.ParseDuration(GetEnvWithDefault("CHANNEL_HANDSHAKE_TIMEOUT", "10s"))
+	reconnectBaseDelay, _ := time.ParseDuration(GetEnvWithDefault("CHANNEL_RECONNECT_BASE_DELAY", "1s"))
+	reconnectMaxDelay, _ := time.ParseDuration(GetEnvWithDefault("CHANNEL_RECONNECT_MAX_DELAY", "1m"))
+	return service.ChannelConfig{
+		URL:                GetEnvWithDefault("CHANNEL_URL", ""),
+		Routes:             routes,
+		HeartbeatInterval:  heartbeatInterval,
+		HeartbeatTimeout:   heartbeatTimeout,
+		HandshakeTimeout:   handshakeTimeout,
+		ReconnectBaseDelay: reconnectBaseDelay,
+		ReconnectMaxDelay:  reconnectMaxDelay,
+	}
+}
+
+// GetGRPCConn connects to the uniqueness service over gRPC, at GRPC_ADDR,
+// with TLS when GRPC_TLS is true. The connection is established lazily, on
+// the first call.
+//
+// Returns:
+//
+//	The client connection, or an error if the settings are invalid.
+func GetGRPCConn() (*grpc.ClientConn, error) {
+	addr := GetEnvWithDefault("GRPC_ADDR", "mock-uniqueness-service:9001")
+	grpcTLSStr := GetEnvWithDefault("GRPC_TLS", "false")
+	grpcTLS, _ := strconv.ParseBool(grpcTLSStr)
+	creds := insecure.NewCredentials()
+	if grpcTLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	return grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+}
+
+// GetMQTTConfig reads the MQTT broker connection and status topic settings
+// from the MQTT_* environment variables. Topics may contain the {orb_id}
+// placeholder.
+//
+// Parameters:
+//
+//	orbID: Identifier of the orb, used in the client ID and presence topic.
+//
+// Returns:
+//
+//	Connection settings of the publisher and publication settings of the
+//	status reports.
+func GetMQTTConfig(orbID string) (platform.MQTTConfig, service.TelemetryConfig) {
+	mqttKeepAliveStr := GetEnvWithDefault("MQTT_KEEP_ALIVE", "30s")
+	mqttKeepAlive, _ := time.ParseDuration(mqttKeepAliveStr)
+	mqttConnectTimeoutStr := GetEnvWithDefault("MQTT_CONNECT_TIMEOUT", "5s")
+	mqttConnectTimeout, _ := time.ParseDuration(mqttConnectTimeoutStr)
+	mqttQoSStr := GetEnvWithDefault("MQTT_QOS", "1")
+	mqttQoS, _ := strconv.ParseUint(mqttQoSStr, 10, 8)
+	mqttRetainStatusStr := GetEnvWithDefault("MQTT_RETAIN_STATUS", "false")
+	mqttRetainStatus, _ := strconv.ParseBool(mqttRetainStatusStr)
+	mqttPresenceTopic := GetEnvWithDefault("MQTT_PRESENCE_TOPIC", "orbs/"+service.TopicOrbID+"/presence")
+	return platform.MQTTConfig{
+		BrokerURL:      GetEnvWithDefault("MQTT_BROKER_URL", "tcp://mqtt-broker:1883"),
+		ClientID:       GetEnvWithDefault("MQTT_CLIENT_ID", "virtual-orb-"+orbID),
+		Username:       GetEnvWithDefault("MQTT_USERNAME", ""),
+		Password:       GetEnvWithDefault("MQTT_PASSWORD", ""),
+		KeepAlive:      mqttKeepAlive,
+		ConnectTimeout: mqttConnectTimeout,
+		PresenceTopic:  service.OrbTopic(mqttPresenceTopic, orbID),
+		PresenceQoS:    byte(mqttQoS),
+	}, service.TelemetryConfig{
+		Topic:    GetEnvWithDefault("MQTT_STATUS_TOPIC", "orbs/"+service.TopicOrbID+"/status"),
+		QoS:      byte(mqttQoS),
+		Retained: mqttRetainStatus,
+	}
+}
+
+// GetHTTPClientConfig reads the HTTP transport settings from the HTTP_*
+// environment variables.
+//
+// Returns:
+//
+//	Transport settings of the HTTP client.
+func GetHTTPClientConfig() platform.HTTPClientConfig {
+	httpTimeoutStr := GetEnvWithDefault("HTTP_TIMEOUT", "10s")
+	httpTimeout, _ := time.ParseDuration(httpTimeoutStr)
+	httpDialTimeoutStr := GetEnvWithDefault("HTTP_DIAL_TIMEOUT", "5s")
+	httpDialTimeout, _ := time.ParseDuration(httpDialTimeoutStr)
+	httpKeepAliveStr := GetEnvWithDefault("HTTP_KEEP_ALIVE", "30s")
+	httpKeepAlive, _ := time.ParseDuration(httpKeepAliveStr)
+	httpTLSHandshakeTimeoutStr := GetEnvWithDefault("HTTP_TLS_HANDSHAKE_TIMEOUT", "5s")
+	httpTLSHandshakeTimeout, _ := time.ParseDuration(httpTLSHandshakeTimeoutStr)
+	httpResponseHeaderTimeoutStr := GetEnvWithDefault("HTTP_RESPONSE_HEADER_TIMEOUT", "5s")
+	httpResponseHeaderTimeout, _ := time.ParseDuration(httpResponseHeaderTimeoutStr)
+	httpIdleConnTimeoutStr := GetEnvWithDefault("HTTP_IDLE_CONN_TIMEOUT", "90s")
+	httpIdleConnTimeout, _ := time.ParseDuration(httpIdleConnTimeoutStr)
+	httpMaxIdleConnsStr := GetEnvWithDefault("HTTP_MAX_IDLE_CONNS", "10")
+	httpMaxIdleConns, _ := strconv.Atoi(httpMaxIdleConnsStr)
+	httpMaxIdleConnsPerHostStr := GetEnvWithDefault("HTTP_MAX_IDLE_CONNS_PER_HOST", "5")
+	httpMaxIdleConnsPerHost, _ := strconv.Atoi(httpMaxIdleConnsPerHostStr)
+	httpDisableKeepAlivesStr := GetEnvWithDefault("HTTP_DISABLE_KEEP_ALIVES", "false")
+	httpDisableKeepAlives, _ := strconv.ParseBool(httpDisableKeepAlivesStr)
+	httpEnableHTTP2Str := GetEnvWithDefault("HTTP_ENABLE_HTTP2", "true")
+	httpEnableHTTP2, _ := strconv.ParseBool(httpEnableHTTP2Str)
+	httpProxyURL := GetEnvWithDefault("HTTP_PROXY_URL", "")
+	return platform.HTTPClientConfig{
+		Timeout:               httpTimeout,
+		DialTimeout:           httpDialTimeout,
+		KeepAlive:             httpKeepAlive,
+		TLSHandshakeTimeout:   httpTLSHandshakeTimeout,
+		ResponseHeaderTimeout: httpResponseHeaderTimeout,
+		IdleConnTimeout:       httpIdleConnTimeout,
+		MaxIdleConns:          httpMaxIdleConns,
+		MaxIdleConnsPerHost:   httpMaxIdleConnsPerHost,
+		DisableKeepAlives:     httpDisableKeepAlives,
+		EnableHTTP2:           httpEnableHTTP2,
+		ProxyURL:              httpProxyURL,
+	}
+}
+
+// GetEncodingOptions reads how request bodies are encoded and compressed
+// from REQUEST_ENCODING and REQUEST_GZIP_MIN_SIZE.
+//
+// Returns:
+//
+//	Request service options applying the settings, or an error if the
+//	encoding is unknown.
+func GetEncodingOptions() ([]service.RequestOption, error) {
+	encoding, err := service.ParseEncoding(GetEnvWithDefault("REQUEST_ENCODING", string(service.EncodingJSON)))
+	if err != nil {
+		return nil, err
+	}
+	gzipMinSizeStr := GetEnvWithDefault("REQUEST_GZIP_MIN_SIZE", "0")
+	gzipMinSize, _ := strconv.Atoi(gzipMinSizeStr)
+	return []service.RequestOption{
+		service.WithEncoding(encoding),
+		service.WithCompression(gzipMinSize),
+	}, nil
+}
+
+// GetCapabilities reads what the orb supports from the SUPPORTED_*
+// environment variables, each a list separated by commas, most preferred
+// first.
+//
+// Parameters:
+//
+//	statusBatchSize: Most samples the orb sends per status batch.
+//	signUpBatchSize: Most sign-ups the orb sends per batch.
+//
+// Returns:
+//
+//	Capabilities of the orb.
+func GetCapabilities(statusBatchSize, signUpBatchSize int) domain.Capabilities {
+	return domain.Capabilities{
+		APIVersions:        GetEnvList("SUPPORTED_API_VERSIONS", "v1"),
+		HashAlgorithms:     GetEnvList("SUPPORTED_HASH_ALGORITHMS", "phash,dhash,ahash"),
+		SignatureSchemes:   GetEnvList("SUPPORTED_SIGNATURE_SCHEMES", "hmac-sha512,hmac-sha256"),
+		MaxStatusBatchSize: statusBatchSize,
+		MaxSignUpBatchSize: signUpBatchSize,
+	}
+}
+
+// NegotiateCapabilities asks the uniqueness service what it supports and
+// picks the options to use with it, unless NEGOTIATE_CAPABILITIES is false.
+// The instances are asked in turn, most preferred first, each for at most
+// CAPABILITIES_TIMEOUT, until one of them answers. The requests only carry
+// the orb identity, as nothing can be signed until the scheme is known.
+//
+// Parameters:
+//
+//	ctx: Context bounding the wait and the negotiation.
+//	transport: HTTP client the requests are sent with.
+//	endpoints: Instances of the uniqueness service.
+//	retryPolicy: How each request is retried while its instance is unreachable.
+//	waitForReady: Whether to first wait for the service to pass its health
+//	check, for at most HEALTH_WAIT_FOR_READY, even if nothing is negotiated.
+//	supported: Capabilities of the orb.
+//
+// Returns:
+//
+//	The negotiated options, or an error wrapping domain.ErrInvalidCapability
+//	if the orb's capabilities are invalid, domain.ErrNoCommonCapability if
+//	the service has nothing in common with the orb, or the failures of every
+//	instance if none could be asked.
+func NegotiateCapabilities(ctx context.Context, transport domain.HttpClient, endpoints []service.Endpoint, retryPolicy service.RetryPolicy, waitForReady bool, supported domain.Capabilities) (domain.Negotiated, error) {
+	negotiate, _ := strconv.ParseBool(GetEnvWithDefault("NEGOTIATE_CAPABILITIES", "true"))
+	if negotiate {
+		if err := service.ValidateCapabilities(supported); err != nil {
+			return domain.Negotiated{}, err
+		}
+	}
+	timeout, _ := time.ParseDuration(GetEnvWithDefault("CAPABILITIES_TIMEOUT", "10s"))
+	orbID := GetEnvWithDefault("ORB_ID", "1")
+	client := service.Chain(transport, service.Identity(GetEnvWithDefault("USER_AGENT", "virtual-orb"), orbID))
+
+	if waitForReady {
+		// A failed wait is left for the negotiation to report.
+		var opts []service.RequestOption
+		if len(endpoints) > 1 {
+			opts = append(opts, service.WithEndpoints(service.NewEndpointPool(endpoints, client, GetFailoverConfig())))
+		}
+		probe := service.NewRequestSvc(endpoints[0].URL, client, service.NewCircuitBreaker(service.BreakerSettings{}), opts...)
+		healthCfg, _ := GetHealthConfig(false)
+		service.NewHealthMonitor(probe, healthCfg).WaitUntilReady(ctx)
+	}
+	if !negotiate {
+		return service.DefaultNegotiated(), nil
+	}
+
+	var errs []error
+	for _, endpoint := range endpoints {
+		cb := service.NewCircuitBreaker(GetBreakerSettings("", "Capabilities Circuit Breaker"))
+		requestSvc := service.NewRequestSvc(endpoint.URL, client, cb, service.WithRetryPolicy(retryPolicy))
+		endpointCtx, cancel := context.WithTimeout(ctx, timeout)
+		negotiated, err := service.NegotiateCapabilities(endpointCtx, requestSvc, supported)
+		cancel()
+		if err == nil {
+			return negotiated, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", endpoint.URL, err))
+	}
+	return domain.Negotiated{}, errors.Join(errs...)
+}
+
+// RenegotiateCapabilities asks the uniqueness service what it supports every
+// CAPABILITIES_RETRY_INTERVAL until it answers, then switches the orb to
+// the negotiated options. It gives up, keeping the options in use, if the
+// service has nothing in common with the orb.
+//
+// Parameters:
+//
+//	ctx: Context bounding the attempts.
+//	logger: Logger the outcome is written to.
+//	negotiation: Holder of the options in use, updated once negotiated.
+//	transport: HTTP client the requests are sent with.
+//	endpoints: Instances of the uniqueness service.
+//	retryPolicy: How each request is retried while its instance is unreachable.
+//	supported: Capabilities of the orb.
+func RenegotiateCapabilities(ctx context.Context, logger *zap.Logger, negotiation interface{ Update(domain.Negotiated) }, transport domain.HttpClient, endpoints []service.Endpoint, retryPolicy service.RetryPolicy, supported domain.Capabilities) {
+	interval, _ := time.ParseDuration(GetEnvWithDefault("CAPABILITIES_RETRY_INTERVAL", "30s"))
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		negotiated, err := NegotiateCapabilities(ctx, transport, endpoints, retryPolicy, false, supported)
+		switch {
+		case errors.Is(err, domain.ErrNoCommonCapability):
+			logger.Error("Renegotiating capabilities with the uniqueness service failed, keeping legacy options",
+				zap.Error(err))
+			return
+		case err != nil:
+			logger.Warn("Asking the uniqueness service for its capabilities failed", zap.Error(err))
+		default:
+			// Batches keep the size they started with, as picked for a legacy service.
+			negotiation.Update(negotiated)
+			logger.Info("Renegotiated capabilities with the uniqueness service",
+				zap.Any("capabilities", negotiated))
+			return
+		}
+	}
+}
+
+// GetEnvList fetches an environment variable holding a list separated by
+// commas, leaving out blank items.
+//
+// Parameters:
+//
+//	key: Name of the environment variable.
+//	defaultValue: Value to split if the environment variable is not set.
+//
+// Returns:
+//
+//	Items of the list.
+func GetEnvList(key, defaultValue string) []string {
+	var items []string
+	for _, item := range strings.Split(GetEnvWithDefault(key, defaultValue), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 // GetEnvWithDefault fetches the value of an environment variable.
@@ -147,3 +1053,42 @@ func GetEnvWithDefault(key, defaultValue string) string {
 	}
 	return value
 }
+
+// GetBreakerSettings reads circuit breaker settings from the CB_* environment
+// variables. Variables carrying the given prefix, such as STATUS_CB_TIMEOUT,
+// take precedence so that each route can be tuned independently.
+//
+// Parameters:
+//
+//	prefix: Prefix of the route-specific variables, or empty for the defaults.
+//	name: Name of the circuit breaker.
+//
+// Returns:
+//
+//	Settings of the circuit breaker, without a state change callback.
+func GetBreakerSettings(prefix, name string) service.BreakerSettings {
+	get := func(key, defaultValue string) string {
+		return GetEnvWithDefault(prefix+key, GetEnvWithDefault(key, defaultValue))
+	}
+	timeout, _ := time.ParseDuration(get("CB_TIMEOUT", "60s"))
+	maxRequests, _ := strconv.Atoi(get("CB_MAX_REQUESTS", "5"))
+	interval, _ := time.ParseDuration(get("CB_INTERVAL", "60s"))
+	minRequests, _ := strconv.Atoi(get("CB_MIN_REQUESTS", "3"))
+	failureRatio, _ := strconv.ParseFloat(get("CB_FAILURE_RATIO", "0.6"), 64)
+	consecutiveFailures, _ := strconv.Atoi(get("CB_CONSECUTIVE_FAILURES", "0"))
+	slowCallRatio, _ := strconv.ParseFloat(get("CB_SLOW_CALL_RATIO", "0"), 64)
+	slowCallThreshold, _ := time.ParseDuration(get("CB_SLOW_CALL_THRESHOLD", "0s"))
+	return service.BreakerSettings{
+		Name:        name,
+		Timeout:     timeout,
+		MaxRequests: uint32(maxRequests),
+		Interval:    interval,
+		Trip: service.TripPolicy{
+			MinRequests:         uint32(minRequests),
+			FailureRatio:        failureRatio,
+			ConsecutiveFailures: uint32(consecutiveFailures),
+			SlowCallRatio:       slowCallRatio,
+			SlowCallThreshold:   slowCallThreshold,
+		},
+	}
+}
@@ -3,13 +3,24 @@ module virtual-orb
 go 1.20
 
 require (
-	github.com/bwmarrin/snowflake v0.3.0 // indirect
-	github.com/bxcodec/faker/v3 v3.8.1 // indirect
-	github.com/corona10/goimagehash v1.1.0 // indirect
-	github.com/google/uuid v1.3.1 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/bwmarrin/snowflake v0.3.0
+	github.com/corona10/goimagehash v1.1.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/gorilla/websocket v1.5.0
+	github.com/joho/godotenv v1.5.1
+	github.com/sony/gobreaker v0.5.0
+	go.uber.org/zap v1.25.0
+	google.golang.org/grpc v1.59.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646 // indirect
-	github.com/sony/gobreaker v0.5.0 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
-	go.uber.org/zap v1.25.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
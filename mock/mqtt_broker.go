@@ -0,0 +1,219 @@
+package mock
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+type (
+	// MQTTBroker is an in-process MQTT 3.1.1 broker for tests. It accepts
+	// publications at every QoS, keeps retained messages and publishes the
+	// last will of clients whose connection is lost without a DISCONNECT.
+	// It does not deliver messages to subscribers; tests inspect what was
+	// published instead. When Username is set, clients must present it and
+	// Password to connect.
+	MQTTBroker struct {
+		Username string
+		Password string
+
+		listener  net.Listener
+		mu        sync.Mutex
+		conns     map[net.Conn]bool
+		published []MQTTMessage
+		retained  map[string]MQTTMessage
+		connects  int
+	}
+
+	// MQTTMessage is a message received by the broker.
+	MQTTMessage struct {
+		ClientID string
+		Topic    string
+		QoS      byte
+		Retained bool
+		Payload  []byte
+		Will     bool // Whether the broker published it as a last will.
+	}
+)
+
+// NewMQTTBroker starts a broker listening on a local port.
+//
+// Returns a pointer to the broker, or an error if it cannot listen.
+func NewMQTTBroker() (*MQTTBroker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &MQTTBroker{
+		listener: listener,
+		conns:    map[net.Conn]bool{},
+		retained: map[string]MQTTMessage{},
+	}
+	go b.accept()
+	return b, nil
+}
+
+// URL returns the address clients connect to.
+func (b *MQTTBroker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// Close stops the broker and drops every client without publishing wills.
+func (b *MQTTBroker) Close() {
+	b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		b.conns[conn] = false
+		conn.Close()
+	}
+}
+
+// DropClients cuts every connection as a network failure would, so that the
+// wills of the clients are published.
+func (b *MQTTBroker) DropClients() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// Published returns the messages received so far, in order.
+func (b *MQTTBroker) Published() []MQTTMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]MQTTMessage(nil), b.published...)
+}
+
+// Retained returns the retained message of the topic, if any.
+func (b *MQTTBroker) Retained(topic string) (MQTTMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	message, ok := b.retained[topic]
+	return message, ok
+}
+
+// Connects returns the number of successful connections so far.
+func (b *MQTTBroker) Connects() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connects
+}
+
+// Await waits until the condition holds, checking it every few milliseconds.
+//
+// timeout: How long to wait.
+// cond: The condition, which may inspect the broker.
+//
+// Returns whether the condition held in time.
+func (b *MQTTBroker) Await(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+func (b *MQTTBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.serve(conn)
+	}
+}
+
+func (b *MQTTBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	packet, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if b.Username != "" && (connect.Username != b.Username || string(connect.Password) != b.Password) {
+		connack.ReturnCode = packets.ErrRefusedNotAuthorised
+		connack.Write(conn)
+		return
+	}
+	b.mu.Lock()
+	b.conns[conn] = true
+	b.connects++
+	b.mu.Unlock()
+	if err := connack.Write(conn); err != nil {
+		return
+	}
+
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			break
+		}
+		switch p := packet.(type) {
+		case *packets.PublishPacket:
+			b.store(MQTTMessage{ClientID: connect.ClientIdentifier, Topic: p.TopicName, QoS: p.Qos, Retained: p.Retain, Payload: p.Payload})
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				err = ack.Write(conn)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				err = rec.Write(conn)
+			}
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			err = comp.Write(conn)
+		case *packets.PingreqPacket:
+			err = packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			b.mu.Lock()
+			delete(b.conns, conn)
+			b.mu.Unlock()
+			return
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	b.mu.Lock()
+	lost := b.conns[conn]
+	delete(b.conns, conn)
+	b.mu.Unlock()
+	if lost && connect.WillFlag {
+		b.store(MQTTMessage{
+			ClientID: connect.ClientIdentifier,
+			Topic:    connect.WillTopic,
+			QoS:      connect.WillQos,
+			Retained: connect.WillRetain,
+			Payload:  connect.WillMessage,
+			Will:     true,
+		})
+	}
+}
+
+func (b *MQTTBroker) store(message MQTTMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, message)
+	if message.Retained {
+		if len(message.Payload) == 0 {
+			delete(b.retained, message.Topic)
+		} else {
+			b.retained[message.Topic] = message
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package mock
+
+import "virtual-orb/pkg/domain"
+
+type (
+	Outbox struct {
+		AppendFunc    func(entry domain.OutboxEntry) error
+		PeekFunc      func() (*domain.OutboxEntry, error)
+		PeekBatchFunc func(max int) ([]domain.OutboxEntry, error)
+		AckFunc       func(id string) error
+		LenFunc       func() int
+	}
+)
+
+func (o *Outbox) Append(entry domain.OutboxEntry) error {
+	return o.AppendFunc(entry)
+}
+
+func (o *Outbox) Peek() (*domain.OutboxEntry, error) {
+	return o.PeekFunc()
+}
+
+func (o *Outbox) PeekBatch(max int) ([]domain.OutboxEntry, error) {
+	return o.PeekBatchFunc(max)
+}
+
+func (o *Outbox) Ack(id string) error {
+	return o.AckFunc(id)
+}
+
+func (o *Outbox) Len() int {
+	return o.LenFunc()
+}
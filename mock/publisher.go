@@ -0,0 +1,13 @@
+package mock
+
+import "context"
+
+type (
+	Publisher struct {
+		PublishFunc func(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error
+	}
+)
+
+func (m *Publisher) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	return m.PublishFunc(ctx, topic, qos, retained, payload)
+}
@@ -1,11 +1,21 @@
 package mock
 
+import (
+	"context"
+	"virtual-orb/pkg/domain"
+)
+
 type (
 	RequestSvc struct {
-		PostFunc func(path string, body any) (httpStatus int, err error)
+		PostFunc func(ctx context.Context, path string, body any) (httpStatus int, err error)
+		DoFunc   func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error)
 	}
 )
 
-func (svc *RequestSvc) Post(path string, body any) (httpStatus int, err error) {
-	return svc.PostFunc(path, body)
+func (svc *RequestSvc) Post(ctx context.Context, path string, body any) (httpStatus int, err error) {
+	return svc.PostFunc(ctx, path, body)
+}
+
+func (svc *RequestSvc) Do(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+	return svc.DoFunc(ctx, req, out)
 }
@@ -0,0 +1,149 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+
+	"github.com/gorilla/websocket"
+)
+
+type (
+	// UniquenessChannel serves the WebSocket channel of the uniqueness
+	// service at /channel, and every other route as Service does. Request
+	// frames are handed to Service as their HTTP counterpart and answered
+	// with a response frame of the same ID. When SignKey is set, handshakes
+	// whose orb signature is missing, stale or tampered with get 401. With
+	// IgnorePings, pings are left unanswered, as by a connection that has
+	// silently died.
+	UniquenessChannel struct {
+		Service     *UniquenessService
+		SignKey     string
+		MaxSkew     time.Duration
+		IgnorePings bool
+
+		mu       sync.Mutex
+		conns    map[*websocket.Conn]*sync.Mutex
+		connects int
+	}
+)
+
+func (u *UniquenessChannel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/channel" {
+		u.Service.ServeHTTP(w, r)
+		return
+	}
+	if u.SignKey != "" {
+		if err := service.VerifySignature(u.SignKey, u.MaxSkew, time.Now(), r.Header, nil); err != nil {
+			writeJSON(w, http.StatusUnauthorized, `{"success":false,"message":"invalid signature"}`)
+			return
+		}
+	}
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	if u.IgnorePings {
+		conn.SetPingHandler(func(string) error { return nil })
+	}
+
+	writeMu := &sync.Mutex{}
+	u.mu.Lock()
+	if u.conns == nil {
+		u.conns = map[*websocket.Conn]*sync.Mutex{}
+	}
+	u.conns[conn] = writeMu
+	u.connects++
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		delete(u.conns, conn)
+		u.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var frame domain.ChannelFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			return
+		}
+		if frame.Type != domain.FrameRequest {
+			continue
+		}
+		reply := u.handle(frame)
+		writeMu.Lock()
+		err := conn.WriteJSON(reply)
+		writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle answers a request frame as Service answers its HTTP counterpart.
+func (u *UniquenessChannel) handle(frame domain.ChannelFrame) domain.ChannelFrame {
+	method := frame.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req := httptest.NewRequest(method, frame.Route, bytes.NewReader(frame.Body))
+	if frame.IdempotencyKey != "" {
+		req.Header.Set(service.HeaderIdempotencyKey, frame.IdempotencyKey)
+	}
+	rec := httptest.NewRecorder()
+	u.Service.ServeHTTP(rec, req)
+
+	reply := domain.ChannelFrame{Type: domain.FrameResponse, ID: frame.ID, Status: rec.Code}
+	if body := bytes.TrimSpace(rec.Body.Bytes()); json.Valid(body) {
+		reply.Body = body
+	}
+	return reply
+}
+
+// Push sends a message to every connected orb.
+//
+// topic: Subject of the message.
+// body: The message, encoded as JSON.
+//
+// Returns the number of orbs it was sent to, and an error if it cannot be
+// encoded.
+func (u *UniquenessChannel) Push(topic string, body any) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	frame := domain.ChannelFrame{Type: domain.FramePush, Topic: topic, Body: data}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	sent := 0
+	for conn, writeMu := range u.conns {
+		writeMu.Lock()
+		if conn.WriteJSON(frame) == nil {
+			sent++
+		}
+		writeMu.Unlock()
+	}
+	return sent, nil
+}
+
+// DropConnections cuts every connection as a network failure would.
+func (u *UniquenessChannel) DropConnections() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for conn := range u.conns {
+		conn.Close()
+	}
+}
+
+// Connects returns the number of connections accepted so far.
+func (u *UniquenessChannel) Connects() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.connects
+}
@@ -0,0 +1,172 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type (
+	// UniquenessGRPC is an in-process stand-in for the gRPC flavour of the
+	// uniqueness service. Each call is handed to Service as its HTTP
+	// counterpart, so both transports behave alike, and the HTTP status is
+	// answered with the matching gRPC code. Duplicate sign-ups carry the ID
+	// of the first registration in their trailer. When SignKey is set,
+	// calls whose orb signature is missing, stale or tampered with get
+	// Unauthenticated.
+	UniquenessGRPC struct {
+		Service *UniquenessService
+		SignKey string
+		MaxSkew time.Duration
+	}
+)
+
+// Dial starts the server on an in-memory listener and connects to it.
+//
+// Returns the client connection, a function stopping both, and an error if
+// the connection could not be set up.
+func (g *UniquenessGRPC) Dial() (*grpc.ClientConn, func(), error) {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ForceServerCodec(service.GRPCCodec{}))
+	server.RegisterService(g.serviceDesc(), g)
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		server.Stop()
+		return nil, nil, err
+	}
+	return conn, func() {
+		conn.Close()
+		server.Stop()
+	}, nil
+}
+
+func (g *UniquenessGRPC) serviceDesc() *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{ServiceName: service.GRPCService, HandlerType: (*any)(nil)}
+	for route, method := range service.GRPCMethods() {
+		route := route
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: method,
+			Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				var frame []byte
+				if err := dec(&frame); err != nil {
+					return nil, err
+				}
+				return g.call(ctx, route, frame)
+			},
+		})
+	}
+	return desc
+}
+
+func (g *UniquenessGRPC) call(ctx context.Context, route string, frame []byte) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	if g.SignKey != "" {
+		header := http.Header{}
+		for _, key := range []string{service.HeaderOrbID, service.HeaderTimestamp, service.HeaderSignature} {
+			header.Set(key, first(key))
+		}
+		if err := service.VerifySignature(g.SignKey, g.MaxSkew, time.Now(), header, frame); err != nil {
+			return nil, status.Error(codes.Unauthenticated, "invalid signature")
+		}
+	}
+
+	body, err := decodeFrame(route, frame)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "malformed message")
+	}
+	method := http.MethodPost
+	if route == "/health-check" {
+		method = http.MethodGet
+	}
+	req := httptest.NewRequest(method, route, bytes.NewReader(body))
+	if key := first(service.MetadataIdempotencyKey); key != "" {
+		req.Header.Set(service.HeaderIdempotencyKey, key)
+	}
+	rec := httptest.NewRecorder()
+	g.Service.ServeHTTP(rec, req)
+
+	code := service.GRPCCode(rec.Code)
+	if code == codes.OK && (route == "/status/batch" || route == "/sign-up/batch") {
+		var response domain.BatchResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			return nil, status.Error(codes.Internal, "malformed reply")
+		}
+		return platform.MarshalBatchResponse(&response), nil
+	}
+	var reply domain.SignUpResponse
+	json.Unmarshal(rec.Body.Bytes(), &reply)
+	if code == codes.OK {
+		return platform.MarshalReply(&reply), nil
+	}
+	if reply.MatchID != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs(service.MetadataMatchID, reply.MatchID))
+	}
+	return nil, status.Error(code, reply.Message)
+}
+
+// decodeFrame turns the message of a call into the JSON body of its HTTP
+// counterpart.
+func decodeFrame(route string, frame []byte) ([]byte, error) {
+	switch route {
+	case "/status":
+		status, err := platform.UnmarshalStatus(frame)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(status)
+	case "/status/batch":
+		batch, err := platform.UnmarshalStatusBatch(frame)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(batch)
+	case "/sign-up":
+		iris, err := platform.UnmarshalIris(frame)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(iris)
+	case "/sign-up/batch":
+		signUps, err := platform.UnmarshalSignUpBatch(frame)
+		if err != nil {
+			return nil, err
+		}
+		batch := domain.SignUpBatch{}
+		for _, iris := range signUps {
+			raw, err := json.Marshal(iris)
+			if err != nil {
+				return nil, err
+			}
+			batch.SignUps = append(batch.SignUps, raw)
+		}
+		return json.Marshal(batch)
+	}
+	return nil, nil
+}
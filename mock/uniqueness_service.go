@@ -0,0 +1,369 @@
+package mock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+)
+
+// contracts are checked against every body received, so that tests catch
+// a client sending bodies the backend would not understand.
+var contracts = service.DefaultContracts()
+
+type (
+	// UniquenessService is an in-process stand-in for the Mockoon uniqueness
+	// service. It serves the same routes and, when SignKey is set, rejects
+	// POST requests whose orb signature is missing, stale or tampered with.
+	// Sign-ups of an already registered iris code are answered with 409 and
+	// the ID of the first registration; malformed sign-ups with 422.
+	// Requests repeating an Idempotency-Key get the original answer back,
+	// keys being scoped to the route and the orb; a key repeated with a
+	// different body gets 422.
+	// Status samples uploaded in batches are recorded in arrival order.
+	// Batches are answered with a result per item; sign-ups in a batch are
+	// handled as if each had been sent alone to /sign-up, their ID serving
+	// as their Idempotency-Key. Batches over MaxBatchSize items, when set, get 413.
+	// Bodies breaking the contract of their route get 422.
+	// Bodies may be gzipped and statuses and iris codes may be sent as
+	// protocol buffers, unless PlainOnly is set, in which case anything but
+	// plain JSON gets 415.
+	// When Capabilities is set, they are served at /capabilities and routes
+	// must be prefixed with one of its API versions, such as /v1/status;
+	// only /capabilities and /health-check are served unprefixed. Requests
+	// are counted under their unprefixed route. Otherwise /capabilities
+	// gets 404, as from a service that predates capability negotiation.
+	// With a ClockOffset, the Date header of responses is set as by a
+	// service whose clock is that far ahead of the orb's.
+	UniquenessService struct {
+		SignKey      string
+		MaxSkew      time.Duration
+		MaxBatchSize int
+		PlainOnly    bool
+		Capabilities *domain.Capabilities
+		ClockOffset  time.Duration
+
+		mu         sync.Mutex
+		down       bool
+		received   map[string]int
+		registered map[string]string
+		replies    map[replyKey]reply
+		samples    []domain.StatusSample
+		headers    map[string]http.Header
+	}
+
+	// replyKey identifies the answer to an idempotent request.
+	replyKey struct {
+		route string
+		orbID string
+		key   string
+	}
+
+	reply struct {
+		status int
+		body   string
+		digest [sha256.Size]byte // Of the request body, to tell a reused key.
+	}
+)
+
+func (u *UniquenessService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if u.ClockOffset != 0 {
+		w.Header().Set("Date", time.Now().Add(u.ClockOffset).UTC().Format(http.TimeFormat))
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, `{"success":false,"message":"unreadable body"}`)
+		return
+	}
+	if u.Capabilities != nil {
+		route, ok := u.unversion(r.URL.Path)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, `{"success":false,"message":"unsupported API version"}`)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path = route
+	}
+
+	if r.Method == http.MethodPost && u.SignKey != "" {
+		if err := service.VerifySignature(u.SignKey, u.MaxSkew, time.Now(), r.Header, body); err != nil {
+			writeJSON(w, http.StatusUnauthorized, `{"success":false,"message":"invalid signature"}`)
+			return
+		}
+	}
+
+	body, err = u.decodeBody(r, body)
+	if err != nil {
+		writeJSON(w, http.StatusUnsupportedMediaType, `{"success":false,"message":"unsupported body encoding"}`)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := contracts.ValidateJSON(r.URL.Path, body); err != nil {
+			message, _ := json.Marshal(domain.SignUpResponse{Message: err.Error()})
+			writeJSON(w, http.StatusUnprocessableEntity, string(message))
+			return
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.down {
+		writeJSON(w, http.StatusServiceUnavailable, `{"success":false,"message":"service unavailable"}`)
+		return
+	}
+	if u.received == nil {
+		u.received = map[string]int{}
+		u.registered = map[string]string{}
+		u.replies = map[replyKey]reply{}
+		u.headers = map[string]http.Header{}
+	}
+	u.received[r.URL.Path]++
+	u.headers[r.URL.Path] = r.Header.Clone()
+
+	// Repeated idempotency keys get the original answer instead of being
+	// processed again.
+	key := replyKey{r.URL.Path, r.Header.Get(service.HeaderOrbID), r.Header.Get(service.HeaderIdempotencyKey)}
+	digest := bodyDigest(body)
+	if cached, ok := u.replies[key]; ok && key.key != "" {
+		if cached.digest != digest {
+			writeJSON(w, http.StatusUnprocessableEntity, `{"success":false,"message":"idempotency key reused with a different body"}`)
+			return
+		}
+		writeJSON(w, cached.status, cached.body)
+		return
+	}
+
+	status, message := u.route(r, body)
+	if key.key != "" {
+		u.replies[key] = reply{status, message, digest}
+	}
+	writeJSON(w, status, message)
+}
+
+// bodyDigest hashes a JSON body regardless of its formatting and key
+// order, so that the same request sent alone or within a batch matches.
+func bodyDigest(body []byte) [sha256.Size]byte {
+	var value any
+	if json.Unmarshal(body, &value) == nil {
+		body, _ = json.Marshal(value)
+	}
+	return sha256.Sum256(body)
+}
+
+func (u *UniquenessService) route(r *http.Request, body []byte) (int, string) {
+	orbID := r.Header.Get(service.HeaderOrbID)
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/status":
+		return http.StatusOK, `{"success":true,"message":"Status recorded!"}`
+	case r.Method == http.MethodPost && r.URL.Path == "/status/batch":
+		return u.statusBatch(body)
+	case r.Method == http.MethodPost && r.URL.Path == "/sign-up":
+		return u.signUp(body)
+	case r.Method == http.MethodPost && r.URL.Path == "/sign-up/batch":
+		return u.signUpBatch(orbID, body)
+	case r.Method == http.MethodGet && r.URL.Path == "/health-check":
+		return http.StatusOK, `{}`
+	case r.Method == http.MethodGet && r.URL.Path == service.RouteCapabilities && u.Capabilities != nil:
+		capabilities, _ := json.Marshal(u.Capabilities)
+		return http.StatusOK, string(capabilities)
+	default:
+		return http.StatusNotFound, `{"success":false,"message":"not found"}`
+	}
+}
+
+// unversion strips the API version from the path of a request.
+//
+// path: The path of the request.
+//
+// Returns the unprefixed route, and whether it was prefixed with a supported
+// version or is served unprefixed.
+func (u *UniquenessService) unversion(path string) (string, bool) {
+	if path == service.RouteCapabilities || path == "/health-check" {
+		return path, true
+	}
+	for _, version := range u.Capabilities.APIVersions {
+		if route, ok := strings.CutPrefix(path, "/"+version+"/"); ok {
+			return "/" + route, true
+		}
+	}
+	return path, false
+}
+
+func (u *UniquenessService) signUp(body []byte) (int, string) {
+	result := u.register(body)
+	return result.Status, signUpReply(result)
+}
+
+func (u *UniquenessService) signUpBatch(orbID string, body []byte) (int, string) {
+	var batch domain.SignUpBatch
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch.SignUps) == 0 {
+		return http.StatusBadRequest, `{"success":false,"message":"signUps are required"}`
+	}
+	if u.MaxBatchSize > 0 && len(batch.SignUps) > u.MaxBatchSize {
+		return http.StatusRequestEntityTooLarge, `{"success":false,"message":"too many items"}`
+	}
+
+	results := make([]domain.BatchItemResult, len(batch.SignUps))
+	for i, item := range batch.SignUps {
+		var iris domain.Iris
+		json.Unmarshal(item, &iris)
+		key := replyKey{"/sign-up", orbID, iris.Id}
+		digest := bodyDigest(item)
+		if cached, ok := u.replies[key]; ok && iris.Id != "" {
+			if cached.digest != digest {
+				results[i] = domain.BatchItemResult{Id: iris.Id, Status: http.StatusUnprocessableEntity, Message: "idempotency key reused with a different body"}
+				continue
+			}
+			var response domain.SignUpResponse
+			json.Unmarshal([]byte(cached.body), &response)
+			results[i] = domain.BatchItemResult{Id: iris.Id, Status: cached.status, Message: response.Message, MatchID: response.MatchID}
+			continue
+		}
+		results[i] = u.register(item)
+		if iris.Id != "" {
+			u.replies[key] = reply{results[i].Status, signUpReply(results[i]), digest}
+		}
+	}
+	return batchReply(results)
+}
+
+// register handles a single sign-up.
+func (u *UniquenessService) register(body []byte) domain.BatchItemResult {
+	var iris domain.Iris
+	if err := json.Unmarshal(body, &iris); err != nil || iris.Id == "" || iris.IrisCode == "" {
+		return domain.BatchItemResult{Id: iris.Id, Status: http.StatusUnprocessableEntity, Message: "id and irisCode are required"}
+	}
+
+	if matchID, ok := u.registered[iris.IrisCode]; ok {
+		return domain.BatchItemResult{Id: iris.Id, Status: http.StatusConflict, Message: "Iris code already registered", MatchID: matchID}
+	}
+	u.registered[iris.IrisCode] = iris.Id
+	return domain.BatchItemResult{Id: iris.Id, Status: http.StatusCreated, Message: "Registration successful!"}
+}
+
+func (u *UniquenessService) statusBatch(body []byte) (int, string) {
+	var batch domain.StatusBatch
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch.Samples) == 0 {
+		return http.StatusBadRequest, `{"success":false,"message":"samples are required"}`
+	}
+	if u.MaxBatchSize > 0 && len(batch.Samples) > u.MaxBatchSize {
+		return http.StatusRequestEntityTooLarge, `{"success":false,"message":"too many items"}`
+	}
+
+	results := make([]domain.BatchItemResult, len(batch.Samples))
+	for i, sample := range batch.Samples {
+		if sample.Count < 1 || sample.To.Before(sample.From) {
+			results[i] = domain.BatchItemResult{Id: sample.Id, Status: http.StatusUnprocessableEntity, Message: "invalid sample"}
+			continue
+		}
+		u.samples = append(u.samples, sample)
+		results[i] = domain.BatchItemResult{Id: sample.Id, Status: http.StatusOK, Message: "Status recorded!"}
+	}
+	return batchReply(results)
+}
+
+func signUpReply(result domain.BatchItemResult) string {
+	body, _ := json.Marshal(domain.SignUpResponse{
+		Success: result.Status == http.StatusCreated,
+		Message: result.Message,
+		MatchID: result.MatchID,
+	})
+	return string(body)
+}
+
+func batchReply(results []domain.BatchItemResult) (int, string) {
+	body, _ := json.Marshal(domain.BatchResponse{Success: true, Message: "Batch processed!", Results: results})
+	return http.StatusOK, string(body)
+}
+
+// decodeBody turns a compressed or binary body back into JSON.
+func (u *UniquenessService) decodeBody(r *http.Request, body []byte) ([]byte, error) {
+	encoding := r.Header.Get("Content-Encoding")
+	contentType := r.Header.Get("Content-Type")
+	if u.PlainOnly && (encoding != "" || contentType == service.ContentTypeProtobuf) {
+		return nil, domain.ErrDecodingPayload
+	}
+
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, domain.ErrDecodingPayload
+	}
+
+	if contentType != service.ContentTypeProtobuf {
+		return body, nil
+	}
+	var message any
+	var err error
+	switch r.URL.Path {
+	case "/status":
+		message, err = platform.UnmarshalStatus(body)
+	case "/sign-up":
+		message, err = platform.UnmarshalIris(body)
+	default:
+		return nil, domain.ErrDecodingPayload
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(message)
+}
+
+// SetDown makes the service answer every request with 503 until it is
+// brought back up, to simulate an outage.
+func (u *UniquenessService) SetDown(down bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.down = down
+}
+
+// StatusSamples returns the status samples uploaded in batches so far.
+func (u *UniquenessService) StatusSamples() []domain.StatusSample {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]domain.StatusSample(nil), u.samples...)
+}
+
+// LastHeader returns the headers of the last accepted request received on
+// the given path, or nil if there was none.
+func (u *UniquenessService) LastHeader(path string) http.Header {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.headers[path]
+}
+
+// Count returns how many accepted requests were received on the given path.
+func (u *UniquenessService) Count(path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.received[path]
+}
+
+// Registered returns how many distinct iris codes have been registered.
+func (u *UniquenessService) Registered() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.registered)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
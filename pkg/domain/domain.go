@@ -1,17 +1,59 @@
 package domain
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/bwmarrin/snowflake"
 )
 
-// Status represents the status of a system, including battery, CPU usage, CPU temperature, and disk space.
+// Status represents the status of a system, including battery, CPU usage, CPU temperature, disk space and clock skew.
 type Status struct {
-	Battery   float32 `json:"battery"`   // Battery level in percentage.
-	CPUUsage  float32 `json:"cpuUsage"`  // CPU usage in percentage.
-	CPUTemp   float32 `json:"cpuTemp"`   // CPU temperature in Celsius.
-	DiskSpace float32 `json:"diskSpace"` // Available disk space.
+	Battery   float32 `json:"battery"`             // Battery level in percentage.
+	CPUUsage  float32 `json:"cpuUsage"`            // CPU usage in percentage.
+	CPUTemp   float32 `json:"cpuTemp"`             // CPU temperature in Celsius.
+	DiskSpace float32 `json:"diskSpace"`           // Available disk space.
+	ClockSkew float32 `json:"clockSkew,omitempty"` // Orb clock minus the uniqueness service's, in milliseconds; zero while unknown.
+}
+
+// StatusSample is a status report, or an aggregate of consecutive reports,
+// covering the period from From to To.
+type StatusSample struct {
+	From  time.Time `json:"from"`         // Time of the first report covered.
+	To    time.Time `json:"to"`           // Time of the last report covered.
+	Count int       `json:"count"`        // Number of reports covered; 1 for a single report.
+	Min   Status    `json:"min"`          // Lowest value of each field over the period.
+	Max   Status    `json:"max"`          // Highest value of each field over the period.
+	Avg   Status    `json:"avg"`          // Average value of each field over the period.
+	Id    string    `json:"id,omitempty"` // Position of the sample in its batch, echoed in its result.
+}
+
+// StatusBatch is the body of a batch upload of buffered status reports.
+type StatusBatch struct {
+	Samples []StatusSample `json:"samples"` // Samples in chronological order.
+}
+
+// SignUpBatch is the body of a batch of sign-ups.
+type SignUpBatch struct {
+	SignUps []json.RawMessage `json:"signUps"` // JSON-encoded Iris requests, oldest first.
+}
+
+// BatchItemResult is the outcome of one item of a batch upload.
+type BatchItemResult struct {
+	Id      string `json:"id,omitempty"`      // ID of the item, for items that have one.
+	Status  int    `json:"status"`            // HTTP status the item would have been answered with on its own.
+	Message string `json:"message,omitempty"` // Reason given for the status, if any.
+	MatchID string `json:"matchId,omitempty"` // Reference of the existing identity, for duplicate sign-ups.
+}
+
+// BatchResponse is the body returned for a batch upload.
+type BatchResponse struct {
+	Success bool              `json:"success"`
+	Message string            `json:"message"`
+	Results []BatchItemResult `json:"results"` // Per-item outcomes, in the order of the items.
 }
 
 // Iris represents the iris code and its associated ID.
@@ -20,22 +62,235 @@ type Iris struct {
 	IrisCode string `json:"irisCode"`
 }
 
+// SignUpOutcome classifies how the uniqueness service handled a sign-up.
+type SignUpOutcome string
+
+const (
+	SignUpRegistered  SignUpOutcome = "registered"  // The iris code was unique and has been registered.
+	SignUpDuplicate   SignUpOutcome = "duplicate"   // The iris code matches an existing identity.
+	SignUpRejected    SignUpOutcome = "rejected"    // The request failed validation and must not be retried as is.
+	SignUpTransient   SignUpOutcome = "transient"   // The request failed for a reason worth retrying later.
+	SignUpQueued      SignUpOutcome = "queued"      // The request was stored in the outbox for later delivery.
+	SignUpUnconfirmed SignUpOutcome = "unconfirmed" // The uniqueness service accepted the request but its answer could not be read.
+)
+
+// SignUpResult describes the outcome of a sign-up.
+type SignUpResult struct {
+	Id      string        // ID the sign-up was submitted with.
+	Outcome SignUpOutcome // How the uniqueness service handled the sign-up.
+	MatchID string        // Reference of the existing identity, for duplicates.
+	Reason  string        // Reason given by the uniqueness service, for rejections.
+}
+
+// SignUpResponse is the body returned by the uniqueness service for a sign-up.
+type SignUpResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	MatchID string `json:"matchId,omitempty"`
+}
+
+// Request describes an HTTP request to be sent by a RequestSvc.
+type Request struct {
+	Method string      // HTTP method, e.g. GET, POST, PUT or DELETE.
+	Route  string      // Endpoint route, relative to the base URL.
+	Query  url.Values  // Optional query parameters.
+	Header http.Header // Optional request headers.
+	Body   any         // Optional payload, JSON-encoded when not nil.
+}
+
+// Types of the frames exchanged over the WebSocket channel.
+const (
+	FrameRequest  = "request"  // A request of the orb, answered by a response of the same ID.
+	FrameResponse = "response" // The answer of the uniqueness service to a request.
+	FramePush     = "push"     // A message the uniqueness service sends on its own.
+)
+
+// ChannelFrame is a message exchanged over the WebSocket channel, sent as a
+// JSON text message.
+type ChannelFrame struct {
+	Type           string          `json:"type"`                     // One of the Frame* types.
+	ID             string          `json:"id,omitempty"`             // Pairs a response with its request.
+	Method         string          `json:"method,omitempty"`         // HTTP method of the equivalent request.
+	Route          string          `json:"route,omitempty"`          // Route of the equivalent HTTP request.
+	IdempotencyKey string          `json:"idempotencyKey,omitempty"` // Idempotency key of the request, if any.
+	Status         int             `json:"status,omitempty"`         // HTTP status of a response.
+	Topic          string          `json:"topic,omitempty"`          // Subject of a pushed message.
+	Body           json.RawMessage `json:"body,omitempty"`           // JSON body of the request, response or pushed message.
+}
+
+// PushMessage is a message pushed by the uniqueness service over the WebSocket channel.
+type PushMessage struct {
+	Topic      string          `json:"topic"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+}
+
+// OutboxEntry is a request kept in the outbox until it has been delivered.
+type OutboxEntry struct {
+	Id        string          `json:"id"`        // ID of the request, also sent as its idempotency key.
+	Route     string          `json:"route"`     // Endpoint route the request is posted to.
+	Body      json.RawMessage `json:"body"`      // JSON-encoded payload of the request.
+	CreatedAt time.Time       `json:"createdAt"` // When the request was stored.
+}
+
+// DeadLetterReason tells why a request was given up on.
+type DeadLetterReason string
+
+const (
+	DeadLetterRejected  DeadLetterReason = "rejected"          // The backend refused the request as invalid.
+	DeadLetterExpired   DeadLetterReason = "expired"           // The request waited too long to be delivered.
+	DeadLetterExhausted DeadLetterReason = "retries-exhausted" // The request kept failing until its retry budget ran out.
+)
+
+// DeadLetter is an outgoing request that failed permanently, kept for
+// inspection and replay. Secrets are removed from its headers and body.
+type DeadLetter struct {
+	Id         string           `json:"id"`
+	Method     string           `json:"method"`
+	Route      string           `json:"route"`
+	Header     http.Header      `json:"header,omitempty"`
+	Body       json.RawMessage  `json:"body,omitempty"`
+	Reason     DeadLetterReason `json:"reason"`
+	Error      string           `json:"error"`
+	StatusCode int              `json:"statusCode,omitempty"` // Last HTTP status received, if any.
+	Attempts   int              `json:"attempts"`             // Delivery attempts made, including replays.
+	CreatedAt  time.Time        `json:"createdAt"`            // When the request was first made.
+	FailedAt   time.Time        `json:"failedAt"`             // When the request last failed.
+}
+
+// BreakerSnapshot describes the state of a circuit breaker at a point in time.
+type BreakerSnapshot struct {
+	Name                 string   `json:"name"`
+	Routes               []string `json:"routes"` // Routes guarded by the breaker; empty for the default one.
+	State                string   `json:"state"`  // closed, half-open or open.
+	Requests             uint32   `json:"requests"`
+	TotalSuccesses       uint32   `json:"totalSuccesses"`
+	TotalFailures        uint32   `json:"totalFailures"`
+	ConsecutiveSuccesses uint32   `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  uint32   `json:"consecutiveFailures"`
+}
+
 // StatusSvc provides an interface for reporting system status.
 type StatusSvc interface {
-	// Report takes a status and reports it, returning an error if any.
-	Report(s *Status) (err error)
+	// Report gathers the current status and reports it, returning an error if any.
+	Report(ctx context.Context) (err error)
 }
 
 // SignUpSvc provides an interface for handling user sign-up based on iris data.
 type SignUpSvc interface {
-	// SignUp processes the given image and signs it up, returning an error if any.
-	SignUp(img []byte) (err error)
+	// SignUp processes the given image and signs it up, returning the outcome and an error if any.
+	SignUp(ctx context.Context, img []byte) (result *SignUpResult, err error)
+}
+
+// EndpointSnapshot describes an instance of the uniqueness service as seen by the orb.
+type EndpointSnapshot struct {
+	URL       string           `json:"url"`
+	Priority  int              `json:"priority"`
+	Weight    int              `json:"weight"`
+	Healthy   bool             `json:"healthy"`
+	Active    bool             `json:"active"` // Whether requests are currently sent to it first.
+	LastError string           `json:"lastError,omitempty"`
+	Breaker   *BreakerSnapshot `json:"breaker,omitempty"`
+}
+
+// Capabilities lists what a party supports. In the document served by the uniqueness
+// service at /capabilities order does not matter; in the orb's own, items come most
+// preferred first. A zero batch size means no limit.
+type Capabilities struct {
+	APIVersions        []string `json:"apiVersions"`                  // Route prefixes, such as v1.
+	HashAlgorithms     []string `json:"hashAlgorithms"`               // Perceptual hashes of iris codes, such as ahash.
+	SignatureSchemes   []string `json:"signatureSchemes"`             // Signing schemes, such as hmac-sha256.
+	MaxStatusBatchSize int      `json:"maxStatusBatchSize,omitempty"` // Most samples per status batch.
+	MaxSignUpBatchSize int      `json:"maxSignUpBatchSize,omitempty"` // Most sign-ups per batch.
+}
+
+// Negotiated holds the options agreed on with the uniqueness service.
+type Negotiated struct {
+	APIVersion         string `json:"apiVersion,omitempty"` // Route prefix, or empty for unversioned routes.
+	HashAlgorithm      string `json:"hashAlgorithm"`
+	SignatureScheme    string `json:"signatureScheme"`
+	MaxStatusBatchSize int    `json:"maxStatusBatchSize,omitempty"`
+	MaxSignUpBatchSize int    `json:"maxSignUpBatchSize,omitempty"`
+	Legacy             bool   `json:"legacy"` // Whether the service published no capabilities.
+}
+
+// ClockSnapshot is the estimated offset of the orb clock from the clock of
+// the uniqueness service.
+type ClockSnapshot struct {
+	Skew      time.Duration `json:"skew"`      // Orb clock minus the service's; positive when the orb is ahead.
+	RTT       time.Duration `json:"rtt"`       // Round trip of the sample the estimate comes from.
+	Samples   int           `json:"samples"`   // Number of samples taken; the skew is unknown while zero.
+	UpdatedAt time.Time     `json:"updatedAt"` // When the last sample was taken.
 }
 
-// RequestSvc provides an interface for making HTTP POST requests.
+// Connectivity is what the orb knows of the health of the uniqueness service.
+type Connectivity string
+
+const (
+	ConnectivityUnknown   Connectivity = "unknown"   // Not probed yet.
+	ConnectivityHealthy   Connectivity = "healthy"   // The last probe succeeded.
+	ConnectivityUnhealthy Connectivity = "unhealthy" // Enough consecutive probes failed.
+)
+
+// HealthSnapshot describes the health of the uniqueness service as last probed by the orb.
+type HealthSnapshot struct {
+	State               Connectivity `json:"state"`
+	Since               time.Time    `json:"since"` // When the state last changed.
+	LastCheck           time.Time    `json:"lastCheck,omitempty"`
+	LastError           string       `json:"lastError,omitempty"`
+	ConsecutiveFailures int          `json:"consecutiveFailures"`
+}
+
+// RequestSvc provides an interface for making HTTP requests.
 type RequestSvc interface {
 	// Post sends a POST request to the given path with the provided body, returning an HTTP status and an error if any.
-	Post(path string, body any) (httpStatus int, err error)
+	Post(ctx context.Context, path string, body any) (httpStatus int, err error)
+	// Do sends the given request and decodes the JSON response body into out when out is not nil,
+	// returning an HTTP status and an error if any.
+	Do(ctx context.Context, req *Request, out any) (httpStatus int, err error)
+}
+
+// Outbox provides an interface for durably queueing requests until they are delivered.
+type Outbox interface {
+	// Append stores the entry at the end of the queue, returning an error if any.
+	Append(entry OutboxEntry) (err error)
+	// Peek returns the oldest pending entry, or nil if there is none, and an error if any.
+	Peek() (entry *OutboxEntry, err error)
+	// PeekBatch returns up to max of the oldest pending entries, oldest first, and an error if any.
+	PeekBatch(max int) (entries []OutboxEntry, err error)
+	// Ack removes the delivered entry with the given ID, returning an error if any.
+	Ack(id string) (err error)
+	// Len returns the number of pending entries.
+	Len() int
+}
+
+// StatusSpill provides an interface for keeping buffered status samples on disk.
+type StatusSpill interface {
+	// Load returns the stored samples, oldest first, and an error if any.
+	Load() (samples []StatusSample, err error)
+	// Append stores the samples after the existing ones, returning an error if any.
+	Append(samples []StatusSample) (err error)
+	// Replace swaps the stored samples for the given ones, returning an error if any.
+	Replace(samples []StatusSample) (err error)
+}
+
+// DeadLetterStore provides an interface for keeping requests that failed permanently.
+type DeadLetterStore interface {
+	// Add stores the dead letter, replacing any with the same ID, and returns an error if any.
+	Add(letter DeadLetter) (err error)
+	// List returns every dead letter, oldest failure first, and an error if any.
+	List() (letters []DeadLetter, err error)
+	// Get returns the dead letter with the given ID and an error if any.
+	Get(id string) (letter *DeadLetter, err error)
+	// Remove deletes the dead letter with the given ID, returning an error if any.
+	Remove(id string) (err error)
+}
+
+// Publisher provides an interface for publishing messages to a message broker.
+type Publisher interface {
+	// Publish sends the payload to the topic with the given quality of service, kept by the broker
+	// as the topic's last message when retained, and returns an error if any.
+	Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) (err error)
 }
 
 // HttpClient is an interface representing the capability to execute HTTP requests.
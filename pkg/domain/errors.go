@@ -10,4 +10,41 @@ var (
 	ErrMarshallingPayload = errors.New("marshalling payload failed")
 	ErrCasting            = errors.New("casting failed")
 	ErrExecutionFailed    = errors.New("circuit breaker execution failed")
+	ErrDuplicateSignUp    = errors.New("iris code already registered")
+	ErrSignUpRejected     = errors.New("sign-up rejected by uniqueness service")
+	ErrTransientFailure   = errors.New("transient failure, retry later")
+	ErrOutboxFull         = errors.New("outbox is full")
+	ErrOutboxStorage      = errors.New("outbox storage failed")
+	ErrStatusSpill        = errors.New("status spill storage failed")
+	ErrDeadLetterStorage  = errors.New("dead letter storage failed")
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrBatchItemsRejected = errors.New("batch items rejected")
+	ErrBulkheadFull       = errors.New("too many concurrent requests for route")
+	ErrRateLimited        = errors.New("request rate limit reached for route")
+	ErrUnsupportedRoute   = errors.New("route not supported by transport")
+	ErrResponseTooLarge   = errors.New("response body exceeds size limit")
+	ErrDecodingResponse   = errors.New("decoding response failed")
+	ErrDecodingPayload    = errors.New("decoding payload failed")
+	ErrInvalidEncoding    = errors.New("invalid payload encoding")
+	ErrContractViolation  = errors.New("payload breaks route contract")
+	ErrInvalidStatusRange = errors.New("invalid status code range")
+	ErrInvalidProxyURL    = errors.New("invalid proxy URL")
+	ErrInvalidEndpoint    = errors.New("invalid endpoint")
+	ErrNoEndpoint         = errors.New("no endpoint to send the request to")
+	ErrEndpointUnhealthy  = errors.New("endpoint failed its health check")
+	ErrSigningRequest     = errors.New("signing request failed")
+	ErrMissingSignature   = errors.New("request signature missing")
+	ErrInvalidSignature   = errors.New("request signature invalid")
+	ErrStaleSignature     = errors.New("request signature timestamp outside allowed window")
+	ErrInvalidBrokerURL   = errors.New("invalid MQTT broker URL")
+	ErrBrokerConnection   = errors.New("connecting to MQTT broker failed")
+	ErrPublishFailed      = errors.New("publishing message failed")
+	ErrInvalidQoS         = errors.New("invalid MQTT quality of service")
+	ErrChannelClosed      = errors.New("channel connection closed")
+	ErrBackendUnhealthy   = errors.New("uniqueness service unhealthy")
+	ErrBackendNotReady    = errors.New("uniqueness service not ready in time")
+	ErrInvalidCapability  = errors.New("invalid capability")
+	ErrNoCommonCapability = errors.New("no capability supported by both orb and uniqueness service")
+	ErrFetchCapabilities  = errors.New("fetching capabilities failed")
+	ErrClockSkewed        = errors.New("orb clock skewed from the uniqueness service")
 )
@@ -0,0 +1,157 @@
+package platform
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+// deadLetterID restricts dead letter IDs to characters that are safe in a
+// file name.
+var deadLetterID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type (
+	// deadLetterStore keeps each dead letter in its own JSON file, so that
+	// letters can be listed, inspected and removed one by one.
+	deadLetterStore struct {
+		dir string
+		mu  sync.Mutex
+	}
+)
+
+// OpenDeadLetterStore prepares the dead letter directory, creating it if
+// needed.
+//
+// dir: Directory the dead letters are kept in.
+//
+// Returns the store, or an error if the directory cannot be created.
+func OpenDeadLetterStore(dir string) (*deadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("OpenDeadLetterStore: %w: %w", domain.ErrDeadLetterStorage, err)
+	}
+	return &deadLetterStore{dir: dir}, nil
+}
+
+// Add writes the dead letter to disk, replacing any letter with the same ID.
+// Letters without a usable ID get one based on the current time.
+//
+// letter: The dead letter to store.
+//
+// Returns an error if the letter could not be written.
+func (s *deadLetterStore) Add(letter domain.DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !deadLetterID.MatchString(letter.Id) {
+		letter.Id = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("Add: %w", domain.ErrMarshallingPayload)
+	}
+
+	path := s.path(letter.Id)
+	tmpPath := path + ".tmp"
+	err = writeSynced(tmpPath, data)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err == nil {
+		err = syncDir(path)
+	}
+	if err != nil {
+		return fmt.Errorf("Add: %w: %w", domain.ErrDeadLetterStorage, err)
+	}
+	return nil
+}
+
+// List returns every stored dead letter, oldest failure first.
+func (s *deadLetterStore) List() ([]domain.DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("List: %w: %w", domain.ErrDeadLetterStorage, err)
+	}
+	var letters []domain.DeadLetter
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		letter, err := s.read(id)
+		if err != nil {
+			return nil, fmt.Errorf("List: %w", err)
+		}
+		letters = append(letters, *letter)
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+	return letters, nil
+}
+
+// Get returns the dead letter with the given ID.
+//
+// Returns domain.ErrDeadLetterNotFound if there is none.
+func (s *deadLetterStore) Get(id string) (*domain.DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, err := s.read(id)
+	if err != nil {
+		return nil, fmt.Errorf("Get: %w", err)
+	}
+	return letter, nil
+}
+
+// Remove deletes the dead letter with the given ID.
+//
+// Returns domain.ErrDeadLetterNotFound if there is none.
+func (s *deadLetterStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !deadLetterID.MatchString(id) {
+		return fmt.Errorf("Remove: %w", domain.ErrDeadLetterNotFound)
+	}
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Remove: %w", domain.ErrDeadLetterNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("Remove: %w: %w", domain.ErrDeadLetterStorage, err)
+	}
+	return nil
+}
+
+func (s *deadLetterStore) read(id string) (*domain.DeadLetter, error) {
+	if !deadLetterID.MatchString(id) {
+		return nil, domain.ErrDeadLetterNotFound
+	}
+	data, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, domain.ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", domain.ErrDeadLetterStorage, err)
+	}
+	var letter domain.DeadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		return nil, fmt.Errorf("%w: %w", domain.ErrDeadLetterStorage, err)
+	}
+	return &letter, nil
+}
+
+func (s *deadLetterStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
@@ -0,0 +1,97 @@
+package platform_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, string)
+	}{
+		{"should add, get and remove dead letters", testDeadLetterRoundTrip},
+		{"should list dead letters oldest failure first", testDeadLetterList},
+		{"should assign an ID to letters without a safe one", testDeadLetterUnsafeID},
+		{"should report missing dead letters", testDeadLetterNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t, filepath.Join(t.TempDir(), "dead-letters"))
+		})
+	}
+}
+
+func deadLetter(id string, failedAt time.Time) domain.DeadLetter {
+	return domain.DeadLetter{
+		Id:       id,
+		Method:   "POST",
+		Route:    "/sign-up",
+		Body:     []byte(`{"id":"` + id + `"}`),
+		Reason:   domain.DeadLetterRejected,
+		Attempts: 1,
+		FailedAt: failedAt,
+	}
+}
+
+func testDeadLetterRoundTrip(t *testing.T, dir string) {
+	store, err := platform.OpenDeadLetterStore(dir)
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, store.Add(deadLetter("42", time.Now())))
+
+	letter, err := store.Get("42")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, letter.Route == "/sign-up" && string(letter.Body) == `{"id":"42"}`, "expected the stored letter, got %+v", letter)
+
+	updated := *letter
+	updated.Attempts = 2
+	testhelper.Ok(t, store.Add(updated))
+	letter, err = store.Get("42")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, letter.Attempts == 2, "expected the letter to be replaced, got %d attempts", letter.Attempts)
+
+	testhelper.Ok(t, store.Remove("42"))
+	_, err = store.Get("42")
+	testhelper.Assert(t, errors.Is(err, domain.ErrDeadLetterNotFound), "expected the letter to be gone, got %v", err)
+}
+
+func testDeadLetterList(t *testing.T, dir string) {
+	store, err := platform.OpenDeadLetterStore(dir)
+	testhelper.Ok(t, err)
+	now := time.Now()
+	testhelper.Ok(t, store.Add(deadLetter("b", now)))
+	testhelper.Ok(t, store.Add(deadLetter("a", now.Add(-time.Minute))))
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0o600)
+
+	letters, err := store.List()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(letters) == 2 && letters[0].Id == "a" && letters[1].Id == "b", "expected a then b, got %+v", letters)
+}
+
+func testDeadLetterUnsafeID(t *testing.T, dir string) {
+	store, err := platform.OpenDeadLetterStore(dir)
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, store.Add(deadLetter("../escape", time.Now())))
+
+	letters, err := store.List()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(letters) == 1 && letters[0].Id != "../escape", "expected a safe ID, got %+v", letters)
+	_, err = os.Stat(filepath.Join(filepath.Dir(dir), "escape.json"))
+	testhelper.Assert(t, os.IsNotExist(err), "expected nothing written outside the store")
+}
+
+func testDeadLetterNotFound(t *testing.T, dir string) {
+	store, err := platform.OpenDeadLetterStore(dir)
+	testhelper.Ok(t, err)
+	_, err = store.Get("missing")
+	testhelper.Assert(t, errors.Is(err, domain.ErrDeadLetterNotFound), "expected not found, got %v", err)
+	err = store.Remove("missing")
+	testhelper.Assert(t, errors.Is(err, domain.ErrDeadLetterNotFound), "expected not found, got %v", err)
+}
@@ -0,0 +1,72 @@
+package platform
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+type (
+	// HTTPClientConfig holds the transport settings used to build the HTTP
+	// client that talks to the uniqueness service. Zero durations disable
+	// the corresponding timeout.
+	HTTPClientConfig struct {
+		Timeout               time.Duration // Overall limit for a request, including reading the body.
+		DialTimeout           time.Duration // Limit for establishing a TCP connection.
+		KeepAlive             time.Duration // Interval between TCP keep-alive probes; negative disables them.
+		TLSHandshakeTimeout   time.Duration // Limit for the TLS handshake.
+		ResponseHeaderTimeout time.Duration // Limit for the response headers once the request is written.
+		IdleConnTimeout       time.Duration // How long an idle connection stays in the pool.
+		MaxIdleConns          int           // Idle connections kept across all hosts.
+		MaxIdleConnsPerHost   int           // Idle connections kept per host.
+		DisableKeepAlives     bool          // Use a new connection for every request.
+		EnableHTTP2           bool          // Negotiate HTTP/2 over TLS when the server supports it.
+		ProxyURL              string        // Proxy for all requests; empty falls back to the environment.
+	}
+)
+
+// NewHTTPClient builds an HTTP client from the given configuration, unlike
+// http.DefaultClient which never times out.
+//
+// cfg: Transport settings of the client.
+//
+// Returns the configured client, or an error if the proxy URL is invalid.
+func NewHTTPClient(cfg HTTPClientConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("NewHTTPClient: %w", domain.ErrInvalidProxyURL)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		DisableKeepAlives:     cfg.DisableKeepAlives,
+		ForceAttemptHTTP2:     cfg.EnableHTTP2,
+	}
+	if !cfg.EnableHTTP2 {
+		// A non-nil, empty map stops the transport from upgrading to HTTP/2.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+	}, nil
+}
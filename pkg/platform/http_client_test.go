@@ -0,0 +1,85 @@
+package platform_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestHTTPClient(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *httptest.Server)
+	}{
+		{"should complete requests within the timeouts", testWithinTimeouts},
+		{"should trip the response header timeout", testResponseHeaderTimeout},
+		{"should trip the overall timeout on a slow body", testOverallTimeout},
+		{"should reject an invalid proxy URL", testInvalidProxyURL},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			// The server waits before sending headers when asked to, and
+			// always trickles the body slowly.
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if delay, err := time.ParseDuration(r.URL.Query().Get("headerDelay")); err == nil {
+					time.Sleep(delay)
+				}
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				if delay, err := time.ParseDuration(r.URL.Query().Get("bodyDelay")); err == nil {
+					time.Sleep(delay)
+				}
+				w.Write([]byte("{}"))
+			}))
+			defer server.Close()
+			test.function(t, server)
+		})
+	}
+}
+
+func testWithinTimeouts(t *testing.T, server *httptest.Server) {
+	client, err := platform.NewHTTPClient(platform.HTTPClientConfig{
+		Timeout:               time.Second,
+		ResponseHeaderTimeout: time.Second,
+	})
+	testhelper.Ok(t, err)
+	resp, err := client.Get(server.URL)
+	testhelper.Ok(t, err)
+	resp.Body.Close()
+	testhelper.Assert(t, resp.StatusCode == http.StatusOK, "expected 200, got %d", resp.StatusCode)
+}
+
+func testResponseHeaderTimeout(t *testing.T, server *httptest.Server) {
+	client, err := platform.NewHTTPClient(platform.HTTPClientConfig{
+		ResponseHeaderTimeout: 50 * time.Millisecond,
+	})
+	testhelper.Ok(t, err)
+	start := time.Now()
+	_, err = client.Get(server.URL + "?headerDelay=500ms")
+	testhelper.Assert(t, err != nil, "expected the response header timeout to trip")
+	testhelper.Assert(t, time.Since(start) < 400*time.Millisecond, "expected the request to fail fast, took %s", time.Since(start))
+}
+
+func testOverallTimeout(t *testing.T, server *httptest.Server) {
+	client, err := platform.NewHTTPClient(platform.HTTPClientConfig{
+		Timeout:               100 * time.Millisecond,
+		ResponseHeaderTimeout: time.Second,
+	})
+	testhelper.Ok(t, err)
+	resp, err := client.Get(server.URL + "?bodyDelay=500ms")
+	testhelper.Ok(t, err)
+	defer resp.Body.Close()
+	_, err = resp.Body.Read(make([]byte, 16))
+	testhelper.Assert(t, err != nil, "expected the overall timeout to interrupt the body")
+}
+
+func testInvalidProxyURL(t *testing.T, server *httptest.Server) {
+	_, err := platform.NewHTTPClient(platform.HTTPClientConfig{ProxyURL: "://nope"})
+	testhelper.Assert(t, errors.Is(err, domain.ErrInvalidProxyURL), "expected an invalid proxy URL error, got %v", err)
+}
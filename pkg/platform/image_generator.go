@@ -12,6 +12,8 @@ import (
 // GenerateRandomImageData creates an image with a random color and encodes it in PNG format.
 // The generated image has a fixed width and height of 500 pixels.
 // This function returns the bytes of the encoded image or an error if the encoding fails.
+// The raw pixel buffer is wiped once encoded, leaving the caller as the only
+// owner of image data.
 func GenerateRandomImageData() ([]byte, error) {
 	rand.NewSource(time.Now().UnixNano())
 
@@ -25,6 +27,7 @@ func GenerateRandomImageData() ([]byte, error) {
 
 	// Create the image with the random color.
 	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	defer WipeImage(img)
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
 			img.Set(x, y, randomColor)
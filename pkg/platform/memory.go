@@ -0,0 +1,35 @@
+package platform
+
+import (
+	"image"
+)
+
+// Wipe overwrites the given buffer with zeros so that biometric data does
+// not linger in memory until the garbage collector reclaims it.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// WipeImage overwrites the pixel buffer of a decoded image with zeros.
+// Only the concrete image types produced by the standard PNG decoder are
+// supported; other image types are left untouched.
+func WipeImage(img image.Image) {
+	switch i := img.(type) {
+	case *image.RGBA:
+		Wipe(i.Pix)
+	case *image.NRGBA:
+		Wipe(i.Pix)
+	case *image.RGBA64:
+		Wipe(i.Pix)
+	case *image.NRGBA64:
+		Wipe(i.Pix)
+	case *image.Gray:
+		Wipe(i.Pix)
+	case *image.Gray16:
+		Wipe(i.Pix)
+	case *image.Paletted:
+		Wipe(i.Pix)
+	}
+}
@@ -0,0 +1,56 @@
+package platform_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+	"virtual-orb/pkg/platform"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestMemory(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{"should wipe byte buffers", testWipeBytes},
+		{"should wipe decoded image pixels", testWipeDecodedImage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, test.function)
+	}
+}
+
+func testWipeBytes(t *testing.T) {
+	b := []byte("biometric")
+	platform.Wipe(b)
+	testhelper.Assert(t, bytes.Equal(b, make([]byte, len(b))), "expected the buffer to be zeroed")
+}
+
+func testWipeDecodedImage(t *testing.T) {
+	data, err := platform.GenerateRandomImageData()
+	testhelper.Ok(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	testhelper.Ok(t, err)
+
+	platform.WipeImage(img)
+	pix := pixels(img)
+	testhelper.Assert(t, pix != nil, "expected a decoder image type with a pixel buffer, got %T", img)
+	testhelper.Assert(t, bytes.Equal(pix, make([]byte, len(pix))), "expected the pixels to be zeroed")
+}
+
+func pixels(img image.Image) []byte {
+	switch i := img.(type) {
+	case *image.RGBA:
+		return i.Pix
+	case *image.NRGBA:
+		return i.Pix
+	case *image.Paletted:
+		return i.Pix
+	case *image.Gray:
+		return i.Pix
+	}
+	return nil
+}
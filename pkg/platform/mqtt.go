@@ -0,0 +1,121 @@
+package platform
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+	"virtual-orb/pkg/domain"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Presence payloads kept retained on the presence topic.
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+type (
+	// MQTTConfig holds the settings of the connection to the MQTT broker.
+	// With a presence topic, the orb retains PresenceOnline there whenever
+	// it connects, and registers PresenceOffline as its retained last will,
+	// so that the broker announces the orb offline if it vanishes.
+	MQTTConfig struct {
+		BrokerURL      string        // Broker address, such as tcp://broker:1883 or ssl://broker:8883.
+		ClientID       string        // Client identifier, unique per orb.
+		Username       string        // Username, if the broker requires one.
+		Password       string        // Password, if the broker requires one.
+		KeepAlive      time.Duration // Interval between keep-alive pings.
+		ConnectTimeout time.Duration // Limit for establishing the connection.
+		PresenceTopic  string        // Topic holding the orb's presence; empty disables it.
+		PresenceQoS    byte          // Quality of service of the presence messages.
+	}
+
+	// mqttPublisher publishes messages through a connection to an MQTT
+	// broker, reconnecting whenever it is lost.
+	mqttPublisher struct {
+		client mqtt.Client
+		cfg    MQTTConfig
+	}
+)
+
+// NewMQTTPublisher creates a publisher and starts connecting it to the
+// broker. The connection is retried in the background until it succeeds, so
+// that the orb starts even while the broker is unreachable; messages of QoS 0
+// published meanwhile are dropped, those of higher QoS are sent once
+// connected.
+//
+// cfg: Connection settings.
+//
+// Returns a pointer to the publisher, or an error if the broker URL is invalid.
+func NewMQTTPublisher(cfg MQTTConfig) (*mqttPublisher, error) {
+	brokerURL, err := url.Parse(cfg.BrokerURL)
+	if err != nil || brokerURL.Host == "" {
+		return nil, fmt.Errorf("NewMQTTPublisher: %w", domain.ErrInvalidBrokerURL)
+	}
+	switch brokerURL.Scheme {
+	case "tcp", "ssl", "tls", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("NewMQTTPublisher: %w: unsupported scheme %q", domain.ErrInvalidBrokerURL, brokerURL.Scheme)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.BrokerURL).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetKeepAlive(cfg.KeepAlive).
+		SetConnectTimeout(cfg.ConnectTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true)
+	if cfg.PresenceTopic != "" {
+		opts.SetWill(cfg.PresenceTopic, PresenceOffline, cfg.PresenceQoS, true)
+		opts.SetOnConnectHandler(func(client mqtt.Client) {
+			// The handler must not block, so the token is not waited for.
+			client.Publish(cfg.PresenceTopic, cfg.PresenceQoS, true, PresenceOnline)
+		})
+	}
+
+	p := &mqttPublisher{client: mqtt.NewClient(opts), cfg: cfg}
+	p.client.Connect()
+	return p, nil
+}
+
+// Publish sends the payload to the topic.
+//
+// ctx: Context bounding the wait for the broker's acknowledgement.
+// topic: The topic to publish to.
+// qos: Quality of service: 0 at most once, 1 at least once, 2 exactly once.
+// retained: Whether the broker keeps the message as the topic's last one.
+// payload: The message.
+//
+// Returns domain.ErrPublishFailed if the message was not acknowledged in time.
+func (p *mqttPublisher) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	token := p.client.Publish(topic, qos, retained, payload)
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("Publish: %w: %w", domain.ErrPublishFailed, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Publish: %w: %w", domain.ErrPublishFailed, ctx.Err())
+	}
+}
+
+// Connected reports whether the publisher is currently connected to the broker.
+func (p *mqttPublisher) Connected() bool {
+	return p.client.IsConnectionOpen()
+}
+
+// Close announces the orb offline on its presence topic, as a clean
+// disconnection discards the last will, and disconnects from the broker.
+//
+// timeout: How long to wait for the announcement and pending messages.
+func (p *mqttPublisher) Close(timeout time.Duration) {
+	if p.cfg.PresenceTopic != "" && p.client.IsConnectionOpen() {
+		p.client.Publish(p.cfg.PresenceTopic, p.cfg.PresenceQoS, true, PresenceOffline).WaitTimeout(timeout)
+	}
+	p.client.Disconnect(uint(timeout / time.Millisecond))
+}
@@ -0,0 +1,167 @@
+package platform_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestMQTTPublisher(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.MQTTBroker, platform.MQTTConfig)
+	}{
+		{"should publish at every QoS", testPublishAtEveryQoS},
+		{"should announce the orb online on connect", testAnnounceOnline},
+		{"should leave an offline will when the connection is lost", testOfflineWill},
+		{"should announce the orb offline on close", testAnnounceOfflineOnClose},
+		{"should reconnect after losing the connection", testReconnect},
+		{"should fail publications the broker does not acknowledge in time", testPublishTimeout},
+		{"should reject an invalid broker URL", testInvalidBrokerURL},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			broker, err := mock.NewMQTTBroker()
+			testhelper.Ok(t, err)
+			defer broker.Close()
+			test.function(t, broker, platform.MQTTConfig{
+				BrokerURL:      broker.URL(),
+				ClientID:       "orb-7",
+				KeepAlive:      time.Second,
+				ConnectTimeout: time.Second,
+				PresenceTopic:  "orbs/7/presence",
+				PresenceQoS:    1,
+			})
+		})
+	}
+}
+
+// connected waits until the publisher has connected.
+func connected(t *testing.T, broker *mock.MQTTBroker, connects int) {
+	ok := broker.Await(2*time.Second, func() bool { return broker.Connects() >= connects })
+	testhelper.Assert(t, ok, "expected %d connections, got %d", connects, broker.Connects())
+}
+
+// presence waits until the presence topic retains the payload.
+func presence(t *testing.T, broker *mock.MQTTBroker, payload string) mock.MQTTMessage {
+	var message mock.MQTTMessage
+	ok := broker.Await(2*time.Second, func() bool {
+		var found bool
+		message, found = broker.Retained("orbs/7/presence")
+		return found && string(message.Payload) == payload
+	})
+	testhelper.Assert(t, ok, "expected the orb to be %s, got %q", payload, message.Payload)
+	return message
+}
+
+func testPublishAtEveryQoS(t *testing.T, broker *mock.MQTTBroker, cfg platform.MQTTConfig) {
+	publisher, err := platform.NewMQTTPublisher(cfg)
+	testhelper.Ok(t, err)
+	defer publisher.Close(time.Second)
+	connected(t, broker, 1)
+
+	for qos := byte(0); qos <= 2; qos++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := publisher.Publish(ctx, "orbs/7/status", qos, false, []byte{'0' + qos})
+		cancel()
+		testhelper.Ok(t, err)
+	}
+	ok := broker.Await(time.Second, func() bool {
+		count := 0
+		for _, message := range broker.Published() {
+			if message.Topic == "orbs/7/status" {
+				count++
+			}
+		}
+		return count == 3
+	})
+	testhelper.Assert(t, ok, "expected 3 statuses, got %+v", broker.Published())
+	for _, message := range broker.Published() {
+		if message.Topic == "orbs/7/status" {
+			testhelper.Assert(t, string(message.Payload) == string('0'+message.QoS), "expected the payload sent at QoS %d, got %q", message.QoS, message.Payload)
+		}
+	}
+}
+
+func testAnnounceOnline(t *testing.T, broker *mock.MQTTBroker, cfg platform.MQTTConfig) {
+	publisher, err := platform.NewMQTTPublisher(cfg)
+	testhelper.Ok(t, err)
+	defer publisher.Close(time.Second)
+
+	message := presence(t, broker, platform.PresenceOnline)
+	testhelper.Assert(t, message.QoS == 1 && message.ClientID == "orb-7", "expected the orb's presence at QoS 1, got %+v", message)
+	testhelper.Assert(t, publisher.Connected(), "expected the publisher to be connected")
+}
+
+func testOfflineWill(t *testing.T, broker *mock.MQTTBroker, cfg platform.MQTTConfig) {
+	publisher, err := platform.NewMQTTPublisher(cfg)
+	testhelper.Ok(t, err)
+	defer publisher.Close(time.Second)
+	presence(t, broker, platform.PresenceOnline)
+
+	// The orb reconnects straight away, so the will is looked for among
+	// the published messages rather than as the retained presence.
+	broker.DropClients()
+	ok := broker.Await(2*time.Second, func() bool {
+		for _, message := range broker.Published() {
+			if message.Will {
+				return message.Topic == "orbs/7/presence" && message.Retained && string(message.Payload) == platform.PresenceOffline
+			}
+		}
+		return false
+	})
+	testhelper.Assert(t, ok, "expected the broker to publish a retained offline will, got %+v", broker.Published())
+}
+
+func testAnnounceOfflineOnClose(t *testing.T, broker *mock.MQTTBroker, cfg platform.MQTTConfig) {
+	publisher, err := platform.NewMQTTPublisher(cfg)
+	testhelper.Ok(t, err)
+	presence(t, broker, platform.PresenceOnline)
+
+	publisher.Close(time.Second)
+	message := presence(t, broker, platform.PresenceOffline)
+	testhelper.Assert(t, !message.Will, "expected the orb to announce itself offline, got the will")
+}
+
+func testReconnect(t *testing.T, broker *mock.MQTTBroker, cfg platform.MQTTConfig) {
+	publisher, err := platform.NewMQTTPublisher(cfg)
+	testhelper.Ok(t, err)
+	defer publisher.Close(time.Second)
+	presence(t, broker, platform.PresenceOnline)
+
+	broker.DropClients()
+	connected(t, broker, 2)
+	presence(t, broker, platform.PresenceOnline)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	testhelper.Ok(t, publisher.Publish(ctx, "orbs/7/status", 1, false, []byte("{}")))
+}
+
+func testPublishTimeout(t *testing.T, broker *mock.MQTTBroker, cfg platform.MQTTConfig) {
+	broker.Username = "orb"
+	broker.Password = "secret"
+	publisher, err := platform.NewMQTTPublisher(cfg)
+	testhelper.Ok(t, err)
+	defer publisher.Close(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = publisher.Publish(ctx, "orbs/7/status", 1, false, []byte("{}"))
+	testhelper.Assert(t, errors.Is(err, domain.ErrPublishFailed), "expected a publish error, got %v", err)
+	testhelper.Assert(t, broker.Connects() == 0, "expected the broker to refuse the orb")
+}
+
+func testInvalidBrokerURL(t *testing.T, broker *mock.MQTTBroker, cfg platform.MQTTConfig) {
+	for _, brokerURL := range []string{"", "broker:1883", "http://broker:1883"} {
+		cfg.BrokerURL = brokerURL
+		_, err := platform.NewMQTTPublisher(cfg)
+		testhelper.Assert(t, errors.Is(err, domain.ErrInvalidBrokerURL), "expected %q to be invalid, got %v", brokerURL, err)
+	}
+}
@@ -0,0 +1,357 @@
+package platform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+// minCompaction is the number of acknowledged records the outbox log has to
+// hold before it is worth rewriting.
+const minCompaction = 64
+
+type (
+	// OutboxConfig configures a file-backed outbox. Zero values disable the
+	// corresponding limit.
+	OutboxConfig struct {
+		Path     string                         // File the outbox log is kept in.
+		Capacity int                            // Maximum number of pending entries.
+		MaxAge   time.Duration                  // Age after which a pending entry is dropped.
+		OnExpire func(entry domain.OutboxEntry) // Called for every entry dropped for its age, with the outbox unlocked.
+	}
+
+	// outbox is an append-only log of pending requests. Every append and
+	// acknowledgement is written as a JSON line and synced to disk before
+	// returning, so the outbox survives crashes and restarts.
+	outbox struct {
+		cfg OutboxConfig
+		now func() time.Time
+
+		mu      sync.Mutex
+		file    *os.File
+		pending []domain.OutboxEntry
+		acked   int // Records in the log that no longer matter.
+	}
+
+	// outboxRecord is a single line of the outbox log.
+	outboxRecord struct {
+		Op    string              `json:"op"`
+		Entry *domain.OutboxEntry `json:"entry,omitempty"`
+		Id    string              `json:"id,omitempty"`
+	}
+)
+
+const (
+	opAppend = "append"
+	opAck    = "ack"
+)
+
+// OpenOutbox opens the outbox log at cfg.Path, creating it if needed, and
+// replays it to recover the entries still pending. A partially written last
+// line, left behind by a crash, is discarded. A corrupt line anywhere else
+// leaves the log untouched, so the records after it are not lost.
+//
+// cfg: Settings of the outbox.
+//
+// Returns the outbox, or an error wrapping domain.ErrOutboxStorage if the log
+// cannot be read or written or holds a corrupt record.
+func OpenOutbox(cfg OutboxConfig) (*outbox, error) {
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o700); err != nil {
+		return nil, fmt.Errorf("OpenOutbox: %w: %w", domain.ErrOutboxStorage, err)
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("OpenOutbox: %w: %w", domain.ErrOutboxStorage, err)
+	}
+
+	o := &outbox{cfg: cfg, now: time.Now, file: file}
+	valid, err := o.replay(file)
+	if err == nil {
+		err = file.Truncate(valid)
+	}
+	if err == nil {
+		_, err = file.Seek(valid, io.SeekStart)
+	}
+	if err == nil {
+		err = syncDir(cfg.Path)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("OpenOutbox: %w: %w", domain.ErrOutboxStorage, err)
+	}
+	return o, nil
+}
+
+// replay rebuilds the pending entries from the log.
+//
+// Returns the length of the log up to the last complete line, or an error if
+// a complete line cannot be decoded.
+func (o *outbox) replay(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Only the last line can be torn by a crash; it has no newline.
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var record outboxRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &record); err != nil {
+			return 0, fmt.Errorf("corrupt record at offset %d: %w", valid, err)
+		}
+		valid += int64(len(line))
+
+		switch {
+		case record.Op == opAppend && record.Entry != nil:
+			o.pending = append(o.pending, *record.Entry)
+		case record.Op == opAck:
+			if o.remove(record.Id) {
+				o.acked += 2
+			}
+		}
+	}
+}
+
+// Append writes the entry to the end of the outbox.
+//
+// entry: The request to deliver later.
+//
+// Returns domain.ErrOutboxFull if the outbox is at capacity, or an error if
+// the entry could not be written to disk.
+func (o *outbox) Append(entry domain.OutboxEntry) error {
+	o.mu.Lock()
+	expired, err := o.expire()
+	defer o.notifyExpired(expired)
+	defer o.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("Append: %w", err)
+	}
+	if o.cfg.Capacity > 0 && len(o.pending) >= o.cfg.Capacity {
+		return fmt.Errorf("Append: %w", domain.ErrOutboxFull)
+	}
+	if err := o.write(outboxRecord{Op: opAppend, Entry: &entry}); err != nil {
+		return fmt.Errorf("Append: %w", err)
+	}
+	o.pending = append(o.pending, entry)
+	return nil
+}
+
+// Peek returns the oldest pending entry without removing it, dropping any
+// entry that expired on the way.
+//
+// Returns the entry, or nil if the outbox is empty.
+func (o *outbox) Peek() (*domain.OutboxEntry, error) {
+	o.mu.Lock()
+	expired, err := o.expire()
+	defer o.notifyExpired(expired)
+	defer o.mu.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("Peek: %w", err)
+	}
+	if len(o.pending) == 0 {
+		return nil, nil
+	}
+	entry := o.pending[0]
+	return &entry, nil
+}
+
+// PeekBatch returns the oldest pending entries without removing them,
+// dropping any entry that expired on the way.
+//
+// max: The maximum number of entries returned.
+//
+// Returns the entries, oldest first, or none if the outbox is empty.
+func (o *outbox) PeekBatch(max int) ([]domain.OutboxEntry, error) {
+	o.mu.Lock()
+	expired, err := o.expire()
+	defer o.notifyExpired(expired)
+	defer o.mu.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("PeekBatch: %w", err)
+	}
+	if max > len(o.pending) {
+		max = len(o.pending)
+	}
+	return append([]domain.OutboxEntry(nil), o.pending[:max]...), nil
+}
+
+// Ack removes the entry with the given ID once it has been delivered.
+//
+// id: ID of the delivered entry.
+//
+// Returns an error if the acknowledgement could not be written to disk.
+func (o *outbox) Ack(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.ack(id); err != nil {
+		return fmt.Errorf("Ack: %w", err)
+	}
+	return nil
+}
+
+// Len returns the number of pending entries.
+func (o *outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Close closes the outbox log.
+func (o *outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
+
+// expire drops the pending entries older than the configured maximum age.
+// Entries are appended in order, so only the head of the queue is checked.
+//
+// Returns the dropped entries, to be handed to notifyExpired once the
+// outbox is unlocked.
+func (o *outbox) expire() ([]domain.OutboxEntry, error) {
+	if o.cfg.MaxAge <= 0 {
+		return nil, nil
+	}
+	var expired []domain.OutboxEntry
+	for len(o.pending) > 0 && o.now().Sub(o.pending[0].CreatedAt) > o.cfg.MaxAge {
+		entry := o.pending[0]
+		if err := o.ack(entry.Id); err != nil {
+			return expired, err
+		}
+		expired = append(expired, entry)
+	}
+	return expired, nil
+}
+
+// notifyExpired calls OnExpire for each expired entry. The outbox must not
+// be locked, so that OnExpire may take its time or use the outbox.
+func (o *outbox) notifyExpired(expired []domain.OutboxEntry) {
+	if o.cfg.OnExpire == nil {
+		return
+	}
+	for _, entry := range expired {
+		o.cfg.OnExpire(entry)
+	}
+}
+
+// ack records the acknowledgement and compacts the log when it is mostly
+// made of acknowledged records.
+func (o *outbox) ack(id string) error {
+	if !o.contains(id) {
+		return nil
+	}
+	if err := o.write(outboxRecord{Op: opAck, Id: id}); err != nil {
+		return err
+	}
+	o.remove(id)
+	o.acked += 2
+
+	if o.acked >= minCompaction && o.acked > len(o.pending) {
+		return o.compact()
+	}
+	return nil
+}
+
+// write appends the record to the log and syncs it to disk.
+func (o *outbox) write(record outboxRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return domain.ErrMarshallingPayload
+	}
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("%w: %w", domain.ErrOutboxStorage, err)
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("%w: %w", domain.ErrOutboxStorage, err)
+	}
+	return nil
+}
+
+// compact rewrites the log with only the pending entries. The new log is
+// synced to a temporary file and renamed over the old one, so a crash
+// leaves either of them intact.
+func (o *outbox) compact() error {
+	tmpPath := o.cfg.Path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("%w: %w", domain.ErrOutboxStorage, err)
+	}
+	writer := bufio.NewWriter(tmp)
+	for i := range o.pending {
+		line, err := json.Marshal(outboxRecord{Op: opAppend, Entry: &o.pending[i]})
+		if err != nil {
+			tmp.Close()
+			return domain.ErrMarshallingPayload
+		}
+		writer.Write(append(line, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, o.cfg.Path)
+	}
+	if err == nil {
+		err = syncDir(o.cfg.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", domain.ErrOutboxStorage, err)
+	}
+
+	file, err := os.OpenFile(o.cfg.Path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("%w: %w", domain.ErrOutboxStorage, err)
+	}
+	o.file.Close()
+	o.file = file
+	o.acked = 0
+	return nil
+}
+
+func (o *outbox) contains(id string) bool {
+	for _, entry := range o.pending {
+		if entry.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *outbox) remove(id string) bool {
+	for i, entry := range o.pending {
+		if entry.Id == id {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// syncDir syncs the directory holding path, so that creating or renaming
+// the file is durable too.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
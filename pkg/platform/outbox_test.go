@@ -0,0 +1,201 @@
+package platform_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestOutbox(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, string)
+	}{
+		{"should return entries in order until acknowledged", testOutboxOrder},
+		{"should survive a restart", testOutboxRestart},
+		{"should discard a partially written record", testOutboxTornRecord},
+		{"should refuse a log with a corrupt record", testOutboxCorruptRecord},
+		{"should reject entries over capacity", testOutboxCapacity},
+		{"should drop expired entries", testOutboxExpiry},
+		{"should compact acknowledged records", testOutboxCompaction},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "outbox", "sign-up.log")
+			test.function(t, path)
+		})
+	}
+}
+
+func outboxEntry(id string) domain.OutboxEntry {
+	return domain.OutboxEntry{
+		Id:        id,
+		Route:     "/sign-up",
+		Body:      []byte(fmt.Sprintf(`{"id":%q}`, id)),
+		CreatedAt: time.Now(),
+	}
+}
+
+func testOutboxOrder(t *testing.T, path string) {
+	o, err := platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	defer o.Close()
+
+	testhelper.Ok(t, o.Append(outboxEntry("1")))
+	testhelper.Ok(t, o.Append(outboxEntry("2")))
+	testhelper.Assert(t, o.Len() == 2, "expected 2 pending entries, got %d", o.Len())
+
+	entry, err := o.Peek()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, entry.Id == "1", "expected the oldest entry first, got %s", entry.Id)
+	entry, _ = o.Peek()
+	testhelper.Assert(t, entry.Id == "1", "expected peek to leave the entry pending, got %s", entry.Id)
+	entries, err := o.PeekBatch(5)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(entries) == 2 && entries[0].Id == "1" && entries[1].Id == "2", "expected both entries in order, got %+v", entries)
+
+	testhelper.Ok(t, o.Ack("1"))
+	entry, _ = o.Peek()
+	testhelper.Assert(t, entry.Id == "2", "expected the next entry, got %s", entry.Id)
+	testhelper.Ok(t, o.Ack("2"))
+	entry, err = o.Peek()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, entry == nil, "expected an empty outbox, got %v", entry)
+}
+
+func testOutboxRestart(t *testing.T, path string) {
+	o, err := platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, o.Append(outboxEntry("1")))
+	testhelper.Ok(t, o.Append(outboxEntry("2")))
+	testhelper.Ok(t, o.Ack("1"))
+	testhelper.Ok(t, o.Close())
+
+	o, err = platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	defer o.Close()
+	testhelper.Assert(t, o.Len() == 1, "expected 1 pending entry after restart, got %d", o.Len())
+	entry, err := o.Peek()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, entry.Id == "2" && string(entry.Body) == `{"id":"2"}`, "expected entry 2 to survive, got %+v", entry)
+
+	testhelper.Ok(t, o.Append(outboxEntry("3")))
+	testhelper.Assert(t, o.Len() == 2, "expected appends to resume after restart, got %d", o.Len())
+}
+
+func testOutboxTornRecord(t *testing.T, path string) {
+	o, err := platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, o.Append(outboxEntry("1")))
+	testhelper.Ok(t, o.Close())
+
+	// Simulate a crash halfway through writing the second record.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	testhelper.Ok(t, err)
+	file.WriteString(`{"op":"append","entry":{"id":"2","rou`)
+	file.Close()
+
+	o, err = platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, o.Len() == 1, "expected the torn record to be discarded, got %d entries", o.Len())
+	testhelper.Ok(t, o.Append(outboxEntry("3")))
+	testhelper.Ok(t, o.Close())
+
+	o, err = platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	defer o.Close()
+	testhelper.Assert(t, o.Len() == 2, "expected records after the torn one to be readable, got %d", o.Len())
+}
+
+func testOutboxCorruptRecord(t *testing.T, path string) {
+	o, err := platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, o.Append(outboxEntry("1")))
+	testhelper.Ok(t, o.Close())
+
+	// Corrupt a complete record in the middle of the log.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	testhelper.Ok(t, err)
+	file.WriteString("{\"op\":\"app\x00\n")
+	file.WriteString(`{"op":"append","entry":{"id":"2","route":"/sign-up"}}` + "\n")
+	file.Close()
+	before, err := os.Stat(path)
+	testhelper.Ok(t, err)
+
+	_, err = platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Assert(t, errors.Is(err, domain.ErrOutboxStorage), "expected ErrOutboxStorage, got %v", err)
+	after, err := os.Stat(path)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, after.Size() == before.Size(), "expected the log to be left untouched, got %d bytes instead of %d", after.Size(), before.Size())
+}
+
+func testOutboxCapacity(t *testing.T, path string) {
+	o, err := platform.OpenOutbox(platform.OutboxConfig{Path: path, Capacity: 1})
+	testhelper.Ok(t, err)
+	defer o.Close()
+
+	testhelper.Ok(t, o.Append(outboxEntry("1")))
+	err = o.Append(outboxEntry("2"))
+	testhelper.Assert(t, errors.Is(err, domain.ErrOutboxFull), "expected a full outbox, got %v", err)
+	testhelper.Ok(t, o.Ack("1"))
+	testhelper.Ok(t, o.Append(outboxEntry("2")))
+}
+
+func testOutboxExpiry(t *testing.T, path string) {
+	var expired []string
+	var outbox domain.Outbox
+	pending := -1
+	o, err := platform.OpenOutbox(platform.OutboxConfig{
+		Path:   path,
+		MaxAge: time.Hour,
+		OnExpire: func(entry domain.OutboxEntry) {
+			expired = append(expired, entry.Id)
+			// The outbox is unlocked by now.
+			pending = outbox.Len()
+		},
+	})
+	testhelper.Ok(t, err)
+	defer o.Close()
+	outbox = o
+
+	old := outboxEntry("1")
+	old.CreatedAt = time.Now().Add(-2 * time.Hour)
+	testhelper.Ok(t, o.Append(old))
+	testhelper.Ok(t, o.Append(outboxEntry("2")))
+
+	entry, err := o.Peek()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, entry.Id == "2", "expected the expired entry to be skipped, got %s", entry.Id)
+	testhelper.Assert(t, len(expired) == 1 && expired[0] == "1", "expected entry 1 to be reported expired, got %v", expired)
+	testhelper.Assert(t, pending == 1, "expected the outbox to be usable from OnExpire, got %d pending", pending)
+}
+
+func testOutboxCompaction(t *testing.T, path string) {
+	o, err := platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprint(i)
+		testhelper.Ok(t, o.Append(outboxEntry(id)))
+		testhelper.Ok(t, o.Ack(id))
+	}
+	testhelper.Ok(t, o.Append(outboxEntry("last")))
+	testhelper.Ok(t, o.Close())
+
+	info, err := os.Stat(path)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, info.Size() < 4096, "expected acknowledged records to be compacted, got %d bytes", info.Size())
+
+	o, err = platform.OpenOutbox(platform.OutboxConfig{Path: path})
+	testhelper.Ok(t, err)
+	defer o.Close()
+	entry, err := o.Peek()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, o.Len() == 1 && entry.Id == "last", "expected only the last entry to remain, got %d", o.Len())
+}
@@ -0,0 +1,456 @@
+package platform
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+// Protocol buffer wire types used by the messages below.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// MarshalStatus encodes the status in the protocol buffer wire format, as
+// the Status message of api/uniqueness.proto. Zero fields are omitted.
+//
+// status: The status to encode.
+//
+// Returns the encoded message.
+func MarshalStatus(status *domain.Status) []byte {
+	var b []byte
+	b = appendFloat(b, 1, status.Battery)
+	b = appendFloat(b, 2, status.CPUUsage)
+	b = appendFloat(b, 3, status.CPUTemp)
+	b = appendFloat(b, 4, status.DiskSpace)
+	b = appendFloat(b, 5, status.ClockSkew)
+	return b
+}
+
+// UnmarshalStatus decodes a Status message in the protocol buffer wire
+// format, skipping unknown fields.
+//
+// data: The encoded message.
+//
+// Returns the status, or an error if the message is malformed.
+func UnmarshalStatus(data []byte) (*domain.Status, error) {
+	status := &domain.Status{}
+	fields := map[uint64]*float32{1: &status.Battery, 2: &status.CPUUsage, 3: &status.CPUTemp, 4: &status.DiskSpace, 5: &status.ClockSkew}
+	err := readFields(data, func(field uint64, wireType int, value []byte) error {
+		target, ok := fields[field]
+		if !ok {
+			return nil
+		}
+		if wireType != wireFixed32 {
+			return fmt.Errorf("UnmarshalStatus: %w: field %d", domain.ErrDecodingPayload, field)
+		}
+		*target = math.Float32frombits(binary.LittleEndian.Uint32(value))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// MarshalIris encodes the iris code in the protocol buffer wire format, as
+// the Iris message of api/uniqueness.proto. Empty fields are omitted.
+//
+// iris: The iris code and its ID.
+//
+// Returns the encoded message.
+func MarshalIris(iris *domain.Iris) []byte {
+	var b []byte
+	b = appendString(b, 1, iris.Id)
+	b = appendString(b, 2, iris.IrisCode)
+	return b
+}
+
+// UnmarshalIris decodes an Iris message in the protocol buffer wire format,
+// skipping unknown fields.
+//
+// data: The encoded message.
+//
+// Returns the iris code, or an error if the message is malformed.
+func UnmarshalIris(data []byte) (*domain.Iris, error) {
+	iris := &domain.Iris{}
+	fields := map[uint64]*string{1: &iris.Id, 2: &iris.IrisCode}
+	err := readFields(data, func(field uint64, wireType int, value []byte) error {
+		target, ok := fields[field]
+		if !ok {
+			return nil
+		}
+		if wireType != wireBytes {
+			return fmt.Errorf("UnmarshalIris: %w: field %d", domain.ErrDecodingPayload, field)
+		}
+		*target = string(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return iris, nil
+}
+
+// MarshalReply encodes an answer of the uniqueness service in the protocol
+// buffer wire format, as the Reply message of api/uniqueness.proto. Empty
+// fields are omitted.
+//
+// reply: The answer to encode.
+//
+// Returns the encoded message.
+func MarshalReply(reply *domain.SignUpResponse) []byte {
+	var b []byte
+	b = appendBool(b, 1, reply.Success)
+	b = appendString(b, 2, reply.Message)
+	b = appendString(b, 3, reply.MatchID)
+	return b
+}
+
+// UnmarshalReply decodes a Reply message in the protocol buffer wire format,
+// skipping unknown fields.
+//
+// data: The encoded message.
+//
+// Returns the answer, or an error if the message is malformed.
+func UnmarshalReply(data []byte) (*domain.SignUpResponse, error) {
+	reply := &domain.SignUpResponse{}
+	err := readFields(data, func(field uint64, wireType int, value []byte) error {
+		var err error
+		switch field {
+		case 1:
+			reply.Success, err = readBool(wireType, value)
+		case 2:
+			reply.Message, err = readString(wireType, value)
+		case 3:
+			reply.MatchID, err = readString(wireType, value)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalReply: %w", err)
+	}
+	return reply, nil
+}
+
+// MarshalStatusBatch encodes a batch of status samples in the protocol
+// buffer wire format, as the StatusBatch message of api/uniqueness.proto.
+//
+// batch: The batch to encode.
+//
+// Returns the encoded message.
+func MarshalStatusBatch(batch *domain.StatusBatch) []byte {
+	var b []byte
+	for i := range batch.Samples {
+		sample := &batch.Samples[i]
+		var m []byte
+		m = appendVarint(m, 1, uint64(unixNano(sample.From)))
+		m = appendVarint(m, 2, uint64(unixNano(sample.To)))
+		m = appendVarint(m, 3, uint64(sample.Count))
+		m = appendMessage(m, 4, MarshalStatus(&sample.Min))
+		m = appendMessage(m, 5, MarshalStatus(&sample.Max))
+		m = appendMessage(m, 6, MarshalStatus(&sample.Avg))
+		m = appendString(m, 7, sample.Id)
+		b = appendMessage(b, 1, m)
+	}
+	return b
+}
+
+// UnmarshalStatusBatch decodes a StatusBatch message in the protocol buffer
+// wire format, skipping unknown fields.
+//
+// data: The encoded message.
+//
+// Returns the batch, or an error if the message is malformed.
+func UnmarshalStatusBatch(data []byte) (*domain.StatusBatch, error) {
+	batch := &domain.StatusBatch{}
+	err := readFields(data, func(field uint64, wireType int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		if wireType != wireBytes {
+			return fmt.Errorf("%w: field %d", domain.ErrDecodingPayload, field)
+		}
+		var sample domain.StatusSample
+		err := readFields(value, func(field uint64, wireType int, value []byte) error {
+			var n uint64
+			var err error
+			switch field {
+			case 1:
+				n, err = readVarint(wireType, value)
+				sample.From = fromUnixNano(int64(n))
+			case 2:
+				n, err = readVarint(wireType, value)
+				sample.To = fromUnixNano(int64(n))
+			case 3:
+				n, err = readVarint(wireType, value)
+				sample.Count = int(n)
+			case 4:
+				sample.Min, err = readStatus(wireType, value)
+			case 5:
+				sample.Max, err = readStatus(wireType, value)
+			case 6:
+				sample.Avg, err = readStatus(wireType, value)
+			case 7:
+				sample.Id, err = readString(wireType, value)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		batch.Samples = append(batch.Samples, sample)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalStatusBatch: %w", err)
+	}
+	return batch, nil
+}
+
+// MarshalSignUpBatch encodes a batch of sign-ups in the protocol buffer wire
+// format, as the SignUpBatch message of api/uniqueness.proto.
+//
+// signUps: The iris codes and their IDs, oldest first.
+//
+// Returns the encoded message.
+func MarshalSignUpBatch(signUps []domain.Iris) []byte {
+	var b []byte
+	for i := range signUps {
+		b = appendMessage(b, 1, MarshalIris(&signUps[i]))
+	}
+	return b
+}
+
+// UnmarshalSignUpBatch decodes a SignUpBatch message in the protocol buffer
+// wire format, skipping unknown fields.
+//
+// data: The encoded message.
+//
+// Returns the sign-ups, or an error if the message is malformed.
+func UnmarshalSignUpBatch(data []byte) ([]domain.Iris, error) {
+	var signUps []domain.Iris
+	err := readFields(data, func(field uint64, wireType int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		if wireType != wireBytes {
+			return fmt.Errorf("%w: field %d", domain.ErrDecodingPayload, field)
+		}
+		iris, err := UnmarshalIris(value)
+		if err != nil {
+			return err
+		}
+		signUps = append(signUps, *iris)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalSignUpBatch: %w", err)
+	}
+	return signUps, nil
+}
+
+// MarshalBatchResponse encodes the answer to a batch in the protocol buffer
+// wire format, as the BatchReply message of api/uniqueness.proto.
+//
+// response: The answer to encode.
+//
+// Returns the encoded message.
+func MarshalBatchResponse(response *domain.BatchResponse) []byte {
+	var b []byte
+	b = appendBool(b, 1, response.Success)
+	b = appendString(b, 2, response.Message)
+	for _, result := range response.Results {
+		var m []byte
+		m = appendString(m, 1, result.Id)
+		m = appendVarint(m, 2, uint64(result.Status))
+		m = appendString(m, 3, result.Message)
+		m = appendString(m, 4, result.MatchID)
+		b = appendMessage(b, 3, m)
+	}
+	return b
+}
+
+// UnmarshalBatchResponse decodes a BatchReply message in the protocol buffer
+// wire format, skipping unknown fields.
+//
+// data: The encoded message.
+//
+// Returns the answer, or an error if the message is malformed.
+func UnmarshalBatchResponse(data []byte) (*domain.BatchResponse, error) {
+	response := &domain.BatchResponse{}
+	err := readFields(data, func(field uint64, wireType int, value []byte) error {
+		var err error
+		switch field {
+		case 1:
+			response.Success, err = readBool(wireType, value)
+		case 2:
+			response.Message, err = readString(wireType, value)
+		case 3:
+			if wireType != wireBytes {
+				return fmt.Errorf("%w: field %d", domain.ErrDecodingPayload, field)
+			}
+			var result domain.BatchItemResult
+			err = readFields(value, func(field uint64, wireType int, value []byte) error {
+				var err error
+				var n uint64
+				switch field {
+				case 1:
+					result.Id, err = readString(wireType, value)
+				case 2:
+					n, err = readVarint(wireType, value)
+					result.Status = int(n)
+				case 3:
+					result.Message, err = readString(wireType, value)
+				case 4:
+					result.MatchID, err = readString(wireType, value)
+				}
+				return err
+			})
+			response.Results = append(response.Results, result)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("UnmarshalBatchResponse: %w", err)
+	}
+	return response, nil
+}
+
+func appendFloat(b []byte, field uint64, value float32) []byte {
+	if value == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, field<<3|wireFixed32)
+	return binary.LittleEndian.AppendUint32(b, math.Float32bits(value))
+}
+
+func appendString(b []byte, field uint64, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, field<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendVarint(b []byte, field uint64, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, field<<3|wireVarint)
+	return binary.AppendUvarint(b, value)
+}
+
+func appendBool(b []byte, field uint64, value bool) []byte {
+	if !value {
+		return b
+	}
+	return appendVarint(b, field, 1)
+}
+
+// appendMessage appends an embedded message, even an empty one, so that
+// repeated fields keep their length.
+func appendMessage(b []byte, field uint64, message []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(message)))
+	return append(b, message...)
+}
+
+func readVarint(wireType int, value []byte) (uint64, error) {
+	if wireType != wireVarint {
+		return 0, fmt.Errorf("%w: expected a varint", domain.ErrDecodingPayload)
+	}
+	n, _ := binary.Uvarint(value)
+	return n, nil
+}
+
+func readBool(wireType int, value []byte) (bool, error) {
+	n, err := readVarint(wireType, value)
+	return n != 0, err
+}
+
+func readString(wireType int, value []byte) (string, error) {
+	if wireType != wireBytes {
+		return "", fmt.Errorf("%w: expected a string", domain.ErrDecodingPayload)
+	}
+	return string(value), nil
+}
+
+func readStatus(wireType int, value []byte) (domain.Status, error) {
+	if wireType != wireBytes {
+		return domain.Status{}, fmt.Errorf("%w: expected a message", domain.ErrDecodingPayload)
+	}
+	status, err := UnmarshalStatus(value)
+	if err != nil {
+		return domain.Status{}, err
+	}
+	return *status, nil
+}
+
+// unixNano encodes a time as nanoseconds since the Unix epoch, and the zero
+// time as zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromUnixNano is the inverse of unixNano, in UTC.
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+// readFields walks the fields of a message, handing each to visit with
+// its raw value: the payload of length-delimited fields and the bytes of
+// fixed-size ones and varints.
+func readFields(data []byte, visit func(field uint64, wireType int, value []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("readFields: %w: bad tag", domain.ErrDecodingPayload)
+		}
+		data = data[n:]
+
+		wireType := int(tag & 7)
+		switch wireType {
+		case wireVarint:
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("readFields: %w: bad varint", domain.ErrDecodingPayload)
+			}
+		case wireFixed64:
+			n = 8
+		case wireFixed32:
+			n = 4
+		case wireBytes:
+			size, m := binary.Uvarint(data)
+			if m <= 0 || size > uint64(len(data)-m) {
+				return fmt.Errorf("readFields: %w: bad length", domain.ErrDecodingPayload)
+			}
+			data = data[m:]
+			n = int(size)
+		default:
+			return fmt.Errorf("readFields: %w: unsupported wire type %d", domain.ErrDecodingPayload, wireType)
+		}
+		if n > len(data) {
+			return fmt.Errorf("readFields: %w: truncated field", domain.ErrDecodingPayload)
+		}
+		value := data[:n]
+		data = data[n:]
+
+		if err := visit(tag>>3, wireType, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
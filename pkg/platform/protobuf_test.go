@@ -0,0 +1,107 @@
+package platform_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestProtobuf(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T)
+	}{
+		{"should round-trip a status", testStatusRoundTrip},
+		{"should round-trip an iris code", testIrisRoundTrip},
+		{"should round-trip a reply", testReplyRoundTrip},
+		{"should round-trip a status batch", testStatusBatchRoundTrip},
+		{"should round-trip a sign-up batch", testSignUpBatchRoundTrip},
+		{"should round-trip a batch response", testBatchResponseRoundTrip},
+		{"should skip unknown fields", testSkipUnknownFields},
+		{"should reject a truncated message", testRejectTruncatedMessage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, test.function)
+	}
+}
+
+func testStatusRoundTrip(t *testing.T) {
+	status := &domain.Status{Battery: 87.5, CPUUsage: 12.25, CPUTemp: 0, DiskSpace: 1024, ClockSkew: -1500}
+	decoded, err := platform.UnmarshalStatus(platform.MarshalStatus(status))
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, *decoded == *status, "expected %+v, got %+v", status, decoded)
+	testhelper.Assert(t, len(platform.MarshalStatus(&domain.Status{})) == 0, "expected zero fields to be omitted")
+}
+
+func testIrisRoundTrip(t *testing.T) {
+	iris := &domain.Iris{Id: "1700000000000000000", IrisCode: "3f2a"}
+	data := platform.MarshalIris(iris)
+	decoded, err := platform.UnmarshalIris(data)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, *decoded == *iris, "expected %+v, got %+v", iris, decoded)
+	testhelper.Assert(t, data[0] == 0x0a && int(data[1]) == len(iris.Id), "expected field 1 as a length-delimited string, got % x", data[:2])
+}
+
+func testReplyRoundTrip(t *testing.T) {
+	reply := &domain.SignUpResponse{Success: false, Message: "already registered", MatchID: "42"}
+	decoded, err := platform.UnmarshalReply(platform.MarshalReply(reply))
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, *decoded == *reply, "expected %+v, got %+v", reply, decoded)
+}
+
+func testStatusBatchRoundTrip(t *testing.T) {
+	from := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	batch := &domain.StatusBatch{Samples: []domain.StatusSample{
+		{From: from, To: from.Add(time.Minute), Count: 3, Min: domain.Status{Battery: 10}, Max: domain.Status{Battery: 30}, Avg: domain.Status{Battery: 20, CPUTemp: 40}, Id: "0"},
+		{From: from.Add(2 * time.Minute), To: from.Add(2 * time.Minute), Count: 1},
+	}}
+	decoded, err := platform.UnmarshalStatusBatch(platform.MarshalStatusBatch(batch))
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(decoded.Samples) == 2, "expected 2 samples, got %d", len(decoded.Samples))
+	for i, sample := range batch.Samples {
+		got := decoded.Samples[i]
+		testhelper.Assert(t, got.From.Equal(sample.From) && got.To.Equal(sample.To) && got.Count == sample.Count &&
+			got.Min == sample.Min && got.Max == sample.Max && got.Avg == sample.Avg && got.Id == sample.Id, "expected %+v, got %+v", sample, got)
+	}
+}
+
+func testSignUpBatchRoundTrip(t *testing.T) {
+	signUps := []domain.Iris{{Id: "1", IrisCode: "a"}, {}, {Id: "3", IrisCode: "c"}}
+	decoded, err := platform.UnmarshalSignUpBatch(platform.MarshalSignUpBatch(signUps))
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(decoded) == 3, "expected empty sign-ups to keep their place, got %+v", decoded)
+	for i := range signUps {
+		testhelper.Assert(t, decoded[i] == signUps[i], "expected %+v, got %+v", signUps[i], decoded[i])
+	}
+}
+
+func testBatchResponseRoundTrip(t *testing.T) {
+	response := &domain.BatchResponse{Success: true, Message: "done", Results: []domain.BatchItemResult{
+		{Id: "1", Status: 201},
+		{Id: "2", Status: 409, Message: "duplicate", MatchID: "1"},
+	}}
+	decoded, err := platform.UnmarshalBatchResponse(platform.MarshalBatchResponse(response))
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, decoded.Success && decoded.Message == "done" && len(decoded.Results) == 2, "expected %+v, got %+v", response, decoded)
+	for i := range response.Results {
+		testhelper.Assert(t, decoded.Results[i] == response.Results[i], "expected %+v, got %+v", response.Results[i], decoded.Results[i])
+	}
+}
+
+func testSkipUnknownFields(t *testing.T) {
+	// Field 9 as a varint, then field 2 ("abc") of an Iris.
+	data := []byte{9 << 3, 0x96, 0x01, 2<<3 | 2, 3, 'a', 'b', 'c'}
+	iris, err := platform.UnmarshalIris(data)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, iris.IrisCode == "abc" && iris.Id == "", "expected only the iris code, got %+v", iris)
+}
+
+func testRejectTruncatedMessage(t *testing.T) {
+	data := platform.MarshalStatus(&domain.Status{Battery: 1})
+	_, err := platform.UnmarshalStatus(data[:len(data)-1])
+	testhelper.Assert(t, errors.Is(err, domain.ErrDecodingPayload), "expected a decoding error, got %v", err)
+}
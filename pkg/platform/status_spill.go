@@ -0,0 +1,164 @@
+package platform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"virtual-orb/pkg/domain"
+)
+
+type (
+	// statusSpill keeps status samples in a file, one JSON line each, for
+	// the part of the status backlog that does not fit in memory.
+	statusSpill struct {
+		path string
+		mu   sync.Mutex
+	}
+)
+
+// OpenStatusSpill prepares the status spill file at path, creating its
+// directory if needed. A partially written last line, left behind by a
+// crash, is cut off so that later samples are appended after valid ones.
+//
+// path: File the spilled samples are kept in.
+//
+// Returns the spill, or an error if the file cannot be prepared.
+func OpenStatusSpill(path string) (*statusSpill, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("OpenStatusSpill: %w: %w", domain.ErrStatusSpill, err)
+	}
+	_, valid, err := readSamples(path)
+	if err == nil {
+		err = os.Truncate(path, valid)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("OpenStatusSpill: %w: %w", domain.ErrStatusSpill, err)
+	}
+	return &statusSpill{path: path}, nil
+}
+
+// Load returns the spilled samples, oldest first. A partially written last
+// line is ignored.
+func (s *statusSpill) Load() ([]domain.StatusSample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples, _, err := readSamples(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Load: %w: %w", domain.ErrStatusSpill, err)
+	}
+	return samples, nil
+}
+
+// Append writes the samples after the spilled ones and syncs them to disk.
+func (s *statusSpill) Append(samples []domain.StatusSample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines, err := encodeSamples(samples)
+	if err != nil {
+		return fmt.Errorf("Append: %w", err)
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("Append: %w: %w", domain.ErrStatusSpill, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(lines); err != nil {
+		return fmt.Errorf("Append: %w: %w", domain.ErrStatusSpill, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("Append: %w: %w", domain.ErrStatusSpill, err)
+	}
+	return nil
+}
+
+// Replace atomically swaps the spilled samples for the given ones.
+func (s *statusSpill) Replace(samples []domain.StatusSample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lines, err := encodeSamples(samples)
+	if err != nil {
+		return fmt.Errorf("Replace: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	err = writeSynced(tmpPath, lines)
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err == nil {
+		err = syncDir(s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("Replace: %w: %w", domain.ErrStatusSpill, err)
+	}
+	return nil
+}
+
+// readSamples reads the samples stored at path, stopping at the first line
+// that is not a complete sample.
+//
+// Returns the samples and the length of the file they were read from.
+func readSamples(path string) ([]domain.StatusSample, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var samples []domain.StatusSample
+	var valid int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return samples, valid, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var sample domain.StatusSample
+		if json.Unmarshal(bytes.TrimSpace(line), &sample) != nil {
+			return samples, valid, nil
+		}
+		samples = append(samples, sample)
+		valid += int64(len(line))
+	}
+}
+
+// encodeSamples renders the samples as JSON lines.
+func encodeSamples(samples []domain.StatusSample) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, sample := range samples {
+		if err := encoder.Encode(sample); err != nil {
+			return nil, domain.ErrMarshallingPayload
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writeSynced writes data to a new file at path and syncs it to disk.
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package platform_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestStatusSpill(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, string)
+	}{
+		{"should append and load samples in order", testSpillAppendLoad},
+		{"should replace the stored samples", testSpillReplace},
+		{"should ignore a partially written sample", testSpillTornSample},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t, filepath.Join(t.TempDir(), "spill", "status.log"))
+		})
+	}
+}
+
+func spillSample(battery float32) domain.StatusSample {
+	status := domain.Status{Battery: battery}
+	now := time.Now().UTC()
+	return domain.StatusSample{From: now, To: now, Count: 1, Min: status, Max: status, Avg: status}
+}
+
+func testSpillAppendLoad(t *testing.T, path string) {
+	spill, err := platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	samples, err := spill.Load()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(samples) == 0, "expected an empty spill, got %d samples", len(samples))
+
+	testhelper.Ok(t, spill.Append([]domain.StatusSample{spillSample(1), spillSample(2)}))
+	testhelper.Ok(t, spill.Append([]domain.StatusSample{spillSample(3)}))
+	samples, err = spill.Load()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(samples) == 3 && samples[0].Avg.Battery == 1 && samples[2].Avg.Battery == 3,
+		"expected samples 1 to 3 in order, got %+v", samples)
+}
+
+func testSpillReplace(t *testing.T, path string) {
+	spill, err := platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, spill.Append([]domain.StatusSample{spillSample(1), spillSample(2)}))
+	testhelper.Ok(t, spill.Replace([]domain.StatusSample{spillSample(9)}))
+
+	samples, err := spill.Load()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(samples) == 1 && samples[0].Avg.Battery == 9, "expected only the replacement, got %+v", samples)
+}
+
+func testSpillTornSample(t *testing.T, path string) {
+	spill, err := platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, spill.Append([]domain.StatusSample{spillSample(1)}))
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	testhelper.Ok(t, err)
+	file.WriteString(`{"from":"2024-01-01T00:00:00Z","cou`)
+	file.Close()
+
+	samples, err := spill.Load()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(samples) == 1, "expected the torn sample to be ignored, got %d samples", len(samples))
+
+	spill, err = platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, spill.Append([]domain.StatusSample{spillSample(2)}))
+	samples, err = spill.Load()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(samples) == 2, "expected samples after the torn one to be readable, got %d", len(samples))
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+type (
+	// BatchConfig bounds the batches uploaded to the batch endpoints.
+	BatchConfig struct {
+		MaxSize   int           // Most items per request; 1 or less sends items one by one.
+		MaxLinger time.Duration // Longest the oldest item waits for the batch to fill up.
+	}
+)
+
+// enabled tells whether items are to be sent in batches.
+func (c BatchConfig) enabled() bool {
+	return c.MaxSize > 1
+}
+
+// ready tells whether a batch should be sent now rather than wait for more
+// items.
+//
+// n: The number of items waiting.
+// oldest: When the oldest of them was created.
+// now: The current time.
+//
+// Returns true once the batch is full or its oldest item has lingered long enough.
+func (c BatchConfig) ready(n int, oldest, now time.Time) bool {
+	return n >= c.MaxSize || now.Sub(oldest) >= c.MaxLinger
+}
+
+// postBatch uploads a batch and decodes the per-item results.
+//
+// ctx: Context bounding the request.
+// requestSvc: Service to handle HTTP requests.
+// route: The batch endpoint.
+// key: Idempotency key of the batch, or empty for none.
+// body: The batch.
+//
+// Returns the HTTP status of the batch, its response and an error if the
+// request itself failed.
+func postBatch(ctx context.Context, requestSvc domain.RequestSvc, route, key string, body any) (int, *domain.BatchResponse, error) {
+	req := &domain.Request{Method: http.MethodPost, Route: route, Body: body}
+	if key != "" {
+		req.Header = http.Header{HeaderIdempotencyKey: []string{key}}
+	}
+	var response domain.BatchResponse
+	statusCode, err := requestSvc.Do(ctx, req, &response)
+	if err != nil {
+		return statusCode, nil, fmt.Errorf("postBatch: %w", err)
+	}
+	return statusCode, &response, nil
+}
+
+// batchKey derives the idempotency key of a batch from the IDs of its
+// items, so that a retried batch carries the same key as the original.
+func batchKey(ids []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(ids, ",")))
+	return "batch-" + hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+
+	"github.com/sony/gobreaker"
+)
+
+// errFailureStatus is returned to the circuit breaker for responses that
+// the response classifier counts as failures. It never leaves the service.
+var errFailureStatus = errors.New("response classified as failure")
+
+// notFailure wraps the error of a request that failed through no fault of
+// the backend, such as a cancellation, so that the breaker does not count
+// it as a failure. It never leaves the service.
+type notFailure struct{ err error }
+
+func (e notFailure) Error() string { return e.err.Error() }
+func (e notFailure) Unwrap() error { return e.err }
+
+// errSlowCallRate is returned to the circuit breaker when a slow call
+// pushes the slow-call rate over the trip policy. It never leaves the breaker.
+var errSlowCallRate = errors.New("slow-call rate exceeded")
+
+type (
+	// StatusRange is an inclusive range of HTTP status codes.
+	StatusRange struct {
+		From int
+		To   int
+	}
+
+	// ResponseClassifier decides which outcomes of a request count as
+	// failures for the circuit breaker. Transport errors always count,
+	// except for timeouts and cancellations when those are disabled.
+	ResponseClassifier struct {
+		FailureStatuses    []StatusRange // Response statuses counted as failures.
+		CountTimeouts      bool          // Whether timed out requests count as failures.
+		CountCancellations bool          // Whether requests cancelled by the caller count as failures.
+	}
+
+	// TripPolicy decides when the circuit breaker opens. Each criterion is
+	// disabled by its zero value, and the breaker opens as soon as any
+	// enabled criterion is met.
+	TripPolicy struct {
+		MinRequests         uint32        // Requests needed before ratios are considered.
+		FailureRatio        float64       // Ratio of failed requests that opens the breaker.
+		ConsecutiveFailures uint32        // Consecutive failures that open the breaker.
+		SlowCallRatio       float64       // Ratio of slow calls that opens the breaker.
+		SlowCallThreshold   time.Duration // Duration above which a call is slow.
+	}
+
+	// BreakerSettings configures a circuit breaker built by NewCircuitBreaker.
+	BreakerSettings struct {
+		Name          string
+		Timeout       time.Duration // How long the breaker stays open before going half-open.
+		MaxRequests   uint32        // Requests allowed through while half-open.
+		Interval      time.Duration // Period after which counts are cleared while closed.
+		Trip          TripPolicy
+		OnStateChange func(name string, from gobreaker.State, to gobreaker.State)
+	}
+
+	// circuitBreaker wraps gobreaker to add slow-call tracking.
+	circuitBreaker struct {
+		cb     *gobreaker.CircuitBreaker
+		policy TripPolicy
+
+		mu        sync.Mutex
+		slowCalls uint32
+	}
+)
+
+// DefaultResponseClassifier counts 5xx responses, transport errors and
+// timeouts as failures, but not requests cancelled by the caller.
+func DefaultResponseClassifier() ResponseClassifier {
+	return ResponseClassifier{
+		FailureStatuses: []StatusRange{{500, 599}},
+		CountTimeouts:   true,
+	}
+}
+
+// WithResponseClassifier sets how request outcomes are reported to the
+// circuit breaker.
+//
+// classifier: The response classifier to use.
+func WithResponseClassifier(classifier ResponseClassifier) RequestOption {
+	return func(r *request) {
+		r.classifier = classifier
+	}
+}
+
+// ParseStatusRanges parses a comma-separated list of status codes and
+// ranges, such as "429,500-599".
+//
+// spec: The list to parse.
+//
+// Returns the parsed ranges, or an error if the list is malformed.
+func ParseStatusRanges(spec string) ([]StatusRange, error) {
+	var ranges []StatusRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+		fromCode, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("ParseStatusRanges: %w", domain.ErrInvalidStatusRange)
+		}
+		toCode, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || toCode < fromCode {
+			return nil, fmt.Errorf("ParseStatusRanges: %w", domain.ErrInvalidStatusRange)
+		}
+		ranges = append(ranges, StatusRange{fromCode, toCode})
+	}
+	return ranges, nil
+}
+
+// isFailureStatus reports whether the response status counts as a failure.
+func (c ResponseClassifier) isFailureStatus(statusCode int) bool {
+	for _, r := range c.FailureStatuses {
+		if statusCode >= r.From && statusCode <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// isFailureError reports whether the transport error counts as a failure.
+func (c ResponseClassifier) isFailureError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return c.CountCancellations
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return c.CountTimeouts
+	}
+	return true
+}
+
+// NewCircuitBreaker creates a circuit breaker from the given settings.
+// It satisfies domain.CircuitBreaker and, on top of gobreaker's own counts,
+// tracks slow calls so that the trip policy can open on a slow-call rate.
+// Errors the response classifier does not count as failures are wrapped in
+// notFailure, which isSuccessful, set as gobreaker's IsSuccessful, accepts,
+// so gobreaker counts them as successes while the caller still gets the error.
+//
+// settings: Settings of the circuit breaker.
+//
+// Returns a pointer to the circuit breaker.
+func NewCircuitBreaker(settings BreakerSettings) *circuitBreaker {
+	c := &circuitBreaker{policy: settings.Trip}
+	c.cb = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:         settings.Name,
+		Timeout:      settings.Timeout,
+		MaxRequests:  settings.MaxRequests,
+		Interval:     settings.Interval,
+		IsSuccessful: isSuccessful,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return c.policy.readyToTrip(counts, c.slowCallCount())
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			c.resetSlowCalls()
+			if settings.OnStateChange != nil {
+				settings.OnStateChange(name, from, to)
+			}
+		},
+	})
+	return c
+}
+
+// Execute runs the action through the breaker, timing it to track slow calls.
+func (c *circuitBreaker) Execute(action func() (any, error)) (any, error) {
+	// gobreaker clears its counts at the start of every generation;
+	// an empty count means the slow calls belong to a previous one.
+	if c.cb.Counts().Requests == 0 {
+		c.resetSlowCalls()
+	}
+
+	result, err := c.cb.Execute(func() (any, error) {
+		start := time.Now()
+		result, err := action()
+		if c.policy.SlowCallThreshold <= 0 || time.Since(start) <= c.policy.SlowCallThreshold {
+			return result, err
+		}
+
+		c.mu.Lock()
+		c.slowCalls++
+		c.mu.Unlock()
+		// Only failures make gobreaker consult the trip policy, so report
+		// the call as one once slow calls alone are enough to trip.
+		if err == nil && c.policy.readyToTrip(c.cb.Counts(), c.slowCallCount()) {
+			return result, errSlowCallRate
+		}
+		return result, err
+	})
+	if errors.Is(err, errSlowCallRate) {
+		return result, nil
+	}
+	return result, err
+}
+
+// Name returns the name of the circuit breaker.
+func (c *circuitBreaker) Name() string {
+	return c.cb.Name()
+}
+
+// State returns the current state of the circuit breaker.
+func (c *circuitBreaker) State() gobreaker.State {
+	return c.cb.State()
+}
+
+// Counts returns the request counts of the current generation.
+func (c *circuitBreaker) Counts() gobreaker.Counts {
+	return c.cb.Counts()
+}
+
+func (c *circuitBreaker) slowCallCount() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.slowCalls
+}
+
+func (c *circuitBreaker) resetSlowCalls() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slowCalls = 0
+}
+
+// isSuccessful reports whether the outcome of a call does not count as a
+// failure of the backend.
+func isSuccessful(err error) bool {
+	var nf notFailure
+	return err == nil || errors.As(err, &nf)
+}
+
+// readyToTrip reports whether the counts meet any enabled criterion.
+func (p TripPolicy) readyToTrip(counts gobreaker.Counts, slowCalls uint32) bool {
+	if p.ConsecutiveFailures > 0 && counts.ConsecutiveFailures >= p.ConsecutiveFailures {
+		return true
+	}
+	if counts.Requests < p.MinRequests || counts.Requests == 0 {
+		return false
+	}
+	requests := float64(counts.Requests)
+	if p.FailureRatio > 0 && float64(counts.TotalFailures)/requests >= p.FailureRatio {
+		return true
+	}
+	if p.SlowCallRatio > 0 && float64(slowCalls)/requests >= p.SlowCallRatio {
+		return true
+	}
+	return false
+}
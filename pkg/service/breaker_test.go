@@ -0,0 +1,151 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.HttpClient)
+	}{
+		{"should trip on consecutive 5xx responses", testTripOnServerErrors},
+		{"should count configured status ranges as failures", testCustomFailureStatuses},
+		{"should not count cancelled requests as failures", testIgnoreCancellations},
+		{"should trip on slow-call rate", testTripOnSlowCalls},
+		{"should report state changes", testReportStateChanges},
+		{"should parse status ranges", testParseStatusRanges},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			h := new(mock.HttpClient)
+			test.function(t, h)
+		})
+	}
+}
+
+func respondWith(h *mock.HttpClient, statusCode int, calls *int) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		*calls++
+		return &http.Response{StatusCode: statusCode, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+}
+
+func testTripOnServerErrors(t *testing.T, h *mock.HttpClient) {
+	calls := 0
+	respondWith(h, 500, &calls)
+	cb := service.NewCircuitBreaker(service.BreakerSettings{
+		Timeout: time.Minute,
+		Trip:    service.TripPolicy{ConsecutiveFailures: 3},
+	})
+	r := service.NewRequestSvc("http://test", h, cb)
+
+	for i := 0; i < 3; i++ {
+		statusCode, err := r.Post(context.Background(), "/status", "body")
+		testhelper.Ok(t, err)
+		testhelper.Assert(t, statusCode == 500, "expected the 500 to be returned, got %d", statusCode)
+	}
+	_, err := r.Post(context.Background(), "/status", "body")
+	testhelper.Assert(t, errors.Is(err, gobreaker.ErrOpenState), "expected an open breaker, got %v", err)
+	testhelper.Assert(t, calls == 3, "expected the open breaker to stop calls, got %d", calls)
+	testhelper.Assert(t, cb.State() == gobreaker.StateOpen, "expected the breaker to be open")
+}
+
+func testCustomFailureStatuses(t *testing.T, h *mock.HttpClient) {
+	calls := 0
+	respondWith(h, 429, &calls)
+	cb := service.NewCircuitBreaker(service.BreakerSettings{Trip: service.TripPolicy{ConsecutiveFailures: 10}})
+	ranges, err := service.ParseStatusRanges("429,500-599")
+	testhelper.Ok(t, err)
+	r := service.NewRequestSvc("http://test", h, cb, service.WithResponseClassifier(service.ResponseClassifier{FailureStatuses: ranges}))
+
+	_, err = r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, cb.Counts().TotalFailures == 1, "expected 429 to count as a failure")
+
+	respondWith(h, 503, &calls)
+	r = service.NewRequestSvc("http://test", h, cb, service.WithResponseClassifier(service.ResponseClassifier{}))
+	_, err = r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, cb.Counts().TotalSuccesses == 1, "expected 503 to count as a success without failure statuses")
+}
+
+func testIgnoreCancellations(t *testing.T, h *mock.HttpClient) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		return nil, req.Context().Err()
+	}
+	cb := service.NewCircuitBreaker(service.BreakerSettings{Trip: service.TripPolicy{ConsecutiveFailures: 1}})
+	r := service.NewRequestSvc("http://test", h, cb)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.Post(ctx, "/status", "body")
+	testhelper.Assert(t, errors.Is(err, context.Canceled), "expected a cancellation error, got %v", err)
+	testhelper.Assert(t, cb.Counts().TotalFailures == 0, "expected the cancellation not to count as a failure")
+	testhelper.Assert(t, cb.State() == gobreaker.StateClosed, "expected the breaker to stay closed")
+}
+
+func testTripOnSlowCalls(t *testing.T, h *mock.HttpClient) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		time.Sleep(20 * time.Millisecond)
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	cb := service.NewCircuitBreaker(service.BreakerSettings{
+		Timeout: time.Minute,
+		Trip: service.TripPolicy{
+			MinRequests:       2,
+			SlowCallRatio:     0.5,
+			SlowCallThreshold: 5 * time.Millisecond,
+		},
+	})
+	r := service.NewRequestSvc("http://test", h, cb)
+
+	for i := 0; i < 2; i++ {
+		statusCode, err := r.Post(context.Background(), "/status", "body")
+		testhelper.Ok(t, err)
+		testhelper.Assert(t, statusCode == 200, "expected slow calls to still succeed, got %d", statusCode)
+	}
+	testhelper.Assert(t, cb.State() == gobreaker.StateOpen, "expected the slow-call rate to open the breaker")
+}
+
+func testReportStateChanges(t *testing.T, h *mock.HttpClient) {
+	calls := 0
+	respondWith(h, 502, &calls)
+	var transitions []string
+	cb := service.NewCircuitBreaker(service.BreakerSettings{
+		Name:    "test",
+		Timeout: time.Minute,
+		Trip:    service.TripPolicy{ConsecutiveFailures: 1},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			transitions = append(transitions, name+":"+from.String()+"->"+to.String())
+		},
+	})
+	r := service.NewRequestSvc("http://test", h, cb)
+	_, err := r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(transitions) == 1 && transitions[0] == "test:closed->open", "unexpected transitions %v", transitions)
+}
+
+func testParseStatusRanges(t *testing.T, h *mock.HttpClient) {
+	ranges, err := service.ParseStatusRanges(" 408, 500-599 ")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(ranges) == 2, "expected 2 ranges, got %d", len(ranges))
+	testhelper.Assert(t, ranges[0] == service.StatusRange{From: 408, To: 408}, "unexpected range %v", ranges[0])
+	testhelper.Assert(t, ranges[1] == service.StatusRange{From: 500, To: 599}, "unexpected range %v", ranges[1])
+
+	_, err = service.ParseStatusRanges("599-500")
+	testhelper.Assert(t, errors.Is(err, domain.ErrInvalidStatusRange), "expected an invalid range error, got %v", err)
+}
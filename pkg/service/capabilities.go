@@ -0,0 +1,265 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"virtual-orb/pkg/domain"
+)
+
+// RouteCapabilities is where the uniqueness service publishes what it
+// supports. Like the health check, it is never prefixed with an API version,
+// so that it can be reached before one is negotiated.
+const RouteCapabilities = "/capabilities"
+
+var (
+	// unversionedRoutes are the routes sent as is whatever the API version.
+	unversionedRoutes = map[string]bool{
+		RouteCapabilities: true,
+		"/health-check":   true,
+	}
+
+	// apiVersionPattern is the form of an API version, such as v1.
+	apiVersionPattern = regexp.MustCompile(`^v[0-9]+$`)
+
+	// legacyCapabilities is what a uniqueness service publishing no
+	// capabilities is assumed to support: unversioned routes, average
+	// hashes, HMAC-SHA256 signatures and no batches, which is a batch limit
+	// of one.
+	legacyCapabilities = domain.Capabilities{
+		HashAlgorithms:     []string{HashAverage},
+		SignatureSchemes:   []string{SchemeHMACSHA256},
+		MaxStatusBatchSize: 1,
+		MaxSignUpBatchSize: 1,
+	}
+)
+
+// negotiation holds the options in use with the uniqueness service, which
+// change when they are renegotiated, such as after starting with those of a
+// legacy service because the service could not be asked.
+type negotiation struct {
+	mu      sync.RWMutex
+	current domain.Negotiated
+}
+
+// NewNegotiation creates a holder of the options in use with the
+// uniqueness service.
+//
+// initial: The options to start with.
+//
+// Returns a pointer to the negotiation.
+func NewNegotiation(initial domain.Negotiated) *negotiation {
+	return &negotiation{current: initial}
+}
+
+// Current returns the options in use.
+func (n *negotiation) Current() domain.Negotiated {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.current
+}
+
+// Update replaces the options in use, such as once they are renegotiated.
+//
+// negotiated: The options to use from now on.
+func (n *negotiation) Update(negotiated domain.Negotiated) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.current = negotiated
+}
+
+// DefaultNegotiated returns the options used when none are negotiated,
+// which are those of a service that predates capability negotiation.
+func DefaultNegotiated() domain.Negotiated {
+	return domain.Negotiated{HashAlgorithm: DefaultHash, SignatureScheme: DefaultScheme}
+}
+
+// LegacyNegotiated returns the options used with a uniqueness service that
+// could not be asked what it supports, which are those of a service that
+// predates capability negotiation and so takes no batches.
+func LegacyNegotiated() domain.Negotiated {
+	negotiated := DefaultNegotiated()
+	negotiated.MaxStatusBatchSize = legacyCapabilities.MaxStatusBatchSize
+	negotiated.MaxSignUpBatchSize = legacyCapabilities.MaxSignUpBatchSize
+	negotiated.Legacy = true
+	return negotiated
+}
+
+// WithAPIVersion prefixes the routes with an API version, such as /v1/status
+// for /status. Routes keep their unprefixed name everywhere else, such as in
+// retry policies, breakers and rate limits.
+//
+// version: The negotiated API version, or empty for unversioned routes.
+func WithAPIVersion(version string) RequestOption {
+	return func(r *request) {
+		r.apiVersion = version
+	}
+}
+
+// WithNegotiatedAPIVersion prefixes the routes with the API version in use,
+// as WithAPIVersion does, following it when it is renegotiated.
+//
+// negotiation: Holder of the options in use.
+func WithNegotiatedAPIVersion(negotiation *negotiation) RequestOption {
+	return func(r *request) {
+		r.negotiation = negotiation
+	}
+}
+
+// versionedRoute returns the path a route is sent to under an API version.
+func versionedRoute(version, route string) string {
+	if version == "" || unversionedRoutes[route] {
+		return route
+	}
+	return "/" + version + route
+}
+
+// ValidateCapabilities checks what the orb supports, as read from its
+// configuration. Each list must hold at least one item, and hash algorithms
+// and signature schemes must be ones the orb implements.
+//
+// supported: The orb's capabilities, most preferred first.
+//
+// Returns domain.ErrInvalidCapability naming the first offending item, if any.
+func ValidateCapabilities(supported domain.Capabilities) error {
+	lists := []struct {
+		name  string
+		items []string
+		valid func(string) bool
+	}{
+		{"API version", supported.APIVersions, apiVersionPattern.MatchString},
+		{"hash algorithm", supported.HashAlgorithms, func(item string) bool {
+			return item == HashAverage || item == HashDifference || item == HashPerception
+		}},
+		{"signature scheme", supported.SignatureSchemes, func(item string) bool {
+			_, err := schemeHash(item)
+			return err == nil
+		}},
+	}
+	for _, list := range lists {
+		if len(list.items) == 0 {
+			return fmt.Errorf("ValidateCapabilities: %w: no %s", domain.ErrInvalidCapability, list.name)
+		}
+		for _, item := range list.items {
+			if !list.valid(item) {
+				return fmt.Errorf("ValidateCapabilities: %w: %s %q", domain.ErrInvalidCapability, list.name, item)
+			}
+		}
+	}
+	if supported.MaxStatusBatchSize < 0 || supported.MaxSignUpBatchSize < 0 {
+		return fmt.Errorf("ValidateCapabilities: %w: negative batch size", domain.ErrInvalidCapability)
+	}
+	return nil
+}
+
+// FetchCapabilities asks the uniqueness service what it supports.
+//
+// ctx: Context bounding the request.
+// requestSvc: Service the request is sent with.
+//
+// Returns the capabilities of the service, nil if it answered 404 and so
+// predates capability negotiation, or domain.ErrFetchCapabilities.
+func FetchCapabilities(ctx context.Context, requestSvc domain.RequestSvc) (*domain.Capabilities, error) {
+	var offered domain.Capabilities
+	statusCode, err := requestSvc.Do(ctx, &domain.Request{Method: http.MethodGet, Route: RouteCapabilities}, &offered)
+	if statusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FetchCapabilities: %w: %w", domain.ErrFetchCapabilities, err)
+	}
+	if statusCode < 200 || statusCode > 299 {
+		return nil, fmt.Errorf("FetchCapabilities: %w: answered %d", domain.ErrFetchCapabilities, statusCode)
+	}
+	return &offered, nil
+}
+
+// Negotiate picks, for each capability, the one the orb prefers among those
+// the uniqueness service supports, and the smaller of both batch limits. A
+// service that predates negotiation takes no batches, so its limits are one.
+//
+// supported: The orb's capabilities, most preferred first.
+// offered: The capabilities of the service, or nil for a service that
+// predates capability negotiation, which is sent unversioned routes.
+//
+// Returns the negotiated options, or domain.ErrNoCommonCapability naming
+// the capability both sides have nothing in common for.
+func Negotiate(supported domain.Capabilities, offered *domain.Capabilities) (domain.Negotiated, error) {
+	negotiated := domain.Negotiated{
+		MaxStatusBatchSize: supported.MaxStatusBatchSize,
+		MaxSignUpBatchSize: supported.MaxSignUpBatchSize,
+	}
+	if offered == nil {
+		negotiated.Legacy = true
+		offered = &legacyCapabilities
+	} else {
+		version, ok := pick(supported.APIVersions, offered.APIVersions)
+		if !ok {
+			return negotiated, noOverlap("API version", supported.APIVersions, offered.APIVersions)
+		}
+		negotiated.APIVersion = version
+	}
+
+	var ok bool
+	if negotiated.HashAlgorithm, ok = pick(supported.HashAlgorithms, offered.HashAlgorithms); !ok {
+		return negotiated, noOverlap("hash algorithm", supported.HashAlgorithms, offered.HashAlgorithms)
+	}
+	if negotiated.SignatureScheme, ok = pick(supported.SignatureSchemes, offered.SignatureSchemes); !ok {
+		return negotiated, noOverlap("signature scheme", supported.SignatureSchemes, offered.SignatureSchemes)
+	}
+	negotiated.MaxStatusBatchSize = smallerLimit(supported.MaxStatusBatchSize, offered.MaxStatusBatchSize)
+	negotiated.MaxSignUpBatchSize = smallerLimit(supported.MaxSignUpBatchSize, offered.MaxSignUpBatchSize)
+	return negotiated, nil
+}
+
+// NegotiateCapabilities fetches the capabilities of the uniqueness service
+// and negotiates them against the orb's.
+//
+// ctx: Context bounding the request.
+// requestSvc: Service the request is sent with; it must not sign requests
+// with a scheme that is yet to be negotiated.
+// supported: The orb's capabilities, most preferred first.
+//
+// Returns the negotiated options, or an error if the orb's capabilities are
+// invalid, the service could not be asked, or there is no overlap.
+func NegotiateCapabilities(ctx context.Context, requestSvc domain.RequestSvc, supported domain.Capabilities) (domain.Negotiated, error) {
+	if err := ValidateCapabilities(supported); err != nil {
+		return domain.Negotiated{}, fmt.Errorf("NegotiateCapabilities: %w", err)
+	}
+	offered, err := FetchCapabilities(ctx, requestSvc)
+	if err != nil {
+		return domain.Negotiated{}, fmt.Errorf("NegotiateCapabilities: %w", err)
+	}
+	negotiated, err := Negotiate(supported, offered)
+	if err != nil {
+		return negotiated, fmt.Errorf("NegotiateCapabilities: %w", err)
+	}
+	return negotiated, nil
+}
+
+// pick returns the first preferred item that is also offered.
+func pick(preferred, offered []string) (string, bool) {
+	for _, p := range preferred {
+		for _, o := range offered {
+			if p == o {
+				return p, true
+			}
+		}
+	}
+	return "", false
+}
+
+// smallerLimit returns the smaller of two limits, zero standing for none.
+func smallerLimit(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// noOverlap reports a capability both sides have nothing in common for.
+func noOverlap(name string, supported, offered []string) error {
+	return fmt.Errorf("Negotiate: %w: %s: orb supports %v, service supports %v", domain.ErrNoCommonCapability, name, supported, offered)
+}
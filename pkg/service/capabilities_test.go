@@ -0,0 +1,190 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.UniquenessService, *httptest.Server)
+	}{
+		{"should pick the preferred options both sides support", testNegotiatePreferred},
+		{"should keep the smaller batch limits", testNegotiateBatchLimits},
+		{"should fall back to legacy options without capabilities", testNegotiateLegacy},
+		{"should fail when there is no common option", testNegotiateNoOverlap},
+		{"should reject invalid orb capabilities", testInvalidCapabilities},
+		{"should fail when the capabilities cannot be fetched", testFetchCapabilitiesFails},
+		{"should prefix routes with the negotiated version", testVersionedRoutes},
+		{"should sign with the negotiated scheme", testNegotiatedScheme},
+		{"should follow renegotiated options", testRenegotiatedOptions},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			backend := &mock.UniquenessService{Capabilities: &domain.Capabilities{
+				APIVersions:      []string{"v1", "v2"},
+				HashAlgorithms:   []string{service.HashAverage, service.HashDifference},
+				SignatureSchemes: []string{service.SchemeHMACSHA256, service.SchemeHMACSHA512},
+			}}
+			server := httptest.NewServer(backend)
+			defer server.Close()
+			test.function(t, backend, server)
+		})
+	}
+}
+
+// orbCapabilities returns what the orb supports by default.
+func orbCapabilities() domain.Capabilities {
+	return domain.Capabilities{
+		APIVersions:      []string{"v1"},
+		HashAlgorithms:   []string{service.HashPerception, service.HashDifference, service.HashAverage},
+		SignatureSchemes: []string{service.SchemeHMACSHA512, service.SchemeHMACSHA256},
+	}
+}
+
+func testNegotiatePreferred(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	requestSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+	negotiated, err := service.NegotiateCapabilities(context.Background(), requestSvc, orbCapabilities())
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, negotiated == domain.Negotiated{
+		APIVersion:      "v1",
+		HashAlgorithm:   service.HashDifference,
+		SignatureScheme: service.SchemeHMACSHA512,
+	}, "unexpected options %+v", negotiated)
+	testhelper.Assert(t, backend.Count(service.RouteCapabilities) == 1, "expected the capabilities to be fetched")
+}
+
+func testNegotiateBatchLimits(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	supported := orbCapabilities()
+	supported.MaxStatusBatchSize = 100
+	offered := *backend.Capabilities
+	offered.MaxStatusBatchSize = 50
+	offered.MaxSignUpBatchSize = 20
+
+	negotiated, err := service.Negotiate(supported, &offered)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, negotiated.MaxStatusBatchSize == 50 && negotiated.MaxSignUpBatchSize == 20,
+		"expected the smaller limits, got %+v", negotiated)
+}
+
+func testNegotiateLegacy(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	backend.Capabilities = nil
+	requestSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+	negotiated, err := service.NegotiateCapabilities(context.Background(), requestSvc, orbCapabilities())
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, negotiated == domain.Negotiated{
+		HashAlgorithm:      service.HashAverage,
+		SignatureScheme:    service.SchemeHMACSHA256,
+		MaxStatusBatchSize: 1,
+		MaxSignUpBatchSize: 1,
+		Legacy:             true,
+	}, "expected legacy options, got %+v", negotiated)
+	testhelper.Assert(t, negotiated == service.LegacyNegotiated(), "expected the options used when the service cannot be asked")
+
+	supported := orbCapabilities()
+	supported.HashAlgorithms = []string{service.HashPerception}
+	_, err = service.NegotiateCapabilities(context.Background(), requestSvc, supported)
+	testhelper.Assert(t, errors.Is(err, domain.ErrNoCommonCapability), "expected no legacy hash in common, got %v", err)
+}
+
+func testNegotiateNoOverlap(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	supported := orbCapabilities()
+	supported.APIVersions = []string{"v3"}
+	_, err := service.Negotiate(supported, backend.Capabilities)
+	testhelper.Assert(t, errors.Is(err, domain.ErrNoCommonCapability), "expected no common version, got %v", err)
+	testhelper.Assert(t, strings.Contains(err.Error(), "API version"), "expected the error to name the capability, got %v", err)
+
+	supported = orbCapabilities()
+	supported.SignatureSchemes = []string{service.SchemeHMACSHA512}
+	offered := *backend.Capabilities
+	offered.SignatureSchemes = []string{"ed25519"}
+	_, err = service.Negotiate(supported, &offered)
+	testhelper.Assert(t, errors.Is(err, domain.ErrNoCommonCapability) && strings.Contains(err.Error(), "signature scheme"),
+		"expected no common signature scheme, got %v", err)
+}
+
+func testInvalidCapabilities(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	invalid := []func(*domain.Capabilities){
+		func(c *domain.Capabilities) { c.APIVersions = nil },
+		func(c *domain.Capabilities) { c.APIVersions = []string{"1"} },
+		func(c *domain.Capabilities) { c.HashAlgorithms = []string{"md5"} },
+		func(c *domain.Capabilities) { c.SignatureSchemes = []string{"hmac-md5"} },
+		func(c *domain.Capabilities) { c.MaxSignUpBatchSize = -1 },
+	}
+	for i, change := range invalid {
+		supported := orbCapabilities()
+		change(&supported)
+		err := service.ValidateCapabilities(supported)
+		testhelper.Assert(t, errors.Is(err, domain.ErrInvalidCapability), "expected case %d to be invalid, got %v", i, err)
+	}
+	testhelper.Ok(t, service.ValidateCapabilities(orbCapabilities()))
+}
+
+func testFetchCapabilitiesFails(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	backend.SetDown(true)
+	requestSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+	_, err := service.NegotiateCapabilities(context.Background(), requestSvc, orbCapabilities())
+	testhelper.Assert(t, errors.Is(err, domain.ErrFetchCapabilities), "expected the fetch to fail, got %v", err)
+}
+
+func testVersionedRoutes(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	cb := service.NewCircuitBreaker(service.BreakerSettings{})
+	unversioned := service.NewRequestSvc(server.URL, server.Client(), cb)
+	statusCode, err := unversioned.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusNotFound, "expected unprefixed routes to be refused, got %d", statusCode)
+
+	versioned := service.NewRequestSvc(server.URL, server.Client(), cb, service.WithAPIVersion("v2"))
+	statusCode, err = versioned.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK && backend.Count("/status") == 1, "expected the status under /v2, got %d", statusCode)
+
+	health := service.NewHealthMonitor(versioned, service.HealthConfig{})
+	testhelper.Ok(t, health.Check(context.Background()))
+}
+
+func testNegotiatedScheme(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	backend.SignKey = "test-key"
+	backend.MaxSkew = time.Minute
+	signer := service.NewRequestSigner("1", "test-key", server.Client(), service.WithScheme(service.SchemeHMACSHA512))
+	requestSvc := service.NewRequestSvc(server.URL, signer, service.NewCircuitBreaker(service.BreakerSettings{}), service.WithAPIVersion("v1"))
+
+	statusCode, err := requestSvc.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected the HMAC-SHA512 signature to be accepted, got %d", statusCode)
+	header := backend.LastHeader("/status")
+	testhelper.Assert(t, header.Get(service.HeaderScheme) == service.SchemeHMACSHA512 && len(header.Get(service.HeaderSignature)) == 128,
+		"expected an HMAC-SHA512 signature, got %v", header)
+}
+
+func testRenegotiatedOptions(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	backend.SignKey = "test-key"
+	backend.MaxSkew = time.Minute
+	negotiation := service.NewNegotiation(service.LegacyNegotiated())
+	signer := service.NewRequestSigner("1", "test-key", server.Client(), service.WithNegotiatedScheme(negotiation))
+	requestSvc := service.NewRequestSvc(server.URL, signer, service.NewCircuitBreaker(service.BreakerSettings{}), service.WithNegotiatedAPIVersion(negotiation))
+
+	statusCode, err := requestSvc.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusNotFound, "expected legacy routes to be refused, got %d", statusCode)
+
+	negotiated, err := service.NegotiateCapabilities(context.Background(), requestSvc, orbCapabilities())
+	testhelper.Ok(t, err)
+	negotiation.Update(negotiated)
+	statusCode, err = requestSvc.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected the renegotiated options to be accepted, got %d", statusCode)
+	testhelper.Assert(t, backend.LastHeader("/status").Get(service.HeaderScheme) == service.SchemeHMACSHA512,
+		"expected the renegotiated scheme, got %v", backend.LastHeader("/status"))
+}
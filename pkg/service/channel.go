@@ -0,0 +1,363 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+
+	"github.com/gorilla/websocket"
+)
+
+type (
+	// ChannelConfig holds the settings of the WebSocket channel to the
+	// uniqueness service.
+	ChannelConfig struct {
+		URL                string        // WebSocket URL of the channel, such as ws://host:8001/channel.
+		Routes             []string      // Routes sent over the channel while it is up; others always use HTTP.
+		HeartbeatInterval  time.Duration // Interval between pings; zero disables them.
+		HeartbeatTimeout   time.Duration // Silence, pongs included, after which the connection is deemed dead; zero waits forever.
+		HandshakeTimeout   time.Duration // Limit for the opening handshake.
+		ReconnectBaseDelay time.Duration // Upper bound of the wait before the first reconnection attempt.
+		ReconnectMaxDelay  time.Duration // Cap on the wait between reconnection attempts.
+	}
+
+	// channel keeps a WebSocket connection open to the uniqueness service,
+	// over which requests to some routes are sent as frames and the service
+	// pushes messages of its own. While the connection is down, requests
+	// are sent by the fallback request service instead.
+	channel struct {
+		cfg         ChannelConfig
+		routes      map[string]bool
+		fallback    domain.RequestSvc
+		dialer      *websocket.Dialer
+		middlewares []Middleware
+		onPush      func(domain.PushMessage)
+		now         func() time.Time
+
+		mu      sync.Mutex
+		conn    *websocket.Conn
+		closed  chan struct{} // Closed once conn is lost.
+		pending map[string]chan domain.ChannelFrame
+		nextID  uint64
+		writeMu sync.Mutex
+	}
+
+	// ChannelOption configures optional behaviour of the channel.
+	ChannelOption func(*channel)
+)
+
+// NewChannel creates a channel to the uniqueness service. It stays
+// disconnected, every request going to the fallback, until Run is called.
+//
+// cfg: The channel settings.
+// fallback: Request service used for the other routes and while the channel is down.
+// opts: Optional settings such as WithChannelMiddlewares or WithPushHandler.
+//
+// Returns a pointer to the channel, which itself satisfies domain.RequestSvc.
+func NewChannel(cfg ChannelConfig, fallback domain.RequestSvc, opts ...ChannelOption) *channel {
+	c := &channel{
+		cfg:      cfg,
+		routes:   map[string]bool{},
+		fallback: fallback,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: cfg.HandshakeTimeout,
+		},
+		now:     time.Now,
+		pending: map[string]chan domain.ChannelFrame{},
+	}
+	for _, route := range cfg.Routes {
+		c.routes[route] = true
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithChannelMiddlewares passes the opening handshake through client
+// middlewares, such as Identity and Signing, so that the connection is
+// authenticated like any HTTP request. Frames sent over it are not signed
+// again.
+//
+// middlewares: The middlewares, outermost first.
+func WithChannelMiddlewares(middlewares ...Middleware) ChannelOption {
+	return func(c *channel) {
+		c.middlewares = middlewares
+	}
+}
+
+// WithPushHandler handles the messages pushed by the uniqueness service.
+// The handler is called from the goroutine reading the connection, so it
+// must not block.
+//
+// handle: Called with each pushed message.
+func WithPushHandler(handle func(domain.PushMessage)) ChannelOption {
+	return func(c *channel) {
+		c.onPush = handle
+	}
+}
+
+// Run keeps the connection open until ctx is done, reconnecting with
+// exponential backoff and full jitter whenever it fails or is lost. The
+// backoff restarts once a connection has stayed up for ReconnectMaxDelay.
+//
+// ctx: Context whose cancellation closes the connection and stops Run.
+func (c *channel) Run(ctx context.Context) {
+	policy := RetryPolicy{BaseDelay: c.cfg.ReconnectBaseDelay, MaxDelay: c.cfg.ReconnectMaxDelay}
+	attempt := 0
+	for {
+		conn, err := c.dial(ctx)
+		if err == nil {
+			started := c.now()
+			c.serve(ctx, conn)
+			if c.now().Sub(started) >= c.cfg.ReconnectMaxDelay {
+				attempt = 0
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		attempt++
+		if sleep(ctx, backoff(policy, attempt)) != nil {
+			return
+		}
+	}
+}
+
+// Connected reports whether the channel is currently up.
+func (c *channel) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Post sends the body to the route, over the channel when it carries the
+// route and is up.
+//
+// ctx: Context bounding the request.
+// route: The endpoint route.
+// body: The payload of the request.
+//
+// Returns the HTTP status of the response and an error if any.
+func (c *channel) Post(ctx context.Context, route string, body any) (httpStatus int, err error) {
+	return c.Do(ctx, &domain.Request{Method: http.MethodPost, Route: route, Body: body}, nil)
+}
+
+// Do sends the request as a frame over the channel when it carries the
+// route and is up, and waits for the response frame of the same ID. Other
+// requests, and those that could not be written to the connection, go to
+// the fallback. A request whose connection is lost after it was written is
+// not sent again, as it may have been delivered.
+//
+// ctx: Context bounding the request.
+// req: The request to send; its query and headers other than the
+// Idempotency-Key are not carried over the channel.
+// out: Pointer to the value the JSON response body is decoded into, or nil
+// to discard it.
+//
+// Returns the HTTP status of the response and an error if any.
+func (c *channel) Do(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+	if !c.routes[req.Route] {
+		return c.fallback.Do(ctx, req, out)
+	}
+	frame := domain.ChannelFrame{
+		Type:           domain.FrameRequest,
+		Method:         req.Method,
+		Route:          req.Route,
+		IdempotencyKey: req.Header.Get(HeaderIdempotencyKey),
+	}
+	if req.Body != nil {
+		if frame.Body, err = json.Marshal(req.Body); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("Do: %w", domain.ErrMarshallingPayload)
+		}
+	}
+
+	conn, closed, replies := c.register(&frame)
+	if conn == nil {
+		return c.fallback.Do(ctx, req, out)
+	}
+	defer c.unregister(frame.ID)
+	if err := c.write(ctx, conn, frame); err != nil {
+		c.drop(conn)
+		return c.fallback.Do(ctx, req, out)
+	}
+
+	select {
+	case reply := <-replies:
+		if out != nil && len(reply.Body) > 0 {
+			if err := json.Unmarshal(reply.Body, out); err != nil {
+				return reply.Status, fmt.Errorf("Do: %w", domain.ErrDecodingResponse)
+			}
+		}
+		return reply.Status, nil
+	case <-closed:
+		return http.StatusInternalServerError, fmt.Errorf("Do: %w: %w", domain.ErrRequestFailed, domain.ErrChannelClosed)
+	case <-ctx.Done():
+		return http.StatusInternalServerError, fmt.Errorf("Do: %w: %w", domain.ErrRequestFailed, ctx.Err())
+	}
+}
+
+// register gives the frame an ID and waits for its response.
+//
+// frame: The request frame, whose ID is set.
+//
+// Returns the connection to write the frame to, a channel closed once the
+// connection is lost and the channel the response is delivered to, or a nil
+// connection if the channel is down.
+func (c *channel) register(frame *domain.ChannelFrame) (*websocket.Conn, <-chan struct{}, <-chan domain.ChannelFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil, nil, nil
+	}
+	c.nextID++
+	frame.ID = strconv.FormatUint(c.nextID, 10)
+	replies := make(chan domain.ChannelFrame, 1)
+	c.pending[frame.ID] = replies
+	return c.conn, c.closed, replies
+}
+
+// unregister stops waiting for the response to a request.
+func (c *channel) unregister(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// write sends a frame, within the context's deadline or the heartbeat
+// timeout.
+func (c *channel) write(ctx context.Context, conn *websocket.Conn, frame domain.ChannelFrame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok && c.cfg.HeartbeatTimeout > 0 {
+		deadline = c.now().Add(c.cfg.HeartbeatTimeout)
+	}
+	conn.SetWriteDeadline(deadline)
+	return conn.WriteJSON(frame)
+}
+
+// dial opens a connection, with the handshake passed through the
+// middlewares.
+func (c *channel) dial(ctx context.Context) (*websocket.Conn, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The middlewares only decorate the handshake request; the dialer
+	// sends it.
+	var header http.Header
+	capture := ClientFunc(func(req *http.Request) (*http.Response, error) {
+		header = req.Header.Clone()
+		return &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	})
+	if _, err := Chain(capture, c.middlewares...).Do(req); err != nil {
+		return nil, err
+	}
+
+	conn, resp, err := c.dialer.DialContext(ctx, c.cfg.URL, header)
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	return conn, err
+}
+
+// serve reads the connection until it is lost or ctx is done, pinging it
+// every heartbeat interval meanwhile.
+func (c *channel) serve(ctx context.Context, conn *websocket.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	c.closed = make(chan struct{})
+	c.mu.Unlock()
+	defer c.drop(conn)
+
+	alive := func() {
+		if c.cfg.HeartbeatTimeout > 0 {
+			conn.SetReadDeadline(c.now().Add(c.cfg.HeartbeatTimeout))
+		}
+	}
+	alive()
+	conn.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		var ticks <-chan time.Time
+		if c.cfg.HeartbeatInterval > 0 {
+			ticker := time.NewTicker(c.cfg.HeartbeatInterval)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				conn.WriteControl(websocket.CloseMessage, message, c.now().Add(time.Second))
+				conn.Close()
+				return
+			case <-ticks:
+				if err := conn.WriteControl(websocket.PingMessage, nil, c.now().Add(c.cfg.HeartbeatInterval)); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		alive()
+		var frame domain.ChannelFrame
+		if json.Unmarshal(data, &frame) != nil {
+			continue
+		}
+		c.dispatch(frame)
+	}
+}
+
+// dispatch hands a received frame to the request waiting for it or to the
+// push handler.
+func (c *channel) dispatch(frame domain.ChannelFrame) {
+	switch frame.Type {
+	case domain.FrameResponse:
+		c.mu.Lock()
+		replies, ok := c.pending[frame.ID]
+		c.mu.Unlock()
+		if ok {
+			select {
+			case replies <- frame:
+			default:
+			}
+		}
+	case domain.FramePush:
+		if c.onPush != nil {
+			c.onPush(domain.PushMessage{Topic: frame.Topic, Body: frame.Body, ReceivedAt: c.now()})
+		}
+	}
+}
+
+// drop marks the connection as lost, failing the requests waiting on it,
+// and closes it.
+func (c *channel) drop(conn *websocket.Conn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+		close(c.closed)
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
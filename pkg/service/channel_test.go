@@ -0,0 +1,206 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestChannel(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.UniquenessChannel, service.ChannelConfig, *mock.RequestSvc, *int)
+	}{
+		{"should stream statuses over the channel", testStreamStatus},
+		{"should decode responses sent over the channel", testChannelResponse},
+		{"should fall back to HTTP while the channel is down", testFallBackWhileDown},
+		{"should keep other routes on HTTP", testOtherRoutesOnHTTP},
+		{"should deliver pushed messages", testDeliverPush},
+		{"should reconnect after losing the connection", testChannelReconnect},
+		{"should reconnect when heartbeats go unanswered", testHeartbeatTimeout},
+		{"should sign the handshake", testSignedHandshake},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			backend := &mock.UniquenessChannel{Service: &mock.UniquenessService{}}
+			server := httptest.NewServer(backend)
+			defer server.Close()
+			fallbacks := 0
+			fallback := &mock.RequestSvc{
+				DoFunc: func(ctx context.Context, req *domain.Request, out any) (int, error) {
+					fallbacks++
+					return http.StatusOK, nil
+				},
+			}
+			test.function(t, backend, service.ChannelConfig{
+				URL:                "ws" + strings.TrimPrefix(server.URL, "http") + "/channel",
+				Routes:             []string{"/status", "/sign-up"},
+				HeartbeatInterval:  20 * time.Millisecond,
+				HeartbeatTimeout:   100 * time.Millisecond,
+				HandshakeTimeout:   time.Second,
+				ReconnectBaseDelay: 10 * time.Millisecond,
+				ReconnectMaxDelay:  50 * time.Millisecond,
+			}, fallback, &fallbacks)
+		})
+	}
+}
+
+// runChannel runs the channel until the test ends.
+func runChannel(t *testing.T, c interface{ Run(context.Context) }) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// await waits until the condition holds.
+func await(t *testing.T, cond func() bool, format string, args ...any) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testStreamStatus(t *testing.T, backend *mock.UniquenessChannel, cfg service.ChannelConfig, fallback *mock.RequestSvc, fallbacks *int) {
+	c := service.NewChannel(cfg, fallback)
+	runChannel(t, c)
+	await(t, c.Connected, "expected the channel to connect")
+
+	for i := 0; i < 3; i++ {
+		statusCode, err := c.Post(context.Background(), "/status", domain.Status{Battery: 50})
+		testhelper.Ok(t, err)
+		testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	}
+	testhelper.Assert(t, backend.Service.Count("/status") == 3, "expected 3 statuses, got %d", backend.Service.Count("/status"))
+	testhelper.Assert(t, *fallbacks == 0, "expected no request over HTTP, got %d", *fallbacks)
+}
+
+func testChannelResponse(t *testing.T, backend *mock.UniquenessChannel, cfg service.ChannelConfig, fallback *mock.RequestSvc, fallbacks *int) {
+	c := service.NewChannel(cfg, fallback)
+	runChannel(t, c)
+	await(t, c.Connected, "expected the channel to connect")
+
+	send := func(id string) (int, domain.SignUpResponse) {
+		var response domain.SignUpResponse
+		statusCode, err := c.Do(context.Background(), &domain.Request{
+			Method: http.MethodPost,
+			Route:  "/sign-up",
+			Header: http.Header{service.HeaderIdempotencyKey: []string{id}},
+			Body:   domain.Iris{Id: id, IrisCode: "code"},
+		}, &response)
+		testhelper.Ok(t, err)
+		return statusCode, response
+	}
+	statusCode, _ := send("1")
+	testhelper.Assert(t, statusCode == http.StatusCreated, "expected 201, got %d", statusCode)
+	statusCode, _ = send("1")
+	testhelper.Assert(t, statusCode == http.StatusCreated, "expected the idempotency key to be honoured, got %d", statusCode)
+	statusCode, response := send("2")
+	testhelper.Assert(t, statusCode == http.StatusConflict && response.MatchID == "1", "expected a duplicate of 1, got %d %+v", statusCode, response)
+}
+
+func testFallBackWhileDown(t *testing.T, backend *mock.UniquenessChannel, cfg service.ChannelConfig, fallback *mock.RequestSvc, fallbacks *int) {
+	cfg.URL = "ws://127.0.0.1:1/channel"
+	c := service.NewChannel(cfg, fallback)
+	runChannel(t, c)
+
+	statusCode, err := c.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK && *fallbacks == 1, "expected the status to go over HTTP, got %d", statusCode)
+	testhelper.Assert(t, !c.Connected(), "expected the channel to be down")
+}
+
+func testOtherRoutesOnHTTP(t *testing.T, backend *mock.UniquenessChannel, cfg service.ChannelConfig, fallback *mock.RequestSvc, fallbacks *int) {
+	c := service.NewChannel(cfg, fallback)
+	runChannel(t, c)
+	await(t, c.Connected, "expected the channel to connect")
+
+	_, err := c.Post(context.Background(), "/status/batch", domain.StatusBatch{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, *fallbacks == 1, "expected the batch to go over HTTP")
+	testhelper.Assert(t, backend.Service.Count("/status/batch") == 0, "expected no batch over the channel")
+}
+
+func testDeliverPush(t *testing.T, backend *mock.UniquenessChannel, cfg service.ChannelConfig, fallback *mock.RequestSvc, fallbacks *int) {
+	var mu sync.Mutex
+	var pushed []domain.PushMessage
+	c := service.NewChannel(cfg, fallback, service.WithPushHandler(func(message domain.PushMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		pushed = append(pushed, message)
+	}))
+	runChannel(t, c)
+	await(t, c.Connected, "expected the channel to connect")
+
+	sent, err := backend.Push("config", map[string]int{"statusInterval": 10})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, sent == 1, "expected one orb to be connected, got %d", sent)
+	await(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(pushed) == 1
+	}, "expected the message to be delivered")
+	testhelper.Assert(t, pushed[0].Topic == "config" && string(pushed[0].Body) == `{"statusInterval":10}`, "unexpected message %+v", pushed[0])
+}
+
+func testChannelReconnect(t *testing.T, backend *mock.UniquenessChannel, cfg service.ChannelConfig, fallback *mock.RequestSvc, fallbacks *int) {
+	cfg.HeartbeatInterval = 0
+	cfg.HeartbeatTimeout = 0
+	c := service.NewChannel(cfg, fallback)
+	runChannel(t, c)
+	await(t, c.Connected, "expected the channel to connect")
+
+	backend.DropConnections()
+	await(t, func() bool { return backend.Connects() == 2 && c.Connected() }, "expected the channel to reconnect, got %d connections", backend.Connects())
+	statusCode, err := c.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK && backend.Service.Count("/status") == 1, "expected the status over the new connection")
+}
+
+func testHeartbeatTimeout(t *testing.T, backend *mock.UniquenessChannel, cfg service.ChannelConfig, fallback *mock.RequestSvc, fallbacks *int) {
+	backend.IgnorePings = true
+	c := service.NewChannel(cfg, fallback)
+	runChannel(t, c)
+
+	await(t, func() bool { return backend.Connects() >= 2 }, "expected the silent connection to be replaced, got %d connections", backend.Connects())
+}
+
+func testSignedHandshake(t *testing.T, backend *mock.UniquenessChannel, cfg service.ChannelConfig, fallback *mock.RequestSvc, fallbacks *int) {
+	backend.SignKey = "test-key"
+	backend.MaxSkew = time.Minute
+
+	unsigned := service.NewChannel(cfg, fallback)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	unsigned.Run(ctx)
+	testhelper.Assert(t, backend.Connects() == 0, "expected unsigned handshakes to be refused")
+
+	signed := service.NewChannel(cfg, fallback, service.WithChannelMiddlewares(
+		service.Identity("virtual-orb/test", "1"),
+		service.Signing("1", "test-key"),
+	))
+	runChannel(t, signed)
+	await(t, signed.Connected, "expected the signed handshake to be accepted")
+
+	statusCode, err := signed.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK && *fallbacks == 0, "expected the status over the channel, got %d", statusCode)
+}
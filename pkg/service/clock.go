@@ -0,0 +1,179 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+// dateResolution is the precision of the Date header, which is truncated
+// to the second.
+const dateResolution = time.Second
+
+type (
+	// ClockConfig holds how the skew of the orb clock is estimated and
+	// bounded.
+	ClockConfig struct {
+		MaxSkew time.Duration // Largest skew tolerated either way; zero for no bound.
+		Window  int           // Number of recent samples the estimate is taken from; at least 1.
+	}
+
+	// clockSample is one reading of the uniqueness service's clock.
+	clockSample struct {
+		offset time.Duration
+		rtt    time.Duration
+		at     time.Time
+	}
+
+	// clockMonitor estimates the skew of the orb clock from the time the
+	// uniqueness service reports in its responses. Each sample is corrected
+	// for the round trip by assuming the service read its clock halfway
+	// through it. As a long round trip is likely to be lopsided, the
+	// estimate is taken from the sample with the shortest round trip among
+	// the recent ones.
+	clockMonitor struct {
+		cfg ClockConfig
+
+		mu       sync.Mutex
+		samples  []clockSample
+		next     int
+		taken    int
+		estimate clockSample
+	}
+
+	// skewReporting adds the clock skew to the system information.
+	skewReporting struct {
+		systemInfo domain.SystemInfo
+		clock      *clockMonitor
+	}
+)
+
+// NewClockMonitor creates a clock monitor. The skew is unknown until the
+// first sample.
+//
+// cfg: Estimation settings.
+//
+// Returns a pointer to the clock monitor.
+func NewClockMonitor(cfg ClockConfig) *clockMonitor {
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+	return &clockMonitor{cfg: cfg, samples: make([]clockSample, 0, cfg.Window)}
+}
+
+// WithClockMonitor samples the clock of the uniqueness service from the
+// Date header of every response.
+//
+// clock: The monitor fed with the samples.
+func WithClockMonitor(clock *clockMonitor) RequestOption {
+	return func(r *request) {
+		r.clock = clock
+	}
+}
+
+// ObserveDate takes a sample from the Date header of a response. As the
+// header is truncated to the second, the service is assumed to have read
+// its clock half a second past it. Missing or malformed headers are ignored.
+//
+// sent: When the request was sent, by the orb clock.
+// received: When the response was received, by the orb clock.
+// date: The Date header of the response.
+func (c *clockMonitor) ObserveDate(sent, received time.Time, date string) {
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	c.Observe(sent, received, serverTime.Add(dateResolution/2))
+}
+
+// Observe takes a sample of the service's clock.
+//
+// sent: When the request was sent, by the orb clock.
+// received: When the response was received, by the orb clock.
+// serverTime: The time the service reported, by its own clock.
+func (c *clockMonitor) Observe(sent, received, serverTime time.Time) {
+	rtt := received.Sub(sent)
+	if rtt < 0 {
+		return
+	}
+	sample := clockSample{offset: sent.Add(rtt / 2).Sub(serverTime), rtt: rtt, at: received}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) < c.cfg.Window {
+		c.samples = append(c.samples, sample)
+	} else {
+		c.samples[c.next] = sample
+	}
+	c.next = (c.next + 1) % c.cfg.Window
+	c.taken++
+	c.estimate = c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.rtt < c.estimate.rtt {
+			c.estimate = s
+		}
+	}
+}
+
+// Skew returns the estimated skew of the orb clock, positive when it is
+// ahead of the service's.
+//
+// Returns the skew, and whether it is known yet.
+func (c *clockMonitor) Skew() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.estimate.offset, c.taken > 0
+}
+
+// Check tells whether the orb clock can be trusted, that is unless its skew
+// is known to exceed MaxSkew.
+//
+// Returns domain.ErrClockSkewed with the skew if it exceeds the bound.
+func (c *clockMonitor) Check() error {
+	skew, known := c.Skew()
+	if !known || c.cfg.MaxSkew <= 0 {
+		return nil
+	}
+	if skew > c.cfg.MaxSkew || skew < -c.cfg.MaxSkew {
+		return fmt.Errorf("Check: %w: %v off, more than %v", domain.ErrClockSkewed, skew.Round(time.Millisecond), c.cfg.MaxSkew)
+	}
+	return nil
+}
+
+// Snapshot returns the current estimate of the skew.
+func (c *clockMonitor) Snapshot() domain.ClockSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := domain.ClockSnapshot{
+		Skew:    c.estimate.offset,
+		RTT:     c.estimate.rtt,
+		Samples: c.taken,
+	}
+	if c.taken > 0 {
+		snapshot.UpdatedAt = c.samples[(c.next+c.cfg.Window-1)%c.cfg.Window].at
+	}
+	return snapshot
+}
+
+// ReportClockSkew adds the estimated clock skew to the system information,
+// so that it is part of every status report.
+//
+// systemInfo: Source of the rest of the system information.
+// clock: The monitor estimating the skew.
+//
+// Returns system information carrying the skew once it is known.
+func ReportClockSkew(systemInfo domain.SystemInfo, clock *clockMonitor) domain.SystemInfo {
+	return &skewReporting{systemInfo, clock}
+}
+
+// GetSystemInfo returns the system information with the clock skew, in
+// milliseconds.
+func (s *skewReporting) GetSystemInfo() *domain.Status {
+	status := *s.systemInfo.GetSystemInfo()
+	if skew, known := s.clock.Skew(); known {
+		status.ClockSkew = float32(skew) / float32(time.Millisecond)
+	}
+	return &status
+}
@@ -0,0 +1,144 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+func TestClockMonitor(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.UniquenessService, *httptest.Server)
+	}{
+		{"should estimate no skew against an accurate service", testNoSkew},
+		{"should detect an orb clock behind the service", testOrbBehind},
+		{"should trust the sample with the shortest round trip", testShortestRoundTrip},
+		{"should ignore responses without a valid date", testIgnoreInvalidDate},
+		{"should block sign-ups beyond the bound", testBlockSkewedSignUp},
+		{"should allow sign-ups while the skew is unknown", testAllowUnknownSkew},
+		{"should report the skew in status reports", testReportSkew},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			backend := &mock.UniquenessService{}
+			server := httptest.NewServer(backend)
+			defer server.Close()
+			test.function(t, backend, server)
+		})
+	}
+}
+
+// sampleClock sends a status so that the monitor samples the service's clock.
+func sampleClock(t *testing.T, server *httptest.Server, clock service.RequestOption) {
+	requestSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}), clock)
+	_, err := requestSvc.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+}
+
+func testNoSkew(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	clock := service.NewClockMonitor(service.ClockConfig{MaxSkew: 5 * time.Second})
+	_, known := clock.Skew()
+	testhelper.Assert(t, !known, "expected the skew to be unknown before any response")
+
+	sampleClock(t, server, service.WithClockMonitor(clock))
+	skew, known := clock.Skew()
+	testhelper.Assert(t, known && skew.Abs() <= time.Second, "expected no skew beyond the Date resolution, got %v", skew)
+	testhelper.Ok(t, clock.Check())
+}
+
+func testOrbBehind(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	backend.ClockOffset = time.Minute
+	clock := service.NewClockMonitor(service.ClockConfig{MaxSkew: 5 * time.Second})
+	sampleClock(t, server, service.WithClockMonitor(clock))
+
+	skew, _ := clock.Skew()
+	testhelper.Assert(t, (skew+time.Minute).Abs() <= time.Second, "expected the orb a minute behind, got %v", skew)
+	snapshot := clock.Snapshot()
+	testhelper.Assert(t, snapshot.Samples == 1 && !snapshot.UpdatedAt.IsZero(), "unexpected snapshot %+v", snapshot)
+	err := clock.Check()
+	testhelper.Assert(t, errors.Is(err, domain.ErrClockSkewed), "expected the skew to exceed the bound, got %v", err)
+}
+
+func testShortestRoundTrip(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	clock := service.NewClockMonitor(service.ClockConfig{Window: 2})
+	start := time.Now()
+	// The service read its clock early in a slow round trip: the midpoint is off by 4s.
+	clock.Observe(start, start.Add(10*time.Second), start.Add(time.Second))
+	// A fast round trip seeing the orb 2s ahead.
+	clock.Observe(start, start.Add(100*time.Millisecond), start.Add(50*time.Millisecond-2*time.Second))
+	skew, _ := clock.Skew()
+	testhelper.Assert(t, skew == 2*time.Second, "expected the fast sample to win, got %v", skew)
+	testhelper.Assert(t, clock.Snapshot().RTT == 100*time.Millisecond, "expected the round trip of the fast sample")
+
+	// Once out of the window, even a fast sample stops counting.
+	clock.Observe(start, start.Add(time.Second), start.Add(500*time.Millisecond))
+	clock.Observe(start, start.Add(time.Second), start.Add(500*time.Millisecond))
+	skew, _ = clock.Skew()
+	testhelper.Assert(t, skew == 0, "expected the old sample to be forgotten, got %v", skew)
+}
+
+func testIgnoreInvalidDate(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	clock := service.NewClockMonitor(service.ClockConfig{})
+	now := time.Now()
+	clock.ObserveDate(now, now, "")
+	clock.ObserveDate(now, now, "yesterday")
+	_, known := clock.Skew()
+	testhelper.Assert(t, !known, "expected no sample from invalid dates")
+}
+
+func testBlockSkewedSignUp(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	backend.ClockOffset = -time.Hour
+	clock := service.NewClockMonitor(service.ClockConfig{MaxSkew: time.Minute})
+	requestSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}), service.WithClockMonitor(clock))
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{})
+	testhelper.Ok(t, health.Check(context.Background()))
+
+	node, _ := snowflake.NewNode(1)
+	signUp := service.NewSignUpSvc("test-key", node, requestSvc, service.WithSignUpClock(clock))
+	img, _ := platform.GenerateRandomImageData()
+	result, err := signUp.SignUp(context.Background(), img)
+	testhelper.Assert(t, result == nil && errors.Is(err, domain.ErrClockSkewed), "expected the sign-up to be blocked, got %+v %v", result, err)
+	testhelper.Assert(t, backend.Count("/sign-up") == 0, "expected no sign-up to reach the service")
+}
+
+func testAllowUnknownSkew(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	clock := service.NewClockMonitor(service.ClockConfig{MaxSkew: time.Nanosecond})
+	requestSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+
+	node, _ := snowflake.NewNode(1)
+	signUp := service.NewSignUpSvc("test-key", node, requestSvc, service.WithSignUpClock(clock))
+	img, _ := platform.GenerateRandomImageData()
+	result, err := signUp.SignUp(context.Background(), img)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, result.Outcome == domain.SignUpRegistered, "expected the sign-up to go through, got %s", result.Outcome)
+}
+
+func testReportSkew(t *testing.T, backend *mock.UniquenessService, server *httptest.Server) {
+	backend.ClockOffset = -30 * time.Second
+	clock := service.NewClockMonitor(service.ClockConfig{})
+	systemInfo := service.ReportClockSkew(&mock.SystemInfo{GetSystemInfoFunc: func() *domain.Status {
+		return &domain.Status{Battery: 50}
+	}}, clock)
+	testhelper.Assert(t, systemInfo.GetSystemInfo().ClockSkew == 0, "expected no skew while unknown")
+
+	var sent *domain.Status
+	requestSvc := &mock.RequestSvc{PostFunc: func(ctx context.Context, route string, body any) (int, error) {
+		sent = body.(*domain.Status)
+		return 200, nil
+	}}
+	sampleClock(t, server, service.WithClockMonitor(clock))
+	testhelper.Ok(t, service.NewStatusSvc(requestSvc, systemInfo).Report(context.Background()))
+	testhelper.Assert(t, sent.Battery == 50 && sent.ClockSkew >= 29000 && sent.ClockSkew <= 31000,
+		"expected the orb 30s ahead, got %+v", sent)
+}
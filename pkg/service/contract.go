@@ -0,0 +1,248 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+type (
+	// Schema describes the JSON values a payload may hold, after the
+	// vocabulary of JSON Schema.
+	Schema struct {
+		Type       string             // object, array, string, number, integer or boolean.
+		Properties map[string]*Schema // Schemas of the known properties of an object.
+		Required   []string           // Properties an object must hold.
+		Closed     bool               // Whether an object may only hold its known properties.
+		Items      *Schema            // Schema of the elements of an array.
+		MinItems   int                // Fewest elements of an array.
+		MinLength  int                // Shortest string.
+		Minimum    *float64           // Lowest number, if bounded.
+		Format     string             // Format of a string; only date-time is checked.
+	}
+
+	// Contracts maps routes to the schema of the body they accept.
+	Contracts map[string]*Schema
+)
+
+// DefaultContracts returns the contracts of the uniqueness service routes.
+func DefaultContracts() Contracts {
+	one := 1.0
+	status := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"battery":   {Type: "number"},
+			"cpuUsage":  {Type: "number"},
+			"cpuTemp":   {Type: "number"},
+			"diskSpace": {Type: "number"},
+			"clockSkew": {Type: "number"},
+		},
+		Required: []string{"battery", "cpuUsage", "cpuTemp", "diskSpace"},
+		Closed:   true,
+	}
+	sample := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"from":  {Type: "string", Format: "date-time"},
+			"to":    {Type: "string", Format: "date-time"},
+			"count": {Type: "integer", Minimum: &one},
+			"min":   status,
+			"max":   status,
+			"avg":   status,
+			"id":    {Type: "string"},
+		},
+		Required: []string{"from", "to", "count", "min", "max", "avg"},
+		Closed:   true,
+	}
+	iris := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"id":       {Type: "string", MinLength: 1},
+			"irisCode": {Type: "string", MinLength: 1},
+		},
+		Required: []string{"id", "irisCode"},
+		Closed:   true,
+	}
+	return Contracts{
+		"/status": status,
+		"/status/batch": {
+			Type:       "object",
+			Properties: map[string]*Schema{"samples": {Type: "array", Items: sample, MinItems: 1}},
+			Required:   []string{"samples"},
+			Closed:     true,
+		},
+		"/sign-up": iris,
+		"/sign-up/batch": {
+			Type:       "object",
+			Properties: map[string]*Schema{"signUps": {Type: "array", Items: iris, MinItems: 1}},
+			Required:   []string{"signUps"},
+			Closed:     true,
+		},
+	}
+}
+
+// WithContracts validates request bodies against the contract of their
+// route before sending them. A body breaking its contract is not sent.
+//
+// contracts: The contracts of the routes; routes without one are not checked.
+func WithContracts(contracts Contracts) RequestOption {
+	return func(r *request) {
+		r.contracts = contracts
+	}
+}
+
+// Validate checks a request body against the contract of its route, in its
+// JSON form.
+//
+// route: The route the body is sent to.
+// body: The request body.
+//
+// Returns domain.ErrContractViolation, with where and why, if the body
+// breaks the contract.
+func (c Contracts) Validate(route string, body any) error {
+	if _, ok := c[route]; !ok {
+		return nil
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("Validate: %w", domain.ErrMarshallingPayload)
+	}
+	return c.ValidateJSON(route, data)
+}
+
+// ValidateJSON checks a JSON-encoded request body against the contract of
+// its route.
+//
+// route: The route the body is sent to.
+// data: The JSON-encoded body.
+//
+// Returns domain.ErrContractViolation, with where and why, if the body
+// breaks the contract.
+func (c Contracts) ValidateJSON(route string, data []byte) error {
+	schema, ok := c[route]
+	if !ok {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("Validate: %w: %s: not JSON", domain.ErrContractViolation, route)
+	}
+	if err := schema.validate(route, value); err != nil {
+		return fmt.Errorf("Validate: %w", err)
+	}
+	return nil
+}
+
+// validate checks a decoded JSON value against the schema.
+//
+// path: Where the value sits, for error messages.
+// value: The value, decoded with numbers kept as json.Number.
+//
+// Returns domain.ErrContractViolation if the value does not match.
+func (s *Schema) validate(path string, value any) error {
+	violation := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s: %s", domain.ErrContractViolation, path, fmt.Sprintf(format, args...))
+	}
+
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return violation("expected an object, got %s", jsonType(value))
+		}
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok {
+				return violation("missing property %q", name)
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.Closed {
+					return violation("unexpected property %q", name)
+				}
+				continue
+			}
+			if err := property.validate(path+"."+name, object[name]); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return violation("expected an array, got %s", jsonType(value))
+		}
+		if len(array) < s.MinItems {
+			return violation("expected at least %d items, got %d", s.MinItems, len(array))
+		}
+		for i, item := range array {
+			if s.Items == nil {
+				break
+			}
+			if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return violation("expected a string, got %s", jsonType(value))
+		}
+		if len(str) < s.MinLength {
+			return violation("expected at least %d characters", s.MinLength)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return violation("expected a date-time, got %q", str)
+			}
+		}
+	case "number", "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return violation("expected a number, got %s", jsonType(value))
+		}
+		if s.Type == "integer" {
+			if _, err := number.Int64(); err != nil {
+				return violation("expected an integer, got %s", number)
+			}
+		}
+		f, _ := number.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return violation("expected at least %v, got %s", *s.Minimum, number)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return violation("expected a boolean, got %s", jsonType(value))
+		}
+	}
+	return nil
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,114 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/sony/gobreaker"
+)
+
+func TestContracts(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, service.Contracts)
+	}{
+		{"should accept the status report as sent", testContractStatusReport},
+		{"should accept the sign-up as sent", testContractSignUp},
+		{"should accept the batches as sent", testContractBatches},
+		{"should reject a status encoded as a JSON string", testContractRejectStringStatus},
+		{"should report where the body breaks the contract", testContractViolationPath},
+		{"should not send a body breaking the contract", testContractAtRuntime},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t, service.DefaultContracts())
+		})
+	}
+}
+
+func testContractStatusReport(t *testing.T, contracts service.Contracts) {
+	var sent any
+	reqSvc := &mock.RequestSvc{PostFunc: func(ctx context.Context, path string, body any) (int, error) {
+		sent = body
+		return http.StatusOK, nil
+	}}
+	sysInfo := &mock.SystemInfo{GetSystemInfoFunc: func() *domain.Status {
+		return &domain.Status{Battery: 50, CPUUsage: 10, CPUTemp: 40, DiskSpace: 100, ClockSkew: 250}
+	}}
+	testhelper.Ok(t, service.NewStatusSvc(reqSvc, sysInfo).Report(context.Background()))
+	testhelper.Ok(t, contracts.Validate("/status", sent))
+}
+
+func testContractSignUp(t *testing.T, contracts service.Contracts) {
+	var sent any
+	reqSvc := &mock.RequestSvc{DoFunc: func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		sent = req.Body
+		return http.StatusCreated, nil
+	}}
+	node, _ := snowflake.NewNode(1)
+	img, _ := platform.GenerateRandomImageData()
+	_, err := service.NewSignUpSvc("test-key", node, reqSvc).SignUp(context.Background(), img)
+	testhelper.Ok(t, err)
+	testhelper.Ok(t, contracts.Validate("/sign-up", sent))
+}
+
+func testContractBatches(t *testing.T, contracts service.Contracts) {
+	sample := service.NewStatusSample(domain.Status{Battery: 50}, time.Now())
+	testhelper.Ok(t, contracts.Validate("/status/batch", domain.StatusBatch{Samples: []domain.StatusSample{sample}}))
+	iris, _ := json.Marshal(domain.Iris{Id: "1", IrisCode: "signed"})
+	testhelper.Ok(t, contracts.Validate("/sign-up/batch", domain.SignUpBatch{SignUps: []json.RawMessage{iris}}))
+}
+
+func testContractRejectStringStatus(t *testing.T, contracts service.Contracts) {
+	payload, _ := json.Marshal(domain.Status{Battery: 50})
+	err := contracts.Validate("/status", string(payload))
+	testhelper.Assert(t, errors.Is(err, domain.ErrContractViolation), "expected a contract violation, got %v", err)
+	testhelper.Assert(t, strings.Contains(err.Error(), "expected an object, got string"), "expected the type mismatch to be reported, got %v", err)
+}
+
+func testContractViolationPath(t *testing.T, contracts service.Contracts) {
+	tests := []struct {
+		route string
+		body  string
+		want  string
+	}{
+		{"/sign-up", `{"id":"1"}`, `/sign-up: missing property "irisCode"`},
+		{"/sign-up", `{"id":"1","irisCode":"a","image":"raw"}`, `/sign-up: unexpected property "image"`},
+		{"/sign-up", `{"id":"","irisCode":"a"}`, `/sign-up.id: expected at least 1 characters`},
+		{"/status", `{"battery":"50","cpuUsage":0,"cpuTemp":0,"diskSpace":0}`, `/status.battery: expected a number, got string`},
+		{"/status/batch", `{"samples":[]}`, `/status/batch.samples: expected at least 1 items, got 0`},
+		{"/status/batch", `{"samples":[{"from":"yesterday","to":"2024-01-01T00:00:00Z","count":1,"min":{},"max":{},"avg":{}}]}`,
+			`/status/batch.samples[0].avg: missing property "battery"`},
+	}
+	for _, test := range tests {
+		err := contracts.ValidateJSON(test.route, []byte(test.body))
+		testhelper.Assert(t, errors.Is(err, domain.ErrContractViolation), "expected a contract violation for %s, got %v", test.body, err)
+		testhelper.Assert(t, strings.Contains(err.Error(), test.want), "expected %q, got %v", test.want, err)
+	}
+	testhelper.Ok(t, contracts.ValidateJSON("/health-check", []byte(`"anything"`)))
+}
+
+func testContractAtRuntime(t *testing.T, contracts service.Contracts) {
+	client := &mock.HttpClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request to %s", req.URL)
+		return nil, errors.New("unexpected request")
+	}}
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{})
+	r := service.NewRequestSvc("http://localhost", client, cb, service.WithContracts(contracts))
+
+	statusCode, err := r.Post(context.Background(), "/status", `{"battery":50}`)
+	testhelper.Assert(t, errors.Is(err, domain.ErrContractViolation), "expected a contract violation, got %v", err)
+	testhelper.Assert(t, statusCode == http.StatusUnprocessableEntity, "expected 422, got %d", statusCode)
+}
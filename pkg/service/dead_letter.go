@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+// redacted replaces secret values kept in dead letters.
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are dropped from dead letters; request signatures are
+// recomputed when a letter is replayed.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", HeaderSignature}
+
+// sensitiveFields are the JSON body fields, matched case-insensitively by
+// substring, whose values are redacted in dead letters.
+var sensitiveFields = []string{"secret", "password", "token", "signkey"}
+
+type (
+	// deadLetterSvc replays dead letters against the backend.
+	deadLetterSvc struct {
+		store      domain.DeadLetterStore
+		requestSvc domain.RequestSvc
+	}
+)
+
+// NewDeadLetterSvc creates a service replaying the stored dead letters.
+//
+// store: Store the dead letters are kept in.
+// requestSvc: Service to handle HTTP requests.
+//
+// Returns a pointer to the dead letter service.
+func NewDeadLetterSvc(store domain.DeadLetterStore, requestSvc domain.RequestSvc) *deadLetterSvc {
+	return &deadLetterSvc{
+		store:      store,
+		requestSvc: requestSvc,
+	}
+}
+
+// Replay sends the dead letter with the given ID again. A letter that is
+// accepted with a 2xx response is removed from the store; otherwise it is
+// kept with the new attempt recorded.
+//
+// ctx: Context bounding the request.
+// id: ID of the dead letter.
+//
+// Returns the HTTP status of the response and an error if the letter could
+// not be found or was not accepted.
+func (d *deadLetterSvc) Replay(ctx context.Context, id string) (int, error) {
+	letter, err := d.store.Get(id)
+	if err != nil {
+		return 0, fmt.Errorf("Replay: %w", err)
+	}
+
+	req := &domain.Request{Method: letter.Method, Route: letter.Route, Header: letter.Header.Clone()}
+	if len(letter.Body) > 0 {
+		req.Body = letter.Body
+	}
+	statusCode, err := d.requestSvc.Do(ctx, req, nil)
+	if err == nil && statusCode >= 200 && statusCode < 300 {
+		if err := d.store.Remove(id); err != nil {
+			return statusCode, fmt.Errorf("Replay: %w", err)
+		}
+		return statusCode, nil
+	}
+
+	letter.Attempts++
+	letter.StatusCode = statusCode
+	letter.FailedAt = time.Now()
+	letter.Error = domain.ErrRequestFailed.Error()
+	if err != nil {
+		letter.Error = err.Error()
+	}
+	if err := d.store.Add(*letter); err != nil {
+		return statusCode, fmt.Errorf("Replay: %w", err)
+	}
+	return statusCode, fmt.Errorf("Replay: %w", domain.ErrRequestFailed)
+}
+
+// NewDeadLetter describes a request that failed permanently, without its
+// secrets.
+//
+// req: The request that failed.
+// body: The JSON-encoded body of the request, or nil for none.
+// reason: Why the request was given up on.
+// statusCode: The last HTTP status received, or zero for none.
+// attempts: The number of delivery attempts made.
+// createdAt: When the request was first made.
+// err: The last error raised by the request.
+//
+// Returns the dead letter, ready to be stored.
+func NewDeadLetter(req *domain.Request, body json.RawMessage, reason domain.DeadLetterReason, statusCode, attempts int, createdAt time.Time, err error) domain.DeadLetter {
+	letter := domain.DeadLetter{
+		Id:         req.Header.Get(HeaderIdempotencyKey),
+		Method:     req.Method,
+		Route:      req.Route,
+		Header:     redactHeader(req.Header),
+		Body:       redactBody(body),
+		Reason:     reason,
+		StatusCode: statusCode,
+		Attempts:   attempts,
+		CreatedAt:  createdAt,
+		FailedAt:   time.Now(),
+	}
+	if err != nil {
+		letter.Error = err.Error()
+	}
+	return letter
+}
+
+// OutboxDeadLetter describes an outbox entry that failed permanently.
+//
+// entry: The outbox entry.
+// reason: Why the entry was given up on.
+// statusCode: The last HTTP status received, or zero for none.
+// attempts: The number of delivery attempts made.
+// err: The last error raised by the entry, if any.
+//
+// Returns the dead letter, ready to be stored.
+func OutboxDeadLetter(entry domain.OutboxEntry, reason domain.DeadLetterReason, statusCode, attempts int, err error) domain.DeadLetter {
+	return NewDeadLetter(outboxRequest(&entry), entry.Body, reason, statusCode, attempts, entry.CreatedAt, err)
+}
+
+// outboxRequest builds the request delivering an outbox entry. The entry ID
+// doubles as idempotency key.
+func outboxRequest(entry *domain.OutboxEntry) *domain.Request {
+	return &domain.Request{
+		Method: http.MethodPost,
+		Route:  entry.Route,
+		Header: http.Header{HeaderIdempotencyKey: []string{entry.Id}},
+		Body:   entry.Body,
+	}
+}
+
+// redactHeader copies the header without the sensitive ones.
+func redactHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	clean := header.Clone()
+	for _, key := range sensitiveHeaders {
+		clean.Del(key)
+	}
+	return clean
+}
+
+// redactBody replaces the values of sensitive top-level fields of a JSON
+// object. Other bodies are kept as they are.
+func redactBody(body json.RawMessage) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return body
+	}
+	changed := false
+	for name := range fields {
+		if isSensitiveField(name) {
+			fields[name] = json.RawMessage(`"` + redacted + `"`)
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	clean, err := json.Marshal(fields)
+	if err != nil {
+		return nil
+	}
+	return clean
+}
@@ -0,0 +1,194 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestDeadLetters(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, domain.DeadLetterStore)
+	}{
+		{"should remove secrets from dead letters", testRedactDeadLetter},
+		{"should replay and remove an accepted dead letter", testReplayAccepted},
+		{"should keep a dead letter that fails again", testReplayRejectedAgain},
+		{"should dead-letter sign-ups rejected by the backend", testDeadLetterRejectedSignUp},
+		{"should dead-letter sign-ups out of attempts", testDeadLetterExhaustedSignUp},
+		{"should dead-letter rejected status samples", testDeadLetterRejectedBatch},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			store, err := platform.OpenDeadLetterStore(filepath.Join(t.TempDir(), "dead-letters"))
+			testhelper.Ok(t, err)
+			test.function(t, store)
+		})
+	}
+}
+
+func testRedactDeadLetter(t *testing.T, _ domain.DeadLetterStore) {
+	req := &domain.Request{
+		Method: http.MethodPost,
+		Route:  "/sign-up",
+		Header: http.Header{
+			service.HeaderIdempotencyKey: []string{"42"},
+			service.HeaderSignature:      []string{"abc"},
+			"Authorization":              []string{"Bearer token"},
+		},
+	}
+	body := json.RawMessage(`{"id":"42","irisCode":"signed","apiToken":"secret"}`)
+	letter := service.NewDeadLetter(req, body, domain.DeadLetterRejected, 422, 1, time.Now(), domain.ErrSignUpRejected)
+
+	testhelper.Assert(t, letter.Id == "42", "expected the idempotency key as ID, got %s", letter.Id)
+	testhelper.Assert(t, letter.Header.Get(service.HeaderSignature) == "" && letter.Header.Get("Authorization") == "",
+		"expected secret headers to be removed, got %v", letter.Header)
+	testhelper.Assert(t, req.Header.Get("Authorization") != "", "expected the request headers to be left alone")
+	var fields map[string]string
+	testhelper.Ok(t, json.Unmarshal(letter.Body, &fields))
+	testhelper.Assert(t, fields["apiToken"] == "[REDACTED]" && fields["irisCode"] == "signed", "expected only secrets to be redacted, got %v", fields)
+	testhelper.Assert(t, letter.Error == domain.ErrSignUpRejected.Error(), "expected the error to be recorded, got %s", letter.Error)
+}
+
+func addSignUpDeadLetter(t *testing.T, store domain.DeadLetterStore, id string) {
+	entry := domain.OutboxEntry{Id: id, Route: "/sign-up", Body: json.RawMessage(`{"id":"` + id + `","irisCode":"signed"}`), CreatedAt: time.Now()}
+	testhelper.Ok(t, store.Add(service.OutboxDeadLetter(entry, domain.DeadLetterExpired, 0, 0, domain.ErrTransientFailure)))
+}
+
+func testReplayAccepted(t *testing.T, store domain.DeadLetterStore) {
+	addSignUpDeadLetter(t, store, "42")
+	u := &mock.UniquenessService{SignKey: "test-key", MaxSkew: time.Minute}
+	server := httptest.NewServer(u)
+	defer server.Close()
+	client := service.NewRequestSigner("1", "test-key", server.Client())
+	reqSvc := service.NewRequestSvc(server.URL, client, service.NewCircuitBreaker(service.BreakerSettings{}))
+
+	statusCode, err := service.NewDeadLetterSvc(store, reqSvc).Replay(context.Background(), "42")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusCreated, "expected the sign-up to be registered, got %d", statusCode)
+	testhelper.Assert(t, u.Registered() == 1, "expected the backend to register the sign-up")
+	_, err = store.Get("42")
+	testhelper.Assert(t, errors.Is(err, domain.ErrDeadLetterNotFound), "expected the letter to be removed, got %v", err)
+}
+
+func testReplayRejectedAgain(t *testing.T, store domain.DeadLetterStore) {
+	addSignUpDeadLetter(t, store, "42")
+	reqSvc := new(mock.RequestSvc)
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		testhelper.Assert(t, req.Header.Get(service.HeaderIdempotencyKey) == "42", "expected the idempotency key to be replayed")
+		return http.StatusUnprocessableEntity, nil
+	}
+
+	statusCode, err := service.NewDeadLetterSvc(store, reqSvc).Replay(context.Background(), "42")
+	testhelper.Assert(t, errors.Is(err, domain.ErrRequestFailed), "expected the replay to fail, got %v", err)
+	testhelper.Assert(t, statusCode == http.StatusUnprocessableEntity, "expected 422, got %d", statusCode)
+	letter, err := store.Get("42")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, letter.Attempts == 1 && letter.StatusCode == http.StatusUnprocessableEntity, "expected the attempt to be recorded, got %+v", letter)
+
+	_, err = service.NewDeadLetterSvc(store, reqSvc).Replay(context.Background(), "missing")
+	testhelper.Assert(t, errors.Is(err, domain.ErrDeadLetterNotFound), "expected not found, got %v", err)
+}
+
+func testDeadLetterRejectedSignUp(t *testing.T, store domain.DeadLetterStore) {
+	outbox, err := platform.OpenOutbox(platform.OutboxConfig{Path: filepath.Join(t.TempDir(), "sign-up.log")})
+	testhelper.Ok(t, err)
+	defer outbox.Close()
+	appendSignUp(t, outbox, "1")
+	reqSvc := new(mock.RequestSvc)
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		out.(*domain.SignUpResponse).Message = "invalid iris code"
+		return http.StatusUnprocessableEntity, nil
+	}
+
+	cfg := senderConfig
+	cfg.DeadLetters = store
+	runSenderWith(t, outbox, reqSvc, cfg, 1)
+	letter, err := store.Get("1")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, letter.Reason == domain.DeadLetterRejected && letter.StatusCode == http.StatusUnprocessableEntity,
+		"expected a rejected dead letter, got %+v", letter)
+	testhelper.Assert(t, len(letter.Body) > 0 && letter.Attempts == 1, "expected the payload and attempt to be kept, got %+v", letter)
+}
+
+func testDeadLetterExhaustedSignUp(t *testing.T, store domain.DeadLetterStore) {
+	outbox, err := platform.OpenOutbox(platform.OutboxConfig{Path: filepath.Join(t.TempDir(), "sign-up.log")})
+	testhelper.Ok(t, err)
+	defer outbox.Close()
+	appendSignUp(t, outbox, "1")
+	appendSignUp(t, outbox, "2")
+	calls := 0
+	reqSvc := new(mock.RequestSvc)
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		calls++
+		if req.Header.Get(service.HeaderIdempotencyKey) == "1" {
+			return http.StatusServiceUnavailable, nil
+		}
+		return http.StatusCreated, nil
+	}
+
+	cfg := senderConfig
+	cfg.DeadLetters = store
+	cfg.Retry.MaxAttempts = 3
+	results := runSenderWith(t, outbox, reqSvc, cfg, 2)
+	testhelper.Assert(t, results[0].Outcome == domain.SignUpTransient && results[1].Outcome == domain.SignUpRegistered,
+		"expected the first sign-up to give up and the second to go through, got %+v", results)
+	testhelper.Assert(t, calls == 4, "expected 3 attempts then 1, got %d", calls)
+	letter, err := store.Get("1")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, letter.Reason == domain.DeadLetterExhausted && letter.Attempts == 3, "expected an exhausted dead letter, got %+v", letter)
+}
+
+func testDeadLetterRejectedBatch(t *testing.T, store domain.DeadLetterStore) {
+	sysInfo := &mock.SystemInfo{GetSystemInfoFunc: func() *domain.Status { return &domain.Status{} }}
+	batchStatus := http.StatusServiceUnavailable
+	reqSvc := new(mock.RequestSvc)
+	reqSvc.PostFunc = func(ctx context.Context, path string, body any) (int, error) {
+		return http.StatusServiceUnavailable, nil
+	}
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		if batchStatus != http.StatusOK {
+			return batchStatus, nil
+		}
+		response := out.(*domain.BatchResponse)
+		for _, sample := range req.Body.(domain.StatusBatch).Samples {
+			response.Results = append(response.Results, domain.BatchItemResult{Id: sample.Id, Status: http.StatusUnprocessableEntity})
+		}
+		return http.StatusOK, nil
+	}
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 10})
+	testhelper.Ok(t, err)
+	statusService := service.NewStatusSvc(reqSvc, sysInfo, service.WithStatusBuffer(buffer, service.BatchConfig{MaxSize: 10}), service.WithStatusDeadLetters(store))
+
+	statusService.Report(context.Background())
+	statusService.Report(context.Background())
+	testhelper.Assert(t, buffer.Len() == 2, "expected 2 buffered reports, got %d", buffer.Len())
+
+	// A batch refused as a whole says nothing of its samples.
+	batchStatus = http.StatusNotFound
+	statusService.Report(context.Background())
+	letters, err := store.List()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, buffer.Len() == 3 && len(letters) == 0, "expected the refused batch to stay buffered, got %d", buffer.Len())
+
+	batchStatus = http.StatusOK
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	testhelper.Assert(t, buffer.Len() == 0, "expected the rejected samples to leave the buffer, got %d", buffer.Len())
+	letters, err = store.List()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(letters) == 1 && letters[0].Route == "/status/batch", "expected the samples to be dead-lettered, got %+v", letters)
+	var batch domain.StatusBatch
+	testhelper.Ok(t, json.Unmarshal(letters[0].Body, &batch))
+	testhelper.Assert(t, len(batch.Samples) == 4, "expected the 4 samples to be kept, got %d", len(batch.Samples))
+}
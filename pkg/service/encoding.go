@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+)
+
+// Content types of request bodies.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+type (
+	// Encoding selects how request bodies are encoded.
+	Encoding string
+
+	// payload is a request body ready to be sent.
+	payload struct {
+		data            []byte
+		contentType     string
+		contentEncoding string
+	}
+)
+
+const (
+	EncodingJSON     Encoding = "json"     // Every body is sent as JSON.
+	EncodingProtobuf Encoding = "protobuf" // Status and Iris bodies are sent as protocol buffers, others as JSON.
+)
+
+// ParseEncoding reads an encoding name such as "json" or "protobuf".
+//
+// name: The name of the encoding.
+//
+// Returns the encoding, or domain.ErrInvalidEncoding if it is unknown.
+func ParseEncoding(name string) (Encoding, error) {
+	switch encoding := Encoding(name); encoding {
+	case EncodingJSON, EncodingProtobuf:
+		return encoding, nil
+	}
+	return "", fmt.Errorf("ParseEncoding: %w: %q", domain.ErrInvalidEncoding, name)
+}
+
+// WithEncoding sets how request bodies are encoded. Bodies without a binary
+// form are sent as JSON whatever the encoding.
+//
+// encoding: The encoding of request bodies.
+func WithEncoding(encoding Encoding) RequestOption {
+	return func(r *request) {
+		r.encoding = encoding
+	}
+}
+
+// WithCompression gzips the request bodies of at least minSize bytes once
+// encoded. Smaller bodies are not worth the overhead.
+//
+// minSize: The smallest body compressed, in bytes; 0 or less disables compression.
+func WithCompression(minSize int) RequestOption {
+	return func(r *request) {
+		r.gzipMinSize = minSize
+	}
+}
+
+// encode turns the request body into a payload, in the configured encoding
+// and compressed if it is large enough.
+//
+// body: The request body, or nil for none.
+// plain: Whether to send plain JSON regardless of the configuration.
+//
+// Returns the payload, or nil for no body, and an error if the body cannot be encoded.
+func (r *request) encode(body any, plain bool) (*payload, error) {
+	if body == nil {
+		return nil, nil
+	}
+
+	p := &payload{contentType: ContentTypeJSON}
+	if data, ok := marshalProtobuf(body); ok && !plain && r.encoding == EncodingProtobuf {
+		p.data, p.contentType = data, ContentTypeProtobuf
+	} else {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, domain.ErrMarshallingPayload
+		}
+		p.data = data
+	}
+
+	if !plain && r.gzipMinSize > 0 && len(p.data) >= r.gzipMinSize {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(p.data)
+		if err := zw.Close(); err != nil {
+			return nil, domain.ErrMarshallingPayload
+		}
+		p.data, p.contentEncoding = buf.Bytes(), "gzip"
+	}
+	return p, nil
+}
+
+// transformed tells whether the payload is anything but plain JSON.
+func (p *payload) transformed() bool {
+	return p != nil && (p.contentType != ContentTypeJSON || p.contentEncoding != "")
+}
+
+// marshalProtobuf encodes the bodies that have a protocol buffer form:
+// statuses and iris codes, including those already encoded as JSON, as
+// queued sign-ups are.
+//
+// body: The request body.
+//
+// Returns the encoded body, and false if it has no protocol buffer form.
+func marshalProtobuf(body any) ([]byte, bool) {
+	switch v := body.(type) {
+	case domain.Status:
+		return platform.MarshalStatus(&v), true
+	case *domain.Status:
+		return platform.MarshalStatus(v), true
+	case domain.Iris:
+		return platform.MarshalIris(&v), true
+	case *domain.Iris:
+		return platform.MarshalIris(v), true
+	case json.RawMessage:
+		var iris domain.Iris
+		if decodeStrict(v, &iris) == nil {
+			return platform.MarshalIris(&iris), true
+		}
+		var status domain.Status
+		if decodeStrict(v, &status) == nil {
+			return platform.MarshalStatus(&status), true
+		}
+	}
+	return nil, false
+}
+
+// decodeStrict decodes a JSON object holding only fields of the target.
+func decodeStrict(data []byte, target any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(target)
+}
@@ -0,0 +1,119 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestEncoding(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.UniquenessService, *httptest.Server)
+	}{
+		{"should gzip signed bodies over the threshold", testGzipOverThreshold},
+		{"should send statuses and iris codes as protobuf", testSendProtobuf},
+		{"should encode queued sign-ups as protobuf", testSendQueuedProtobuf},
+		{"should fall back to plain JSON when unsupported", testFallBackToPlainJSON},
+		{"should reject an unknown encoding", testRejectUnknownEncoding},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			u := &mock.UniquenessService{SignKey: "test-key", MaxSkew: time.Minute}
+			server := httptest.NewServer(u)
+			defer server.Close()
+			test.function(t, u, server)
+		})
+	}
+}
+
+func newEncodingRequestSvc(server *httptest.Server, opts ...service.RequestOption) domain.RequestSvc {
+	signer := service.NewRequestSigner("1", "test-key", server.Client())
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{})
+	return service.NewRequestSvc(server.URL, signer, cb, opts...)
+}
+
+func testGzipOverThreshold(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	r := newEncodingRequestSvc(server, service.WithCompression(200))
+
+	statusCode, err := r.Post(context.Background(), "/status", domain.Status{Battery: 50})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	testhelper.Assert(t, u.LastHeader("/status").Get("Content-Encoding") == "", "expected a small body to be sent as is")
+
+	batch := domain.StatusBatch{}
+	for i := 0; i < 10; i++ {
+		batch.Samples = append(batch.Samples, service.NewStatusSample(domain.Status{Battery: float32(i)}, time.Now()))
+	}
+	statusCode, err = r.Post(context.Background(), "/status/batch", batch)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	testhelper.Assert(t, u.LastHeader("/status/batch").Get("Content-Encoding") == "gzip", "expected a large body to be gzipped")
+	testhelper.Assert(t, len(u.StatusSamples()) == 10, "expected the samples to be decoded, got %d", len(u.StatusSamples()))
+}
+
+func testSendProtobuf(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	r := newEncodingRequestSvc(server, service.WithEncoding(service.EncodingProtobuf), service.WithCompression(1))
+
+	statusCode, err := r.Post(context.Background(), "/sign-up", domain.Iris{Id: "1", IrisCode: "signed"})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusCreated, "expected 201, got %d", statusCode)
+	header := u.LastHeader("/sign-up")
+	testhelper.Assert(t, header.Get("Content-Type") == service.ContentTypeProtobuf && header.Get("Content-Encoding") == "gzip",
+		"expected a gzipped protobuf body, got %v", header)
+	testhelper.Assert(t, u.Registered() == 1, "expected the iris code to be registered")
+
+	statusCode, err = r.Post(context.Background(), "/status", &domain.Status{Battery: 50})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	testhelper.Assert(t, u.LastHeader("/status").Get("Content-Type") == service.ContentTypeProtobuf, "expected a protobuf status")
+
+	statusCode, err = r.Post(context.Background(), "/status/batch", domain.StatusBatch{Samples: []domain.StatusSample{service.NewStatusSample(domain.Status{}, time.Now())}})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	testhelper.Assert(t, u.LastHeader("/status/batch").Get("Content-Type") == service.ContentTypeJSON, "expected a batch without binary form as JSON")
+}
+
+func testSendQueuedProtobuf(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	r := newEncodingRequestSvc(server, service.WithEncoding(service.EncodingProtobuf))
+	body, _ := json.Marshal(domain.Iris{Id: "1", IrisCode: "signed"})
+
+	statusCode, err := r.Do(context.Background(), &domain.Request{Method: http.MethodPost, Route: "/sign-up", Body: json.RawMessage(body)}, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusCreated, "expected 201, got %d", statusCode)
+	testhelper.Assert(t, u.LastHeader("/sign-up").Get("Content-Type") == service.ContentTypeProtobuf, "expected a protobuf body")
+}
+
+func testFallBackToPlainJSON(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	u.PlainOnly = true
+	r := newEncodingRequestSvc(server, service.WithEncoding(service.EncodingProtobuf), service.WithCompression(1))
+
+	for i := 0; i < 2; i++ {
+		statusCode, err := r.Post(context.Background(), "/status", domain.Status{Battery: 50})
+		testhelper.Ok(t, err)
+		testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+		header := u.LastHeader("/status")
+		testhelper.Assert(t, header.Get("Content-Type") == service.ContentTypeJSON && header.Get("Content-Encoding") == "",
+			"expected plain JSON, got %v", header)
+	}
+	testhelper.Assert(t, u.Count("/status") == 2, "expected 2 accepted reports, got %d", u.Count("/status"))
+}
+
+func testRejectUnknownEncoding(t *testing.T, _ *mock.UniquenessService, _ *httptest.Server) {
+	encoding, err := service.ParseEncoding("protobuf")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, encoding == service.EncodingProtobuf, "expected protobuf, got %s", encoding)
+	_, err = service.ParseEncoding("xml")
+	testhelper.Assert(t, errors.Is(err, domain.ErrInvalidEncoding), "expected an invalid encoding, got %v", err)
+}
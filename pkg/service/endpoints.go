@@ -0,0 +1,384 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"virtual-orb/pkg/domain"
+
+	"github.com/sony/gobreaker"
+)
+
+type (
+	// Endpoint is one instance of the uniqueness service.
+	Endpoint struct {
+		URL      string                // Base URL of the instance.
+		Priority int                   // Lower is preferred; instances sharing a priority share the load.
+		Weight   int                   // Share of the load among instances of the same priority; below 1 counts as 1.
+		Breaker  domain.CircuitBreaker // Optional breaker guarding the instance alone.
+	}
+
+	// FailoverConfig configures how an endpoint pool checks its endpoints
+	// and moves between them.
+	FailoverConfig struct {
+		HealthInterval time.Duration // Wait between health checks of every endpoint; DefaultHealthInterval if not positive.
+		HealthTimeout  time.Duration // Longest a health check may take; zero for no limit.
+		FailBackAfter  time.Duration // How long a preferred endpoint must stay healthy before traffic moves back to it.
+	}
+
+	// endpointPool spreads requests over several instances of the
+	// uniqueness service. Requests stick to an active endpoint while it
+	// answers, fail over to the next best one when it does not, and fail
+	// back to a preferred endpoint once it has recovered.
+	endpointPool struct {
+		client domain.HttpClient
+		cfg    FailoverConfig
+		now    func() time.Time
+
+		mu        sync.Mutex
+		endpoints []*endpointState
+		active    *endpointState
+	}
+
+	// endpointState is what the pool knows of an endpoint.
+	endpointState struct {
+		Endpoint
+		healthy      bool
+		healthySince time.Time
+		lastErr      error
+	}
+)
+
+// NewEndpointPool creates a pool over the given endpoints. Every endpoint
+// starts healthy, and the active one is picked among the preferred ones.
+//
+// endpoints: The instances of the uniqueness service.
+// client: The HTTP client health checks are sent with.
+// cfg: Health checking and fail-back settings.
+//
+// Returns a pointer to the pool.
+func NewEndpointPool(endpoints []Endpoint, client domain.HttpClient, cfg FailoverConfig) *endpointPool {
+	if cfg.HealthInterval <= 0 {
+		cfg.HealthInterval = DefaultHealthInterval
+	}
+	p := &endpointPool{client: client, cfg: cfg, now: time.Now}
+	for _, endpoint := range endpoints {
+		p.endpoints = append(p.endpoints, &endpointState{Endpoint: endpoint, healthy: true})
+	}
+	sort.SliceStable(p.endpoints, func(i, j int) bool {
+		return p.endpoints[i].Priority < p.endpoints[j].Priority
+	})
+	p.active = p.pick()
+	return p
+}
+
+// WithEndpoints sends the requests to the endpoints of the pool rather than
+// to the base URL. A request finding the breaker of an endpoint open, or
+// failing to connect to it, is sent to the next one within the same attempt.
+// A request that may have reached the failing endpoint is sent on only if
+// it is safe to send twice.
+//
+// pool: The endpoint pool, see NewEndpointPool.
+func WithEndpoints(pool *endpointPool) RequestOption {
+	return func(r *request) {
+		r.endpoints = pool
+	}
+}
+
+// ParseEndpoints parses a comma-separated list of endpoints, most preferred
+// first, such as "http://a:8001,http://b:8001;weight=3;priority=1". Each
+// endpoint gets its position in the list as priority unless it sets one.
+//
+// spec: The list of endpoints.
+//
+// Returns the endpoints, or domain.ErrInvalidEndpoint if one is malformed.
+func ParseEndpoints(spec string) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ";")
+		endpoint := Endpoint{URL: strings.TrimRight(strings.TrimSpace(fields[0]), "/"), Priority: len(endpoints), Weight: 1}
+		if u, err := url.Parse(endpoint.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("ParseEndpoints: %w: %q", domain.ErrInvalidEndpoint, endpoint.URL)
+		}
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("ParseEndpoints: %w: %q", domain.ErrInvalidEndpoint, field)
+			}
+			switch key {
+			case "priority":
+				endpoint.Priority = n
+			case "weight":
+				endpoint.Weight = n
+			default:
+				return nil, fmt.Errorf("ParseEndpoints: %w: %q", domain.ErrInvalidEndpoint, field)
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("ParseEndpoints: %w: none given", domain.ErrInvalidEndpoint)
+	}
+	return endpoints, nil
+}
+
+// Run checks the health of every endpoint at each interval until ctx is
+// done.
+//
+// ctx: Context bounding the health checks.
+func (p *endpointPool) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		p.Check(ctx)
+		if sleep(ctx, p.cfg.HealthInterval) != nil {
+			return
+		}
+	}
+}
+
+// Check sends a health check to every endpoint at once, then fails over
+// from an unhealthy active endpoint or fails back to a preferred one that
+// has been healthy long enough.
+//
+// ctx: Context bounding the health checks.
+func (p *endpointPool) Check(ctx context.Context) {
+	p.mu.Lock()
+	endpoints := append([]*endpointState(nil), p.endpoints...)
+	p.mu.Unlock()
+
+	errs := make([]error, len(endpoints))
+	var checks sync.WaitGroup
+	for i, endpoint := range endpoints {
+		checks.Add(1)
+		go func(i int, endpoint *endpointState) {
+			defer checks.Done()
+			errs[i] = p.check(ctx, endpoint.URL)
+		}(i, endpoint)
+	}
+	checks.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, endpoint := range endpoints {
+		p.mark(endpoint, errs[i])
+	}
+	p.rebalance()
+}
+
+// check asks an endpoint whether it is healthy.
+//
+// ctx: Context bounding the health check.
+// baseURL: Base URL of the endpoint.
+//
+// Returns an error unless the endpoint answered with a 2xx status.
+func (p *endpointPool) check(ctx context.Context, baseURL string) error {
+	if p.cfg.HealthTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.HealthTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/health-check", nil)
+	if err != nil {
+		return fmt.Errorf("check: %w", domain.ErrRequestFailed)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("check: %w: %w", domain.ErrRequestFailed, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("check: %w: status %d", domain.ErrEndpointUnhealthy, resp.StatusCode)
+	}
+	return nil
+}
+
+// execute runs the exchange against the endpoints, the active one first,
+// until one of them answers without failing. Endpoints that fail are marked
+// unhealthy, and the next healthy one becomes active. The exchange moves on
+// to the next endpoint only if the request never reached the failing one,
+// or if it is safe to send twice.
+//
+// ctx: Context the exchange is bound to; once done, no endpoint is tried.
+// retrySafe: Whether the request may be sent to several endpoints.
+// exchange: Sends the request to the endpoint with the given base URL, with
+// the same outcomes as a circuit breaker action.
+//
+// Returns the outcome of the first endpoint that did not fail, or of the
+// last one tried.
+func (p *endpointPool) execute(ctx context.Context, retrySafe bool, exchange func(baseURL string) (any, error)) (any, error) {
+	var result any
+	err := fmt.Errorf("execute: %w", domain.ErrNoEndpoint)
+	for _, endpoint := range p.candidates() {
+		if ctx.Err() != nil {
+			break
+		}
+		action := func() (any, error) {
+			return exchange(endpoint.URL)
+		}
+		if endpoint.Breaker != nil {
+			result, err = endpoint.Breaker.Execute(action)
+		} else {
+			result, err = action()
+		}
+		if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+			continue
+		}
+		if err != nil && isSuccessful(err) {
+			// Not the endpoint's fault, so it says nothing of its health.
+			return result, err
+		}
+
+		p.mu.Lock()
+		if err == nil {
+			p.mark(endpoint, nil)
+			if p.active == nil || !p.active.healthy {
+				p.active = endpoint
+			}
+		} else if ctx.Err() == nil {
+			p.mark(endpoint, err)
+			p.rebalance()
+		}
+		p.mu.Unlock()
+		if err == nil || !retrySafe && !notConnected(err) {
+			return result, err
+		}
+	}
+	return result, err
+}
+
+// notConnected tells whether an exchange failed before a connection to the
+// endpoint was made, so that the request provably never reached it.
+func notConnected(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial" || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// candidates lists the endpoints in the order they are to be tried: the
+// active one, the other healthy ones by priority, then the unhealthy ones as
+// a last resort.
+func (p *endpointPool) candidates() []*endpointState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	candidates := []*endpointState{}
+	if p.active != nil {
+		candidates = append(candidates, p.active)
+	}
+	for _, healthy := range []bool{true, false} {
+		for _, endpoint := range p.endpoints {
+			if endpoint != p.active && endpoint.healthy == healthy {
+				candidates = append(candidates, endpoint)
+			}
+		}
+	}
+	return candidates
+}
+
+// mark records the outcome of a request or health check of an endpoint.
+// Callers hold p.mu.
+func (p *endpointPool) mark(endpoint *endpointState, err error) {
+	endpoint.lastErr = err
+	if err != nil {
+		endpoint.healthy = false
+		return
+	}
+	if !endpoint.healthy {
+		endpoint.healthy = true
+		endpoint.healthySince = p.now()
+	}
+}
+
+// rebalance fails over from an unhealthy active endpoint, and fails back to
+// a preferred endpoint once it has been healthy for FailBackAfter. Callers
+// hold p.mu.
+func (p *endpointPool) rebalance() {
+	best := p.pick()
+	switch {
+	case best == nil:
+		return
+	case p.active == nil || !p.active.healthy:
+		p.active = best
+	case best.Priority < p.active.Priority && p.now().Sub(best.healthySince) >= p.cfg.FailBackAfter:
+		p.active = best
+	}
+}
+
+// pick draws a healthy endpoint of the best priority, in proportion to the
+// weights. Callers hold p.mu.
+//
+// Returns the endpoint, or nil if none is healthy.
+func (p *endpointPool) pick() *endpointState {
+	var preferred []*endpointState
+	total := 0
+	for _, endpoint := range p.endpoints {
+		if !endpoint.healthy {
+			continue
+		}
+		if len(preferred) > 0 && endpoint.Priority > preferred[0].Priority {
+			break
+		}
+		preferred = append(preferred, endpoint)
+		total += weight(endpoint.Weight)
+	}
+	if len(preferred) == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, endpoint := range preferred {
+		if n -= weight(endpoint.Weight); n < 0 {
+			return endpoint
+		}
+	}
+	return preferred[len(preferred)-1]
+}
+
+// weight returns the share of an endpoint, at least 1.
+func weight(w int) int {
+	if w < 1 {
+		return 1
+	}
+	return w
+}
+
+// Endpoints returns a snapshot of every endpoint of the pool, most
+// preferred first.
+func (p *endpointPool) Endpoints() []domain.EndpointSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshots := make([]domain.EndpointSnapshot, 0, len(p.endpoints))
+	for _, endpoint := range p.endpoints {
+		snapshot := domain.EndpointSnapshot{
+			URL:      endpoint.URL,
+			Priority: endpoint.Priority,
+			Weight:   weight(endpoint.Weight),
+			Healthy:  endpoint.healthy,
+			Active:   endpoint == p.active,
+		}
+		if endpoint.lastErr != nil {
+			snapshot.LastError = endpoint.lastErr.Error()
+		}
+		if breaker, ok := snapshotBreaker(endpoint.Breaker, nil); ok {
+			snapshot.Breaker = &breaker
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
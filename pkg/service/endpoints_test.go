@@ -0,0 +1,252 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestEndpoints(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, []*mock.UniquenessService, []*httptest.Server)
+	}{
+		{"should fail over when the primary is down", testFailOverWhenPrimaryDown},
+		{"should fail over when the primary is unreachable", testFailOverWhenPrimaryUnreachable},
+		{"should stick to the backup until a health check", testStickToBackup},
+		{"should fail back once the primary is healthy", testFailBackAfterHealthCheck},
+		{"should wait before failing back", testWaitBeforeFailingBack},
+		{"should fail over from an unhealthy primary on health check", testFailOverOnHealthCheck},
+		{"should skip an endpoint whose breaker is open", testSkipOpenEndpointBreaker},
+		{"should return the last failure when every endpoint fails", testEveryEndpointFails},
+		{"should not resend a request that is not retry safe", testNoFailOverWhenNotRetrySafe},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			services := []*mock.UniquenessService{{}, {}}
+			var servers []*httptest.Server
+			for _, u := range services {
+				server := httptest.NewServer(u)
+				defer server.Close()
+				servers = append(servers, server)
+			}
+			test.function(t, services, servers)
+		})
+	}
+}
+
+// endpointPool is the part of the pool the scenarios inspect.
+type endpointPool interface {
+	Check(ctx context.Context)
+	Endpoints() []domain.EndpointSnapshot
+}
+
+func newPool(servers []*httptest.Server, cfg service.FailoverConfig) (domain.RequestSvc, endpointPool) {
+	var endpoints []service.Endpoint
+	for i, server := range servers {
+		endpoints = append(endpoints, service.Endpoint{URL: server.URL, Priority: i})
+	}
+	pool := service.NewEndpointPool(endpoints, servers[0].Client(), cfg)
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{})
+	return service.NewRequestSvc("http://unused", servers[0].Client(), cb, service.WithEndpoints(pool)), pool
+}
+
+// statusKeys numbers the idempotency keys of the statuses posted.
+var statusKeys atomic.Int64
+
+// postStatus posts a status with an idempotency key, so that it may be sent
+// to several endpoints.
+func postStatus(t *testing.T, r domain.RequestSvc) int {
+	statusCode, err := r.Do(context.Background(), &domain.Request{
+		Method: http.MethodPost,
+		Route:  "/status",
+		Header: http.Header{service.HeaderIdempotencyKey: []string{strconv.FormatInt(statusKeys.Add(1), 10)}},
+		Body:   domain.Status{Battery: 50},
+	}, nil)
+	testhelper.Ok(t, err)
+	return statusCode
+}
+
+func activeEndpoint(endpoints []domain.EndpointSnapshot) string {
+	for _, endpoint := range endpoints {
+		if endpoint.Active {
+			return endpoint.URL
+		}
+	}
+	return ""
+}
+
+func testFailOverWhenPrimaryDown(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	r, pool := newPool(servers, service.FailoverConfig{})
+	services[0].SetDown(true)
+
+	statusCode := postStatus(t, r)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200 from the backup, got %d", statusCode)
+	testhelper.Assert(t, services[1].Count("/status") == 1, "expected the backup to get the status")
+
+	endpoints := pool.Endpoints()
+	testhelper.Assert(t, !endpoints[0].Healthy && endpoints[0].LastError != "", "expected the primary to be unhealthy, got %+v", endpoints[0])
+	testhelper.Assert(t, activeEndpoint(endpoints) == servers[1].URL, "expected the backup to be active, got %+v", endpoints)
+}
+
+func testFailOverWhenPrimaryUnreachable(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	r, pool := newPool(servers, service.FailoverConfig{})
+	servers[0].Close()
+
+	statusCode := postStatus(t, r)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200 from the backup, got %d", statusCode)
+	testhelper.Assert(t, activeEndpoint(pool.Endpoints()) == servers[1].URL, "expected the backup to be active")
+}
+
+func testStickToBackup(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	r, _ := newPool(servers, service.FailoverConfig{})
+	services[0].SetDown(true)
+	postStatus(t, r)
+	services[0].SetDown(false)
+
+	postStatus(t, r)
+	postStatus(t, r)
+	testhelper.Assert(t, services[0].Count("/status") == 0, "expected the recovered primary to wait for a health check")
+	testhelper.Assert(t, services[1].Count("/status") == 3, "expected the backup to keep the traffic, got %d", services[1].Count("/status"))
+}
+
+func testFailBackAfterHealthCheck(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	r, pool := newPool(servers, service.FailoverConfig{})
+	services[0].SetDown(true)
+	postStatus(t, r)
+	services[0].SetDown(false)
+
+	pool.Check(context.Background())
+	testhelper.Assert(t, services[0].Count("/health-check") == 1, "expected the primary to be checked")
+	testhelper.Assert(t, activeEndpoint(pool.Endpoints()) == servers[0].URL, "expected the primary to be active again")
+	postStatus(t, r)
+	testhelper.Assert(t, services[0].Count("/status") == 1, "expected the traffic to move back to the primary")
+}
+
+func testWaitBeforeFailingBack(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	r, pool := newPool(servers, service.FailoverConfig{FailBackAfter: time.Hour})
+	services[0].SetDown(true)
+	postStatus(t, r)
+	services[0].SetDown(false)
+
+	pool.Check(context.Background())
+	endpoints := pool.Endpoints()
+	testhelper.Assert(t, endpoints[0].Healthy, "expected the primary to be healthy")
+	testhelper.Assert(t, activeEndpoint(endpoints) == servers[1].URL, "expected the backup to stay active until the primary has been healthy long enough")
+}
+
+func testFailOverOnHealthCheck(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	r, pool := newPool(servers, service.FailoverConfig{})
+	services[0].SetDown(true)
+
+	pool.Check(context.Background())
+	testhelper.Assert(t, activeEndpoint(pool.Endpoints()) == servers[1].URL, "expected the backup to be active")
+	postStatus(t, r)
+	testhelper.Assert(t, services[0].Count("/status") == 0, "expected the unhealthy primary not to be tried")
+}
+
+func testSkipOpenEndpointBreaker(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	open := &mock.CircuitBreaker{ExecuteFunc: func(action any) (any, error) {
+		return nil, gobreaker.ErrOpenState
+	}}
+	pool := service.NewEndpointPool([]service.Endpoint{
+		{URL: servers[0].URL, Priority: 0, Breaker: open},
+		{URL: servers[1].URL, Priority: 1},
+	}, servers[0].Client(), service.FailoverConfig{})
+	r := service.NewRequestSvc("http://unused", servers[0].Client(), gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithEndpoints(pool))
+
+	statusCode := postStatus(t, r)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200 from the backup, got %d", statusCode)
+	testhelper.Assert(t, open.ExecuteFuncInvoked, "expected the primary breaker to be consulted")
+	testhelper.Assert(t, pool.Endpoints()[0].Healthy, "expected an open breaker not to mark the primary unhealthy")
+}
+
+func testEveryEndpointFails(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	r, pool := newPool(servers, service.FailoverConfig{})
+	services[0].SetDown(true)
+	services[1].SetDown(true)
+
+	statusCode := postStatus(t, r)
+	testhelper.Assert(t, statusCode == http.StatusServiceUnavailable, "expected 503, got %d", statusCode)
+	for _, endpoint := range pool.Endpoints() {
+		testhelper.Assert(t, !endpoint.Healthy, "expected %s to be unhealthy", endpoint.URL)
+	}
+}
+
+func testNoFailOverWhenNotRetrySafe(t *testing.T, services []*mock.UniquenessService, servers []*httptest.Server) {
+	r, pool := newPool(servers, service.FailoverConfig{})
+	services[0].SetDown(true)
+
+	statusCode, err := r.Post(context.Background(), "/status", domain.Status{Battery: 50})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusServiceUnavailable, "expected the 503 of the primary, got %d", statusCode)
+	testhelper.Assert(t, services[1].Count("/status") == 0, "expected the status not to be sent twice")
+	testhelper.Assert(t, activeEndpoint(pool.Endpoints()) == servers[1].URL, "expected the backup to be active for the next request")
+
+	// A refused connection proves the request never reached the backup.
+	services[0].SetDown(false)
+	servers[1].Close()
+	statusCode, err = r.Post(context.Background(), "/status", domain.Status{Battery: 50})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected the request to go on to the primary, got %d", statusCode)
+	testhelper.Assert(t, services[0].Count("/status") == 1, "expected the primary to get the status")
+}
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct {
+		scenario string
+		spec     string
+		expected []service.Endpoint
+		err      error
+	}{
+		{"should keep the list order as priority", "http://a:8001, http://b:8001/", []service.Endpoint{
+			{URL: "http://a:8001", Priority: 0, Weight: 1},
+			{URL: "http://b:8001", Priority: 1, Weight: 1},
+		}, nil},
+		{"should read priority and weight", "http://a:8001;weight=3,http://b:8001;priority=0", []service.Endpoint{
+			{URL: "http://a:8001", Priority: 0, Weight: 3},
+			{URL: "http://b:8001", Priority: 0, Weight: 1},
+		}, nil},
+		{"should reject a URL without host", "a:8001", nil, domain.ErrInvalidEndpoint},
+		{"should reject an unknown setting", "http://a:8001;zone=2", nil, domain.ErrInvalidEndpoint},
+		{"should reject an empty list", " , ", nil, domain.ErrInvalidEndpoint},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			endpoints, err := service.ParseEndpoints(test.spec)
+			testhelper.Assert(t, errors.Is(err, test.err), "expected %v, got %v", test.err, err)
+			testhelper.Assert(t, len(endpoints) == len(test.expected), "expected %d endpoints, got %d", len(test.expected), len(endpoints))
+			for i := range test.expected {
+				testhelper.Assert(t, endpoints[i] == test.expected[i], "expected %+v, got %+v", test.expected[i], endpoints[i])
+			}
+		})
+	}
+}
+
+func TestEndpointWeights(t *testing.T) {
+	endpoints := []service.Endpoint{
+		{URL: "http://light:8001", Weight: 1},
+		{URL: "http://heavy:8001", Weight: 99},
+		{URL: "http://backup:8001", Priority: 1, Weight: 1000},
+	}
+	picks := map[string]int{}
+	for i := 0; i < 200; i++ {
+		pool := service.NewEndpointPool(endpoints, new(mock.HttpClient), service.FailoverConfig{})
+		picks[activeEndpoint(pool.Endpoints())]++
+	}
+	testhelper.Assert(t, picks["http://backup:8001"] == 0, "expected a lower priority never to be picked while others are healthy")
+	testhelper.Assert(t, picks["http://heavy:8001"] > 150, "expected the heavier endpoint to get most picks, got %v", picks)
+}
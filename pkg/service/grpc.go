@@ -0,0 +1,416 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCService is the full name of the uniqueness service in
+// api/uniqueness.proto.
+const GRPCService = "uniqueness.Uniqueness"
+
+// Metadata keys of the gRPC transport. The orb identity and signature keys
+// mirror the HTTP headers of the same name.
+const (
+	MetadataIdempotencyKey = "idempotency-key"
+	MetadataMatchID        = "x-match-id"
+)
+
+type (
+	// GRPCCodec passes messages through as raw bytes. Messages are encoded
+	// by the platform package, so no generated code is needed; the codec
+	// is named "proto", so the wire format is the standard one.
+	GRPCCodec struct{}
+
+	// grpcRequest sends the requests of the uniqueness service routes as
+	// gRPC calls, mapping each route to a method of the service.
+	grpcRequest struct {
+		conn          grpc.ClientConnInterface
+		cb            domain.CircuitBreaker
+		routeBreakers map[string]domain.CircuitBreaker
+		bulkheads     map[string]chan struct{}
+		limiters      map[string]*rateLimiter
+		orbID         string
+		signKey       string
+		now           func() time.Time
+	}
+
+	// GRPCOption configures optional behaviour of the gRPC request service.
+	GRPCOption func(*grpcRequest)
+)
+
+// grpcStatuses pairs gRPC status codes with the HTTP statuses callers of a
+// domain.RequestSvc expect.
+var grpcStatuses = []struct {
+	code       codes.Code
+	statusCode int
+}{
+	{codes.FailedPrecondition, http.StatusBadRequest},
+	{codes.Unauthenticated, http.StatusUnauthorized},
+	{codes.PermissionDenied, http.StatusForbidden},
+	{codes.NotFound, http.StatusNotFound},
+	{codes.AlreadyExists, http.StatusConflict},
+	{codes.OutOfRange, http.StatusRequestEntityTooLarge},
+	{codes.InvalidArgument, http.StatusUnprocessableEntity},
+	{codes.ResourceExhausted, http.StatusTooManyRequests},
+	{codes.Internal, http.StatusInternalServerError},
+	{codes.Unimplemented, http.StatusNotImplemented},
+	{codes.Unavailable, http.StatusServiceUnavailable},
+	{codes.DeadlineExceeded, http.StatusGatewayTimeout},
+}
+
+// GRPCMethods returns the method of the uniqueness service each route maps
+// to.
+func GRPCMethods() map[string]string {
+	return map[string]string{
+		"/status":        "ReportStatus",
+		"/status/batch":  "ReportStatusBatch",
+		"/sign-up":       "SignUp",
+		"/sign-up/batch": "SignUpBatch",
+		"/health-check":  "Health",
+	}
+}
+
+// NewGRPCRequestSvc creates a request service speaking gRPC to the
+// uniqueness service, as an alternative to the HTTP one.
+//
+// conn: The connection to the uniqueness service.
+// cb: The circuit breaker guarding the calls of routes without a breaker of
+// their own.
+// opts: Optional settings such as WithGRPCSigning, WithGRPCRouteBreaker,
+// WithGRPCBulkhead or WithGRPCRateLimit.
+//
+// Returns a pointer to the gRPC request service.
+func NewGRPCRequestSvc(conn grpc.ClientConnInterface, cb domain.CircuitBreaker, opts ...GRPCOption) *grpcRequest {
+	r := &grpcRequest{
+		conn:          conn,
+		cb:            cb,
+		routeBreakers: map[string]domain.CircuitBreaker{},
+		bulkheads:     map[string]chan struct{}{},
+		limiters:      map[string]*rateLimiter{},
+		now:           time.Now,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// WithGRPCSigning signs every call with the orb's identity, as the request
+// signer does for HTTP: the signature covers the encoded request message
+// and travels in the metadata.
+//
+// orbID: Identifier of the orb sending the calls.
+// signKey: Secret key used for signing operations.
+func WithGRPCSigning(orbID, signKey string) GRPCOption {
+	return func(r *grpcRequest) {
+		r.orbID = orbID
+		r.signKey = signKey
+	}
+}
+
+// WithGRPCRouteBreaker guards the calls of a route, or of a group of routes
+// sharing a breaker, with a circuit breaker of their own, as
+// WithRouteBreaker does over HTTP.
+//
+// cb: The circuit breaker guarding the routes.
+// routes: The routes of the equivalent HTTP requests.
+func WithGRPCRouteBreaker(cb domain.CircuitBreaker, routes ...string) GRPCOption {
+	return func(r *grpcRequest) {
+		for _, route := range routes {
+			r.routeBreakers[route] = cb
+		}
+	}
+}
+
+// WithGRPCBulkhead limits how many calls of a route, or of a group of
+// routes sharing the limit, may be in flight at once, as WithBulkhead does
+// over HTTP.
+//
+// maxConcurrent: The maximum number of concurrent calls; zero or less
+// leaves the routes unlimited.
+// routes: The routes of the equivalent HTTP requests.
+func WithGRPCBulkhead(maxConcurrent int, routes ...string) GRPCOption {
+	return func(r *grpcRequest) {
+		slots := newBulkhead(maxConcurrent)
+		if slots == nil {
+			return
+		}
+		for _, route := range routes {
+			r.bulkheads[route] = slots
+		}
+	}
+}
+
+// WithGRPCRateLimit caps the rate of calls of a route, or of a group of
+// routes sharing the limit, with a token bucket, as WithRateLimit does over
+// HTTP. There are no headers announcing the backend's limits to follow.
+//
+// rate: The sustained number of calls per second.
+// burst: The most calls that may go out back to back.
+// routes: The routes of the equivalent HTTP requests.
+func WithGRPCRateLimit(rate float64, burst int, routes ...string) GRPCOption {
+	return func(r *grpcRequest) {
+		limiter := newRateLimiter(rate, burst)
+		for _, route := range routes {
+			r.limiters[route] = limiter
+		}
+	}
+}
+
+// Breakers returns a snapshot of every circuit breaker used by the gRPC
+// request service, as the HTTP one does.
+func (r *grpcRequest) Breakers() []domain.BreakerSnapshot {
+	return snapshotBreakers(r.cb, r.routeBreakers)
+}
+
+// Post sends the body to the method the route maps to.
+//
+// ctx: Context bounding the call.
+// route: The route of the equivalent HTTP request.
+// body: The payload of the call.
+//
+// Returns the HTTP status matching the outcome and an error if any.
+func (r *grpcRequest) Post(ctx context.Context, route string, body any) (httpStatus int, err error) {
+	return r.Do(ctx, &domain.Request{Method: http.MethodPost, Route: route, Body: body}, nil)
+}
+
+// Do calls the method the route of the request maps to, with the body
+// encoded as its protocol buffer message. The gRPC status is reported as the
+// HTTP status the HTTP transport would have seen, so callers need not know
+// which transport is used. The Idempotency-Key header is sent as metadata.
+// The call waits for the rate limiter of its route, then takes a slot in
+// its bulkhead and goes through its circuit breaker.
+//
+// ctx: Context bounding the call.
+// req: The request to send; only its route, idempotency key and body are used.
+// out: Pointer to the value the reply is decoded into, as if it were the
+// JSON response body, or nil to discard it.
+//
+// Returns the HTTP status matching the outcome and an error if any.
+func (r *grpcRequest) Do(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+	method, ok := GRPCMethods()[req.Route]
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("Do: %w: %s", domain.ErrUnsupportedRoute, req.Route)
+	}
+	frame, err := encodeGRPC(req.Route, req.Body)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Do: %w", err)
+	}
+
+	md := metadata.MD{}
+	if key := req.Header.Get(HeaderIdempotencyKey); key != "" {
+		md.Set(MetadataIdempotencyKey, key)
+	}
+	if r.signKey != "" {
+		timestamp := strconv.FormatInt(r.now().Unix(), 10)
+		md.Set(HeaderOrbID, r.orbID)
+		md.Set(HeaderTimestamp, timestamp)
+		md.Set(HeaderSignature, SignPayload(r.signKey, r.orbID, timestamp, frame))
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	if limiter, ok := r.limiters[req.Route]; ok {
+		if err := limiter.wait(ctx); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	release, err := acquireSlot(r.bulkheads[req.Route])
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+	defer release()
+
+	cb := r.cb
+	if routeCb, ok := r.routeBreakers[req.Route]; ok {
+		cb = routeCb
+	}
+	var reply []byte
+	var trailer metadata.MD
+	var callErr error
+	_, err = cb.Execute(func() (any, error) {
+		callErr = r.conn.Invoke(ctx, "/"+GRPCService+"/"+method, frame, &reply, grpc.ForceCodec(GRPCCodec{}), grpc.Trailer(&trailer))
+		if statusForCall(req.Route, callErr) >= http.StatusInternalServerError {
+			return nil, callErr
+		}
+		return nil, nil
+	})
+	if err != nil && !errors.Is(err, callErr) {
+		return http.StatusInternalServerError, fmt.Errorf("Do: %w: %w", domain.ErrExecutionFailed, err)
+	}
+	if ctx.Err() != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Do: %w: %w", domain.ErrRequestFailed, ctx.Err())
+	}
+
+	statusCode := statusForCall(req.Route, callErr)
+	if out == nil {
+		return statusCode, nil
+	}
+	decoded, err := decodeGRPC(req.Route, reply, callErr, trailer)
+	if err != nil {
+		return statusCode, fmt.Errorf("Do: %w", domain.ErrDecodingResponse)
+	}
+	data, err := json.Marshal(decoded)
+	if err != nil || json.Unmarshal(data, out) != nil {
+		return statusCode, fmt.Errorf("Do: %w", domain.ErrDecodingResponse)
+	}
+	return statusCode, nil
+}
+
+// encodeGRPC encodes a request body as the protocol buffer message of its
+// route. The body is first brought to its JSON form, so that values,
+// pointers and JSON-encoded bodies, such as those kept in the outbox, are
+// all accepted.
+//
+// route: The route of the equivalent HTTP request.
+// body: The request body, or nil for none.
+//
+// Returns the encoded message, or domain.ErrMarshallingPayload.
+func encodeGRPC(route string, body any) ([]byte, error) {
+	data := []byte("{}")
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, domain.ErrMarshallingPayload
+		}
+	}
+	decode := func(target any) error {
+		if err := json.Unmarshal(data, target); err != nil {
+			return domain.ErrMarshallingPayload
+		}
+		return nil
+	}
+
+	switch route {
+	case "/status":
+		var status domain.Status
+		err := decode(&status)
+		return platform.MarshalStatus(&status), err
+	case "/status/batch":
+		var batch domain.StatusBatch
+		err := decode(&batch)
+		return platform.MarshalStatusBatch(&batch), err
+	case "/sign-up":
+		var iris domain.Iris
+		err := decode(&iris)
+		return platform.MarshalIris(&iris), err
+	case "/sign-up/batch":
+		var batch domain.SignUpBatch
+		if err := decode(&batch); err != nil {
+			return nil, err
+		}
+		signUps := make([]domain.Iris, len(batch.SignUps))
+		for i, raw := range batch.SignUps {
+			if err := json.Unmarshal(raw, &signUps[i]); err != nil {
+				return nil, domain.ErrMarshallingPayload
+			}
+		}
+		return platform.MarshalSignUpBatch(signUps), nil
+	}
+	return nil, nil
+}
+
+// decodeGRPC decodes the reply of a call into the value the HTTP transport
+// would have decoded from the response body. A failed call is described by
+// its status message and, for duplicates, the match ID of its trailer.
+//
+// route: The route of the equivalent HTTP request.
+// reply: The encoded reply message.
+// err: The error of the call, if any.
+// trailer: The trailer metadata of the call.
+//
+// Returns the decoded reply, or an error if it is malformed.
+func decodeGRPC(route string, reply []byte, err error, trailer metadata.MD) (any, error) {
+	if err != nil {
+		response := &domain.SignUpResponse{Message: status.Convert(err).Message()}
+		if matchID := trailer.Get(MetadataMatchID); len(matchID) > 0 {
+			response.MatchID = matchID[0]
+		}
+		return response, nil
+	}
+	switch route {
+	case "/status/batch", "/sign-up/batch":
+		return platform.UnmarshalBatchResponse(reply)
+	}
+	return platform.UnmarshalReply(reply)
+}
+
+// statusForCall gives the HTTP status matching the outcome of a call.
+//
+// route: The route of the equivalent HTTP request, which decides the status
+// of a successful call.
+// err: The error of the call, if any.
+func statusForCall(route string, err error) int {
+	code := status.Code(err)
+	if code == codes.OK {
+		if route == "/sign-up" {
+			return http.StatusCreated
+		}
+		return http.StatusOK
+	}
+	for _, s := range grpcStatuses {
+		if s.code == code {
+			return s.statusCode
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// GRPCCode gives the gRPC status code matching an HTTP status, for servers
+// answering calls as their HTTP counterpart would.
+//
+// statusCode: The HTTP status.
+//
+// Returns the gRPC status code.
+func GRPCCode(statusCode int) codes.Code {
+	for _, s := range grpcStatuses {
+		if s.statusCode == statusCode {
+			return s.code
+		}
+	}
+	switch {
+	case statusCode >= 200 && statusCode <= 299:
+		return codes.OK
+	case statusCode >= 400 && statusCode <= 499:
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
+}
+
+// Name returns the name of the codec, which sets the content subtype.
+func (GRPCCodec) Name() string {
+	return "proto"
+}
+
+// Marshal returns the raw message.
+func (GRPCCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case []byte:
+		return m, nil
+	case *[]byte:
+		return *m, nil
+	}
+	return nil, fmt.Errorf("Marshal: %w: %T", domain.ErrMarshallingPayload, v)
+}
+
+// Unmarshal copies the raw message.
+func (GRPCCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("Unmarshal: %w: %T", domain.ErrDecodingPayload, v)
+	}
+	*m = append([]byte(nil), data...)
+	return nil
+}
@@ -0,0 +1,230 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc"
+)
+
+func TestGRPC(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.UniquenessGRPC, *grpc.ClientConn)
+	}{
+		{"should report status", testGRPCReportStatus},
+		{"should report a status batch", testGRPCReportStatusBatch},
+		{"should sign up and find duplicates", testGRPCSignUpDuplicate},
+		{"should honour the idempotency key", testGRPCIdempotencyKey},
+		{"should refuse an idempotency key reused with another body", testGRPCReusedIdempotencyKey},
+		{"should sign up in batches", testGRPCSignUpBatch},
+		{"should check health", testGRPCHealth},
+		{"should guard routes with their own breakers", testGRPCRouteBreakers},
+		{"should rate limit routes", testGRPCRateLimit},
+		{"should sign calls accepted by the backend", testGRPCSigning},
+		{"should reject routes without a method", testGRPCUnsupportedRoute},
+		{"should carry sign-ups end to end", testGRPCSignUpSvc},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			g := &mock.UniquenessGRPC{Service: &mock.UniquenessService{}}
+			conn, stop, err := g.Dial()
+			testhelper.Ok(t, err)
+			defer stop()
+			test.function(t, g, conn)
+		})
+	}
+}
+
+func newGRPCRequestSvc(conn *grpc.ClientConn, opts ...service.GRPCOption) domain.RequestSvc {
+	return service.NewGRPCRequestSvc(conn, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), opts...)
+}
+
+func testGRPCReportStatus(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	r := newGRPCRequestSvc(conn)
+	statusCode, err := r.Post(context.Background(), "/status", domain.Status{Battery: 80, CPUUsage: 10, CPUTemp: 40, DiskSpace: 512})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	testhelper.Assert(t, g.Service.Count("/status") == 1, "expected the backend to record the status")
+}
+
+func testGRPCReportStatusBatch(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	r := newGRPCRequestSvc(conn)
+	from := time.Now().UTC().Truncate(time.Second)
+	batch := &domain.StatusBatch{Samples: []domain.StatusSample{
+		{From: from, To: from, Count: 1, Min: domain.Status{Battery: 50}, Max: domain.Status{Battery: 50}, Avg: domain.Status{Battery: 50}},
+		{From: from.Add(time.Second), To: from, Count: 1},
+	}}
+	var response domain.BatchResponse
+	statusCode, err := r.Do(context.Background(), &domain.Request{Method: http.MethodPost, Route: "/status/batch", Body: batch}, &response)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	testhelper.Assert(t, len(response.Results) == 2, "expected a result per sample, got %+v", response)
+	testhelper.Assert(t, response.Results[0].Status == http.StatusOK && response.Results[1].Status == http.StatusUnprocessableEntity,
+		"expected the sample ending before it starts to be rejected, got %+v", response.Results)
+	samples := g.Service.StatusSamples()
+	testhelper.Assert(t, len(samples) == 1 && samples[0].From.Equal(from), "expected the valid sample to be recorded, got %+v", samples)
+}
+
+func testGRPCSignUpDuplicate(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	r := newGRPCRequestSvc(conn)
+	var response domain.SignUpResponse
+	statusCode, err := r.Do(context.Background(), &domain.Request{Method: http.MethodPost, Route: "/sign-up", Body: domain.Iris{Id: "1", IrisCode: "code"}}, &response)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusCreated && response.Success, "expected 201, got %d %+v", statusCode, response)
+
+	response = domain.SignUpResponse{}
+	statusCode, err = r.Do(context.Background(), &domain.Request{Method: http.MethodPost, Route: "/sign-up", Body: domain.Iris{Id: "2", IrisCode: "code"}}, &response)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusConflict, "expected 409, got %d", statusCode)
+	testhelper.Assert(t, response.MatchID == "1" && response.Message != "", "expected the match ID and reason, got %+v", response)
+}
+
+func testGRPCIdempotencyKey(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	r := newGRPCRequestSvc(conn)
+	req := &domain.Request{
+		Method: http.MethodPost,
+		Route:  "/sign-up",
+		Header: http.Header{service.HeaderIdempotencyKey: []string{"1"}},
+		Body:   domain.Iris{Id: "1", IrisCode: "code"},
+	}
+	for i := 0; i < 2; i++ {
+		statusCode, err := r.Do(context.Background(), req, nil)
+		testhelper.Ok(t, err)
+		testhelper.Assert(t, statusCode == http.StatusCreated, "expected the original answer, got %d", statusCode)
+	}
+	testhelper.Assert(t, g.Service.Registered() == 1, "expected a single registration, got %d", g.Service.Registered())
+}
+
+func testGRPCReusedIdempotencyKey(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	r := newGRPCRequestSvc(conn)
+	signUp := func(code string) int {
+		statusCode, err := r.Do(context.Background(), &domain.Request{
+			Method: http.MethodPost,
+			Route:  "/sign-up",
+			Header: http.Header{service.HeaderIdempotencyKey: []string{"1"}},
+			Body:   domain.Iris{Id: "1", IrisCode: code},
+		}, nil)
+		testhelper.Ok(t, err)
+		return statusCode
+	}
+	testhelper.Assert(t, signUp("a") == http.StatusCreated, "expected the first sign-up to be registered")
+	statusCode := signUp("b")
+	testhelper.Assert(t, statusCode == http.StatusUnprocessableEntity, "expected the reused key to be refused, got %d", statusCode)
+
+	// Keys are scoped to their route.
+	statusCode, err := r.Do(context.Background(), &domain.Request{
+		Method: http.MethodPost,
+		Route:  "/status",
+		Header: http.Header{service.HeaderIdempotencyKey: []string{"1"}},
+		Body:   domain.Status{Battery: 50},
+	}, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected the status to be recorded, got %d", statusCode)
+	testhelper.Assert(t, g.Service.Registered() == 1, "expected a single registration, got %d", g.Service.Registered())
+}
+
+func testGRPCSignUpBatch(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	r := newGRPCRequestSvc(conn)
+	var signUps []json.RawMessage
+	for _, iris := range []domain.Iris{{Id: "1", IrisCode: "a"}, {Id: "2", IrisCode: "a"}, {Id: "3", IrisCode: "b"}} {
+		raw, _ := json.Marshal(iris)
+		signUps = append(signUps, raw)
+	}
+	var response domain.BatchResponse
+	statusCode, err := r.Do(context.Background(), &domain.Request{Method: http.MethodPost, Route: "/sign-up/batch", Body: domain.SignUpBatch{SignUps: signUps}}, &response)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	statuses := []int{http.StatusCreated, http.StatusConflict, http.StatusCreated}
+	testhelper.Assert(t, len(response.Results) == len(statuses), "expected a result per sign-up, got %+v", response)
+	for i, expected := range statuses {
+		testhelper.Assert(t, response.Results[i].Status == expected, "expected %d for item %d, got %+v", expected, i, response.Results[i])
+	}
+	testhelper.Assert(t, response.Results[1].MatchID == "1", "expected the duplicate to point at the first sign-up")
+}
+
+func testGRPCHealth(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	r := newGRPCRequestSvc(conn)
+	statusCode, err := r.Do(context.Background(), &domain.Request{Route: "/health-check"}, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+
+	g.Service.SetDown(true)
+	statusCode, err = r.Do(context.Background(), &domain.Request{Route: "/health-check"}, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusServiceUnavailable, "expected 503 while down, got %d", statusCode)
+}
+
+func testGRPCSigning(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	g.SignKey = "test-key"
+	g.MaxSkew = time.Minute
+
+	statusCode, err := newGRPCRequestSvc(conn).Post(context.Background(), "/status", domain.Status{Battery: 50})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusUnauthorized, "expected unsigned calls to be refused, got %d", statusCode)
+
+	statusCode, err = newGRPCRequestSvc(conn, service.WithGRPCSigning("1", "test-key")).Post(context.Background(), "/status", domain.Status{Battery: 50})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected signed calls to go through, got %d", statusCode)
+}
+
+func testGRPCUnsupportedRoute(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	statusCode, err := newGRPCRequestSvc(conn).Post(context.Background(), "/unknown", nil)
+	testhelper.Assert(t, errors.Is(err, domain.ErrUnsupportedRoute), "expected an unsupported route, got %v", err)
+	testhelper.Assert(t, statusCode == http.StatusNotFound, "expected 404, got %d", statusCode)
+}
+
+func testGRPCSignUpSvc(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	node, err := snowflake.NewNode(1)
+	testhelper.Ok(t, err)
+	imgData, err := platform.GenerateRandomImageData()
+	testhelper.Ok(t, err)
+
+	signUp := service.NewSignUpSvc("test-key", node, newGRPCRequestSvc(conn))
+	result, err := signUp.SignUp(context.Background(), imgData)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, result.Outcome == domain.SignUpRegistered, "expected the sign-up to be registered, got %+v", result)
+}
+
+func testGRPCRouteBreakers(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	statusCb := service.NewCircuitBreaker(service.BreakerSettings{Name: "status", Timeout: time.Minute, Trip: service.TripPolicy{ConsecutiveFailures: 1}})
+	r := service.NewGRPCRequestSvc(conn, service.NewCircuitBreaker(service.BreakerSettings{Name: "default"}),
+		service.WithGRPCRouteBreaker(statusCb, "/status", "/status/batch"))
+
+	g.Service.SetDown(true)
+	r.Post(context.Background(), "/status", domain.Status{})
+	g.Service.SetDown(false)
+
+	_, err := r.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Assert(t, errors.Is(err, domain.ErrExecutionFailed), "expected the status breaker to be open, got %v", err)
+	statusCode, err := r.Do(context.Background(), &domain.Request{Route: "/health-check"}, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected other routes to go through, got %d", statusCode)
+	snapshots := r.Breakers()
+	testhelper.Assert(t, len(snapshots) == 2 && snapshots[0].Name == "default" && snapshots[1].State == "open",
+		"expected the default breaker closed and the status one open, got %+v", snapshots)
+}
+
+func testGRPCRateLimit(t *testing.T, g *mock.UniquenessGRPC, conn *grpc.ClientConn) {
+	r := newGRPCRequestSvc(conn, service.WithGRPCRateLimit(0.1, 1, "/status"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := r.Post(ctx, "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	_, err = r.Post(ctx, "/status", domain.Status{})
+	testhelper.Assert(t, errors.Is(err, domain.ErrRateLimited), "expected the second status to be rate limited, got %v", err)
+	testhelper.Assert(t, g.Service.Count("/status") == 1, "expected a single status to reach the backend")
+}
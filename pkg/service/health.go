@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+
+	"github.com/sony/gobreaker"
+)
+
+// DefaultHealthInterval is the wait between two probes when none is given.
+const DefaultHealthInterval = 10 * time.Second
+
+type (
+	// HealthConfig holds how the health of the uniqueness service is probed.
+	HealthConfig struct {
+		Interval         time.Duration // Wait between two probes; DefaultHealthInterval if not positive.
+		Timeout          time.Duration // Longest a probe may take; zero for no limit.
+		WaitForReady     time.Duration // How long WaitUntilReady waits for a healthy probe.
+		FailureThreshold int           // Consecutive failed probes before the service is deemed unhealthy; at least 1.
+	}
+
+	// healthMonitor probes the health endpoint of the uniqueness service
+	// and tracks what the orb knows of its connectivity. Probes go through
+	// the request service, and so through the circuit breaker of their
+	// route, and their outcome is recorded in the breakers given with
+	// WithProbeBreakers: failed probes count towards opening them, and once
+	// one is half-open a successful probe closes it again before any
+	// capture is risked.
+	healthMonitor struct {
+		requestSvc domain.RequestSvc
+		cfg        HealthConfig
+		onChange   func(from, to domain.Connectivity)
+		breakers   []domain.CircuitBreaker
+		now        func() time.Time
+
+		mu       sync.Mutex
+		snapshot domain.HealthSnapshot
+	}
+
+	// HealthOption configures optional behaviour of the health monitor.
+	HealthOption func(*healthMonitor)
+)
+
+// NewHealthMonitor creates a health monitor. The connectivity is unknown
+// until the first probe.
+//
+// requestSvc: Service the probes are sent with.
+// cfg: Probing settings.
+// opts: Optional settings such as WithHealthChange.
+//
+// Returns a pointer to the health monitor.
+func NewHealthMonitor(requestSvc domain.RequestSvc, cfg HealthConfig, opts ...HealthOption) *healthMonitor {
+	if cfg.FailureThreshold < 1 {
+		cfg.FailureThreshold = 1
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultHealthInterval
+	}
+	h := &healthMonitor{requestSvc: requestSvc, cfg: cfg, now: time.Now}
+	h.snapshot = domain.HealthSnapshot{State: domain.ConnectivityUnknown, Since: h.now()}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// WithHealthChange calls a function whenever the connectivity changes.
+//
+// onChange: Called with the previous and the new connectivity.
+func WithHealthChange(onChange func(from, to domain.Connectivity)) HealthOption {
+	return func(h *healthMonitor) {
+		h.onChange = onChange
+	}
+}
+
+// WithProbeBreakers records the outcome of every probe in circuit breakers
+// the probes do not go through, such as those of the routes with a breaker
+// of their own.
+//
+// breakers: The circuit breakers fed with the probes.
+func WithProbeBreakers(breakers ...domain.CircuitBreaker) HealthOption {
+	return func(h *healthMonitor) {
+		h.breakers = append(h.breakers, breakers...)
+	}
+}
+
+// WaitUntilReady probes the uniqueness service every interval until a probe
+// succeeds, for at most WaitForReady.
+//
+// ctx: Context bounding the wait.
+//
+// Returns nil once the service is healthy, or domain.ErrBackendNotReady.
+func (h *healthMonitor) WaitUntilReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.WaitForReady)
+	defer cancel()
+	for {
+		err := h.Check(ctx)
+		if err == nil {
+			return nil
+		}
+		if sleep(ctx, h.cfg.Interval) != nil {
+			return fmt.Errorf("WaitUntilReady: %w: %w", domain.ErrBackendNotReady, err)
+		}
+	}
+}
+
+// Run probes the uniqueness service at each interval until ctx is done.
+//
+// ctx: Context bounding the probes.
+func (h *healthMonitor) Run(ctx context.Context) {
+	for sleep(ctx, h.cfg.Interval) == nil {
+		h.Check(ctx)
+	}
+}
+
+// Check probes the health endpoint once and records the outcome. Anything
+// but a 2xx answer is a failure, including a rejection by the circuit
+// breaker.
+//
+// ctx: Context bounding the probe.
+//
+// Returns domain.ErrBackendUnhealthy if the probe failed, wrapping its cause.
+func (h *healthMonitor) Check(ctx context.Context) error {
+	if h.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.cfg.Timeout)
+		defer cancel()
+	}
+	statusCode, err := h.requestSvc.Do(ctx, &domain.Request{Method: http.MethodGet, Route: "/health-check"}, nil)
+	if err == nil && (statusCode < 200 || statusCode > 299) {
+		err = fmt.Errorf("health check answered %d", statusCode)
+	}
+	h.record(err)
+	h.feedBreakers(err)
+	if err != nil {
+		return fmt.Errorf("Check: %w: %w", domain.ErrBackendUnhealthy, err)
+	}
+	return nil
+}
+
+// record updates the connectivity with the outcome of a probe.
+func (h *healthMonitor) record(err error) {
+	h.mu.Lock()
+	from := h.snapshot.State
+	to := from
+	now := h.now()
+	h.snapshot.LastCheck = now
+	if err == nil {
+		h.snapshot.LastError = ""
+		h.snapshot.ConsecutiveFailures = 0
+		to = domain.ConnectivityHealthy
+	} else {
+		h.snapshot.LastError = err.Error()
+		h.snapshot.ConsecutiveFailures++
+		if h.snapshot.ConsecutiveFailures >= h.cfg.FailureThreshold {
+			to = domain.ConnectivityUnhealthy
+		}
+	}
+	if to != from {
+		h.snapshot.State = to
+		h.snapshot.Since = now
+	}
+	h.mu.Unlock()
+
+	if to != from && h.onChange != nil {
+		h.onChange(from, to)
+	}
+}
+
+// feedBreakers records the outcome of a probe in the probe breakers, unless
+// it never reached the uniqueness service, having been refused by a breaker
+// on the way or cancelled.
+func (h *healthMonitor) feedBreakers(err error) {
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) || errors.Is(err, context.Canceled) {
+		return
+	}
+	for _, cb := range h.breakers {
+		cb.Execute(func() (any, error) {
+			return nil, err
+		})
+	}
+}
+
+// Ready reports whether captures may be attempted, that is unless the
+// uniqueness service is known to be unhealthy.
+func (h *healthMonitor) Ready() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.snapshot.State != domain.ConnectivityUnhealthy
+}
+
+// Snapshot returns what the orb knows of the health of the uniqueness service.
+func (h *healthMonitor) Snapshot() domain.HealthSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.snapshot
+}
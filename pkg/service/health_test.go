@@ -0,0 +1,157 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestHealthMonitor(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.UniquenessService, domain.RequestSvc)
+	}{
+		{"should be healthy once a probe succeeds", testHealthyProbe},
+		{"should be unhealthy after consecutive failed probes", testUnhealthyAfterThreshold},
+		{"should report connectivity changes", testConnectivityChanges},
+		{"should wait until the service is ready", testWaitUntilReady},
+		{"should give up waiting for readiness", testNotReadyInTime},
+		{"should feed probes into the circuit breaker", testProbesFeedBreaker},
+		{"should feed probes into the route breakers", testProbesFeedRouteBreakers},
+		{"should default a missing probe interval", testDefaultProbeInterval},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			backend := &mock.UniquenessService{}
+			server := httptest.NewServer(backend)
+			defer server.Close()
+			requestSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+			test.function(t, backend, requestSvc)
+		})
+	}
+}
+
+func testHealthyProbe(t *testing.T, backend *mock.UniquenessService, requestSvc domain.RequestSvc) {
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{Timeout: time.Second})
+	testhelper.Assert(t, health.Snapshot().State == domain.ConnectivityUnknown, "expected an unknown connectivity before probing")
+	testhelper.Assert(t, health.Ready(), "expected captures to be allowed before probing")
+
+	testhelper.Ok(t, health.Check(context.Background()))
+	snapshot := health.Snapshot()
+	testhelper.Assert(t, snapshot.State == domain.ConnectivityHealthy && !snapshot.LastCheck.IsZero(), "expected a healthy service, got %+v", snapshot)
+	testhelper.Assert(t, backend.Count("/health-check") == 1, "expected the health endpoint to be probed")
+}
+
+func testUnhealthyAfterThreshold(t *testing.T, backend *mock.UniquenessService, requestSvc domain.RequestSvc) {
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{FailureThreshold: 2})
+	testhelper.Ok(t, health.Check(context.Background()))
+
+	backend.SetDown(true)
+	err := health.Check(context.Background())
+	testhelper.Assert(t, errors.Is(err, domain.ErrBackendUnhealthy), "expected a failed probe, got %v", err)
+	testhelper.Assert(t, health.Ready(), "expected a single failure to be tolerated")
+
+	health.Check(context.Background())
+	snapshot := health.Snapshot()
+	testhelper.Assert(t, snapshot.State == domain.ConnectivityUnhealthy && snapshot.ConsecutiveFailures == 2 && snapshot.LastError != "",
+		"expected an unhealthy service, got %+v", snapshot)
+	testhelper.Assert(t, !health.Ready(), "expected captures to be suppressed")
+}
+
+func testConnectivityChanges(t *testing.T, backend *mock.UniquenessService, requestSvc domain.RequestSvc) {
+	var changes []domain.Connectivity
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{}, service.WithHealthChange(func(from, to domain.Connectivity) {
+		changes = append(changes, to)
+	}))
+
+	backend.SetDown(true)
+	health.Check(context.Background())
+	health.Check(context.Background())
+	backend.SetDown(false)
+	health.Check(context.Background())
+
+	testhelper.Assert(t, len(changes) == 2 && changes[0] == domain.ConnectivityUnhealthy && changes[1] == domain.ConnectivityHealthy,
+		"expected unhealthy then healthy, got %v", changes)
+}
+
+func testWaitUntilReady(t *testing.T, backend *mock.UniquenessService, requestSvc domain.RequestSvc) {
+	backend.SetDown(true)
+	time.AfterFunc(50*time.Millisecond, func() { backend.SetDown(false) })
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{Interval: 10 * time.Millisecond, WaitForReady: time.Second})
+
+	testhelper.Ok(t, health.WaitUntilReady(context.Background()))
+	testhelper.Assert(t, health.Snapshot().State == domain.ConnectivityHealthy, "expected a healthy service")
+	testhelper.Assert(t, backend.Count("/health-check") >= 1, "expected the service to be probed until ready")
+}
+
+func testNotReadyInTime(t *testing.T, backend *mock.UniquenessService, requestSvc domain.RequestSvc) {
+	backend.SetDown(true)
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{Interval: 10 * time.Millisecond, WaitForReady: 50 * time.Millisecond})
+
+	start := time.Now()
+	err := health.WaitUntilReady(context.Background())
+	testhelper.Assert(t, errors.Is(err, domain.ErrBackendNotReady), "expected the service not to be ready, got %v", err)
+	testhelper.Assert(t, time.Since(start) < time.Second, "expected to give up after the readiness timeout")
+	testhelper.Assert(t, !health.Ready(), "expected captures to be suppressed")
+}
+
+func testProbesFeedBreaker(t *testing.T, backend *mock.UniquenessService, _ domain.RequestSvc) {
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	cb := service.NewCircuitBreaker(service.BreakerSettings{Timeout: time.Minute, Trip: service.TripPolicy{ConsecutiveFailures: 2}})
+	requestSvc := service.NewRequestSvc(server.URL, server.Client(), cb)
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{})
+
+	backend.SetDown(true)
+	health.Check(context.Background())
+	health.Check(context.Background())
+	backend.SetDown(false)
+
+	// The breaker opened on the failed probes, so the sign-up is not sent.
+	_, err := requestSvc.Post(context.Background(), "/sign-up", domain.Iris{Id: "1", IrisCode: "code"})
+	testhelper.Assert(t, errors.Is(err, domain.ErrExecutionFailed), "expected the breaker to be open, got %v", err)
+	testhelper.Assert(t, backend.Count("/sign-up") == 0, "expected no sign-up to reach the service")
+}
+
+func testProbesFeedRouteBreakers(t *testing.T, backend *mock.UniquenessService, _ domain.RequestSvc) {
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	settings := service.BreakerSettings{Timeout: 50 * time.Millisecond, MaxRequests: 1, Trip: service.TripPolicy{ConsecutiveFailures: 2}}
+	signUpCb := service.NewCircuitBreaker(settings)
+	requestSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}),
+		service.WithRouteBreaker(signUpCb, "/sign-up"))
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{}, service.WithProbeBreakers(signUpCb))
+
+	backend.SetDown(true)
+	health.Check(context.Background())
+	health.Check(context.Background())
+	backend.SetDown(false)
+	testhelper.Assert(t, signUpCb.State() == gobreaker.StateOpen, "expected the failed probes to open the sign-up breaker")
+
+	// Once half-open, a successful probe closes it before any sign-up is risked.
+	time.Sleep(60 * time.Millisecond)
+	testhelper.Ok(t, health.Check(context.Background()))
+	testhelper.Assert(t, signUpCb.State() == gobreaker.StateClosed, "expected the probe to close the sign-up breaker, got %s", signUpCb.State())
+	testhelper.Assert(t, backend.Count("/sign-up") == 0, "expected no sign-up to reach the service")
+}
+
+func testDefaultProbeInterval(t *testing.T, _ *mock.UniquenessService, _ domain.RequestSvc) {
+	probes := 0
+	requestSvc := &mock.RequestSvc{DoFunc: func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		probes++
+		return 503, nil
+	}}
+	health := service.NewHealthMonitor(requestSvc, service.HealthConfig{WaitForReady: 50 * time.Millisecond})
+
+	testhelper.Assert(t, errors.Is(health.WaitUntilReady(context.Background()), domain.ErrBackendNotReady), "expected the service not to be ready")
+	testhelper.Assert(t, probes == 1, "expected a single probe within the default interval, got %d", probes)
+}
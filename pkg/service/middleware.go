@@ -0,0 +1,161 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+type (
+	// Middleware decorates an HTTP client with a cross-cutting concern,
+	// such as signing, headers, logging or timing.
+	Middleware func(next domain.HttpClient) domain.HttpClient
+
+	// ClientFunc adapts a function to the domain.HttpClient interface.
+	ClientFunc func(req *http.Request) (*http.Response, error)
+
+	// RequestLog describes a request sent through the logging middleware,
+	// with its secrets redacted. Bodies are never logged.
+	RequestLog struct {
+		Method     string
+		URL        string        // URL of the request, sensitive query values redacted.
+		Header     http.Header   // Headers as sent, sensitive values redacted.
+		StatusCode int           // HTTP status of the response, or zero if there was none.
+		Elapsed    time.Duration // Time until the response headers arrived.
+		Err        error         // Error raised by the client, if any.
+	}
+)
+
+// Do calls f.
+func (f ClientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Chain wraps the client in the middlewares. The first middleware is the
+// outermost: it sees the request first and the response last.
+//
+// client: The client sending the requests, usually the HTTP transport.
+// middlewares: The middlewares, outermost first.
+//
+// Returns the decorated client.
+func Chain(client domain.HttpClient, middlewares ...Middleware) domain.HttpClient {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		client = middlewares[i](client)
+	}
+	return client
+}
+
+// Signing signs the requests with the orb's identity; see NewRequestSigner.
+// Middlewares after it in the chain see the signed request.
+//
+// orbID: Identifier of the orb sending the requests.
+// signKey: Secret key used for signing operations.
+// opts: Optional signer settings such as WithScheme.
+func Signing(orbID, signKey string, opts ...SignerOption) Middleware {
+	return func(next domain.HttpClient) domain.HttpClient {
+		return NewRequestSigner(orbID, signKey, next, opts...)
+	}
+}
+
+// Identity sets the User-Agent and orb ID headers of the requests.
+//
+// userAgent: The User-Agent header value.
+// orbID: Identifier of the orb sending the requests.
+func Identity(userAgent, orbID string) Middleware {
+	return func(next domain.HttpClient) domain.HttpClient {
+		return ClientFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Set("User-Agent", userAgent)
+			req.Header.Set(HeaderOrbID, orbID)
+			return next.Do(req)
+		})
+	}
+}
+
+// Timing measures how long the requests take, until the response headers
+// arrive.
+//
+// observe: Called after each request with its route, the HTTP status, or
+// zero if there was no response, and the time taken.
+func Timing(observe func(route string, statusCode int, elapsed time.Duration)) Middleware {
+	return func(next domain.HttpClient) domain.HttpClient {
+		return ClientFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.Do(req)
+			statusCode := 0
+			if resp != nil {
+				statusCode = resp.StatusCode
+			}
+			observe(req.URL.Path, statusCode, time.Since(start))
+			return resp, err
+		})
+	}
+}
+
+// Logging reports every request once it has been answered or has failed.
+// Credentials and signatures in headers, and sensitive query parameters,
+// are redacted before log sees them.
+//
+// log: Called with the description of each request.
+func Logging(log func(RequestLog)) Middleware {
+	return func(next domain.HttpClient) domain.HttpClient {
+		return ClientFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.Do(req)
+			entry := RequestLog{
+				Method:  req.Method,
+				URL:     redactURL(req),
+				Header:  maskHeader(req.Header),
+				Elapsed: time.Since(start),
+				Err:     err,
+			}
+			if resp != nil {
+				entry.StatusCode = resp.StatusCode
+			}
+			log(entry)
+			return resp, err
+		})
+	}
+}
+
+// maskHeader copies the header with the values of the sensitive ones
+// replaced, so that their presence still shows.
+func maskHeader(header http.Header) http.Header {
+	masked := header.Clone()
+	for _, key := range sensitiveHeaders {
+		if masked.Get(key) != "" {
+			masked.Set(key, redacted)
+		}
+	}
+	return masked
+}
+
+// redactURL renders the request URL with the values of sensitive query
+// parameters replaced.
+func redactURL(req *http.Request) string {
+	u := *req.URL
+	query := u.Query()
+	changed := false
+	for name := range query {
+		if isSensitiveField(name) {
+			query.Set(name, redacted)
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// isSensitiveField tells whether a body field or query parameter may hold a
+// secret.
+func isSensitiveField(name string) bool {
+	lower := strings.ToLower(name)
+	for _, sensitive := range sensitiveFields {
+		if strings.Contains(lower, sensitive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.HttpClient)
+	}{
+		{"should apply middlewares outermost first", testChainOrder},
+		{"should set the identity headers", testIdentityHeaders},
+		{"should log requests with secrets redacted", testLoggingRedacts},
+		{"should log failed requests", testLoggingFailure},
+		{"should time requests per route", testTiming},
+		{"should sign requests accepted by the backend", testSigningMiddleware},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			h := &mock.HttpClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+			}}
+			test.function(t, h)
+		})
+	}
+}
+
+func tracing(name string, trace *[]string) service.Middleware {
+	return func(next domain.HttpClient) domain.HttpClient {
+		return service.ClientFunc(func(req *http.Request) (*http.Response, error) {
+			*trace = append(*trace, name+" in")
+			resp, err := next.Do(req)
+			*trace = append(*trace, name+" out")
+			return resp, err
+		})
+	}
+}
+
+func testChainOrder(t *testing.T, h *mock.HttpClient) {
+	var trace []string
+	client := service.Chain(h, tracing("a", &trace), tracing("b", &trace))
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/status", nil)
+	_, err := client.Do(req)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, strings.Join(trace, ",") == "a in,b in,b out,a out", "expected a around b, got %v", trace)
+}
+
+func testIdentityHeaders(t *testing.T, h *mock.HttpClient) {
+	var header http.Header
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		header = req.Header
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	client := service.Chain(h, service.Identity("virtual-orb/test", "7"))
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/health-check", nil)
+	_, err := client.Do(req)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, header.Get("User-Agent") == "virtual-orb/test" && header.Get(service.HeaderOrbID) == "7", "expected identity headers, got %v", header)
+}
+
+func testLoggingRedacts(t *testing.T, h *mock.HttpClient) {
+	var logs []service.RequestLog
+	client := service.Chain(h, service.Signing("1", "test-key"), service.Logging(func(entry service.RequestLog) {
+		logs = append(logs, entry)
+	}))
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/status?accessToken=abc&page=2", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer abc")
+	_, err := client.Do(req)
+	testhelper.Ok(t, err)
+
+	testhelper.Assert(t, len(logs) == 1, "expected 1 log entry, got %d", len(logs))
+	entry := logs[0]
+	testhelper.Assert(t, entry.Method == http.MethodPost && entry.StatusCode == http.StatusOK, "expected the request and its status, got %+v", entry)
+	testhelper.Assert(t, entry.Header.Get(service.HeaderSignature) == "[REDACTED]" && entry.Header.Get("Authorization") == "[REDACTED]",
+		"expected credentials to be redacted, got %v", entry.Header)
+	testhelper.Assert(t, entry.Header.Get(service.HeaderOrbID) == "1", "expected other headers to be kept, got %v", entry.Header)
+	testhelper.Assert(t, !strings.Contains(entry.URL, "abc") && strings.Contains(entry.URL, "page=2"), "expected the token to be redacted, got %s", entry.URL)
+	testhelper.Assert(t, req.Header.Get("Authorization") == "Bearer abc", "expected the request itself to be left alone")
+}
+
+func testLoggingFailure(t *testing.T, h *mock.HttpClient) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}
+	var logs []service.RequestLog
+	client := service.Chain(h, service.Logging(func(entry service.RequestLog) {
+		logs = append(logs, entry)
+	}))
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/health-check", nil)
+	_, err := client.Do(req)
+	testhelper.Assert(t, err != nil, "expected the error to go through")
+	testhelper.Assert(t, len(logs) == 1 && logs[0].StatusCode == 0 && logs[0].Err == err, "expected the failure to be logged, got %+v", logs)
+}
+
+func testTiming(t *testing.T, h *mock.HttpClient) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		time.Sleep(5 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusCreated, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+	}
+	var route string
+	var statusCode int
+	var elapsed time.Duration
+	client := service.Chain(h, service.Timing(func(r string, s int, e time.Duration) {
+		route, statusCode, elapsed = r, s, e
+	}))
+	r := service.NewRequestSvc("http://localhost", client, gobreaker.NewCircuitBreaker(gobreaker.Settings{}))
+	_, err := r.Post(context.Background(), "/sign-up", domain.Iris{Id: "1", IrisCode: "signed"})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, route == "/sign-up" && statusCode == http.StatusCreated, "expected the route and status, got %s %d", route, statusCode)
+	testhelper.Assert(t, elapsed >= 5*time.Millisecond, "expected the time taken, got %s", elapsed)
+}
+
+func testSigningMiddleware(t *testing.T, _ *mock.HttpClient) {
+	u := &mock.UniquenessService{SignKey: "test-key", MaxSkew: time.Minute}
+	server := httptest.NewServer(u)
+	defer server.Close()
+	client := service.Chain(server.Client(), service.Identity("virtual-orb/test", "1"), service.Signing("1", "test-key"))
+	r := service.NewRequestSvc(server.URL, client, gobreaker.NewCircuitBreaker(gobreaker.Settings{}))
+
+	statusCode, err := r.Post(context.Background(), "/status", domain.Status{Battery: 50})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected 200, got %d", statusCode)
+	testhelper.Assert(t, u.LastHeader("/status").Get("User-Agent") == "virtual-orb/test", "expected the User-Agent to reach the backend")
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+// maxRateLimitPause bounds how long a rate-limit header can hold requests
+// back, so that a bogus header cannot silence the orb.
+const maxRateLimitPause = 5 * time.Minute
+
+type (
+	// rateLimiter paces the requests to a route, or to a group of routes
+	// sharing the limit, with a token bucket and with the limits the
+	// backend announces in its responses.
+	rateLimiter struct {
+		rate  float64 // Tokens added per second; zero for no local limit.
+		burst float64 // Most tokens the bucket holds.
+
+		mu        sync.Mutex
+		tokens    float64
+		last      time.Time
+		notBefore time.Time // No request goes out before this, as the backend asked.
+	}
+)
+
+// WithRateLimit caps the rate of requests to a route, or to a group of
+// routes sharing the limit, with a token bucket. Requests over the limit
+// wait for a token, or fail immediately with domain.ErrRateLimited if their
+// context would expire first.
+//
+// rate: The sustained number of requests per second.
+// burst: The most requests that may go out back to back.
+// routes: The endpoint routes the limit applies to.
+func WithRateLimit(rate float64, burst int, routes ...string) RequestOption {
+	return func(r *request) {
+		limiter := newRateLimiter(rate, burst)
+		for _, route := range routes {
+			r.limiters[route] = limiter
+		}
+	}
+}
+
+// newRateLimiter creates a token bucket starting full.
+//
+// rate: The sustained number of requests per second.
+// burst: The most requests that may go out back to back; at least 1.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// limiter returns the rate limiter of the given route. Routes without a
+// limit of their own get one that only follows the backend's limits.
+func (r *request) limiter(route string) *rateLimiter {
+	r.limitersMu.Lock()
+	defer r.limitersMu.Unlock()
+	limiter, ok := r.limiters[route]
+	if !ok {
+		limiter = &rateLimiter{}
+		r.limiters[route] = limiter
+	}
+	return limiter
+}
+
+// wait blocks until the request may be sent.
+//
+// ctx: Context of the request; the wait ends early once it is done.
+//
+// Returns domain.ErrRateLimited if ctx would expire before the request may
+// be sent, or the context's error if it is done while waiting.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	delay := l.reserve(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		l.release()
+		return fmt.Errorf("Do: %w", domain.ErrRateLimited)
+	}
+	if err := sleep(ctx, delay); err != nil {
+		l.release()
+		return fmt.Errorf("Do: %w", err)
+	}
+	return nil
+}
+
+// reserve takes a token, going into debt if there is none left.
+//
+// now: The current time.
+//
+// Returns how long to wait before the token, and the backend's limits, allow
+// the request.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var delay time.Duration
+	if l.notBefore.After(now) {
+		delay = l.notBefore.Sub(now)
+	}
+	if l.rate <= 0 {
+		return delay
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens < 0 {
+		if wait := time.Duration(-l.tokens / l.rate * float64(time.Second)); wait > delay {
+			delay = wait
+		}
+	}
+	return delay
+}
+
+// release gives back a token reserved by a request that was not sent.
+func (l *rateLimiter) release() {
+	if l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+// observe slows the limiter down as the backend asks. Requests left in the
+// current window are spread over the time until it resets, and none goes
+// out before a Retry-After has passed.
+//
+// statusCode: HTTP status of the response.
+// header: Headers of the response.
+// now: The current time.
+func (l *rateLimiter) observe(statusCode int, header http.Header, now time.Time) {
+	var pause time.Duration
+	if remaining, reset, ok := parseRateLimit(header, now); ok {
+		pause = reset / time.Duration(remaining+1)
+	}
+	if retryAfter := parseRetryAfter(statusCode, header, now); retryAfter > pause {
+		pause = retryAfter
+	}
+	if pause > maxRateLimitPause {
+		pause = maxRateLimitPause
+	}
+	if pause <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := now.Add(pause); until.After(l.notBefore) {
+		l.notBefore = until
+	}
+}
+
+// parseRateLimit reads the RateLimit-Remaining and RateLimit-Reset headers,
+// or their X- prefixed variants. The reset holds either a number of seconds
+// or, when it is too large to be one, a Unix time.
+//
+// header: Headers of the response.
+// now: The current time, used to resolve Unix times.
+//
+// Returns the requests left in the window, the time until the window resets
+// and whether both headers were present and valid.
+func parseRateLimit(header http.Header, now time.Time) (int, time.Duration, bool) {
+	get := func(name string) (int64, bool) {
+		value := header.Get(name)
+		if value == "" {
+			value = header.Get("X-" + name)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		return n, err == nil && n >= 0
+	}
+	remaining, ok := get("RateLimit-Remaining")
+	if !ok {
+		return 0, 0, false
+	}
+	reset, ok := get("RateLimit-Reset")
+	if !ok {
+		return 0, 0, false
+	}
+	if reset > 1e9 {
+		until := time.Unix(reset, 0)
+		if !until.After(now) {
+			return 0, 0, false
+		}
+		return int(remaining), until.Sub(now), true
+	}
+	return int(remaining), time.Duration(reset) * time.Second, true
+}
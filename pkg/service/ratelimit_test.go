@@ -0,0 +1,147 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.HttpClient, *int)
+	}{
+		{"should let a burst through then pace requests", testPaceAfterBurst},
+		{"should fail fast when the wait outlasts the context", testFailFastWhenRateLimited},
+		{"should share a limit between routes", testShareRateLimit},
+		{"should pause until the backend window resets", testPauseUntilWindowResets},
+		{"should spread the requests left in the backend window", testSpreadBackendWindow},
+		{"should read the reset as a Unix time", testReadResetAsUnixTime},
+		{"should honour Retry-After on later requests", testHonourRetryAfterLater},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			sent := 0
+			h := &mock.HttpClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+				sent++
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+			}}
+			test.function(t, h, &sent)
+		})
+	}
+}
+
+// answerWith answers every request with the given status and headers.
+func answerWith(h *mock.HttpClient, sent *int, statusCode int, header http.Header) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		*sent++
+		return &http.Response{StatusCode: statusCode, Header: header, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+}
+
+func testPaceAfterBurst(t *testing.T, h *mock.HttpClient, sent *int) {
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}), service.WithRateLimit(20, 2, "/status"))
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := r.Post(context.Background(), "/status", "body")
+		testhelper.Ok(t, err)
+	}
+	elapsed := time.Since(start)
+	testhelper.Assert(t, *sent == 3, "expected 3 requests, got %d", *sent)
+	testhelper.Assert(t, elapsed >= 40*time.Millisecond, "expected the third request to wait for a token, took %s", elapsed)
+}
+
+func testFailFastWhenRateLimited(t *testing.T, h *mock.HttpClient, sent *int) {
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}), service.WithRateLimit(0.1, 1, "/sign-up"))
+	_, err := r.Post(context.Background(), "/sign-up", "body")
+	testhelper.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = r.Post(ctx, "/sign-up", "body")
+	testhelper.Assert(t, errors.Is(err, domain.ErrRateLimited), "expected a rate limit error, got %v", err)
+	testhelper.Assert(t, time.Since(start) < 40*time.Millisecond, "expected to fail without waiting")
+	testhelper.Assert(t, *sent == 1, "expected the limited request not to be sent")
+}
+
+func testShareRateLimit(t *testing.T, h *mock.HttpClient, sent *int) {
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}),
+		service.WithRateLimit(0.1, 1, "/status", "/status/batch"))
+	_, err := r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = r.Post(ctx, "/status/batch", "body")
+	testhelper.Assert(t, errors.Is(err, domain.ErrRateLimited), "expected the batch to share the status limit, got %v", err)
+	_, err = r.Post(ctx, "/sign-up", "body")
+	testhelper.Ok(t, err)
+}
+
+func testPauseUntilWindowResets(t *testing.T, h *mock.HttpClient, sent *int) {
+	answerWith(h, sent, http.StatusOK, http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"60"}})
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}))
+	_, err := r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = r.Post(ctx, "/status", "body")
+	testhelper.Assert(t, errors.Is(err, domain.ErrRateLimited), "expected to wait for the window to reset, got %v", err)
+	_, err = r.Post(ctx, "/sign-up", "body")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, *sent == 2, "expected only the other route to be sent, got %d requests", *sent)
+}
+
+func testSpreadBackendWindow(t *testing.T, h *mock.HttpClient, sent *int) {
+	answerWith(h, sent, http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"9"}, "X-Ratelimit-Reset": {"1"}})
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}))
+	_, err := r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+
+	start := time.Now()
+	_, err = r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+	elapsed := time.Since(start)
+	testhelper.Assert(t, elapsed >= 90*time.Millisecond && elapsed < 500*time.Millisecond,
+		"expected the 9 requests left to be spread over a second, waited %s", elapsed)
+}
+
+func testReadResetAsUnixTime(t *testing.T, h *mock.HttpClient, sent *int) {
+	reset := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	answerWith(h, sent, http.StatusOK, http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {reset}})
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}))
+	_, err := r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = r.Post(ctx, "/status", "body")
+	testhelper.Assert(t, errors.Is(err, domain.ErrRateLimited), "expected to wait for the window to reset, got %v", err)
+}
+
+func testHonourRetryAfterLater(t *testing.T, h *mock.HttpClient, sent *int) {
+	answerWith(h, sent, http.StatusTooManyRequests, http.Header{"Retry-After": {"30"}})
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}))
+	statusCode, err := r.Post(context.Background(), "/sign-up", "body")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusTooManyRequests, "expected 429, got %d", statusCode)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = r.Post(ctx, "/sign-up", "body")
+	testhelper.Assert(t, errors.Is(err, domain.ErrRateLimited), "expected to hold off until Retry-After, got %v", err)
+	testhelper.Assert(t, *sent == 1, "expected a single request, got %d", *sent)
+}
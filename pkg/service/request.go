@@ -2,19 +2,55 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 	"virtual-orb/pkg/domain"
 )
 
+// DefaultMaxResponseSize is the largest response body, in bytes, that the
+// request service will read when decoding a response.
+const DefaultMaxResponseSize = 1 << 20
+
 // request represents a struct that holds properties
 // required for executing HTTP requests.
 type (
 	request struct {
-		baseURL string
-		client  domain.HttpClient
-		cb      domain.CircuitBreaker
+		baseURL         string
+		client          domain.HttpClient
+		cb              domain.CircuitBreaker
+		maxResponseSize int64
+		defaultRetry    RetryPolicy
+		routeRetry      map[string]RetryPolicy
+		classifier      ResponseClassifier
+		routeBreakers   map[string]domain.CircuitBreaker
+		bulkheads       map[string]chan struct{}
+		encoding        Encoding
+		gzipMinSize     int
+		plainOnly       atomic.Bool
+		contracts       Contracts
+		endpoints       *endpointPool
+		limitersMu      sync.Mutex
+		limiters        map[string]*rateLimiter
+		apiVersion      string
+		negotiation     *negotiation
+		clock           *clockMonitor
+	}
+
+	// RequestOption configures optional behaviour of the request service.
+	RequestOption func(*request)
+
+	// response holds what the request service keeps of an HTTP response.
+	response struct {
+		statusCode int
+		header     http.Header
+		body       []byte
 	}
 )
 
@@ -23,57 +59,260 @@ type (
 //
 // baseURL: The base URL to which the HTTP requests will be sent.
 // client: The HTTP client that will be used to send requests.
-// cb: The circuit breaker that will be used to handle failures.
+// cb: The circuit breaker used for routes without a breaker of their own.
+// opts: Optional settings such as WithMaxResponseSize, WithRetryPolicy,
+// WithResponseClassifier, WithRouteBreaker, WithBulkhead, WithEncoding,
+// WithCompression, WithContracts, WithEndpoints, WithRateLimit,
+// WithAPIVersion, WithNegotiatedAPIVersion or WithClockMonitor.
 //
 // Returns a pointer to a request service instance.
-func NewRequestSvc(baseURL string, client domain.HttpClient, cb domain.CircuitBreaker) *request {
-	return &request{
-		baseURL,
-		client,
-		cb,
+func NewRequestSvc(baseURL string, client domain.HttpClient, cb domain.CircuitBreaker, opts ...RequestOption) *request {
+	r := &request{
+		baseURL:         baseURL,
+		client:          client,
+		cb:              cb,
+		maxResponseSize: DefaultMaxResponseSize,
+		defaultRetry:    RetryPolicy{MaxAttempts: 1},
+		routeRetry:      map[string]RetryPolicy{},
+		classifier:      DefaultResponseClassifier(),
+		routeBreakers:   map[string]domain.CircuitBreaker{},
+		bulkheads:       map[string]chan struct{}{},
+		limiters:        map[string]*rateLimiter{},
+		encoding:        EncodingJSON,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// WithMaxResponseSize limits how many bytes of a response body are read
+// when decoding it.
+//
+// size: The maximum response body size in bytes.
+func WithMaxResponseSize(size int64) RequestOption {
+	return func(r *request) {
+		r.maxResponseSize = size
 	}
 }
 
 // Post sends a POST request to the given route with the provided body.
 //
+// ctx: Context bounding the request, including any retries.
 // route: The endpoint route to send the POST request to (relative to baseURL).
 // body: The payload/body for the POST request.
 //
 // Returns the HTTP status code of the response and an error if any occurred during the process.
-func (r *request) Post(route string, body any) (httpStatus int, err error) {
-	payload, err := json.Marshal(body)
+func (r *request) Post(ctx context.Context, route string, body any) (httpStatus int, err error) {
+	return r.Do(ctx, &domain.Request{Method: http.MethodPost, Route: route, Body: body}, nil)
+}
+
+// Do sends the given request and, when out is not nil, decodes the JSON
+// response body into it. Response bodies larger than the configured limit
+// are rejected rather than truncated. Failed attempts are retried according
+// to the retry policy of the route, until ctx is done. The body is encoded
+// and compressed as configured; if the backend answers 415 Unsupported Media
+// Type, the request is sent again as plain JSON, as are all later ones.
+// With contracts, a body breaking the contract of its route is answered
+// with 422 without being sent.
+//
+// ctx: Context bounding the request, including any retries.
+// req: The request to send; its method defaults to GET when empty.
+// out: Pointer to the value the response body is decoded into, or nil to discard it.
+//
+// Returns the HTTP status code of the response and an error if any occurred during the process.
+func (r *request) Do(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+	if r.contracts != nil && req.Body != nil {
+		if err := r.contracts.Validate(req.Route, req.Body); err != nil {
+			// Answer as the backend would, so the body is never retried.
+			return http.StatusUnprocessableEntity, fmt.Errorf("Do: %w", err)
+		}
+	}
+
+	body, err := r.encode(req.Body, r.plainOnly.Load())
 	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("Post: %w", domain.ErrMarshallingPayload)
+		return http.StatusInternalServerError, fmt.Errorf("Do: %w", err)
 	}
 
-	var statusCode int
+	resp, err := r.send(ctx, req, body, out != nil)
+	if err == nil && resp.statusCode == http.StatusUnsupportedMediaType && body.transformed() {
+		// The backend cannot read compressed or binary bodies: settle for
+		// plain JSON from now on.
+		r.plainOnly.Store(true)
+		if body, err = r.encode(req.Body, true); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("Do: %w", err)
+		}
+		resp, err = r.send(ctx, req, body, out != nil)
+	}
+	if errors.Is(err, domain.ErrBulkheadFull) {
+		return http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
 
-	action := func() (any, error) {
-		url := fmt.Sprintf("%s%s", r.baseURL, route)
-		req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if int64(len(resp.body)) > r.maxResponseSize {
+		return resp.statusCode, fmt.Errorf("Do: %w", domain.ErrResponseTooLarge)
+	}
+	if len(resp.body) > 0 {
+		if err := json.Unmarshal(resp.body, out); err != nil {
+			return resp.statusCode, fmt.Errorf("Do: %w", domain.ErrDecodingResponse)
+		}
+	}
+	return resp.statusCode, nil
+}
 
+// send sends the request, retrying failed attempts according to the retry
+// policy of the route until ctx is done. Every attempt first waits for the
+// rate limiter of the route, which learns from each response, then takes a
+// slot in the bulkhead of the route for as long as it is in flight.
+//
+// ctx: Context bounding the request, including any retries.
+// req: The request to send.
+// body: The encoded body, or nil for none.
+// readBody: Whether the response body has to be kept for decoding.
+//
+// Returns the last response and an error if no response was received.
+func (r *request) send(ctx context.Context, req *domain.Request, body *payload, readBody bool) (*response, error) {
+	policy := r.retryPolicy(req.Route)
+	limiter := r.limiter(req.Route)
+	for attempt := 1; ; attempt++ {
+		if err := limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		release, err := r.acquire(req.Route)
 		if err != nil {
-			return nil, fmt.Errorf("Post: %w", domain.ErrRequestFailed)
+			return nil, err
 		}
-		req.Header.Set("Content-Type", "application/json")
+		resp, err := r.attempt(ctx, req, body, readBody)
+		release()
 
-		resp, err := r.client.Do(req)
+		var statusCode int
+		var retryAfter time.Duration
+		if err == nil {
+			now := time.Now()
+			statusCode = resp.statusCode
+			retryAfter = parseRetryAfter(resp.statusCode, resp.header, now)
+			limiter.observe(resp.statusCode, resp.header, now)
+		}
+		delay, retry := nextRetry(policy, attempt, req, statusCode, retryAfter, err)
+		if !retry {
+			return resp, err
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, fmt.Errorf("Do: %w", err)
+		}
+	}
+}
+
+// attempt sends the request once, through the circuit breaker.
+//
+// ctx: Context the HTTP request is bound to.
+// req: The request to send.
+// body: The encoded body, or nil for none.
+// readBody: Whether the response body has to be kept for decoding.
+//
+// Returns the response and an error if any occurred during the process.
+// Errors raised by the circuit breaker itself are wrapped so they can be told apart.
+// Outcomes are reported to the breaker as the response classifier dictates,
+// so a 5xx response can count as a failure while still being returned.
+func (r *request) attempt(ctx context.Context, req *domain.Request, body *payload, readBody bool) (*response, error) {
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	version := r.apiVersion
+	if r.negotiation != nil {
+		version = r.negotiation.Current().APIVersion
+	}
+	path := versionedRoute(version, req.Route)
+	if len(req.Query) > 0 {
+		path = fmt.Sprintf("%s?%s", path, req.Query.Encode())
+	}
+
+	resp := &response{}
+
+	exchange := func(baseURL string) (any, error) {
+		url := baseURL + path
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body.data)
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, method, url, reader)
 		if err != nil {
-			return nil, fmt.Errorf("Post: %w", domain.ErrRequestFailed)
+			return nil, fmt.Errorf("Do: %w", domain.ErrRequestFailed)
+		}
+		for key, values := range req.Header {
+			httpReq.Header[key] = append([]string(nil), values...)
+		}
+		if body != nil {
+			httpReq.Header.Set("Content-Type", body.contentType)
+			if body.contentEncoding != "" {
+				httpReq.Header.Set("Content-Encoding", body.contentEncoding)
+			}
+		}
+		if readBody {
+			httpReq.Header.Set("Accept", "application/json")
 		}
 
-		defer resp.Body.Close()
-		return resp.StatusCode, nil
+		sent := time.Now()
+		httpResp, err := r.client.Do(httpReq)
+		if err == nil && r.clock != nil {
+			r.clock.ObserveDate(sent, time.Now(), httpResp.Header.Get("Date"))
+		}
+		if err != nil {
+			if !r.classifier.isFailureError(err) {
+				// Not the backend's fault: fail the request without
+				// counting it against the breaker.
+				return nil, notFailure{fmt.Errorf("Do: %w: %w", domain.ErrRequestFailed, err)}
+			}
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("Do: %w: %w", domain.ErrRequestFailed, ctx.Err())
+			}
+			return nil, fmt.Errorf("Do: %w: %w", domain.ErrRequestFailed, err)
+		}
+		defer httpResp.Body.Close()
+
+		resp.header = httpResp.Header
+		if readBody {
+			// Read one byte past the limit to tell a body that exactly fits
+			// apart from one that has to be rejected.
+			resp.body, err = io.ReadAll(io.LimitReader(httpResp.Body, r.maxResponseSize+1))
+			if err != nil {
+				return nil, fmt.Errorf("Do: %w", domain.ErrRequestFailed)
+			}
+		}
+		if r.classifier.isFailureStatus(httpResp.StatusCode) {
+			resp.statusCode = httpResp.StatusCode
+			return nil, errFailureStatus
+		}
+		return httpResp.StatusCode, nil
+	}
+	action := func() (any, error) {
+		return exchange(r.baseURL)
+	}
+	if r.endpoints != nil {
+		action = func() (any, error) {
+			return r.endpoints.execute(ctx, isRetrySafe(req), exchange)
+		}
 	}
 
-	result, err := r.cb.Execute(action)
+	result, err := r.breaker(req.Route).Execute(action)
+	if errors.Is(err, errFailureStatus) {
+		return resp, nil
+	}
+	var nf notFailure
+	if errors.As(err, &nf) {
+		return nil, nf.err
+	}
 	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("Post: %w", domain.ErrExecutionFailed)
+		return nil, fmt.Errorf("Do: %w: %w", domain.ErrExecutionFailed, err)
 	}
 
 	statusCode, ok := result.(int)
 	if !ok {
-		return http.StatusInternalServerError, fmt.Errorf("Post: %w", domain.ErrCasting)
+		return nil, fmt.Errorf("Do: %w", domain.ErrCasting)
 	}
-	return statusCode, nil
+	resp.statusCode = statusCode
+	return resp, nil
 }
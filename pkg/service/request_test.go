@@ -2,11 +2,16 @@ package service_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
 	"virtual-orb/pkg/service"
 	testhelper "virtual-orb/test_helper"
 
@@ -22,6 +27,18 @@ func TestRequest(t *testing.T) {
 		{"should handle client error", testHandleClientError},
 		{"should handle circuit breaker error", testHandleCBError},
 		{"should handle JSON marshal error", testHandleJSONError},
+		{"should send method, query and headers", testSendMethodQueryHeaders},
+		{"should decode JSON response into caller type", testDecodeResponse},
+		{"should reject response exceeding size limit", testRejectLargeResponse},
+		{"should handle response decoding error", testHandleDecodingError},
+		{"should retry idempotent request honouring Retry-After", testRetryIdempotentRequest},
+		{"should not retry non-idempotent request", testNoRetryNonIdempotentRequest},
+		{"should retry idempotency-keyed request", testRetryIdempotencyKeyedRequest},
+		{"should give up after max attempts", testGiveUpAfterMaxAttempts},
+		{"should stop retrying once the circuit breaker opens", testStopRetryingWhenBreakerOpens},
+		{"should bind the HTTP request to the context", testBindRequestToContext},
+		{"should stop retrying once the context is done", testStopRetryingWhenContextDone},
+		{"should honour Retry-After without a max delay", testRetryAfterWithoutMaxDelay},
 	}
 
 	for _, test := range tests {
@@ -48,7 +65,7 @@ func testSuccessfullyPost(t *testing.T, baseUrl string, h *mock.HttpClient, cb *
 
 	r := service.NewRequestSvc(baseUrl, h, cb)
 	body := []byte("body")
-	_, err := r.Post("/test", body)
+	_, err := r.Post(context.Background(), "/test", body)
 	testhelper.Ok(t, err)
 	testhelper.Assert(t, cb.ExecuteFuncInvoked == true, "expected httpClient.Do to be invoked")
 }
@@ -61,7 +78,7 @@ func testHandleClientError(t *testing.T, baseUrl string, h *mock.HttpClient, cb
 	cbReal := gobreaker.NewCircuitBreaker(cbSettings)
 	r := service.NewRequestSvc(baseUrl, h, cbReal)
 	body := []byte("body")
-	_, err := r.Post("/test", body)
+	_, err := r.Post(context.Background(), "/test", body)
 	testhelper.Assert(t, err != nil, "expected an error from client")
 }
 
@@ -72,13 +89,233 @@ func testHandleCBError(t *testing.T, baseUrl string, h *mock.HttpClient, cb *moc
 
 	r := service.NewRequestSvc(baseUrl, h, cb)
 	body := []byte("body")
-	_, err := r.Post("/test", body)
+	_, err := r.Post(context.Background(), "/test", body)
 	testhelper.Assert(t, err != nil, "expected an error from circuit breaker")
 }
 
 func testHandleJSONError(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
 	r := service.NewRequestSvc(baseUrl, h, cb)
 	body := make(chan int) // A type that can't be marshaled to JSON
-	_, err := r.Post("/test", body)
+	_, err := r.Post(context.Background(), "/test", body)
 	testhelper.Assert(t, err != nil, "expected a JSON marshalling error")
 }
+
+func testSendMethodQueryHeaders(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	var sent *http.Request
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		sent = req
+		return &http.Response{
+			StatusCode: 204,
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}))
+	req := &domain.Request{
+		Method: http.MethodDelete,
+		Route:  "/sign-up/42",
+		Query:  url.Values{"reason": []string{"revoked"}},
+		Header: http.Header{"X-Test": []string{"yes"}},
+	}
+	statusCode, err := r.Do(context.Background(), req, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == 204, "expected 204, got %d", statusCode)
+	testhelper.Assert(t, sent.Method == http.MethodDelete, "expected DELETE, got %s", sent.Method)
+	testhelper.Assert(t, sent.URL.String() == baseUrl+"/sign-up/42?reason=revoked", "unexpected URL %s", sent.URL)
+	testhelper.Assert(t, sent.Header.Get("X-Test") == "yes", "expected custom header to be sent")
+	testhelper.Assert(t, sent.Body == nil, "expected no body for a request without payload")
+}
+
+func testDecodeResponse(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 409,
+			Body:       io.NopCloser(strings.NewReader(`{"success":false,"message":"Already registered"}`)),
+		}, nil
+	}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}))
+	var out struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	statusCode, err := r.Do(context.Background(), &domain.Request{Method: http.MethodPost, Route: "/sign-up", Body: "body"}, &out)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == 409, "expected 409, got %d", statusCode)
+	testhelper.Assert(t, out.Message == "Already registered", "unexpected message %q", out.Message)
+}
+
+func testRejectLargeResponse(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(strings.NewReader(`{"message":"` + strings.Repeat("a", 64) + `"}`)),
+		}, nil
+	}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithMaxResponseSize(32))
+	var out map[string]any
+	_, err := r.Do(context.Background(), &domain.Request{Route: "/status"}, &out)
+	testhelper.Assert(t, errors.Is(err, domain.ErrResponseTooLarge), "expected a response too large error, got %v", err)
+}
+
+func testHandleDecodingError(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(strings.NewReader("not json")),
+		}, nil
+	}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}))
+	var out map[string]any
+	_, err := r.Do(context.Background(), &domain.Request{Route: "/status"}, &out)
+	testhelper.Assert(t, errors.Is(err, domain.ErrDecodingResponse), "expected a decoding error, got %v", err)
+}
+
+func testRetryIdempotentRequest(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	calls := 0
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			return &http.Response{
+				StatusCode: 503,
+				Header:     http.Header{"Retry-After": []string{"1"}},
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	policy := service.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithRetryPolicy(policy))
+
+	start := time.Now()
+	statusCode, err := r.Do(context.Background(), &domain.Request{Method: http.MethodGet, Route: "/health-check"}, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == 200, "expected 200, got %d", statusCode)
+	testhelper.Assert(t, calls == 2, "expected 2 attempts, got %d", calls)
+	testhelper.Assert(t, time.Since(start) >= time.Second, "expected Retry-After to be honoured")
+}
+
+func testNoRetryNonIdempotentRequest(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	calls := 0
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 503, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	policy := service.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithRetryPolicy(policy))
+	statusCode, _ := r.Post(context.Background(), "/status", "body")
+	testhelper.Assert(t, statusCode == 503, "expected 503, got %d", statusCode)
+	testhelper.Assert(t, calls == 1, "expected a single attempt, got %d", calls)
+}
+
+func testRetryIdempotencyKeyedRequest(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	var keys []string
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		keys = append(keys, req.Header.Get(service.HeaderIdempotencyKey))
+		if len(keys) < 3 {
+			return nil, errors.New("connection reset")
+		}
+		return &http.Response{StatusCode: 201, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	policy := service.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithRouteRetryPolicy("/sign-up", policy))
+	req := &domain.Request{
+		Method: http.MethodPost,
+		Route:  "/sign-up",
+		Header: http.Header{service.HeaderIdempotencyKey: []string{"123"}},
+		Body:   "body",
+	}
+	statusCode, err := r.Do(context.Background(), req, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == 201, "expected 201, got %d", statusCode)
+	testhelper.Assert(t, len(keys) == 3, "expected 3 attempts, got %d", len(keys))
+	for _, key := range keys {
+		testhelper.Assert(t, key == "123", "expected the idempotency key on every attempt, got %q", key)
+	}
+}
+
+func testGiveUpAfterMaxAttempts(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	calls := 0
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		calls++
+		return nil, errors.New("connection refused")
+	}
+	policy := service.RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithRetryPolicy(policy))
+	_, err := r.Do(context.Background(), &domain.Request{Route: "/health-check"}, nil)
+	testhelper.Assert(t, errors.Is(err, domain.ErrExecutionFailed), "expected an execution error, got %v", err)
+	testhelper.Assert(t, calls == 4, "expected 4 attempts, got %d", calls)
+}
+
+func testStopRetryingWhenBreakerOpens(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	calls := 0
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		calls++
+		return nil, errors.New("connection refused")
+	}
+	cbReal := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= 2
+		},
+	})
+	policy := service.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	r := service.NewRequestSvc(baseUrl, h, cbReal, service.WithRetryPolicy(policy))
+	_, err := r.Do(context.Background(), &domain.Request{Route: "/health-check"}, nil)
+	testhelper.Assert(t, errors.Is(err, gobreaker.ErrOpenState), "expected the open breaker to end retries, got %v", err)
+	testhelper.Assert(t, calls == 2, "expected 2 attempts before the breaker opened, got %d", calls)
+}
+
+func testBindRequestToContext(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "orb")
+	var seen any
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		seen = req.Context().Value(key{})
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}))
+	_, err := r.Post(ctx, "/status", "body")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, seen == "orb", "expected the request to carry the caller's context")
+}
+
+func testStopRetryingWhenContextDone(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	calls := 0
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{
+			StatusCode: 503,
+			Header:     http.Header{"Retry-After": []string{"1"}},
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+	policy := service.RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: time.Second}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithRetryPolicy(policy))
+
+	start := time.Now()
+	_, err := r.Do(ctx, &domain.Request{Route: "/health-check"}, nil)
+	testhelper.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected a deadline error, got %v", err)
+	testhelper.Assert(t, time.Since(start) < time.Second, "expected the backoff to be cut short by the context")
+	testhelper.Assert(t, calls == 1, "expected no more attempts after the deadline, got %d", calls)
+}
+
+func testRetryAfterWithoutMaxDelay(t *testing.T, baseUrl string, h *mock.HttpClient, cb *mock.CircuitBreaker) {
+	calls := 0
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			return &http.Response{
+				StatusCode: 503,
+				Header:     http.Header{"Retry-After": []string{"1"}},
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	policy := service.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+	r := service.NewRequestSvc(baseUrl, h, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithRetryPolicy(policy))
+
+	statusCode, err := r.Do(context.Background(), &domain.Request{Route: "/health-check"}, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == 200 && calls == 2, "expected Retry-After to be honoured without a cap, got %d after %d calls", statusCode, calls)
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+	"virtual-orb/pkg/domain"
+
+	"github.com/sony/gobreaker"
+)
+
+// HeaderIdempotencyKey marks a request as safe to retry even when its
+// method is not idempotent.
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// RetryPolicy configures how failed requests to a route are retried.
+// Delays grow exponentially from BaseDelay up to MaxDelay, if any, and each
+// wait is drawn uniformly between zero and that bound ("full jitter").
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts, including the first one. Values below 2 disable retries.
+	BaseDelay   time.Duration // Upper bound of the wait before the first retry.
+	MaxDelay    time.Duration // Cap on the wait between two attempts, including Retry-After; zero for no cap.
+}
+
+// WithRetryPolicy sets the retry policy used for routes without a
+// route-specific policy.
+//
+// policy: The retry policy to apply by default.
+func WithRetryPolicy(policy RetryPolicy) RequestOption {
+	return func(r *request) {
+		r.defaultRetry = policy
+	}
+}
+
+// WithRouteRetryPolicy sets the retry policy for a single route.
+//
+// route: The endpoint route the policy applies to.
+// policy: The retry policy for that route.
+func WithRouteRetryPolicy(route string, policy RetryPolicy) RequestOption {
+	return func(r *request) {
+		r.routeRetry[route] = policy
+	}
+}
+
+// retryPolicy returns the retry policy configured for the given route.
+func (r *request) retryPolicy(route string) RetryPolicy {
+	if policy, ok := r.routeRetry[route]; ok {
+		return policy
+	}
+	return r.defaultRetry
+}
+
+// nextRetry decides whether a failed attempt should be retried and how long
+// to wait before doing so. Only idempotent or idempotency-keyed requests are
+// retried, never once the caller's context is done, and never while the
+// circuit breaker is rejecting calls, so that retries do not hammer a
+// backend the breaker has already given up on.
+//
+// policy: The retry policy of the route.
+// attempt: Number of attempts made so far.
+// req: The request being sent.
+// statusCode: HTTP status of the last attempt, if a response was received.
+// retryAfter: Wait requested by the backend through the Retry-After header.
+// err: Error of the last attempt, if any.
+//
+// Returns the wait before the next attempt and whether to retry at all.
+func nextRetry(policy RetryPolicy, attempt int, req *domain.Request, statusCode int, retryAfter time.Duration, err error) (time.Duration, bool) {
+	if attempt >= policy.MaxAttempts || !isRetrySafe(req) {
+		return 0, false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0, false
+	}
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return 0, false
+	}
+	if err == nil && !isRetryableStatus(statusCode) {
+		return 0, false
+	}
+
+	if retryAfter > 0 {
+		// Waiting longer than the policy allows would stall the caller, so
+		// give up and let the next periodic run try again.
+		if policy.MaxDelay > 0 && retryAfter > policy.MaxDelay {
+			return 0, false
+		}
+		return retryAfter, true
+	}
+	return backoff(policy, attempt), true
+}
+
+// sleep waits for the given duration, returning early with the context's
+// error if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isRetrySafe reports whether sending the request twice cannot have
+// unintended side effects.
+func isRetrySafe(req *domain.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get(HeaderIdempotencyKey) != ""
+}
+
+// isRetryableStatus reports whether a response status signals a failure
+// that may go away on its own.
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns a random wait between zero and the exponential bound for
+// the given attempt. Without a MaxDelay, the bound stops growing before it
+// overflows.
+func backoff(policy RetryPolicy, attempt int) time.Duration {
+	capped := policy.MaxDelay > 0
+	bound := policy.BaseDelay
+	for i := 1; i < attempt && bound > 0 && bound <= math.MaxInt64/2; i++ {
+		if capped && bound >= policy.MaxDelay {
+			break
+		}
+		bound *= 2
+	}
+	if capped && bound > policy.MaxDelay {
+		bound = policy.MaxDelay
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(bound) + 1))
+}
+
+// parseRetryAfter reads the Retry-After header of 429 and 503 responses,
+// which holds either a number of seconds or an HTTP date.
+//
+// statusCode: HTTP status of the response.
+// header: Headers of the response.
+// now: The current time, used to resolve HTTP dates.
+//
+// Returns the requested wait, or zero if there is none.
+func parseRetryAfter(statusCode int, header http.Header, now time.Time) time.Duration {
+	if statusCode != http.StatusTooManyRequests && statusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
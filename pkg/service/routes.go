@@ -0,0 +1,155 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"virtual-orb/pkg/domain"
+
+	"github.com/sony/gobreaker"
+)
+
+type (
+	// inspectableBreaker is implemented by circuit breakers that expose
+	// their state, such as gobreaker's and the one built by NewCircuitBreaker.
+	inspectableBreaker interface {
+		Name() string
+		State() gobreaker.State
+		Counts() gobreaker.Counts
+	}
+)
+
+// WithRouteBreaker guards a route, or a group of routes sharing a breaker,
+// with its own circuit breaker instead of the default one, so that a failing
+// endpoint cannot block the others.
+//
+// cb: The circuit breaker guarding the routes.
+// routes: The endpoint routes the breaker applies to.
+func WithRouteBreaker(cb domain.CircuitBreaker, routes ...string) RequestOption {
+	return func(r *request) {
+		for _, route := range routes {
+			r.routeBreakers[route] = cb
+		}
+	}
+}
+
+// WithBulkhead limits how many requests to a route, or to a group of routes
+// sharing the limit, may be in flight at once. Requests over the limit fail
+// immediately with domain.ErrBulkheadFull rather than queueing up. A slot is
+// only held while an attempt is in flight, not while a retry backs off.
+//
+// maxConcurrent: The maximum number of concurrent requests; zero or less
+// leaves the routes unlimited.
+// routes: The endpoint routes the limit applies to.
+func WithBulkhead(maxConcurrent int, routes ...string) RequestOption {
+	return func(r *request) {
+		slots := newBulkhead(maxConcurrent)
+		if slots == nil {
+			return
+		}
+		for _, route := range routes {
+			r.bulkheads[route] = slots
+		}
+	}
+}
+
+// newBulkhead returns the slots of a bulkhead, or nil for no limit.
+func newBulkhead(maxConcurrent int) chan struct{} {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return make(chan struct{}, maxConcurrent)
+}
+
+// breaker returns the circuit breaker guarding the given route.
+func (r *request) breaker(route string) domain.CircuitBreaker {
+	if cb, ok := r.routeBreakers[route]; ok {
+		return cb
+	}
+	return r.cb
+}
+
+// acquire takes a slot in the bulkhead of the given route, if it has one.
+//
+// route: The endpoint route about to be requested.
+//
+// Returns a function releasing the slot, or an error if the bulkhead is full.
+func (r *request) acquire(route string) (func(), error) {
+	return acquireSlot(r.bulkheads[route])
+}
+
+// acquireSlot takes a slot of a bulkhead without waiting.
+//
+// slots: The slots of the bulkhead, or nil for no limit.
+//
+// Returns the function giving the slot back, or domain.ErrBulkheadFull.
+func acquireSlot(slots chan struct{}) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	default:
+		return nil, fmt.Errorf("Do: %w", domain.ErrBulkheadFull)
+	}
+}
+
+// Breakers returns a snapshot of every circuit breaker used by the request
+// service, along with the routes it guards. The default breaker comes first
+// and lists no routes. Breakers that do not expose their state are skipped.
+func (r *request) Breakers() []domain.BreakerSnapshot {
+	return snapshotBreakers(r.cb, r.routeBreakers)
+}
+
+// snapshotBreakers captures the default circuit breaker, then those of the
+// routes, in the order of their names.
+//
+// defaultCb: The default circuit breaker.
+// routeBreakers: The circuit breakers of the routes with one of their own.
+//
+// Returns the snapshots of the breakers that expose their state.
+func snapshotBreakers(defaultCb domain.CircuitBreaker, routeBreakers map[string]domain.CircuitBreaker) []domain.BreakerSnapshot {
+	routes := map[domain.CircuitBreaker][]string{}
+	for route, cb := range routeBreakers {
+		routes[cb] = append(routes[cb], route)
+	}
+
+	var snapshots []domain.BreakerSnapshot
+	for cb, guarded := range routes {
+		if snapshot, ok := snapshotBreaker(cb, guarded); ok {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	if snapshot, ok := snapshotBreaker(defaultCb, nil); ok {
+		snapshots = append([]domain.BreakerSnapshot{snapshot}, snapshots...)
+	}
+	return snapshots
+}
+
+// snapshotBreaker captures the state and counts of a circuit breaker.
+//
+// cb: The circuit breaker to inspect.
+// routes: The routes the breaker guards.
+//
+// Returns the snapshot, and false if the breaker does not expose its state.
+func snapshotBreaker(cb domain.CircuitBreaker, routes []string) (domain.BreakerSnapshot, bool) {
+	inspectable, ok := cb.(inspectableBreaker)
+	if !ok {
+		return domain.BreakerSnapshot{}, false
+	}
+	sort.Strings(routes)
+	counts := inspectable.Counts()
+	return domain.BreakerSnapshot{
+		Name:                 inspectable.Name(),
+		Routes:               routes,
+		State:                inspectable.State().String(),
+		Requests:             counts.Requests,
+		TotalSuccesses:       counts.TotalSuccesses,
+		TotalFailures:        counts.TotalFailures,
+		ConsecutiveSuccesses: counts.ConsecutiveSuccesses,
+		ConsecutiveFailures:  counts.ConsecutiveFailures,
+	}, true
+}
@@ -0,0 +1,164 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestRoutes(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.HttpClient)
+	}{
+		{"should isolate routes with their own breaker", testIsolateRouteBreakers},
+		{"should reject requests over the bulkhead limit", testRejectOverBulkhead},
+		{"should release bulkhead slots", testReleaseBulkheadSlots},
+		{"should release bulkhead slots while backing off", testReleaseBulkheadWhileBackingOff},
+		{"should not limit routes with a bulkhead of zero", testUnlimitedBulkhead},
+		{"should snapshot breakers per route", testSnapshotBreakers},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			h := new(mock.HttpClient)
+			test.function(t, h)
+		})
+	}
+}
+
+func testIsolateRouteBreakers(t *testing.T, h *mock.HttpClient) {
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		statusCode := http.StatusOK
+		if req.URL.Path == "/sign-up" {
+			statusCode = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: statusCode, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	trip := service.TripPolicy{ConsecutiveFailures: 1}
+	statusCb := service.NewCircuitBreaker(service.BreakerSettings{Name: "status", Timeout: time.Minute, Trip: trip})
+	signUpCb := service.NewCircuitBreaker(service.BreakerSettings{Name: "sign-up", Timeout: time.Minute, Trip: trip})
+	r := service.NewRequestSvc("http://test", h, statusCb, service.WithRouteBreaker(signUpCb, "/sign-up"))
+
+	_, err := r.Post(context.Background(), "/sign-up", "body")
+	testhelper.Ok(t, err)
+	_, err = r.Post(context.Background(), "/sign-up", "body")
+	testhelper.Assert(t, errors.Is(err, gobreaker.ErrOpenState), "expected the sign-up breaker to be open, got %v", err)
+
+	statusCode, err := r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected status reports to go through, got %d", statusCode)
+	testhelper.Assert(t, statusCb.State() == gobreaker.StateClosed, "expected the status breaker to stay closed")
+}
+
+func testRejectOverBulkhead(t *testing.T, h *mock.HttpClient) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		close(started)
+		<-unblock
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}), service.WithBulkhead(1, "/sign-up"))
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Post(context.Background(), "/sign-up", "body")
+		done <- err
+	}()
+	<-started
+
+	statusCode, err := r.Post(context.Background(), "/sign-up", "body")
+	testhelper.Assert(t, errors.Is(err, domain.ErrBulkheadFull), "expected a full bulkhead, got %v", err)
+	testhelper.Assert(t, statusCode == http.StatusServiceUnavailable, "expected 503, got %d", statusCode)
+
+	close(unblock)
+	testhelper.Ok(t, <-done)
+}
+
+func testReleaseBulkheadSlots(t *testing.T, h *mock.HttpClient) {
+	calls := 0
+	respondWith(h, http.StatusOK, &calls)
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}), service.WithBulkhead(1, "/status"))
+
+	for i := 0; i < 3; i++ {
+		_, err := r.Post(context.Background(), "/status", "body")
+		testhelper.Ok(t, err)
+	}
+	testhelper.Assert(t, calls == 3, "expected every sequential request to go through, got %d", calls)
+}
+
+func testReleaseBulkheadWhileBackingOff(t *testing.T, h *mock.HttpClient) {
+	var calls atomic.Int64
+	failed := make(chan struct{})
+	h.DoFunc = func(req *http.Request) (*http.Response, error) {
+		if calls.Add(1) == 1 {
+			defer close(failed)
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Header:     http.Header{"Retry-After": []string{"1"}},
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	policy := service.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second}
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}),
+		service.WithRetryPolicy(policy), service.WithBulkhead(1, "/health-check"))
+	request := &domain.Request{Method: http.MethodGet, Route: "/health-check"}
+
+	done := make(chan error)
+	go func() {
+		_, err := r.Do(context.Background(), request, nil)
+		done <- err
+	}()
+	<-failed
+	// Let the failed attempt hand its slot back; the retry waits a second.
+	time.Sleep(100 * time.Millisecond)
+
+	statusCode, err := r.Do(context.Background(), request, nil)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK, "expected a request to go through during the backoff, got %d", statusCode)
+	testhelper.Ok(t, <-done)
+	testhelper.Assert(t, calls.Load() == 3, "expected the first request to be retried, got %d calls", calls.Load())
+}
+
+func testUnlimitedBulkhead(t *testing.T, h *mock.HttpClient) {
+	calls := 0
+	respondWith(h, http.StatusOK, &calls)
+	r := service.NewRequestSvc("http://test", h, service.NewCircuitBreaker(service.BreakerSettings{}), service.WithBulkhead(0, "/status"))
+
+	statusCode, err := r.Post(context.Background(), "/status", "body")
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusOK && calls == 1, "expected the request to go through, got %d", statusCode)
+}
+
+func testSnapshotBreakers(t *testing.T, h *mock.HttpClient) {
+	calls := 0
+	respondWith(h, http.StatusInternalServerError, &calls)
+	defaultCb := service.NewCircuitBreaker(service.BreakerSettings{Name: "default"})
+	signUpCb := service.NewCircuitBreaker(service.BreakerSettings{Name: "sign-up"})
+	r := service.NewRequestSvc("http://test", h, defaultCb, service.WithRouteBreaker(signUpCb, "/sign-up/batch", "/sign-up"))
+
+	_, err := r.Post(context.Background(), "/sign-up", "body")
+	testhelper.Ok(t, err)
+
+	snapshots := r.Breakers()
+	testhelper.Assert(t, len(snapshots) == 2, "expected 2 breakers, got %d", len(snapshots))
+	testhelper.Assert(t, snapshots[0].Name == "default" && len(snapshots[0].Routes) == 0, "expected the default breaker first, got %+v", snapshots[0])
+	testhelper.Assert(t, snapshots[1].Name == "sign-up", "expected the sign-up breaker, got %+v", snapshots[1])
+	testhelper.Assert(t, strings.Join(snapshots[1].Routes, ",") == "/sign-up,/sign-up/batch", "expected sorted routes, got %v", snapshots[1].Routes)
+	testhelper.Assert(t, snapshots[1].TotalFailures == 1 && snapshots[0].Requests == 0, "expected the failure on the sign-up breaker only, got %+v", snapshots)
+	testhelper.Assert(t, snapshots[1].State == "closed", "expected a closed breaker, got %s", snapshots[1].State)
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+type (
+	// SenderConfig configures how a sign-up sender drains the outbox.
+	SenderConfig struct {
+		PollInterval time.Duration          // Wait between checks of an empty outbox.
+		Retry        RetryPolicy            // Backoff between deliveries failing transiently; MaxAttempts counts answered deliveries only, below 1 retries forever.
+		DeadLetters  domain.DeadLetterStore // Optional store for sign-ups that are rejected or run out of attempts.
+		Batch        BatchConfig            // Optional batching of the sign-ups sent to "/sign-up/batch".
+	}
+
+	// signUpSender delivers the sign-ups stored in an outbox, in the order
+	// they were stored.
+	signUpSender struct {
+		outbox     domain.Outbox
+		requestSvc domain.RequestSvc
+		cfg        SenderConfig
+		onResult   func(result *domain.SignUpResult, err error)
+		sends      map[string]int // Deliveries of the entries not yet settled.
+		attempts   map[string]int // Those of the deliveries the uniqueness service answered.
+		noBatches  bool           // Whether the uniqueness service has no batch endpoint.
+	}
+
+	// delivery is the outcome of sending one outbox entry.
+	delivery struct {
+		entry      domain.OutboxEntry
+		statusCode int
+		result     *domain.SignUpResult
+		err        error
+	}
+)
+
+// NewSignUpSender creates a sender draining the sign-up outbox.
+//
+// outbox: The outbox sign-ups are read from.
+// requestSvc: Service to handle HTTP requests.
+// cfg: Polling, backoff and batching settings.
+// onResult: Called with the outcome of every sign-up leaving the outbox, or
+// with a nil result when the outbox itself fails.
+//
+// Returns a pointer to the sender.
+func NewSignUpSender(outbox domain.Outbox, requestSvc domain.RequestSvc, cfg SenderConfig, onResult func(*domain.SignUpResult, error)) *signUpSender {
+	return &signUpSender{
+		outbox:     outbox,
+		requestSvc: requestSvc,
+		cfg:        cfg,
+		onResult:   onResult,
+		sends:      map[string]int{},
+		attempts:   map[string]int{},
+	}
+}
+
+// Run drains the outbox until ctx is done. The oldest sign-up is retried
+// with backoff while it fails transiently or its answer cannot be read, so
+// later ones never overtake it, until its retry budget runs out; any other
+// outcome removes it from the outbox. Rejected and exhausted sign-ups are
+// moved to the dead letters. Retries reuse the sign-up ID as idempotency
+// key, including after a restart, which also resets the retry budget.
+//
+// Only the deliveries the uniqueness service answered count against the
+// retry budget. A sign-up that cannot reach the service at all, through
+// network failures or an open breaker, stays in the outbox until it
+// expires for its age.
+//
+// With batching, sign-ups wait until a full batch is queued or the oldest
+// has lingered long enough, then go out together; the results are settled
+// in order up to the first transient failure, and the sign-ups after it
+// are sent again with it. A batch the uniqueness service refuses as a whole
+// is sent again one sign-up at a time, and so are all later ones if it has
+// no batch endpoint.
+//
+// ctx: Context bounding the sender.
+func (s *signUpSender) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		entries, err := s.next()
+		if err != nil || len(entries) == 0 {
+			if err != nil {
+				s.onResult(nil, err)
+			}
+			if sleep(ctx, s.cfg.PollInterval) != nil {
+				return
+			}
+			continue
+		}
+
+		deliveries := s.send(ctx, entries)
+		settled := 0
+		for settled < len(deliveries) && !retryable(deliveries[settled].result.Outcome) {
+			if !s.settle(ctx, deliveries[settled]) {
+				break
+			}
+			settled++
+		}
+		if settled == len(deliveries) || !retryable(deliveries[settled].result.Outcome) {
+			continue
+		}
+
+		head := deliveries[settled]
+		if ctx.Err() != nil {
+			return
+		}
+		if s.cfg.Retry.MaxAttempts > 0 && s.attempts[head.entry.Id] >= s.cfg.Retry.MaxAttempts {
+			s.settle(ctx, head)
+			continue
+		}
+		if sleep(ctx, backoff(s.cfg.Retry, s.sends[head.entry.Id])) != nil {
+			return
+		}
+	}
+}
+
+// next picks the entries to send. With batching, a partial batch is held
+// back while its oldest entry may still linger, unless it is being retried.
+//
+// Returns the entries, oldest first, or none if there is nothing to send yet.
+func (s *signUpSender) next() ([]domain.OutboxEntry, error) {
+	if !s.cfg.Batch.enabled() {
+		entry, err := s.outbox.Peek()
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		return []domain.OutboxEntry{*entry}, nil
+	}
+
+	entries, err := s.outbox.PeekBatch(s.cfg.Batch.MaxSize)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	retrying := s.sends[entries[0].Id] > 0
+	if !retrying && !s.cfg.Batch.ready(len(entries), entries[0].CreatedAt, time.Now()) {
+		return nil, nil
+	}
+	// A batch goes to a single route.
+	for i := range entries {
+		if entries[i].Route != entries[0].Route {
+			return entries[:i], nil
+		}
+	}
+	return entries, nil
+}
+
+// settle moves a delivered, rejected or exhausted sign-up out of the outbox,
+// into the dead letters when it failed, and reports it.
+//
+// ctx: Context bounding the sender.
+// d: The delivery of the sign-up.
+//
+// Returns false if the sign-up could not leave the outbox.
+func (s *signUpSender) settle(ctx context.Context, d delivery) bool {
+	if reason, dead := deadLetterReason(d.result.Outcome); dead && s.cfg.DeadLetters != nil {
+		letter := OutboxDeadLetter(d.entry, reason, d.statusCode, s.sends[d.entry.Id], d.err)
+		if d.result.Reason != "" {
+			letter.Error = fmt.Sprintf("%s: %s", letter.Error, d.result.Reason)
+		}
+		if dlErr := s.cfg.DeadLetters.Add(letter); dlErr != nil {
+			// Keep the sign-up in the outbox rather than lose it.
+			s.onResult(nil, dlErr)
+			sleep(ctx, s.cfg.PollInterval)
+			return false
+		}
+	}
+	if ackErr := s.outbox.Ack(d.entry.Id); ackErr != nil {
+		// The entry will be sent again, and its idempotency key
+		// makes the uniqueness service return the same answer.
+		s.onResult(nil, ackErr)
+		return false
+	}
+	delete(s.sends, d.entry.Id)
+	delete(s.attempts, d.entry.Id)
+	s.onResult(d.result, d.err)
+	return true
+}
+
+// send posts stored sign-ups to the uniqueness service, as a batch when
+// there are several, or one by one, stopping at the first that has to be
+// sent again.
+//
+// ctx: Context bounding the request.
+// entries: The stored sign-ups.
+//
+// Returns the delivery of each sign-up sent, in the same order.
+func (s *signUpSender) send(ctx context.Context, entries []domain.OutboxEntry) []delivery {
+	var deliveries []delivery
+	if len(entries) > 1 && !s.noBatches {
+		deliveries = s.sendBatch(ctx, entries)
+	}
+	if deliveries == nil {
+		for _, entry := range entries {
+			var response domain.SignUpResponse
+			statusCode, doErr := s.requestSvc.Do(ctx, outboxRequest(&entry), &response)
+			result, err := classifySignUp(entry.Id, statusCode, &response, doErr)
+			deliveries = append(deliveries, delivery{entry, statusCode, result, err})
+			if retryable(result.Outcome) {
+				break
+			}
+		}
+	}
+	for _, d := range deliveries {
+		s.sends[d.entry.Id]++
+		if !isTransportFailure(d.err) {
+			s.attempts[d.entry.Id]++
+		}
+	}
+	return deliveries
+}
+
+// sendBatch posts stored sign-ups to the batch endpoint of their route. A
+// batch that fails as a whole gives each sign-up the status and error of
+// the batch, so that none is settled on an answer that could not be read,
+// and a sign-up missing from the results counts as a transient failure.
+// A batch refused as a whole, such as for its size or by a service without
+// batches, says nothing of the sign-ups within, which are left to be sent
+// one by one.
+//
+// ctx: Context bounding the request.
+// entries: The stored sign-ups, all for the same route.
+//
+// Returns the delivery of each sign-up, in the same order, or nil if the
+// batch was refused as a whole.
+func (s *signUpSender) sendBatch(ctx context.Context, entries []domain.OutboxEntry) []delivery {
+	batch := domain.SignUpBatch{SignUps: make([]json.RawMessage, len(entries))}
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		batch.SignUps[i] = entry.Body
+		ids[i] = entry.Id
+	}
+	// The sign-up IDs stay the idempotency keys of the sign-ups within.
+	statusCode, response, batchErr := postBatch(ctx, s.requestSvc, entries[0].Route+"/batch", batchKey(ids), batch)
+	if batchErr == nil && isRejectedStatus(statusCode) {
+		if statusCode == http.StatusNotFound || statusCode == http.StatusMethodNotAllowed {
+			s.noBatches = true
+		}
+		return nil
+	}
+	answered := batchErr == nil && statusCode == http.StatusOK
+
+	items := map[string]domain.BatchItemResult{}
+	if answered {
+		for _, item := range response.Results {
+			items[item.Id] = item
+		}
+	}
+	deliveries := make([]delivery, len(entries))
+	for i, entry := range entries {
+		itemStatus := statusCode
+		var itemResponse domain.SignUpResponse
+		if answered {
+			item := items[entry.Id]
+			itemStatus = item.Status
+			itemResponse = domain.SignUpResponse{Message: item.Message, MatchID: item.MatchID}
+		}
+		result, err := classifySignUp(entry.Id, itemStatus, &itemResponse, batchErr)
+		deliveries[i] = delivery{entry, itemStatus, result, err}
+	}
+	return deliveries
+}
+
+// retryable tells whether a sign-up has to be sent again: it failed
+// transiently, or it was accepted but the answer could not be read. The
+// idempotency key makes the uniqueness service answer the same again.
+func retryable(outcome domain.SignUpOutcome) bool {
+	return outcome == domain.SignUpTransient || outcome == domain.SignUpUnconfirmed
+}
+
+// deadLetterReason tells whether a sign-up outcome is a permanent failure
+// and why.
+func deadLetterReason(outcome domain.SignUpOutcome) (domain.DeadLetterReason, bool) {
+	switch outcome {
+	case domain.SignUpRejected:
+		return domain.DeadLetterRejected, true
+	case domain.SignUpTransient, domain.SignUpUnconfirmed:
+		return domain.DeadLetterExhausted, true
+	}
+	return "", false
+}
@@ -0,0 +1,351 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+func TestSignUpSender(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.RequestSvc, domain.Outbox)
+	}{
+		{"should deliver sign-ups in order", testDeliverInOrder},
+		{"should retry transient failures before moving on", testRetryTransientInOrder},
+		{"should remove rejected sign-ups", testRemoveRejected},
+		{"should retry sign-ups whose answer cannot be read", testRetryUnconfirmed},
+		{"should only count answered deliveries against the budget", testCountAnsweredAttempts},
+		{"should queue sign-ups and deliver them after an outage", testQueueThroughOutage},
+		{"should send a full batch at once", testSendFullBatch},
+		{"should hold a partial batch until it has lingered", testLingerPartialBatch},
+		{"should settle batch results in order up to a transient failure", testSettleBatchInOrder},
+		{"should not settle a batch whose results cannot be read", testUnreadableBatch},
+		{"should send a batch refused as a whole one by one", testSendRefusedBatchSingly},
+		{"should stop batching without a batch endpoint", testStopBatchingWithoutEndpoint},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			outbox, err := platform.OpenOutbox(platform.OutboxConfig{Path: filepath.Join(t.TempDir(), "sign-up.log")})
+			testhelper.Ok(t, err)
+			defer outbox.Close()
+			test.function(t, new(mock.RequestSvc), outbox)
+		})
+	}
+}
+
+var senderConfig = service.SenderConfig{
+	PollInterval: time.Millisecond,
+	Retry:        service.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+}
+
+// runSender drains the outbox until want results have been reported.
+func runSender(t *testing.T, outbox domain.Outbox, reqSvc domain.RequestSvc, want int) []*domain.SignUpResult {
+	return runSenderWith(t, outbox, reqSvc, senderConfig, want)
+}
+
+func runSenderWith(t *testing.T, outbox domain.Outbox, reqSvc domain.RequestSvc, cfg service.SenderConfig, want int) []*domain.SignUpResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var results []*domain.SignUpResult
+	sender := service.NewSignUpSender(outbox, reqSvc, cfg, func(result *domain.SignUpResult, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		testhelper.Assert(t, result != nil, "unexpected outbox failure: %v", err)
+		results = append(results, result)
+		if len(results) == want {
+			cancel()
+		}
+	})
+	sender.Run(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	testhelper.Assert(t, len(results) == want, "expected %d results, got %d", want, len(results))
+	return results
+}
+
+func appendSignUp(t *testing.T, outbox domain.Outbox, id string) {
+	body, _ := json.Marshal(domain.Iris{Id: id, IrisCode: "signed-" + id})
+	testhelper.Ok(t, outbox.Append(domain.OutboxEntry{Id: id, Route: "/sign-up", Body: body, CreatedAt: time.Now()}))
+}
+
+func testDeliverInOrder(t *testing.T, reqSvc *mock.RequestSvc, outbox domain.Outbox) {
+	appendSignUp(t, outbox, "1")
+	appendSignUp(t, outbox, "2")
+	var keys []string
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		keys = append(keys, req.Header.Get(service.HeaderIdempotencyKey))
+		return 201, nil
+	}
+
+	results := runSender(t, outbox, reqSvc, 2)
+	testhelper.Assert(t, results[0].Id == "1" && results[1].Id == "2", "expected sign-ups in order, got %+v", results)
+	testhelper.Assert(t, results[0].Outcome == domain.SignUpRegistered, "expected a registered sign-up, got %s", results[0].Outcome)
+	testhelper.Assert(t, len(keys) == 2 && keys[0] == "1" && keys[1] == "2", "expected IDs as idempotency keys, got %v", keys)
+	testhelper.Assert(t, outbox.Len() == 0, "expected an empty outbox, got %d", outbox.Len())
+}
+
+func testRetryTransientInOrder(t *testing.T, reqSvc *mock.RequestSvc, outbox domain.Outbox) {
+	appendSignUp(t, outbox, "1")
+	appendSignUp(t, outbox, "2")
+	var sent []string
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		var iris domain.Iris
+		json.Unmarshal(req.Body.(json.RawMessage), &iris)
+		sent = append(sent, iris.Id)
+		if len(sent) <= 2 {
+			return 503, nil
+		}
+		return 201, nil
+	}
+
+	results := runSender(t, outbox, reqSvc, 2)
+	testhelper.Assert(t, results[0].Id == "1" && results[1].Id == "2", "expected sign-ups in order, got %+v", results)
+	testhelper.Assert(t, len(sent) == 4 && sent[0] == "1" && sent[1] == "1" && sent[2] == "1", "expected the first sign-up retried before the second, got %v", sent)
+}
+
+func testRemoveRejected(t *testing.T, reqSvc *mock.RequestSvc, outbox domain.Outbox) {
+	appendSignUp(t, outbox, "1")
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		out.(*domain.SignUpResponse).Message = "invalid iris code"
+		return 422, nil
+	}
+
+	results := runSender(t, outbox, reqSvc, 1)
+	testhelper.Assert(t, results[0].Outcome == domain.SignUpRejected, "expected a rejected sign-up, got %s", results[0].Outcome)
+	testhelper.Assert(t, outbox.Len() == 0, "expected the rejected sign-up to leave the outbox, got %d", outbox.Len())
+}
+
+func testRetryUnconfirmed(t *testing.T, reqSvc *mock.RequestSvc, outbox domain.Outbox) {
+	appendSignUp(t, outbox, "1")
+	calls := 0
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		calls++
+		if calls == 1 {
+			return 201, domain.ErrDecodingResponse
+		}
+		return 201, nil
+	}
+
+	results := runSender(t, outbox, reqSvc, 1)
+	testhelper.Assert(t, calls == 2, "expected the unreadable answer to be asked again, got %d calls", calls)
+	testhelper.Assert(t, results[0].Outcome == domain.SignUpRegistered, "expected a registered sign-up, got %s", results[0].Outcome)
+	testhelper.Assert(t, outbox.Len() == 0, "expected an empty outbox, got %d", outbox.Len())
+}
+
+func testCountAnsweredAttempts(t *testing.T, reqSvc *mock.RequestSvc, outbox domain.Outbox) {
+	appendSignUp(t, outbox, "1")
+	calls := 0
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		calls++
+		if calls <= 4 {
+			return 500, domain.ErrRequestFailed
+		}
+		return 503, nil
+	}
+	cfg := senderConfig
+	cfg.Retry.MaxAttempts = 2
+
+	results := runSenderWith(t, outbox, reqSvc, cfg, 1)
+	testhelper.Assert(t, results[0].Outcome == domain.SignUpTransient, "expected an exhausted sign-up, got %s", results[0].Outcome)
+	testhelper.Assert(t, calls == 6, "expected 4 unanswered and 2 answered deliveries, got %d", calls)
+	testhelper.Assert(t, outbox.Len() == 0, "expected the exhausted sign-up to leave the outbox, got %d", outbox.Len())
+}
+
+func testQueueThroughOutage(t *testing.T, _ *mock.RequestSvc, outbox domain.Outbox) {
+	u := &mock.UniquenessService{}
+	server := httptest.NewServer(u)
+	server.Close()
+
+	node, _ := snowflake.NewNode(1)
+	cb := service.NewCircuitBreaker(service.BreakerSettings{})
+	reqSvc := service.NewRequestSvc(server.URL, server.Client(), cb)
+	signUp := service.NewSignUpSvc("test-key", node, reqSvc, service.WithOutbox(outbox))
+
+	for i := 0; i < 2; i++ {
+		img, _ := platform.GenerateRandomImageData()
+		result, err := signUp.SignUp(context.Background(), img)
+		testhelper.Ok(t, err)
+		testhelper.Assert(t, result.Outcome == domain.SignUpQueued, "expected a queued sign-up, got %s", result.Outcome)
+	}
+
+	// The uniqueness service is unreachable: nothing leaves the outbox.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	service.NewSignUpSender(outbox, reqSvc, senderConfig, func(result *domain.SignUpResult, err error) {
+		t.Errorf("unexpected result during the outage: %+v, %v", result, err)
+	}).Run(ctx)
+	cancel()
+	testhelper.Assert(t, outbox.Len() == 2, "expected both sign-ups to stay queued, got %d", outbox.Len())
+
+	// Back online.
+	server = httptest.NewServer(u)
+	defer server.Close()
+	reqSvc = service.NewRequestSvc(server.URL, server.Client(), cb)
+	results := runSender(t, outbox, reqSvc, 2)
+	for _, result := range results {
+		testhelper.Assert(t, result.Outcome == domain.SignUpRegistered || result.Outcome == domain.SignUpDuplicate,
+			"expected the sign-up to be delivered, got %s", result.Outcome)
+	}
+	testhelper.Assert(t, u.Count("/sign-up") == 2, "expected 2 deliveries, got %d", u.Count("/sign-up"))
+}
+
+func testSendFullBatch(t *testing.T, _ *mock.RequestSvc, outbox domain.Outbox) {
+	u := &mock.UniquenessService{MaxBatchSize: 3}
+	server := httptest.NewServer(u)
+	defer server.Close()
+	reqSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+	for _, id := range []string{"1", "2", "3", "4"} {
+		appendSignUp(t, outbox, id)
+	}
+	cfg := senderConfig
+	cfg.Batch = service.BatchConfig{MaxSize: 3, MaxLinger: time.Hour}
+
+	results := runSenderWith(t, outbox, reqSvc, cfg, 3)
+	for i, result := range results {
+		testhelper.Assert(t, result.Id == strconv.Itoa(i+1) && result.Outcome == domain.SignUpRegistered, "expected sign-ups registered in order, got %+v", result)
+	}
+	testhelper.Assert(t, u.Count("/sign-up/batch") == 1 && u.Count("/sign-up") == 0, "expected a single batch, got %d batches and %d sign-ups",
+		u.Count("/sign-up/batch"), u.Count("/sign-up"))
+	testhelper.Assert(t, outbox.Len() == 1, "expected the fourth sign-up to wait for a full batch, got %d pending", outbox.Len())
+}
+
+func testLingerPartialBatch(t *testing.T, _ *mock.RequestSvc, outbox domain.Outbox) {
+	u := &mock.UniquenessService{}
+	server := httptest.NewServer(u)
+	defer server.Close()
+	reqSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+	appendSignUp(t, outbox, "1")
+	appendSignUp(t, outbox, "2")
+	cfg := senderConfig
+	cfg.Batch = service.BatchConfig{MaxSize: 10, MaxLinger: 50 * time.Millisecond}
+
+	start := time.Now()
+	results := runSenderWith(t, outbox, reqSvc, cfg, 2)
+	testhelper.Assert(t, time.Since(start) >= 40*time.Millisecond, "expected the batch to linger, sent after %s", time.Since(start))
+	testhelper.Assert(t, results[0].Outcome == domain.SignUpRegistered && results[1].Outcome == domain.SignUpRegistered, "expected both sign-ups registered, got %+v", results)
+	testhelper.Assert(t, u.Count("/sign-up/batch") == 1, "expected a single batch, got %d", u.Count("/sign-up/batch"))
+}
+
+func testSettleBatchInOrder(t *testing.T, reqSvc *mock.RequestSvc, outbox domain.Outbox) {
+	appendSignUp(t, outbox, "1")
+	appendSignUp(t, outbox, "2")
+	appendSignUp(t, outbox, "3")
+	var batches [][]string
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		testhelper.Assert(t, req.Route == "/sign-up/batch", "expected a batch, got %s", req.Route)
+		var ids []string
+		for _, body := range req.Body.(domain.SignUpBatch).SignUps {
+			var iris domain.Iris
+			json.Unmarshal(body, &iris)
+			ids = append(ids, iris.Id)
+		}
+		batches = append(batches, ids)
+		response := out.(*domain.BatchResponse)
+		for _, id := range ids {
+			status := 201
+			if id == "2" && len(batches) == 1 {
+				status = 503
+			}
+			response.Results = append(response.Results, domain.BatchItemResult{Id: id, Status: status})
+		}
+		return 200, nil
+	}
+	cfg := senderConfig
+	cfg.Batch = service.BatchConfig{MaxSize: 3}
+
+	results := runSenderWith(t, outbox, reqSvc, cfg, 3)
+	for i, result := range results {
+		testhelper.Assert(t, result.Id == strconv.Itoa(i+1) && result.Outcome == domain.SignUpRegistered, "expected sign-ups registered in order, got %+v", result)
+	}
+	testhelper.Assert(t, len(batches) == 2 && len(batches[1]) == 2 && batches[1][0] == "2",
+		"expected the sign-ups from the transient failure on to be sent again, got %v", batches)
+}
+
+func testUnreadableBatch(t *testing.T, reqSvc *mock.RequestSvc, outbox domain.Outbox) {
+	appendSignUp(t, outbox, "1")
+	appendSignUp(t, outbox, "2")
+	batches := 0
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		batches++
+		if batches == 1 {
+			return 200, domain.ErrDecodingResponse
+		}
+		response := out.(*domain.BatchResponse)
+		for _, body := range req.Body.(domain.SignUpBatch).SignUps {
+			var iris domain.Iris
+			json.Unmarshal(body, &iris)
+			response.Results = append(response.Results, domain.BatchItemResult{Id: iris.Id, Status: 201})
+		}
+		return 200, nil
+	}
+	cfg := senderConfig
+	cfg.Batch = service.BatchConfig{MaxSize: 2}
+
+	results := runSenderWith(t, outbox, reqSvc, cfg, 2)
+	testhelper.Assert(t, batches == 2, "expected the unreadable batch to be sent again, got %d batches", batches)
+	for _, result := range results {
+		testhelper.Assert(t, result.Outcome == domain.SignUpRegistered, "expected the sign-ups registered once readable, got %+v", result)
+	}
+}
+
+func testSendRefusedBatchSingly(t *testing.T, _ *mock.RequestSvc, outbox domain.Outbox) {
+	u := &mock.UniquenessService{MaxBatchSize: 2}
+	server := httptest.NewServer(u)
+	defer server.Close()
+	reqSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+	for _, id := range []string{"1", "2", "3"} {
+		appendSignUp(t, outbox, id)
+	}
+	store, err := platform.OpenDeadLetterStore(t.TempDir())
+	testhelper.Ok(t, err)
+	cfg := senderConfig
+	cfg.DeadLetters = store
+	cfg.Batch = service.BatchConfig{MaxSize: 3}
+
+	results := runSenderWith(t, outbox, reqSvc, cfg, 3)
+	for i, result := range results {
+		testhelper.Assert(t, result.Id == strconv.Itoa(i+1) && result.Outcome == domain.SignUpRegistered, "expected sign-ups registered in order, got %+v", result)
+	}
+	testhelper.Assert(t, u.Count("/sign-up") == 3, "expected the oversized batch to be sent one by one, got %d sign-ups", u.Count("/sign-up"))
+	letters, err := store.List()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(letters) == 0, "expected no dead letters, got %+v", letters)
+}
+
+func testStopBatchingWithoutEndpoint(t *testing.T, reqSvc *mock.RequestSvc, outbox domain.Outbox) {
+	for _, id := range []string{"1", "2", "3", "4"} {
+		appendSignUp(t, outbox, id)
+	}
+	batches := 0
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		if req.Route == "/sign-up/batch" {
+			batches++
+			return 404, nil
+		}
+		return 201, nil
+	}
+	cfg := senderConfig
+	cfg.Batch = service.BatchConfig{MaxSize: 2}
+
+	results := runSenderWith(t, outbox, reqSvc, cfg, 4)
+	for _, result := range results {
+		testhelper.Assert(t, result.Outcome == domain.SignUpRegistered, "expected the sign-ups registered one by one, got %+v", result)
+	}
+	testhelper.Assert(t, batches == 1, "expected a single batch to be tried, got %d", batches)
+}
@@ -2,18 +2,33 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
-	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
+	"image"
 	"image/png"
 	"net/http"
 	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
 
 	"github.com/corona10/goimagehash"
 )
 
+// Perceptual hashes the iris code can be computed with. Each is sent with
+// its own prefix, as ImageHash.ToString renders it.
+const (
+	HashAverage    = "ahash"
+	HashDifference = "dhash"
+	HashPerception = "phash"
+	DefaultHash    = HashAverage
+)
+
 // signUpSvc encapsulates services required for user sign-up,
 // especially with an emphasis on image processing and cryptographic security.
 type (
@@ -21,7 +36,16 @@ type (
 		signKey       string
 		snowflakeNode domain.SnowFlakeNode
 		requestSvc    domain.RequestSvc
+		outbox        domain.Outbox
+		deadLetters   domain.DeadLetterStore
+		hash          string
+		scheme        string
+		clock         *clockMonitor
+		negotiation   *negotiation
 	}
+
+	// SignUpOption configures optional behaviour of the sign-up service.
+	SignUpOption func(*signUpSvc)
 )
 
 // NewSignUpSvc initializes a new signUpSvc instance.
@@ -29,67 +53,338 @@ type (
 // signKey: Secret key used for signing operations.
 // snowflakeNode: Entity responsible for generating unique IDs.
 // requestSvc: Service to handle HTTP requests.
+// opts: Optional settings such as WithOutbox or WithDeadLetters.
 //
 // Returns a pointer to an initialized signUpSvc instance.
-func NewSignUpSvc(signKey string, snowflakeNode domain.SnowFlakeNode, requestSvc domain.RequestSvc) *signUpSvc {
-	return &signUpSvc{
-		signKey,
-		snowflakeNode,
-		requestSvc,
+func NewSignUpSvc(signKey string, snowflakeNode domain.SnowFlakeNode, requestSvc domain.RequestSvc, opts ...SignUpOption) *signUpSvc {
+	s := &signUpSvc{
+		signKey:       signKey,
+		snowflakeNode: snowflakeNode,
+		requestSvc:    requestSvc,
+		hash:          DefaultHash,
+		scheme:        DefaultScheme,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithOutbox makes SignUp store signed requests in the outbox instead of
+// sending them, leaving delivery to a sign-up sender draining it.
+//
+// outbox: The outbox sign-up requests are written to.
+func WithOutbox(outbox domain.Outbox) SignUpOption {
+	return func(s *signUpSvc) {
+		s.outbox = outbox
+	}
+}
+
+// WithHashAlgorithm computes iris codes with the given perceptual hash
+// instead of the average hash.
+//
+// algorithm: One of the Hash constants, usually the negotiated one.
+func WithHashAlgorithm(algorithm string) SignUpOption {
+	return func(s *signUpSvc) {
+		s.hash = algorithm
+	}
+}
+
+// WithIrisScheme signs iris codes with the given scheme instead of
+// HMAC-SHA256.
+//
+// scheme: One of the Scheme constants, usually the negotiated one.
+func WithIrisScheme(scheme string) SignUpOption {
+	return func(s *signUpSvc) {
+		s.scheme = scheme
+	}
+}
+
+// WithNegotiatedOptions computes and signs iris codes with the hash
+// algorithm and scheme in use, following them when they are renegotiated.
+//
+// negotiation: Holder of the options in use.
+func WithNegotiatedOptions(negotiation *negotiation) SignUpOption {
+	return func(s *signUpSvc) {
+		s.negotiation = negotiation
+	}
+}
+
+// WithSignUpClock refuses sign-ups while the orb clock is known to be
+// skewed beyond the bound of the monitor, as their snowflake IDs and
+// signatures would carry a wrong time.
+//
+// clock: The monitor estimating the skew.
+func WithSignUpClock(clock *clockMonitor) SignUpOption {
+	return func(s *signUpSvc) {
+		s.clock = clock
 	}
 }
 
 // SignUp processes a user sign-up request using an image (iris scan).
 // The image is perceptually hashed, signed, and sent for further processing.
+// The image buffer, the decoded pixels and the unsigned iris code are wiped
+// before returning, and none of them ever ends up in a returned error.
 //
-// img: The image data in bytes.
+// ctx: Context bounding the sign-up request.
+// img: The image data in bytes. It is zeroed once SignUp returns.
 //
-// Returns an error if any occurred during the process.
-func (s *signUpSvc) SignUp(img []byte) error {
+// Returns the outcome of the sign-up, or nil if it was never submitted,
+// and an error matching the outcome if it was not registered. With an
+// outbox, the outcome is SignUpQueued once the request is safely on disk.
+// With a clock monitor, domain.ErrClockSkewed is returned without
+// submitting anything while the orb clock is too far off.
+func (s *signUpSvc) SignUp(ctx context.Context, img []byte) (*domain.SignUpResult, error) {
+	defer platform.Wipe(img)
+
+	if s.clock != nil {
+		if err := s.clock.Check(); err != nil {
+			return nil, fmt.Errorf("SignUp: %w", err)
+		}
+	}
 
 	imgType := http.DetectContentType(img)
 	if imgType != "image/png" {
-		return fmt.Errorf("SignUp: %w", domain.ErrInvalidImageFormat)
+		return nil, fmt.Errorf("SignUp: %w", domain.ErrInvalidImageFormat)
 	}
 
 	i, err := png.Decode(bytes.NewReader(img))
 	if err != nil {
-		return fmt.Errorf("SignUp: %w", domain.ErrDecode)
+		return nil, fmt.Errorf("SignUp: %w", domain.ErrDecode)
 	}
+	defer platform.WipeImage(i)
 
 	// Hash the image to generate iris code.
 	// Calculate the iris code locally to maximize privacy.
 	// References:
 	// https://www.hackerfactor.com/blog/index.php?/archives/432-Looks-Like-It.html
 	// Todo read https://tech.okcupid.com/evaluating-perceptual-image-hashes-at-okcupid-e98a3e74aa3a
-	irisCode, err := goimagehash.AverageHash(i)
+	algorithm, scheme := s.hash, s.scheme
+	if s.negotiation != nil {
+		negotiated := s.negotiation.Current()
+		algorithm, scheme = negotiated.HashAlgorithm, negotiated.SignatureScheme
+	}
+	irisCode, err := hashImage(algorithm, i)
 	if err != nil {
-		return fmt.Errorf("SignUp: %w", domain.ErrImageHash)
+		return nil, fmt.Errorf("SignUp: %w", domain.ErrImageHash)
 	}
 
+	unsignedIrisCode := encodeIrisCode(irisCode)
+	*irisCode = goimagehash.ImageHash{}
+	defer platform.Wipe(unsignedIrisCode)
+
 	// Sign the iris code for security verification.
-	signedIrisCode := s.signIrisCode(irisCode.ToString())
+	signedIrisCode, err := s.signIrisCode(scheme, unsignedIrisCode)
+	if err != nil {
+		return nil, fmt.Errorf("SignUp: %w", err)
+	}
 
 	id := s.snowflakeNode.Generate().String()
 	request := domain.Iris{
 		Id:       id,
 		IrisCode: signedIrisCode,
 	}
+	if s.outbox != nil {
+		return s.enqueue(request)
+	}
 
-	statusCode, err := s.requestSvc.Post("/sign-up", request)
-	if err != nil || statusCode != http.StatusCreated {
-		return fmt.Errorf("SignUp: %w", domain.ErrRequestFailed)
+	var response domain.SignUpResponse
+	// The snowflake ID doubles as idempotency key, so that a retry after a
+	// lost response returns the original result instead of a duplicate.
+	// Errors from the request service are classified together with the
+	// status code it reports alongside them.
+	req := &domain.Request{
+		Method: http.MethodPost,
+		Route:  "/sign-up",
+		Header: http.Header{HeaderIdempotencyKey: []string{id}},
+		Body:   request,
+	}
+	createdAt := time.Now()
+	statusCode, doErr := s.requestSvc.Do(ctx, req, &response)
+	result, err := classifySignUp(id, statusCode, &response, doErr)
+	if result.Outcome == domain.SignUpRejected && s.deadLetters != nil {
+		if dlErr := s.deadLetter(req, statusCode, createdAt, result, err); dlErr != nil {
+			return result, errors.Join(err, dlErr)
+		}
+	}
+	return result, err
+}
+
+// deadLetter stores a rejected sign-up as a dead letter.
+//
+// req: The rejected request.
+// statusCode: The HTTP status it was rejected with.
+// createdAt: When the sign-up was sent.
+// result: The outcome of the sign-up.
+// err: The error matching the outcome.
+//
+// Returns an error if the dead letter could not be stored.
+func (s *signUpSvc) deadLetter(req *domain.Request, statusCode int, createdAt time.Time, result *domain.SignUpResult, err error) error {
+	body, marshalErr := json.Marshal(req.Body)
+	if marshalErr != nil {
+		return fmt.Errorf("SignUp: %w", domain.ErrMarshallingPayload)
+	}
+	letter := NewDeadLetter(req, body, domain.DeadLetterRejected, statusCode, 1, createdAt, err)
+	if result.Reason != "" {
+		letter.Error = fmt.Sprintf("%s: %s", letter.Error, result.Reason)
+	}
+	if err := s.deadLetters.Add(letter); err != nil {
+		return fmt.Errorf("SignUp: %w", err)
 	}
 	return nil
 }
 
-// signIrisCode signs the provided iris code using HMAC-SHA256 and the service's signKey.
+// WithDeadLetters keeps the sign-ups rejected by the uniqueness service as
+// dead letters. It only applies to sign-ups sent directly; the sign-up
+// sender has its own store for those queued in the outbox.
+//
+// store: The store rejected sign-ups are written to.
+func WithDeadLetters(store domain.DeadLetterStore) SignUpOption {
+	return func(s *signUpSvc) {
+		s.deadLetters = store
+	}
+}
+
+// enqueue writes the signed sign-up request to the outbox.
+//
+// request: The signed iris code and its ID.
+//
+// Returns the queued sign-up, or an error if it could not be stored.
+func (s *signUpSvc) enqueue(request domain.Iris) (*domain.SignUpResult, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("SignUp: %w", domain.ErrMarshallingPayload)
+	}
+	err = s.outbox.Append(domain.OutboxEntry{
+		Id:        request.Id,
+		Route:     "/sign-up",
+		Body:      body,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("SignUp: %w", err)
+	}
+	return &domain.SignUpResult{Id: request.Id, Outcome: domain.SignUpQueued}, nil
+}
+
+// classifySignUp maps the uniqueness service's answer to a sign-up outcome.
+// Timeouts, throttling, server errors and network failures are transient;
+// any other 4xx means the request itself was not acceptable. A 2xx whose
+// body could not be read leaves the sign-up unconfirmed; other statuses
+// with such a body are classified by the status alone.
+//
+// id: ID the sign-up was submitted with.
+// statusCode: HTTP status returned by the request service.
+// response: The decoded response body.
+// doErr: Error returned by the request service alongside the status, if any.
+//
+// Returns the sign-up result and an error matching its outcome, if any.
+func classifySignUp(id string, statusCode int, response *domain.SignUpResponse, doErr error) (*domain.SignUpResult, error) {
+	result := &domain.SignUpResult{Id: id}
+
+	unreadable := errors.Is(doErr, domain.ErrDecodingResponse) || errors.Is(doErr, domain.ErrResponseTooLarge)
+	switch {
+	case unreadable && statusCode >= 200 && statusCode < 300:
+		result.Outcome = domain.SignUpUnconfirmed
+		return result, fmt.Errorf("SignUp: %w", doErr)
+	case unreadable:
+		*response = domain.SignUpResponse{}
+	case isTransportFailure(doErr):
+		result.Outcome = domain.SignUpTransient
+		return result, fmt.Errorf("SignUp: %w: %w", domain.ErrTransientFailure, doErr)
+	}
+
+	switch {
+	case statusCode == http.StatusCreated:
+		result.Outcome = domain.SignUpRegistered
+		return result, nil
+	case statusCode == http.StatusConflict:
+		result.Outcome = domain.SignUpDuplicate
+		result.MatchID = response.MatchID
+		return result, fmt.Errorf("SignUp: %w", domain.ErrDuplicateSignUp)
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests:
+		result.Outcome = domain.SignUpTransient
+		return result, fmt.Errorf("SignUp: %w", domain.ErrTransientFailure)
+	case statusCode >= 400 && statusCode < 500:
+		result.Outcome = domain.SignUpRejected
+		result.Reason = response.Message
+		return result, fmt.Errorf("SignUp: %w", domain.ErrSignUpRejected)
+	default:
+		result.Outcome = domain.SignUpTransient
+		return result, fmt.Errorf("SignUp: %w", domain.ErrTransientFailure)
+	}
+}
+
+// isTransportFailure tells whether a request got no answer from the
+// uniqueness service: it could not be sent, the circuit breaker refused it
+// or its context ended.
+func isTransportFailure(err error) bool {
+	return errors.Is(err, domain.ErrRequestFailed) ||
+		errors.Is(err, domain.ErrExecutionFailed) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// hashImage computes the perceptual hash of the iris scan.
+//
+// algorithm: One of the Hash constants.
+// img: The decoded iris scan.
+//
+// Returns the hash, or an error if the algorithm is unknown or fails.
+func hashImage(algorithm string, img image.Image) (*goimagehash.ImageHash, error) {
+	switch algorithm {
+	case HashAverage:
+		return goimagehash.AverageHash(img)
+	case HashDifference:
+		return goimagehash.DifferenceHash(img)
+	case HashPerception:
+		return goimagehash.PerceptionHash(img)
+	default:
+		return nil, fmt.Errorf("%w: hash algorithm %q", domain.ErrInvalidCapability, algorithm)
+	}
+}
+
+// hashPrefixes maps the kind of a hash to the prefix ImageHash.ToString
+// renders it with.
+var hashPrefixes = map[goimagehash.Kind]string{
+	goimagehash.AHash: "a:",
+	goimagehash.DHash: "d:",
+	goimagehash.PHash: "p:",
+}
+
+// encodeIrisCode renders the iris code in the same "<kind>:<hex>" form as
+// ImageHash.ToString, but into a byte slice owned by the caller.
+// Strings are immutable and fmt keeps pooled buffers, so neither could be
+// wiped once the iris code has been signed.
 //
 // irisCode: The perceptual hash of the iris scan.
 //
-// Returns the signed iris code in hex string format.
-func (s *signUpSvc) signIrisCode(irisCode string) string {
-	mac := hmac.New(sha256.New, []byte(s.signKey))
-	mac.Write([]byte(irisCode))
-	return hex.EncodeToString(mac.Sum(nil))
+// Returns the textual iris code as bytes.
+func encodeIrisCode(irisCode *goimagehash.ImageHash) []byte {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], irisCode.GetHash())
+	defer platform.Wipe(raw[:])
+
+	encoded := make([]byte, 2+hex.EncodedLen(len(raw)))
+	copy(encoded, hashPrefixes[irisCode.GetKind()])
+	hex.Encode(encoded[2:], raw[:])
+	return encoded
+}
+
+// signIrisCode signs the provided iris code using the given scheme and the
+// service's signKey.
+//
+// scheme: One of the Scheme constants.
+// irisCode: The perceptual hash of the iris scan.
+//
+// Returns the signed iris code in hex string format, or an error if the
+// scheme is unknown.
+func (s *signUpSvc) signIrisCode(scheme string, irisCode []byte) (string, error) {
+	h, err := schemeHash(scheme)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(h, []byte(s.signKey))
+	mac.Write(irisCode)
+	return hex.EncodeToString(mac.Sum(nil)), nil
 }
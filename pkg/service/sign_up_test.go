@@ -1,9 +1,20 @@
 package service_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"virtual-orb/mock"
 	"virtual-orb/pkg/domain"
@@ -12,6 +23,8 @@ import (
 	testhelper "virtual-orb/test_helper"
 
 	"github.com/bwmarrin/snowflake"
+	"github.com/corona10/goimagehash"
+	"github.com/sony/gobreaker"
 )
 
 func TestSignUpService(t *testing.T) {
@@ -23,6 +36,21 @@ func TestSignUpService(t *testing.T) {
 		{"should handle image decoding error", testImageDecodingError},
 		{"should reject non-PNG image format", testNonPNGImage},
 		{"should handle post request error", testPostRequestError},
+		{"should wipe the image buffer after sign-up", testWipeImageAfterSignUp},
+		{"should wipe the image buffer when sign-up fails", testWipeImageOnFailure},
+		{"should never send the unsigned iris code", testNoUnsignedIrisCodeSent},
+		{"should hash and sign with the negotiated options", testNegotiatedIrisCode},
+		{"should report a registered sign-up", testRegisteredOutcome},
+		{"should report a duplicate sign-up", testDuplicateOutcome},
+		{"should report a rejected sign-up", testRejectedOutcome},
+		{"should report a transient failure", testTransientOutcome},
+		{"should report transport failures as transient", testTransportFailureOutcome},
+		{"should leave a sign-up with an unreadable answer unconfirmed", testUnconfirmedOutcome},
+		{"should detect a duplicate against the uniqueness service", testDuplicateAgainstService},
+		{"should send the snowflake ID as idempotency key", testIdempotencyKeySent},
+		{"should register once when a response is lost", testRegisterOnceOnLostResponse},
+		{"should queue the signed sign-up in the outbox", testQueueInOutbox},
+		{"should report a full outbox", testFullOutbox},
 	}
 
 	for _, test := range tests {
@@ -36,7 +64,7 @@ func TestSignUpService(t *testing.T) {
 
 func testHandleAndSignImage(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
 	img, _ := platform.GenerateRandomImageData()
-	reqSvc.PostFunc = func(path string, body any) (httpStatus int, err error) {
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
 		return 201, nil
 	}
 	sfNode.GenerateFunc = func() snowflake.ID {
@@ -44,33 +72,318 @@ func testHandleAndSignImage(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.
 	}
 	signKey := "test-key"
 	signUpService := service.NewSignUpSvc(signKey, sfNode, reqSvc)
-	err := signUpService.SignUp(img)
+	_, err := signUpService.SignUp(context.Background(), img)
 	testhelper.Ok(t, err)
 }
 
 func testImageDecodingError(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
 	badImg := []byte("not a valid image")
 	signUpService := service.NewSignUpSvc("test-key", sfNode, reqSvc)
-	err := signUpService.SignUp(badImg)
+	_, err := signUpService.SignUp(context.Background(), badImg)
 	testhelper.Assert(t, err != nil, "expected an image decoding error")
 }
 
 func testNonPNGImage(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
 	nonPngImg := []byte("GIF89a...")
 	signUpService := service.NewSignUpSvc("test-key", sfNode, reqSvc)
-	err := signUpService.SignUp(nonPngImg)
+	_, err := signUpService.SignUp(context.Background(), nonPngImg)
 	testhelper.Assert(t, err != nil && errors.Is(err, domain.ErrInvalidImageFormat), "expected an error for non-PNG image format")
 }
 
 func testPostRequestError(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
 	img, _ := platform.GenerateRandomImageData()
-	reqSvc.PostFunc = func(path string, body any) (httpStatus int, err error) {
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
 		return 500, fmt.Errorf("Post request failed")
 	}
 	sfNode.GenerateFunc = func() snowflake.ID {
 		return snowflake.ID(123456789)
 	}
 	signUpService := service.NewSignUpSvc("test-key", sfNode, reqSvc)
-	err := signUpService.SignUp(img)
+	_, err := signUpService.SignUp(context.Background(), img)
 	testhelper.Assert(t, err != nil, "expected a post request error")
 }
+
+func testWipeImageAfterSignUp(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		return 201, nil
+	}
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(123456789)
+	}
+	signUpService := service.NewSignUpSvc("test-key", sfNode, reqSvc)
+
+	// Simulate a capture buffer that is reused between scans.
+	buf := make([]byte, 0, 1<<16)
+	for i := 0; i < 3; i++ {
+		img, _ := platform.GenerateRandomImageData()
+		buf = append(buf[:0], img...)
+		_, err := signUpService.SignUp(context.Background(), buf)
+		testhelper.Ok(t, err)
+		testhelper.Assert(t, isZeroed(buf), "expected the reused buffer to be wiped after scan %d", i)
+	}
+}
+
+func testWipeImageOnFailure(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		return 500, fmt.Errorf("Post request failed")
+	}
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(123456789)
+	}
+	img, _ := platform.GenerateRandomImageData()
+	signUpService := service.NewSignUpSvc("test-key", sfNode, reqSvc)
+	_, err := signUpService.SignUp(context.Background(), img)
+	testhelper.Assert(t, err != nil, "expected a post request error")
+	testhelper.Assert(t, isZeroed(img), "expected the image buffer to be wiped")
+
+	corrupt := append([]byte("\x89PNG\r\n\x1a\n"), []byte("corrupt")...)
+	_, err = signUpService.SignUp(context.Background(), corrupt)
+	testhelper.Assert(t, errors.Is(err, domain.ErrDecode), "expected a decoding error")
+	testhelper.Assert(t, isZeroed(corrupt), "expected the corrupt image buffer to be wiped")
+}
+
+func testNoUnsignedIrisCodeSent(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	img, _ := platform.GenerateRandomImageData()
+	decoded, _ := png.Decode(bytes.NewReader(img))
+	hash, _ := goimagehash.AverageHash(decoded)
+	unsigned := hash.ToString()
+
+	var sent string
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		sent = fmt.Sprintf("%+v", req.Body)
+		return 201, nil
+	}
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(123456789)
+	}
+	signUpService := service.NewSignUpSvc("test-key", sfNode, reqSvc)
+	_, err := signUpService.SignUp(context.Background(), img)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, sent != "", "expected a sign-up request to be sent")
+	testhelper.Assert(t, !strings.Contains(sent, unsigned[2:]), "expected the unsigned iris code to stay on the orb")
+}
+
+func testNegotiatedIrisCode(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	img, _ := platform.GenerateRandomImageData()
+	decoded, _ := png.Decode(bytes.NewReader(img))
+	hash, _ := goimagehash.PerceptionHash(decoded)
+	mac := hmac.New(sha512.New, []byte("test-key"))
+	mac.Write([]byte(hash.ToString()))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	var sent domain.Iris
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		sent = req.Body.(domain.Iris)
+		return 201, nil
+	}
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(123456789)
+	}
+	signUpService := service.NewSignUpSvc("test-key", sfNode, reqSvc,
+		service.WithHashAlgorithm(service.HashPerception),
+		service.WithIrisScheme(service.SchemeHMACSHA512))
+	_, err := signUpService.SignUp(context.Background(), img)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, sent.IrisCode == expected, "expected an HMAC-SHA512 of the perception hash, got %s", sent.IrisCode)
+}
+
+func isZeroed(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func testRegisteredOutcome(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	result, err := signUpWithResponse(reqSvc, sfNode, 201, domain.SignUpResponse{Success: true})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, result.Outcome == domain.SignUpRegistered, "expected registered, got %s", result.Outcome)
+	testhelper.Assert(t, result.Id == "123456789", "expected the snowflake ID, got %s", result.Id)
+}
+
+func testDuplicateOutcome(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	result, err := signUpWithResponse(reqSvc, sfNode, 409, domain.SignUpResponse{Message: "Already registered", MatchID: "42"})
+	testhelper.Assert(t, errors.Is(err, domain.ErrDuplicateSignUp), "expected a duplicate error, got %v", err)
+	testhelper.Assert(t, result.Outcome == domain.SignUpDuplicate, "expected duplicate, got %s", result.Outcome)
+	testhelper.Assert(t, result.MatchID == "42", "expected the matching identity reference, got %s", result.MatchID)
+}
+
+func testRejectedOutcome(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	result, err := signUpWithResponse(reqSvc, sfNode, 422, domain.SignUpResponse{Message: "irisCode is malformed"})
+	testhelper.Assert(t, errors.Is(err, domain.ErrSignUpRejected), "expected a rejection error, got %v", err)
+	testhelper.Assert(t, result.Outcome == domain.SignUpRejected, "expected rejected, got %s", result.Outcome)
+	testhelper.Assert(t, result.Reason == "irisCode is malformed", "expected the rejection reason, got %s", result.Reason)
+}
+
+func testTransientOutcome(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	for _, statusCode := range []int{429, 500, 503} {
+		result, err := signUpWithResponse(reqSvc, sfNode, statusCode, domain.SignUpResponse{})
+		testhelper.Assert(t, errors.Is(err, domain.ErrTransientFailure), "expected a transient error for %d, got %v", statusCode, err)
+		testhelper.Assert(t, result.Outcome == domain.SignUpTransient, "expected transient for %d, got %s", statusCode, result.Outcome)
+	}
+}
+
+func testTransportFailureOutcome(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	failures := []error{
+		fmt.Errorf("Do: %w", domain.ErrRequestFailed),
+		fmt.Errorf("Do: %w: %w", domain.ErrExecutionFailed, gobreaker.ErrOpenState),
+		fmt.Errorf("Do: %w: %w", domain.ErrRequestFailed, context.DeadlineExceeded),
+	}
+	for _, failure := range failures {
+		reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+			// The status that comes with a failure is a mere placeholder.
+			return http.StatusBadRequest, failure
+		}
+		sfNode.GenerateFunc = func() snowflake.ID { return snowflake.ID(123456789) }
+		img, _ := platform.GenerateRandomImageData()
+		result, err := service.NewSignUpSvc("test-key", sfNode, reqSvc).SignUp(context.Background(), img)
+		testhelper.Assert(t, result.Outcome == domain.SignUpTransient, "expected transient for %v, got %s", failure, result.Outcome)
+		testhelper.Assert(t, errors.Is(err, domain.ErrTransientFailure) && errors.Is(err, failure), "expected the cause to be kept, got %v", err)
+	}
+}
+
+func testUnconfirmedOutcome(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	for _, failure := range []error{domain.ErrDecodingResponse, domain.ErrResponseTooLarge} {
+		reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+			return http.StatusCreated, fmt.Errorf("Do: %w", failure)
+		}
+		sfNode.GenerateFunc = func() snowflake.ID { return snowflake.ID(123456789) }
+		img, _ := platform.GenerateRandomImageData()
+		result, err := service.NewSignUpSvc("test-key", sfNode, reqSvc).SignUp(context.Background(), img)
+		testhelper.Assert(t, result.Outcome == domain.SignUpUnconfirmed, "expected unconfirmed for %v, got %s", failure, result.Outcome)
+		testhelper.Assert(t, errors.Is(err, failure), "expected %v, got %v", failure, err)
+	}
+
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		*out.(*domain.SignUpResponse) = domain.SignUpResponse{MatchID: "garbage"}
+		return http.StatusConflict, fmt.Errorf("Do: %w", domain.ErrDecodingResponse)
+	}
+	img, _ := platform.GenerateRandomImageData()
+	result, err := service.NewSignUpSvc("test-key", sfNode, reqSvc).SignUp(context.Background(), img)
+	testhelper.Assert(t, result.Outcome == domain.SignUpDuplicate && result.MatchID == "", "expected a duplicate classified by its status, got %+v", result)
+	testhelper.Assert(t, errors.Is(err, domain.ErrDuplicateSignUp), "expected a duplicate error, got %v", err)
+}
+
+func testDuplicateAgainstService(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	server := httptest.NewServer(&mock.UniquenessService{})
+	defer server.Close()
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{})
+	r := service.NewRequestSvc(server.URL, server.Client(), cb)
+
+	ids := []snowflake.ID{1, 2}
+	sfNode.GenerateFunc = func() snowflake.ID {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	signUpService := service.NewSignUpSvc("test-key", sfNode, r)
+
+	img, _ := platform.GenerateRandomImageData()
+	again := append([]byte(nil), img...)
+	result, err := signUpService.SignUp(context.Background(), img)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, result.Outcome == domain.SignUpRegistered, "expected registered, got %s", result.Outcome)
+
+	result, err = signUpService.SignUp(context.Background(), again)
+	testhelper.Assert(t, errors.Is(err, domain.ErrDuplicateSignUp), "expected a duplicate error, got %v", err)
+	testhelper.Assert(t, result.MatchID == "1", "expected the first registration to match, got %q", result.MatchID)
+}
+
+func testIdempotencyKeySent(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	var key string
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		key = req.Header.Get(service.HeaderIdempotencyKey)
+		return 201, nil
+	}
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(123456789)
+	}
+	img, _ := platform.GenerateRandomImageData()
+	_, err := service.NewSignUpSvc("test-key", sfNode, reqSvc).SignUp(context.Background(), img)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, key == "123456789", "expected the snowflake ID as idempotency key, got %q", key)
+}
+
+func testRegisterOnceOnLostResponse(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	u := &mock.UniquenessService{}
+	server := httptest.NewServer(u)
+	defer server.Close()
+
+	// The first response is dropped after the server has stored the sign-up.
+	lost := false
+	client := &mock.HttpClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		resp, err := server.Client().Do(req)
+		if err == nil && !lost {
+			lost = true
+			resp.Body.Close()
+			return nil, errors.New("connection reset")
+		}
+		return resp, err
+	}}
+	policy := service.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	r := service.NewRequestSvc(server.URL, client, gobreaker.NewCircuitBreaker(gobreaker.Settings{}), service.WithRetryPolicy(policy))
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(7)
+	}
+
+	img, _ := platform.GenerateRandomImageData()
+	result, err := service.NewSignUpSvc("test-key", sfNode, r).SignUp(context.Background(), img)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, result.Outcome == domain.SignUpRegistered, "expected the original result, got %s", result.Outcome)
+	testhelper.Assert(t, u.Count("/sign-up") == 2, "expected the sign-up to be sent twice, got %d", u.Count("/sign-up"))
+	testhelper.Assert(t, u.Registered() == 1, "expected a single registration, got %d", u.Registered())
+}
+
+func signUpWithResponse(reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode, statusCode int, response domain.SignUpResponse) (*domain.SignUpResult, error) {
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		*out.(*domain.SignUpResponse) = response
+		return statusCode, nil
+	}
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(123456789)
+	}
+	img, _ := platform.GenerateRandomImageData()
+	return service.NewSignUpSvc("test-key", sfNode, reqSvc).SignUp(context.Background(), img)
+}
+
+func testQueueInOutbox(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	img, _ := platform.GenerateRandomImageData()
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(42)
+	}
+	var queued []domain.OutboxEntry
+	outbox := &mock.Outbox{AppendFunc: func(entry domain.OutboxEntry) error {
+		queued = append(queued, entry)
+		return nil
+	}}
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (int, error) {
+		t.Error("expected the sign-up not to be sent directly")
+		return 201, nil
+	}
+
+	result, err := service.NewSignUpSvc("test-key", sfNode, reqSvc, service.WithOutbox(outbox)).SignUp(context.Background(), img)
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, result.Outcome == domain.SignUpQueued && result.Id == "42", "expected sign-up 42 to be queued, got %+v", result)
+	testhelper.Assert(t, len(queued) == 1 && queued[0].Id == "42" && queued[0].Route == "/sign-up", "expected one queued sign-up, got %+v", queued)
+
+	var iris domain.Iris
+	testhelper.Ok(t, json.Unmarshal(queued[0].Body, &iris))
+	testhelper.Assert(t, iris.Id == "42" && len(iris.IrisCode) == 64, "expected the signed iris code to be stored, got %+v", iris)
+}
+
+func testFullOutbox(t *testing.T, reqSvc *mock.RequestSvc, sfNode *mock.SnowFlakeNode) {
+	img, _ := platform.GenerateRandomImageData()
+	sfNode.GenerateFunc = func() snowflake.ID {
+		return snowflake.ID(42)
+	}
+	outbox := &mock.Outbox{AppendFunc: func(entry domain.OutboxEntry) error {
+		return fmt.Errorf("Append: %w", domain.ErrOutboxFull)
+	}}
+
+	result, err := service.NewSignUpSvc("test-key", sfNode, reqSvc, service.WithOutbox(outbox)).SignUp(context.Background(), img)
+	testhelper.Assert(t, errors.Is(err, domain.ErrOutboxFull), "expected a full outbox, got %v", err)
+	testhelper.Assert(t, result == nil, "expected no result, got %+v", result)
+	testhelper.Assert(t, isZeroed(img), "expected the image to be wiped")
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+// Headers carrying the orb identity and the request signature.
+const (
+	HeaderOrbID     = "X-Orb-Id"
+	HeaderTimestamp = "X-Orb-Timestamp"
+	HeaderSignature = "X-Orb-Signature"
+	HeaderScheme    = "X-Orb-Signature-Scheme"
+)
+
+// Signature schemes the orb can sign with. Requests signed with the default
+// scheme carry no scheme header, as they did before schemes were negotiated.
+const (
+	SchemeHMACSHA256 = "hmac-sha256"
+	SchemeHMACSHA512 = "hmac-sha512"
+	DefaultScheme    = SchemeHMACSHA256
+)
+
+// DefaultMaxSkew is how far the signed timestamp of a request may be from
+// the verifier's clock when no bound is given.
+const DefaultMaxSkew = 5 * time.Minute
+
+// requestSigner decorates an HTTP client and signs every outgoing request
+// with the orb's identity, using the same key as sign-ups.
+type (
+	requestSigner struct {
+		orbID   string
+		signKey string
+		client  domain.HttpClient
+		now     func() time.Time
+		scheme  string
+
+		negotiation *negotiation
+	}
+
+	// SignerOption configures optional behaviour of the request signer.
+	SignerOption func(*requestSigner)
+)
+
+// NewRequestSigner creates a new instance of the request signer.
+//
+// orbID: Identifier of the orb sending the requests.
+// signKey: Secret key used for signing operations.
+// client: The HTTP client that will send the signed requests.
+// opts: Optional settings such as WithScheme.
+//
+// Returns a pointer to a request signer, which itself satisfies domain.HttpClient.
+func NewRequestSigner(orbID string, signKey string, client domain.HttpClient, opts ...SignerOption) *requestSigner {
+	rs := &requestSigner{
+		orbID:   orbID,
+		signKey: signKey,
+		client:  client,
+		now:     time.Now,
+		scheme:  DefaultScheme,
+	}
+	for _, opt := range opts {
+		opt(rs)
+	}
+	return rs
+}
+
+// WithScheme signs the requests with the given scheme instead of the
+// default HMAC-SHA256.
+//
+// scheme: One of the Scheme constants, usually the negotiated one.
+func WithScheme(scheme string) SignerOption {
+	return func(rs *requestSigner) {
+		rs.scheme = scheme
+	}
+}
+
+// WithNegotiatedScheme signs the requests with the scheme in use, following
+// it when it is renegotiated.
+//
+// negotiation: Holder of the options in use.
+func WithNegotiatedScheme(negotiation *negotiation) SignerOption {
+	return func(rs *requestSigner) {
+		rs.negotiation = negotiation
+	}
+}
+
+// Do signs the request body together with the orb ID and the current
+// timestamp, sets the signature headers and sends the request.
+//
+// req: The HTTP request to sign and send.
+//
+// Returns the HTTP response and an error if any occurred during the process.
+func (rs *requestSigner) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Do: %w", domain.ErrSigningRequest)
+		}
+		body = b
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	scheme := rs.scheme
+	if rs.negotiation != nil {
+		scheme = rs.negotiation.Current().SignatureScheme
+	}
+	timestamp := strconv.FormatInt(rs.now().Unix(), 10)
+	req.Header.Set(HeaderOrbID, rs.orbID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	signature, err := SignPayloadWith(scheme, rs.signKey, rs.orbID, timestamp, body)
+	if err != nil {
+		return nil, fmt.Errorf("Do: %w: %w", domain.ErrSigningRequest, err)
+	}
+	req.Header.Set(HeaderSignature, signature)
+	if scheme != DefaultScheme {
+		req.Header.Set(HeaderScheme, scheme)
+	}
+
+	return rs.client.Do(req)
+}
+
+// SignPayload computes the HMAC-SHA256 signature of a request.
+// The orb ID, timestamp and body are joined with newlines before signing
+// so that none of them can be swapped without invalidating the signature.
+//
+// signKey: Secret key used for signing operations.
+// orbID: Identifier of the orb sending the request.
+// timestamp: Unix timestamp, in seconds, at which the request was signed.
+// body: The raw request body.
+//
+// Returns the signature in hex string format.
+func SignPayload(signKey string, orbID string, timestamp string, body []byte) string {
+	return signPayload(sha256.New, signKey, orbID, timestamp, body)
+}
+
+// SignPayloadWith computes the signature of a request as SignPayload does,
+// with the given scheme.
+//
+// scheme: One of the Scheme constants.
+// signKey: Secret key used for signing operations.
+// orbID: Identifier of the orb sending the request.
+// timestamp: Unix timestamp, in seconds, at which the request was signed.
+// body: The raw request body.
+//
+// Returns the signature in hex string format, or domain.ErrInvalidCapability
+// if the scheme is unknown.
+func SignPayloadWith(scheme string, signKey string, orbID string, timestamp string, body []byte) (string, error) {
+	h, err := schemeHash(scheme)
+	if err != nil {
+		return "", fmt.Errorf("SignPayloadWith: %w", err)
+	}
+	return signPayload(h, signKey, orbID, timestamp, body), nil
+}
+
+// schemeHash returns the hash function an HMAC scheme is built on.
+func schemeHash(scheme string) (func() hash.Hash, error) {
+	switch scheme {
+	case SchemeHMACSHA256:
+		return sha256.New, nil
+	case SchemeHMACSHA512:
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("%w: signature scheme %q", domain.ErrInvalidCapability, scheme)
+	}
+}
+
+// signPayload computes the HMAC of a request with the given hash function.
+func signPayload(h func() hash.Hash, signKey string, orbID string, timestamp string, body []byte) string {
+	mac := hmac.New(h, []byte(signKey))
+	mac.Write([]byte(orbID))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the signature headers of a received request.
+// It is the server-side counterpart of the request signer. Requests without
+// a scheme header are taken to be signed with the default scheme.
+//
+// signKey: Secret key shared with the orb.
+// maxSkew: Maximum allowed distance between the signed timestamp and now;
+// zero or less stands for DefaultMaxSkew.
+// now: The current time of the verifier.
+// header: The headers of the received request.
+// body: The raw body of the received request.
+//
+// Returns nil if the signature is valid, or an error describing why it is not.
+func VerifySignature(signKey string, maxSkew time.Duration, now time.Time, header http.Header, body []byte) error {
+	orbID := header.Get(HeaderOrbID)
+	timestamp := header.Get(HeaderTimestamp)
+	signature := header.Get(HeaderSignature)
+	if orbID == "" || timestamp == "" || signature == "" {
+		return fmt.Errorf("VerifySignature: %w", domain.ErrMissingSignature)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("VerifySignature: %w", domain.ErrInvalidSignature)
+	}
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("VerifySignature: %w", domain.ErrStaleSignature)
+	}
+
+	scheme := header.Get(HeaderScheme)
+	if scheme == "" {
+		scheme = DefaultScheme
+	}
+	expected, err := SignPayloadWith(scheme, signKey, orbID, timestamp, body)
+	if err != nil {
+		return fmt.Errorf("VerifySignature: %w", domain.ErrInvalidSignature)
+	}
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("VerifySignature: %w", domain.ErrInvalidSignature)
+	}
+	return nil
+}
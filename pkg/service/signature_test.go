@@ -0,0 +1,114 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestSignature(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.UniquenessService, *httptest.Server)
+	}{
+		{"should accept signed status report", testAcceptSignedStatus},
+		{"should reject unsigned status report", testRejectUnsignedStatus},
+		{"should reject tampered status report", testRejectTamperedStatus},
+		{"should reject stale signature", testRejectStaleSignature},
+		{"should default the allowed skew", testDefaultMaxSkew},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			u := &mock.UniquenessService{SignKey: "test-key", MaxSkew: time.Minute}
+			server := httptest.NewServer(u)
+			defer server.Close()
+			test.function(t, u, server)
+		})
+	}
+}
+
+func testAcceptSignedStatus(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	signer := service.NewRequestSigner("1", "test-key", server.Client())
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{})
+	r := service.NewRequestSvc(server.URL, signer, cb)
+	sysInfo := &mock.SystemInfo{GetSystemInfoFunc: func() *domain.Status {
+		return &domain.Status{Battery: 50}
+	}}
+	err := service.NewStatusSvc(r, sysInfo).Report(context.Background())
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, u.Count("/status") == 1, "expected the status report to be accepted")
+}
+
+func testRejectUnsignedStatus(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{})
+	r := service.NewRequestSvc(server.URL, server.Client(), cb)
+	statusCode, err := r.Post(context.Background(), "/status", domain.Status{})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusUnauthorized, "expected 401, got %d", statusCode)
+	testhelper.Assert(t, u.Count("/status") == 0, "expected the status report to be rejected")
+}
+
+func testRejectTamperedStatus(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	tamper := &mock.HttpClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		tampered := []byte(`{"battery":100}`)
+		req.Body = io.NopCloser(bytes.NewReader(tampered))
+		req.ContentLength = int64(len(tampered))
+		return server.Client().Do(req)
+	}}
+	signer := service.NewRequestSigner("1", "test-key", tamper)
+	cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{})
+	r := service.NewRequestSvc(server.URL, signer, cb)
+	statusCode, err := r.Post(context.Background(), "/status", domain.Status{Battery: 5})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, statusCode == http.StatusUnauthorized, "expected 401, got %d", statusCode)
+	testhelper.Assert(t, u.Count("/status") == 0, "expected the status report to be rejected")
+}
+
+func testRejectStaleSignature(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	body := []byte(`{"battery":5}`)
+	timestamp := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	header := http.Header{}
+	header.Set(service.HeaderOrbID, "1")
+	header.Set(service.HeaderTimestamp, timestamp)
+	header.Set(service.HeaderSignature, service.SignPayload("test-key", "1", timestamp, body))
+
+	err := service.VerifySignature("test-key", time.Minute, time.Now(), header, body)
+	testhelper.Assert(t, errors.Is(err, domain.ErrStaleSignature), "expected a stale signature error, got %v", err)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/status", bytes.NewReader(body))
+	req.Header = header
+	resp, err := server.Client().Do(req)
+	testhelper.Ok(t, err)
+	resp.Body.Close()
+	testhelper.Assert(t, resp.StatusCode == http.StatusUnauthorized, "expected 401, got %d", resp.StatusCode)
+}
+
+func testDefaultMaxSkew(t *testing.T, u *mock.UniquenessService, server *httptest.Server) {
+	body := []byte(`{"battery":5}`)
+	sign := func(at time.Time) http.Header {
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		header := http.Header{}
+		header.Set(service.HeaderOrbID, "1")
+		header.Set(service.HeaderTimestamp, timestamp)
+		header.Set(service.HeaderSignature, service.SignPayload("test-key", "1", timestamp, body))
+		return header
+	}
+	now := time.Now()
+
+	testhelper.Ok(t, service.VerifySignature("test-key", 0, now, sign(now.Add(-time.Minute)), body))
+	err := service.VerifySignature("test-key", 0, now, sign(now.Add(-service.DefaultMaxSkew-time.Minute)), body)
+	testhelper.Assert(t, errors.Is(err, domain.ErrStaleSignature), "expected a stale signature beyond the default, got %v", err)
+}
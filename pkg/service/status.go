@@ -1,48 +1,218 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 	"virtual-orb/pkg/domain"
 )
 
 // statusSvc provides services related to reporting the status of the system.
-type statusSvc struct {
-	requestSvc domain.RequestSvc
-	systemInfo domain.SystemInfo
-}
+type (
+	statusSvc struct {
+		requestSvc  domain.RequestSvc
+		systemInfo  domain.SystemInfo
+		buffer      *statusBuffer
+		batch       BatchConfig
+		deadLetters domain.DeadLetterStore
+	}
+
+	// StatusOption configures optional behaviour of the status service.
+	StatusOption func(*statusSvc)
+)
 
 // NewStatusSvc initializes a new instance of statusSvc.
 //
 // requestSvc: Service used to handle HTTP requests.
 // systemInfo: Entity responsible for retrieving system-related information.
+// opts: Optional settings such as WithStatusBuffer or WithStatusDeadLetters.
 //
 // Returns a pointer to an initialized statusSvc instance.
-func NewStatusSvc(requestSvc domain.RequestSvc, systemInfo domain.SystemInfo) *statusSvc {
-	return &statusSvc{
-		requestSvc,
-		systemInfo,
+func NewStatusSvc(requestSvc domain.RequestSvc, systemInfo domain.SystemInfo, opts ...StatusOption) *statusSvc {
+	ss := &statusSvc{
+		requestSvc: requestSvc,
+		systemInfo: systemInfo,
+	}
+	for _, opt := range opts {
+		opt(ss)
+	}
+	return ss
+}
+
+// WithStatusBuffer keeps the reports that could not be delivered in the
+// buffer, and uploads them to "/status/batch" once the backend is reachable.
+// With a MaxLinger, live reports are buffered as well, and only uploaded
+// once a full batch is waiting or the oldest has lingered that long.
+//
+// buffer: The buffer holding undelivered reports.
+// batch: The maximum number of samples uploaded per request and how long they may linger.
+func WithStatusBuffer(buffer *statusBuffer, batch BatchConfig) StatusOption {
+	return func(ss *statusSvc) {
+		ss.buffer = buffer
+		ss.batch = batch
+	}
+}
+
+// WithStatusDeadLetters keeps the buffered batches rejected by the backend
+// as dead letters, instead of retrying them forever.
+//
+// store: The store rejected batches are written to.
+func WithStatusDeadLetters(store domain.DeadLetterStore) StatusOption {
+	return func(ss *statusSvc) {
+		ss.deadLetters = store
 	}
 }
 
 // Report gathers system information and reports it.
-// The system information is marshaled into a JSON string and then sent as a payload to a "/status" endpoint.
+// The system information is sent as a JSON object to the "/status" endpoint.
+// With a status buffer, a report that cannot be delivered is buffered, and
+// while a backlog exists new reports join it so that the backend receives
+// them in order, as batches. When reports may linger, every report joins
+// the buffer, which is uploaded once the batch is ready.
+//
+// ctx: Context bounding the report.
 //
 // Returns an error if any occurred during the process.
-func (ss *statusSvc) Report() error {
+func (ss *statusSvc) Report(ctx context.Context) error {
 	status := ss.systemInfo.GetSystemInfo()
+	if ss.buffer == nil {
+		return ss.post(ctx, status)
+	}
 
-	payload, err := json.Marshal(status)
+	now := time.Now()
+	lingering := ss.batch.MaxLinger > 0
+	if ss.buffer.Len() == 0 && !lingering {
+		err := ss.post(ctx, status)
+		if err == nil {
+			return nil
+		}
+		if bufErr := ss.buffer.Add(NewStatusSample(*status, now)); bufErr != nil {
+			return fmt.Errorf("Report: %w", bufErr)
+		}
+		return err
+	}
+
+	if err := ss.buffer.Add(NewStatusSample(*status, now)); err != nil {
+		return fmt.Errorf("Report: %w", err)
+	}
+	if lingering && !ss.batch.ready(ss.buffer.Len(), ss.buffer.Oldest(), now) {
+		return nil
+	}
+	rejected := 0
+	err := ss.buffer.Drain(ss.batch.MaxSize, func(samples []domain.StatusSample) ([]domain.StatusSample, error) {
+		n, left, err := ss.postBatch(ctx, samples)
+		rejected += n
+		return left, err
+	})
 	if err != nil {
-		return fmt.Errorf("Report: %w", domain.ErrMarshallingPayload)
+		return fmt.Errorf("Report: %w", err)
+	}
+	if rejected > 0 && ss.deadLetters == nil {
+		return fmt.Errorf("Report: %d samples dropped: %w", rejected, domain.ErrBatchItemsRejected)
 	}
-	payloadJson := string(payload)
+	return nil
+}
 
-	statusCode, err := ss.requestSvc.Post("/status", payloadJson)
+// postBatch uploads buffered samples to the "/status/batch" endpoint, each
+// carrying its position in the batch as ID, which its result echoes.
+// Samples the backend rejects are set aside as a dead letter, since sending
+// them again would be rejected again, so that the rest of the backlog can
+// get through, or dropped without a dead letter store. When single samples
+// fail otherwise, or have no result, only those are sent again, so that the
+// accepted ones are not duplicated. A batch refused or failing as a whole
+// says nothing of the samples within and is sent again. A response without
+// per-item results accepts every sample.
+//
+// ctx: Context bounding the request.
+// samples: The samples to upload.
+//
+// Returns the number of samples rejected, the samples to send again and an
+// error if there are any.
+func (ss *statusSvc) postBatch(ctx context.Context, samples []domain.StatusSample) (int, []domain.StatusSample, error) {
+	batch := domain.StatusBatch{Samples: make([]domain.StatusSample, len(samples))}
+	for i, sample := range samples {
+		sample.Id = strconv.Itoa(i)
+		batch.Samples[i] = sample
+	}
+	statusCode, response, err := postBatch(ctx, ss.requestSvc, "/status/batch", "", batch)
+	if err != nil || statusCode != http.StatusOK {
+		return 0, samples, domain.ErrRequestFailed
+	}
+	if len(response.Results) == 0 {
+		return 0, nil, nil
+	}
+
+	items := map[string]domain.BatchItemResult{}
+	for _, item := range response.Results {
+		items[item.Id] = item
+	}
+	var rejected, failed []domain.StatusSample
+	rejectedStatus := 0
+	for i, sample := range samples {
+		item, ok := items[batch.Samples[i].Id]
+		switch {
+		case ok && item.Status >= 200 && item.Status < 300:
+		case ok && isRejectedStatus(item.Status):
+			rejected = append(rejected, sample)
+			rejectedStatus = item.Status
+		default:
+			failed = append(failed, sample)
+		}
+	}
+	if len(rejected) > 0 {
+		if err := ss.deadLetter(domain.StatusBatch{Samples: rejected}, rejectedStatus); err != nil {
+			// Keep the batch as it was rather than lose the rejected samples.
+			return 0, samples, err
+		}
+	}
+	if len(failed) > 0 {
+		return len(rejected), failed, domain.ErrRequestFailed
+	}
+	return len(rejected), nil, nil
+}
+
+// post sends a single status report to the "/status" endpoint.
+//
+// ctx: Context bounding the request.
+// status: The status report.
+//
+// Returns an error if any occurred during the process.
+func (ss *statusSvc) post(ctx context.Context, status *domain.Status) error {
+	statusCode, err := ss.requestSvc.Post(ctx, "/status", status)
 	if err != nil || statusCode != http.StatusOK {
 		return fmt.Errorf("Report: %w", domain.ErrRequestFailed)
 	}
 
 	return nil
 }
+
+// deadLetter stores samples rejected by the backend as a dead letter, if
+// there is a store for them.
+//
+// batch: The rejected samples.
+// statusCode: The HTTP status they were rejected with.
+//
+// Returns an error if the dead letter could not be stored.
+func (ss *statusSvc) deadLetter(batch domain.StatusBatch, statusCode int) error {
+	if ss.deadLetters == nil {
+		return nil
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return domain.ErrMarshallingPayload
+	}
+	req := &domain.Request{Method: http.MethodPost, Route: "/status/batch"}
+	createdAt := batch.Samples[0].From
+	letter := NewDeadLetter(req, body, domain.DeadLetterRejected, statusCode, 1, createdAt, domain.ErrRequestFailed)
+	return ss.deadLetters.Add(letter)
+}
+
+// isRejectedStatus reports whether a response status means the request
+// itself is unacceptable, so that sending it again cannot succeed.
+func isRejectedStatus(statusCode int) bool {
+	return statusCode >= 400 && statusCode < 500 &&
+		statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests
+}
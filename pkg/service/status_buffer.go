@@ -0,0 +1,312 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"virtual-orb/pkg/domain"
+)
+
+type (
+	// StatusBufferConfig configures the buffer holding status reports that
+	// could not be delivered.
+	StatusBufferConfig struct {
+		Capacity      int                // Samples kept in memory; at least 2.
+		Spill         domain.StatusSpill // Optional disk tier for samples that do not fit in memory.
+		SpillCapacity int                // Samples kept in the spill.
+	}
+
+	// statusBuffer is a bounded, chronological buffer of status samples.
+	// When memory is full, its older half moves to the spill if there is
+	// one, or is downsampled by merging neighbouring samples into aggregates
+	// otherwise. A full spill is downsampled the same way, so the oldest
+	// part of the timeline becomes coarser rather than being dropped.
+	statusBuffer struct {
+		cfg StatusBufferConfig
+
+		drainMu sync.Mutex // Held for a whole drain, so that drains do not overlap.
+
+		mu          sync.Mutex
+		samples     []domain.StatusSample // In memory, all newer than the spilled ones.
+		spilled     int
+		pinned      int  // Oldest samples being sent, which are neither spilled nor downsampled.
+		pinnedSpill bool // Whether the pinned samples are the oldest of the spill rather than of memory.
+		length      atomic.Int64
+	}
+)
+
+// NewStatusBuffer creates a status buffer, picking up the samples left in
+// the spill by a previous run.
+//
+// cfg: Settings of the buffer.
+//
+// Returns a pointer to the buffer, or an error if the spill cannot be read.
+func NewStatusBuffer(cfg StatusBufferConfig) (*statusBuffer, error) {
+	if cfg.Capacity < 2 {
+		cfg.Capacity = 2
+	}
+	b := &statusBuffer{cfg: cfg}
+	if cfg.Spill != nil {
+		stored, err := cfg.Spill.Load()
+		if err != nil {
+			return nil, fmt.Errorf("NewStatusBuffer: %w", err)
+		}
+		b.spilled = len(stored)
+	}
+	b.updateLen()
+	return b, nil
+}
+
+// NewStatusSample wraps a single status report into a sample.
+//
+// status: The status report.
+// at: When the report was taken.
+//
+// Returns the sample covering only that report.
+func NewStatusSample(status domain.Status, at time.Time) domain.StatusSample {
+	return domain.StatusSample{From: at, To: at, Count: 1, Min: status, Max: status, Avg: status}
+}
+
+// Add appends the sample to the buffer, making room first if it is full.
+// The sample is always buffered; an error means the spill failed and the
+// samples meant for it were downsampled in memory instead.
+//
+// sample: The sample to buffer.
+//
+// Returns an error if any occurred while spilling.
+func (b *statusBuffer) Add(sample domain.StatusSample) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.updateLen()
+
+	var err error
+	if len(b.samples) >= b.cfg.Capacity {
+		err = b.makeRoom()
+	}
+	b.samples = append(b.samples, sample)
+	return err
+}
+
+// Drain hands the buffered samples to send in batches, oldest first, and
+// removes each batch once it has been sent. The buffer is not locked while
+// a batch is being sent, so samples can be added meanwhile; the batch itself
+// is kept out of spilling and downsampling until send returns.
+//
+// batchSize: The maximum number of samples per batch.
+// send: Delivers a batch, returning the samples of it that have to be sent
+// again, in order, and an error if the batch was not fully delivered.
+//
+// Returns the first error raised by send or by the spill.
+func (b *statusBuffer) Drain(batchSize int, send func([]domain.StatusSample) ([]domain.StatusSample, error)) error {
+	b.drainMu.Lock()
+	defer b.drainMu.Unlock()
+
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	for {
+		batch, err := b.pin(batchSize)
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+		left, sendErr := send(batch)
+		if err := b.unpin(left); err != nil {
+			return err
+		}
+		if sendErr != nil {
+			return sendErr
+		}
+	}
+}
+
+// pin picks the next batch to send, from the spill first, and keeps it from
+// being spilled or downsampled until unpin.
+//
+// Returns a copy of the batch, or none if the buffer is empty.
+func (b *statusBuffer) pin(batchSize int) ([]domain.StatusSample, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.updateLen()
+
+	source := b.samples
+	b.pinnedSpill = false
+	if b.spilled > 0 {
+		stored, err := b.cfg.Spill.Load()
+		if err != nil {
+			return nil, fmt.Errorf("Drain: %w", err)
+		}
+		b.spilled = len(stored)
+		if len(stored) > 0 {
+			source, b.pinnedSpill = stored, true
+		}
+	}
+	b.pinned = batchSize
+	if b.pinned > len(source) {
+		b.pinned = len(source)
+	}
+	return append([]domain.StatusSample(nil), source[:b.pinned]...), nil
+}
+
+// unpin replaces the pinned batch with the samples of it left to send.
+func (b *statusBuffer) unpin(left []domain.StatusSample) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.updateLen()
+
+	n := b.pinned
+	b.pinned = 0
+	if !b.pinnedSpill {
+		b.samples = append(left, b.samples[n:]...)
+		return nil
+	}
+	if len(left) == n {
+		return nil
+	}
+	// Samples were only appended to the spill meanwhile, so the batch is
+	// still at its head.
+	stored, err := b.cfg.Spill.Load()
+	if err == nil {
+		stored = append(left, stored[n:]...)
+		err = b.cfg.Spill.Replace(stored)
+	}
+	if err != nil {
+		return fmt.Errorf("Drain: %w", err)
+	}
+	b.spilled = len(stored)
+	return nil
+}
+
+// Oldest returns when the oldest buffered sample starts. Spilled samples
+// are older than any in memory, so the zero time stands for them rather
+// than reading the spill.
+//
+// Returns the start of the oldest sample, or the current time if the buffer is empty.
+func (b *statusBuffer) Oldest() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.spilled > 0:
+		return time.Time{}
+	case len(b.samples) > 0:
+		return b.samples[0].From
+	}
+	return time.Now()
+}
+
+// Len returns the number of buffered samples, without waiting for a drain
+// in progress.
+func (b *statusBuffer) Len() int {
+	return int(b.length.Load())
+}
+
+// makeRoom frees memory by moving its older half to the spill or, failing
+// that, by downsampling it. The half is rounded up to an even number so that
+// downsampling always frees at least one slot.
+//
+// Samples being sent are left alone. While they are in memory, nothing is
+// spilled, as the spill has to stay older than memory, and memory may
+// exceed its capacity by up to a batch when there is nothing else to
+// downsample. While they are in the spill, it is only appended to.
+func (b *statusBuffer) makeRoom() error {
+	memPinned := 0
+	if !b.pinnedSpill {
+		memPinned = b.pinned
+	}
+	free := b.samples[memPinned:]
+	if len(free) < 2 {
+		return nil
+	}
+	half := (len(free)/2 + 1) &^ 1
+	older := free[:half]
+
+	var err error
+	canSpill := memPinned == 0 && (b.pinned == 0 || b.spilled+half <= b.cfg.SpillCapacity)
+	if b.cfg.Spill != nil && b.cfg.SpillCapacity > 0 && canSpill {
+		if err = b.spill(older); err == nil {
+			b.samples = append([]domain.StatusSample(nil), free[half:]...)
+			return nil
+		}
+	}
+	kept := append(append([]domain.StatusSample(nil), b.samples[:memPinned]...), downsample(older)...)
+	b.samples = append(kept, free[half:]...)
+	return err
+}
+
+// spill moves the samples to the spill, downsampling what it already holds
+// until they fit.
+func (b *statusBuffer) spill(samples []domain.StatusSample) error {
+	for b.spilled+len(samples) > b.cfg.SpillCapacity {
+		stored, err := b.cfg.Spill.Load()
+		if err != nil {
+			return fmt.Errorf("spill: %w", err)
+		}
+		if len(stored) < 2 {
+			return fmt.Errorf("spill: %w", domain.ErrStatusSpill)
+		}
+		stored = downsample(stored)
+		if err := b.cfg.Spill.Replace(stored); err != nil {
+			return fmt.Errorf("spill: %w", err)
+		}
+		b.spilled = len(stored)
+	}
+	if err := b.cfg.Spill.Append(samples); err != nil {
+		return fmt.Errorf("spill: %w", err)
+	}
+	b.spilled += len(samples)
+	return nil
+}
+
+func (b *statusBuffer) updateLen() {
+	b.length.Store(int64(len(b.samples) + b.spilled))
+}
+
+// downsample merges neighbouring samples pairwise, halving their number.
+func downsample(samples []domain.StatusSample) []domain.StatusSample {
+	merged := make([]domain.StatusSample, 0, (len(samples)+1)/2)
+	for i := 0; i < len(samples); i += 2 {
+		if i+1 == len(samples) {
+			merged = append(merged, samples[i])
+			break
+		}
+		merged = append(merged, mergeSamples(samples[i], samples[i+1]))
+	}
+	return merged
+}
+
+// mergeSamples aggregates two consecutive samples into one covering both.
+func mergeSamples(a, b domain.StatusSample) domain.StatusSample {
+	wa, wb := float32(a.Count), float32(b.Count)
+	return domain.StatusSample{
+		From:  a.From,
+		To:    b.To,
+		Count: a.Count + b.Count,
+		Min: combineStatus(a.Min, b.Min, func(x, y float32) float32 {
+			if x < y {
+				return x
+			}
+			return y
+		}),
+		Max: combineStatus(a.Max, b.Max, func(x, y float32) float32 {
+			if x > y {
+				return x
+			}
+			return y
+		}),
+		Avg: combineStatus(a.Avg, b.Avg, func(x, y float32) float32 {
+			return (x*wa + y*wb) / (wa + wb)
+		}),
+	}
+}
+
+// combineStatus applies f to each field of the two statuses.
+func combineStatus(a, b domain.Status, f func(x, y float32) float32) domain.Status {
+	return domain.Status{
+		Battery:   f(a.Battery, b.Battery),
+		CPUUsage:  f(a.CPUUsage, b.CPUUsage),
+		CPUTemp:   f(a.CPUTemp, b.CPUTemp),
+		DiskSpace: f(a.DiskSpace, b.DiskSpace),
+		ClockSkew: f(a.ClockSkew, b.ClockSkew),
+	}
+}
@@ -0,0 +1,216 @@
+package service_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/platform"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestStatusBuffer(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, string)
+	}{
+		{"should downsample older samples when full", testDownsampleWhenFull},
+		{"should aggregate min, max and average", testAggregateSamples},
+		{"should spill older samples to disk", testSpillOlderSamples},
+		{"should downsample a full spill", testDownsampleFullSpill},
+		{"should drain in order and stop on failure", testDrainInOrder},
+		{"should pick up spilled samples after a restart", testSpillRestart},
+		{"should take samples while a batch is being sent", testAddWhileSending},
+		{"should keep only the samples left to send", testKeepSamplesLeft},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			test.function(t, filepath.Join(t.TempDir(), "status.log"))
+		})
+	}
+}
+
+var statusEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// statusAt returns a sample taken i seconds after the epoch, with a battery
+// level of i.
+func statusAt(i int) domain.StatusSample {
+	return service.NewStatusSample(domain.Status{Battery: float32(i)}, statusEpoch.Add(time.Duration(i)*time.Second))
+}
+
+func drainAll(t *testing.T, buffer interface {
+	Drain(int, func([]domain.StatusSample) ([]domain.StatusSample, error)) error
+}) []domain.StatusSample {
+	var drained []domain.StatusSample
+	testhelper.Ok(t, buffer.Drain(100, func(samples []domain.StatusSample) ([]domain.StatusSample, error) {
+		drained = append(drained, samples...)
+		return nil, nil
+	}))
+	return drained
+}
+
+// assertTimeline checks that the samples are in order, do not overlap and
+// cover every report from 0 to last.
+func assertTimeline(t *testing.T, samples []domain.StatusSample, last int) {
+	t.Helper()
+	total := 0
+	for i, sample := range samples {
+		total += sample.Count
+		if i > 0 {
+			testhelper.Assert(t, sample.From.After(samples[i-1].To), "expected sample %d to follow the previous one", i)
+		}
+	}
+	testhelper.Assert(t, total == last+1, "expected %d reports to be covered, got %d", last+1, total)
+	testhelper.Assert(t, samples[0].From.Equal(statusAt(0).From), "expected the timeline to start at the first report")
+	testhelper.Assert(t, samples[len(samples)-1].To.Equal(statusAt(last).To), "expected the timeline to end at the last report")
+}
+
+func testDownsampleWhenFull(t *testing.T, _ string) {
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 4})
+	testhelper.Ok(t, err)
+	for i := 0; i < 20; i++ {
+		testhelper.Ok(t, buffer.Add(statusAt(i)))
+		testhelper.Assert(t, buffer.Len() <= 4, "expected at most 4 samples, got %d", buffer.Len())
+	}
+
+	samples := drainAll(t, buffer)
+	assertTimeline(t, samples, 19)
+	testhelper.Assert(t, samples[len(samples)-1].Count == 1, "expected the newest sample to stay raw")
+	testhelper.Assert(t, samples[0].Count > samples[len(samples)-1].Count, "expected older samples to be coarser")
+	testhelper.Assert(t, buffer.Len() == 0, "expected an empty buffer after draining, got %d", buffer.Len())
+}
+
+func testAggregateSamples(t *testing.T, _ string) {
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 2})
+	testhelper.Ok(t, err)
+	for _, battery := range []float32{10, 40, 90} {
+		testhelper.Ok(t, buffer.Add(service.NewStatusSample(domain.Status{Battery: battery}, statusEpoch)))
+	}
+
+	samples := drainAll(t, buffer)
+	testhelper.Assert(t, len(samples) == 2 && samples[0].Count == 2, "expected the first two reports to be merged, got %+v", samples)
+	aggregate := samples[0]
+	testhelper.Assert(t, aggregate.Min.Battery == 10 && aggregate.Max.Battery == 40 && aggregate.Avg.Battery == 25,
+		"expected min 10, max 40 and avg 25, got %+v", aggregate)
+}
+
+func testSpillOlderSamples(t *testing.T, path string) {
+	spill, err := platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 4, Spill: spill, SpillCapacity: 100})
+	testhelper.Ok(t, err)
+	for i := 0; i < 20; i++ {
+		testhelper.Ok(t, buffer.Add(statusAt(i)))
+	}
+
+	testhelper.Assert(t, buffer.Len() == 20, "expected every sample to be kept, got %d", buffer.Len())
+	stored, err := spill.Load()
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, len(stored) > 0, "expected samples on disk")
+
+	samples := drainAll(t, buffer)
+	assertTimeline(t, samples, 19)
+	testhelper.Assert(t, len(samples) == 20, "expected no downsampling, got %d samples", len(samples))
+}
+
+func testDownsampleFullSpill(t *testing.T, path string) {
+	spill, err := platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 4, Spill: spill, SpillCapacity: 8})
+	testhelper.Ok(t, err)
+	for i := 0; i < 50; i++ {
+		testhelper.Ok(t, buffer.Add(statusAt(i)))
+		testhelper.Assert(t, buffer.Len() <= 12, "expected at most 12 samples, got %d", buffer.Len())
+	}
+
+	samples := drainAll(t, buffer)
+	assertTimeline(t, samples, 49)
+}
+
+func testDrainInOrder(t *testing.T, path string) {
+	spill, err := platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 4, Spill: spill, SpillCapacity: 100})
+	testhelper.Ok(t, err)
+	for i := 0; i < 10; i++ {
+		testhelper.Ok(t, buffer.Add(statusAt(i)))
+	}
+
+	failure := errors.New("offline")
+	var sent []domain.StatusSample
+	err = buffer.Drain(3, func(samples []domain.StatusSample) ([]domain.StatusSample, error) {
+		if len(sent) >= 3 {
+			return samples, failure
+		}
+		sent = append(sent, samples...)
+		return nil, nil
+	})
+	testhelper.Assert(t, errors.Is(err, failure), "expected the send failure, got %v", err)
+	testhelper.Assert(t, buffer.Len() == 7, "expected the unsent samples to stay buffered, got %d", buffer.Len())
+
+	sent = append(sent, drainAll(t, buffer)...)
+	assertTimeline(t, sent, 9)
+	testhelper.Assert(t, len(sent) == 10, "expected every sample to be sent once, got %d", len(sent))
+}
+
+func testSpillRestart(t *testing.T, path string) {
+	spill, err := platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 2, Spill: spill, SpillCapacity: 100})
+	testhelper.Ok(t, err)
+	for i := 0; i < 5; i++ {
+		testhelper.Ok(t, buffer.Add(statusAt(i)))
+	}
+
+	spill, err = platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	buffer, err = service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 2, Spill: spill, SpillCapacity: 100})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, buffer.Len() == 4, "expected the spilled samples to survive, got %d", buffer.Len())
+	samples := drainAll(t, buffer)
+	testhelper.Assert(t, samples[0].From.Equal(statusAt(0).From), "expected the oldest spilled sample first")
+}
+
+func testAddWhileSending(t *testing.T, path string) {
+	spill, err := platform.OpenStatusSpill(path)
+	testhelper.Ok(t, err)
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 2, Spill: spill, SpillCapacity: 100})
+	testhelper.Ok(t, err)
+	for i := 0; i < 4; i++ {
+		testhelper.Ok(t, buffer.Add(statusAt(i)))
+	}
+
+	next := 4
+	var sent []domain.StatusSample
+	err = buffer.Drain(2, func(samples []domain.StatusSample) ([]domain.StatusSample, error) {
+		// The buffer stays usable during the send, filling up past the batch.
+		for i := 0; i < 3 && next < 10; i++ {
+			testhelper.Ok(t, buffer.Add(statusAt(next)))
+			next++
+		}
+		sent = append(sent, samples...)
+		return nil, nil
+	})
+	testhelper.Ok(t, err)
+	testhelper.Assert(t, buffer.Len() == 0, "expected the samples added meanwhile to be drained too, got %d", buffer.Len())
+	assertTimeline(t, sent, 9)
+}
+
+func testKeepSamplesLeft(t *testing.T, path string) {
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 10})
+	testhelper.Ok(t, err)
+	for i := 0; i < 3; i++ {
+		testhelper.Ok(t, buffer.Add(statusAt(i)))
+	}
+
+	failure := errors.New("sample 1 failed")
+	err = buffer.Drain(3, func(samples []domain.StatusSample) ([]domain.StatusSample, error) {
+		return samples[1:2], failure
+	})
+	testhelper.Assert(t, errors.Is(err, failure), "expected the send failure, got %v", err)
+	samples := drainAll(t, buffer)
+	testhelper.Assert(t, len(samples) == 1 && samples[0].From.Equal(statusAt(1).From), "expected only sample 1 to be sent again, got %+v", samples)
+}
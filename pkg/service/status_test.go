@@ -1,8 +1,11 @@
 package service_test
 
 import (
+	"context"
 	"errors"
+	"net/http/httptest"
 	"testing"
+	"time"
 	"virtual-orb/mock"
 	"virtual-orb/pkg/domain"
 	"virtual-orb/pkg/service"
@@ -16,6 +19,12 @@ func TestStatusService(t *testing.T) {
 	}{
 		{"should report status successfully", testSuccessfulStatusReport},
 		{"should handle post request error", testStatusPostRequestError},
+		{"should buffer undelivered reports", testBufferUndeliveredReports},
+		{"should upload the backlog as a batch once reachable", testUploadBacklogAsBatch},
+		{"should hold reports until the batch is ready", testLingerStatusBatch},
+		{"should drop samples rejected one by one", testDropRejectedSamples},
+		{"should send again only the samples that failed", testResendFailedSamples},
+		{"should send again the samples missing from the results", testResendMissingSamples},
 	}
 
 	for _, test := range tests {
@@ -31,11 +40,11 @@ func testSuccessfulStatusReport(t *testing.T, reqSvc *mock.RequestSvc, sysInfo *
 	sysInfo.GetSystemInfoFunc = func() *domain.Status {
 		return &domain.Status{}
 	}
-	reqSvc.PostFunc = func(path string, body any) (httpStatus int, err error) {
+	reqSvc.PostFunc = func(ctx context.Context, path string, body any) (httpStatus int, err error) {
 		return 200, nil
 	}
 	statusService := service.NewStatusSvc(reqSvc, sysInfo)
-	err := statusService.Report()
+	err := statusService.Report(context.Background())
 	testhelper.Ok(t, err)
 }
 
@@ -43,10 +52,164 @@ func testStatusPostRequestError(t *testing.T, reqSvc *mock.RequestSvc, sysInfo *
 	sysInfo.GetSystemInfoFunc = func() *domain.Status {
 		return &domain.Status{}
 	}
-	reqSvc.PostFunc = func(path string, body any) (httpStatus int, err error) {
+	reqSvc.PostFunc = func(ctx context.Context, path string, body any) (httpStatus int, err error) {
 		return 500, errors.New("mocked post error")
 	}
 	statusService := service.NewStatusSvc(reqSvc, sysInfo)
-	err := statusService.Report()
+	err := statusService.Report(context.Background())
 	testhelper.Assert(t, err != nil, "expected a post request error")
 }
+
+func testBufferUndeliveredReports(t *testing.T, reqSvc *mock.RequestSvc, sysInfo *mock.SystemInfo) {
+	sysInfo.GetSystemInfoFunc = func() *domain.Status {
+		return &domain.Status{Battery: 50}
+	}
+	var paths []string
+	reqSvc.PostFunc = func(ctx context.Context, path string, body any) (httpStatus int, err error) {
+		paths = append(paths, path)
+		return 503, nil
+	}
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		paths = append(paths, req.Route)
+		return 503, nil
+	}
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 10})
+	testhelper.Ok(t, err)
+	statusService := service.NewStatusSvc(reqSvc, sysInfo, service.WithStatusBuffer(buffer, service.BatchConfig{MaxSize: 5}))
+
+	for i := 0; i < 3; i++ {
+		err := statusService.Report(context.Background())
+		testhelper.Assert(t, errors.Is(err, domain.ErrRequestFailed), "expected a request failure, got %v", err)
+	}
+	testhelper.Assert(t, buffer.Len() == 3, "expected 3 buffered reports, got %d", buffer.Len())
+	testhelper.Assert(t, len(paths) == 3 && paths[0] == "/status" && paths[1] == "/status/batch",
+		"expected the backlog to be retried as a batch, got %v", paths)
+}
+
+func testUploadBacklogAsBatch(t *testing.T, _ *mock.RequestSvc, sysInfo *mock.SystemInfo) {
+	battery := float32(0)
+	sysInfo.GetSystemInfoFunc = func() *domain.Status {
+		battery++
+		return &domain.Status{Battery: battery}
+	}
+	u := &mock.UniquenessService{}
+	server := httptest.NewServer(u)
+	defer server.Close()
+	reqSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 4})
+	testhelper.Ok(t, err)
+	statusService := service.NewStatusSvc(reqSvc, sysInfo, service.WithStatusBuffer(buffer, service.BatchConfig{MaxSize: 2}))
+
+	u.SetDown(true)
+	for i := 0; i < 6; i++ {
+		testhelper.Assert(t, statusService.Report(context.Background()) != nil, "expected the report to fail during the outage")
+	}
+	u.SetDown(false)
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	testhelper.Ok(t, statusService.Report(context.Background()))
+
+	samples := u.StatusSamples()
+	total := 0
+	for i, sample := range samples {
+		total += sample.Count
+		if i > 0 {
+			testhelper.Assert(t, !sample.From.Before(samples[i-1].To), "expected samples in order")
+		}
+	}
+	testhelper.Assert(t, total == 7, "expected the outage and the first report after it to be covered, got %d", total)
+	testhelper.Assert(t, samples[0].Min.Battery == 1 && samples[len(samples)-1].Max.Battery == 7, "expected reports 1 to 7, got %+v", samples)
+	testhelper.Assert(t, u.Count("/status/batch") == 2, "expected the backlog to be sent in 2 batches, got %d", u.Count("/status/batch"))
+	testhelper.Assert(t, u.Count("/status") == 1 && buffer.Len() == 0, "expected live reporting to resume once drained")
+}
+
+func testLingerStatusBatch(t *testing.T, _ *mock.RequestSvc, sysInfo *mock.SystemInfo) {
+	sysInfo.GetSystemInfoFunc = func() *domain.Status {
+		return &domain.Status{Battery: 50}
+	}
+	u := &mock.UniquenessService{}
+	server := httptest.NewServer(u)
+	defer server.Close()
+	reqSvc := service.NewRequestSvc(server.URL, server.Client(), service.NewCircuitBreaker(service.BreakerSettings{}))
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 10})
+	testhelper.Ok(t, err)
+	statusService := service.NewStatusSvc(reqSvc, sysInfo, service.WithStatusBuffer(buffer, service.BatchConfig{MaxSize: 3, MaxLinger: time.Hour}))
+
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	testhelper.Assert(t, buffer.Len() == 2 && u.Count("/status") == 0 && u.Count("/status/batch") == 0,
+		"expected the reports to linger, got %d buffered", buffer.Len())
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	testhelper.Assert(t, buffer.Len() == 0 && u.Count("/status/batch") == 1 && len(u.StatusSamples()) == 3,
+		"expected a full batch to be uploaded, got %d batches", u.Count("/status/batch"))
+}
+
+func testDropRejectedSamples(t *testing.T, reqSvc *mock.RequestSvc, sysInfo *mock.SystemInfo) {
+	sysInfo.GetSystemInfoFunc = func() *domain.Status {
+		return &domain.Status{}
+	}
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		out.(*domain.BatchResponse).Results = []domain.BatchItemResult{{Id: "0", Status: 200}, {Id: "1", Status: 422}}
+		return 200, nil
+	}
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 10})
+	testhelper.Ok(t, err)
+	statusService := service.NewStatusSvc(reqSvc, sysInfo, service.WithStatusBuffer(buffer, service.BatchConfig{MaxSize: 2, MaxLinger: time.Hour}))
+
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	err = statusService.Report(context.Background())
+	testhelper.Assert(t, errors.Is(err, domain.ErrBatchItemsRejected), "expected rejected samples, got %v", err)
+	testhelper.Assert(t, buffer.Len() == 0, "expected the batch to leave the buffer, got %d", buffer.Len())
+}
+
+func testResendFailedSamples(t *testing.T, reqSvc *mock.RequestSvc, sysInfo *mock.SystemInfo) {
+	battery := float32(0)
+	sysInfo.GetSystemInfoFunc = func() *domain.Status {
+		battery++
+		return &domain.Status{Battery: battery}
+	}
+	var batches [][]float32
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		var batteries []float32
+		response := out.(*domain.BatchResponse)
+		for _, sample := range req.Body.(domain.StatusBatch).Samples {
+			batteries = append(batteries, sample.Avg.Battery)
+			status := 200
+			if sample.Avg.Battery == 2 && len(batches) == 0 {
+				status = 503
+			}
+			response.Results = append(response.Results, domain.BatchItemResult{Id: sample.Id, Status: status})
+		}
+		batches = append(batches, batteries)
+		return 200, nil
+	}
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 10})
+	testhelper.Ok(t, err)
+	statusService := service.NewStatusSvc(reqSvc, sysInfo, service.WithStatusBuffer(buffer, service.BatchConfig{MaxSize: 2, MaxLinger: time.Hour}))
+
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	err = statusService.Report(context.Background())
+	testhelper.Assert(t, errors.Is(err, domain.ErrRequestFailed), "expected the failed sample to be reported, got %v", err)
+	testhelper.Assert(t, buffer.Len() == 1, "expected only the failed sample to stay buffered, got %d", buffer.Len())
+
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	testhelper.Assert(t, len(batches) == 2 && len(batches[1]) == 2 && batches[1][0] == 2 && batches[1][1] == 3,
+		"expected the failed sample to be sent again with the next report, got %v", batches)
+}
+
+func testResendMissingSamples(t *testing.T, reqSvc *mock.RequestSvc, sysInfo *mock.SystemInfo) {
+	sysInfo.GetSystemInfoFunc = func() *domain.Status {
+		return &domain.Status{}
+	}
+	reqSvc.DoFunc = func(ctx context.Context, req *domain.Request, out any) (httpStatus int, err error) {
+		out.(*domain.BatchResponse).Results = []domain.BatchItemResult{{Id: "1", Status: 200}}
+		return 200, nil
+	}
+	buffer, err := service.NewStatusBuffer(service.StatusBufferConfig{Capacity: 10})
+	testhelper.Ok(t, err)
+	statusService := service.NewStatusSvc(reqSvc, sysInfo, service.WithStatusBuffer(buffer, service.BatchConfig{MaxSize: 2, MaxLinger: time.Hour}))
+
+	testhelper.Ok(t, statusService.Report(context.Background()))
+	err = statusService.Report(context.Background())
+	testhelper.Assert(t, errors.Is(err, domain.ErrRequestFailed), "expected the missing sample to be reported, got %v", err)
+	testhelper.Assert(t, buffer.Len() == 1, "expected the sample without a result to stay buffered, got %d", buffer.Len())
+}
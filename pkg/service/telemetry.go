@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"virtual-orb/pkg/domain"
+)
+
+// TopicOrbID is the placeholder of topic templates replaced by the orb ID.
+const TopicOrbID = "{orb_id}"
+
+type (
+	// TelemetryConfig holds how status reports are published.
+	TelemetryConfig struct {
+		Topic    string // Topic template, where TopicOrbID stands for the orb ID.
+		QoS      byte   // Quality of service: 0 at most once, 1 at least once, 2 exactly once.
+		Retained bool   // Whether the broker keeps the latest report for new subscribers.
+	}
+
+	// telemetrySvc reports the status of the system by publishing it to a
+	// message broker, as an alternative to posting it to "/status".
+	telemetrySvc struct {
+		publisher  domain.Publisher
+		systemInfo domain.SystemInfo
+		topic      string
+		cfg        TelemetryConfig
+	}
+)
+
+// NewTelemetrySvc initializes a status service publishing to a broker.
+//
+// publisher: Publisher connected to the broker.
+// systemInfo: Entity responsible for retrieving system-related information.
+// orbID: Identifier of the orb, substituted into the topic.
+// cfg: The topic and delivery settings.
+//
+// Returns a pointer to the telemetry service, or domain.ErrInvalidQoS.
+func NewTelemetrySvc(publisher domain.Publisher, systemInfo domain.SystemInfo, orbID string, cfg TelemetryConfig) (*telemetrySvc, error) {
+	if cfg.QoS > 2 {
+		return nil, fmt.Errorf("NewTelemetrySvc: %w: %d", domain.ErrInvalidQoS, cfg.QoS)
+	}
+	return &telemetrySvc{
+		publisher:  publisher,
+		systemInfo: systemInfo,
+		topic:      OrbTopic(cfg.Topic, orbID),
+		cfg:        cfg,
+	}, nil
+}
+
+// OrbTopic gives the topic of an orb.
+//
+// template: The topic template, where TopicOrbID stands for the orb ID.
+// orbID: Identifier of the orb.
+//
+// Returns the topic.
+func OrbTopic(template, orbID string) string {
+	return strings.ReplaceAll(template, TopicOrbID, orbID)
+}
+
+// Report gathers system information and publishes it as a JSON object,
+// with the same fields as the body posted to "/status".
+//
+// ctx: Context bounding the wait for the broker's acknowledgement.
+//
+// Returns an error if any occurred during the process.
+func (ts *telemetrySvc) Report(ctx context.Context) error {
+	status := ts.systemInfo.GetSystemInfo()
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("Report: %w", domain.ErrMarshallingPayload)
+	}
+	if err := ts.publisher.Publish(ctx, ts.topic, ts.cfg.QoS, ts.cfg.Retained, payload); err != nil {
+		if errors.Is(err, domain.ErrPublishFailed) {
+			return fmt.Errorf("Report: %w", err)
+		}
+		return fmt.Errorf("Report: %w: %w", domain.ErrPublishFailed, err)
+	}
+	return nil
+}
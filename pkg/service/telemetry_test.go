@@ -0,0 +1,67 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"virtual-orb/mock"
+	"virtual-orb/pkg/domain"
+	"virtual-orb/pkg/service"
+	testhelper "virtual-orb/test_helper"
+)
+
+func TestTelemetryService(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *mock.Publisher, *mock.SystemInfo)
+	}{
+		{"should publish the status to the orb's topic", testPublishStatus},
+		{"should report a failed publication", testPublishFailure},
+		{"should refuse an invalid QoS", testInvalidQoS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			publisher := new(mock.Publisher)
+			sysInfo := &mock.SystemInfo{GetSystemInfoFunc: func() *domain.Status {
+				return &domain.Status{Battery: 80, CPUUsage: 10, CPUTemp: 40, DiskSpace: 512}
+			}}
+			test.function(t, publisher, sysInfo)
+		})
+	}
+}
+
+func testPublishStatus(t *testing.T, publisher *mock.Publisher, sysInfo *mock.SystemInfo) {
+	var topic string
+	var qos byte
+	var retained bool
+	var status domain.Status
+	publisher.PublishFunc = func(ctx context.Context, t string, q byte, r bool, payload []byte) error {
+		topic, qos, retained = t, q, r
+		return json.Unmarshal(payload, &status)
+	}
+	telemetry, err := service.NewTelemetrySvc(publisher, sysInfo, "7", service.TelemetryConfig{Topic: "orbs/{orb_id}/status", QoS: 1, Retained: true})
+	testhelper.Ok(t, err)
+
+	testhelper.Ok(t, telemetry.Report(context.Background()))
+	testhelper.Assert(t, topic == "orbs/7/status", "expected the orb's topic, got %q", topic)
+	testhelper.Assert(t, qos == 1 && retained, "expected QoS 1 and retained, got %d %v", qos, retained)
+	testhelper.Assert(t, status == domain.Status{Battery: 80, CPUUsage: 10, CPUTemp: 40, DiskSpace: 512}, "expected the status as JSON, got %+v", status)
+}
+
+func testPublishFailure(t *testing.T, publisher *mock.Publisher, sysInfo *mock.SystemInfo) {
+	publisher.PublishFunc = func(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+		return errors.New("mocked publish error")
+	}
+	telemetry, err := service.NewTelemetrySvc(publisher, sysInfo, "7", service.TelemetryConfig{Topic: "status"})
+	testhelper.Ok(t, err)
+
+	err = telemetry.Report(context.Background())
+	testhelper.Assert(t, errors.Is(err, domain.ErrPublishFailed), "expected a publish error, got %v", err)
+}
+
+func testInvalidQoS(t *testing.T, publisher *mock.Publisher, sysInfo *mock.SystemInfo) {
+	_, err := service.NewTelemetrySvc(publisher, sysInfo, "7", service.TelemetryConfig{Topic: "status", QoS: 3})
+	testhelper.Assert(t, errors.Is(err, domain.ErrInvalidQoS), "expected an invalid QoS error, got %v", err)
+}